@@ -0,0 +1,792 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sashabaranov/go-openai"
+	"gopkg.in/yaml.v2"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/db/sqlite"
+	"github.com/iamwavecut/ngbot/internal/event"
+	"github.com/iamwavecut/ngbot/internal/federation"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
+	"github.com/iamwavecut/ngbot/internal/i18n"
+	"github.com/iamwavecut/ngbot/internal/infra"
+	"github.com/iamwavecut/ngbot/internal/lists"
+	"github.com/iamwavecut/ngbot/internal/llm"
+	"github.com/iamwavecut/ngbot/internal/telegram/telegramtest"
+	"github.com/iamwavecut/ngbot/resources"
+)
+
+const (
+	waitTimeout = 5 * time.Second
+
+	lolsBannedUser = 100
+	spammerUser    = 101
+	regularUser    = 102
+	operatorUser   = 400
+)
+
+var (
+	group   = api.Chat{ID: -1001234567890, Type: "supergroup", Title: "Test group"}
+	partner = api.Chat{ID: -1009876543210, Type: "supergroup", Title: "Partner group"}
+)
+
+type e2e struct {
+	tg   *telegramtest.Server
+	lols *httptest.Server
+	llm  *httptest.Server
+	// resolver unshortens bit.ly/promo to evil.example
+	resolver *httptest.Server
+	// resolverCalls counts the links sent to the resolver
+	resolverCalls atomic.Int32
+	lolsHit       sync.Map
+	// llmCalls counts the completions asked for
+	llmCalls atomic.Int32
+	db       db.Client
+}
+
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "ngbot-e2e")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// TestEndToEnd runs a bot against fake Bot API, lols.bot and LLM servers
+func TestEndToEnd(t *testing.T) {
+	env := &e2e{tg: telegramtest.NewServer()}
+	defer env.tg.Close()
+	env.tg.AddChat(group)
+	env.tg.AddChat(partner)
+
+	env.lols = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		counter, _ := env.lolsHit.LoadOrStore(id, &atomic.Int32{})
+		counter.(*atomic.Int32).Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "banned": id == fmt.Sprint(lolsBannedUser)})
+	}))
+	defer env.lols.Close()
+
+	env.llm = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.llmCalls.Add(1)
+		var req openai.ChatCompletionRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		// the text of a fake image is its bytes
+		last := req.Messages[len(req.Messages)-1]
+		content := last.Content
+		for _, part := range last.MultiContent {
+			content += part.Text
+			if part.ImageURL != nil {
+				_, data, _ := strings.Cut(part.ImageURL.URL, ";base64,")
+				image, _ := base64.StdEncoding.DecodeString(data)
+				content += string(image)
+			}
+		}
+		verdict := "NOT_SPAM"
+		if strings.Contains(content, "crypto") {
+			verdict = "SPAM"
+		}
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: "assistant", Content: verdict}}},
+		})
+	}))
+	defer env.llm.Close()
+
+	env.resolver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.resolverCalls.Add(1)
+		target := r.URL.Query().Get("url")
+		if target == "https://bit.ly/promo" {
+			target = "https://evil.example/landing"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"url": target})
+	}))
+	defer env.resolver.Close()
+
+	// low risk joiners are only let in without a challenge when the operator opts in
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(configPath, []byte("plugin_settings:\n  gatekeeper:\n    risk_challenge: \"20\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NG_TOKEN", telegramtest.Token)
+	t.Setenv("NG_OPENAI_API_KEY", "test")
+	cfg, err := config.Init([]string{
+		"--config", configPath,
+		"--openai-base-url", env.llm.URL,
+		"--lols-url", env.lols.URL,
+		"--telegram-api-endpoint", env.tg.Endpoint(),
+		"--db-path", filepath.Join(t.TempDir(), "bot.db"),
+		"--operators", fmt.Sprint(operatorUser),
+		"--link-resolver", env.resolver.URL,
+		"--reject-timeout", "30m",
+		"--log-level", "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SetupLogging(cfg)
+	i18n.Init()
+
+	dbClient := sqlite.NewSQLiteClient(cfg.DBPath)
+	defer dbClient.Close()
+	env.db = dbClient.Namespaced(cfg.BotList()[0].SettingsNamespace())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rt, err := newBotRuntime(ctx, cfg.BotList()[0], sharedBackends{db: dbClient, llm: llm.New(cfg, dbClient), lists: lists.New(dbClient), spam: fingerprint.New(dbClient), health: infra.NewHealth()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.close()
+	go rt.run(ctx)
+
+	t.Run("reactor bans a user known to lols.bot", env.testLolsBan)
+	t.Run("reactor bans a spammer by the LLM verdict", env.testLLMBan)
+	t.Run("reactor trusts a user after a clean first message", env.testCleanMessage)
+	t.Run("gatekeeper approves a join request after the right answer", env.testJoinApproved)
+	t.Run("gatekeeper declines a join request after a wrong answer", env.testJoinDeclined)
+	t.Run("gatekeeper lets a low risk joiner in without a challenge", env.testLowRiskJoin)
+	t.Run("gatekeeper declines a high risk joiner right away", env.testHighRiskJoin)
+	t.Run("trust group shares a spam ban with the partner chat", env.testFederatedBan)
+	t.Run("admins approve and deny the appeals of rejected joiners", env.testAppeals)
+	t.Run("reactor bans a blocklisted link without asking the LLM", env.testBlocklist)
+	t.Run("reactor deletes links breaking the link policy", env.testLinkPolicy)
+	t.Run("reactor keeps links local in the strict privacy mode", env.testStrictLinks)
+	t.Run("reactor applies the media rules and keeps unchecked users untrusted", env.testMediaRules)
+	t.Run("reactor bans a spam picture by the vision model verdict", env.testVision)
+	t.Run("reactor rescans messages edited into spam and revokes the trust", env.testEditedSpam)
+	t.Run("reactor bans the variations of known spam without asking the LLM", env.testSpamWave)
+}
+
+func (env *e2e) testLolsBan(t *testing.T) {
+	u := env.tg.Push(env.tg.Message(group, api.User{ID: lolsBannedUser, FirstName: "Known"}, "hello"))
+	env.expectSpamHandled(t, lolsBannedUser, u.Message.MessageID)
+}
+
+func (env *e2e) testLLMBan(t *testing.T) {
+	u := env.tg.Push(env.tg.Message(group, api.User{ID: spammerUser, FirstName: "Spammer"}, "earn on crypto, DM me"))
+	env.expectSpamHandled(t, spammerUser, u.Message.MessageID)
+}
+
+func (env *e2e) testCleanMessage(t *testing.T) {
+	user := api.User{ID: regularUser, FirstName: "Regular"}
+	env.tg.Push(env.tg.Message(group, user, "hi all, glad to be here"))
+	second := env.tg.Push(env.tg.Message(group, user, "what is the plan for today?"))
+
+	// the second message is not checked, wait for it to be processed by looking at the next update
+	marker := env.tg.Push(env.tg.Message(group, api.User{ID: lolsBannedUser + 1000}, "marker"))
+	if _, ok := env.waitLols(marker.Message.From.ID); !ok {
+		t.Fatal("the marker message was not checked")
+	}
+	if n := env.lolsHits(regularUser); n != 1 {
+		t.Errorf("lols.bot was asked %d times about the regular user, want 1", n)
+	}
+	for _, c := range env.tg.Calls("deleteMessage") {
+		if c.Int("message_id") == int64(second.Message.MessageID) {
+			t.Error("a message of the regular user was deleted")
+		}
+	}
+	for _, c := range env.tg.Calls("banChatMember") {
+		if c.Int("user_id") == regularUser {
+			t.Error("the regular user was banned")
+		}
+	}
+}
+
+func (env *e2e) testJoinApproved(t *testing.T) {
+	joiner := api.User{ID: 200, FirstName: "Joiner", LanguageCode: "en"}
+	challenge := env.joinChallenge(t, joiner)
+
+	env.tg.Push(env.tg.Callback(joiner, challenge.message, challenge.right))
+	if _, ok := env.tg.WaitCall("approveChatJoinRequest", waitTimeout, env.forUser(group.ID, joiner.ID)); !ok {
+		t.Fatal("join request was not approved")
+	}
+	if _, ok := env.tg.WaitCall("deleteMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == joiner.ID && c.Int("message_id") == int64(challenge.message.MessageID)
+	}); !ok {
+		t.Error("challenge message was not deleted")
+	}
+}
+
+func (env *e2e) testJoinDeclined(t *testing.T) {
+	joiner := api.User{ID: 201, FirstName: "Bot-like", LanguageCode: "en"}
+	challenge := env.joinChallenge(t, joiner)
+
+	env.tg.Push(env.tg.Callback(joiner, challenge.message, challenge.wrong))
+	if _, ok := env.tg.WaitCall("declineChatJoinRequest", waitTimeout, env.forUser(group.ID, joiner.ID)); !ok {
+		t.Fatal("join request was not declined")
+	}
+	if _, ok := env.tg.WaitCall("banChatMember", waitTimeout, env.forUser(group.ID, joiner.ID)); !ok {
+		t.Error("joiner was not banned")
+	}
+	for _, c := range env.tg.Calls("approveChatJoinRequest") {
+		if c.Int("user_id") == joiner.ID {
+			t.Error("join request was approved")
+		}
+	}
+}
+
+func (env *e2e) testLowRiskJoin(t *testing.T) {
+	joiner := api.User{ID: 202, FirstName: "Known", UserName: "known_person", LanguageCode: "en"}
+	env.tg.SetProfilePhotos(joiner.ID, 3)
+	env.tg.Push(env.tg.JoinRequest(group, joiner))
+
+	if _, ok := env.tg.WaitCall("approveChatJoinRequest", waitTimeout, env.forUser(group.ID, joiner.ID)); !ok {
+		t.Fatal("join request was not approved")
+	}
+	for _, c := range env.tg.Calls("sendMessage") {
+		if c.Int("chat_id") == joiner.ID {
+			t.Error("low risk joiner was challenged")
+		}
+	}
+}
+
+func (env *e2e) testHighRiskJoin(t *testing.T) {
+	joiner := api.User{ID: 7_500_000_203, FirstName: "💰💰💰💰 Crypto profit", LastName: "t.me/easy_money"}
+	u := env.tg.JoinRequest(group, joiner)
+	u.ChatJoinRequest.Bio = "Earn 1000$ daily https://example.com"
+	env.tg.Push(u)
+
+	if _, ok := env.tg.WaitCall("declineChatJoinRequest", waitTimeout, env.forUser(group.ID, joiner.ID)); !ok {
+		t.Fatal("join request was not declined")
+	}
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == joiner.ID && strings.Contains(c.Params.Get("reply_markup"), "appeal")
+	}); !ok {
+		t.Error("declined joiner was not offered an appeal")
+	}
+	for _, c := range env.tg.Calls("restrictChatMember") {
+		if c.Int("user_id") == joiner.ID {
+			t.Error("high risk joiner was challenged")
+		}
+	}
+}
+
+func (env *e2e) testFederatedBan(t *testing.T) {
+	admin := api.User{ID: 300, FirstName: "Admin"}
+	for _, chat := range []api.Chat{group, partner} {
+		env.tg.SetChatMember(chat.ID, api.ChatMember{User: &admin, Status: "creator"})
+	}
+
+	env.tg.Push(env.tg.Command(group, admin, "/federation create friends"))
+	call, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == admin.ID && strings.Contains(c.Params.Get("text"), "/federation join ")
+	})
+	if !ok {
+		t.Fatal("join code was not sent to the admin")
+	}
+	_, code, _ := strings.Cut(call.Params.Get("text"), "/federation join ")
+
+	env.tg.Push(env.tg.Command(partner, admin, "/federation join "+code))
+	env.tg.Push(env.tg.Command(partner, admin, "/federation action pre_ban"))
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == partner.ID && strings.Contains(c.Params.Get("text"), "pre_ban")
+	}); !ok {
+		t.Fatal("partner chat did not switch to pre-ban")
+	}
+
+	spammer := api.User{ID: 301, FirstName: "Travelling", UserName: "traveller"}
+	u := env.tg.Push(env.tg.Message(group, spammer, "crypto signals in my channel"))
+	env.expectSpamHandled(t, spammer.ID, u.Message.MessageID)
+
+	env.waitDecision(t, spammer.ID, func(m *federation.Match) bool { return m.Spam() })
+
+	// a profile that would pass without a challenge on its own
+	env.tg.SetProfilePhotos(spammer.ID, 2)
+	env.tg.Push(env.tg.JoinRequest(partner, spammer))
+	if _, ok := env.tg.WaitCall("declineChatJoinRequest", waitTimeout, env.forUser(partner.ID, spammer.ID)); !ok {
+		t.Fatal("join request to the partner chat was not declined")
+	}
+
+	// a pardon in the partner chat is not undone by the spam decision of the group
+	env.tg.Push(env.tg.Command(partner, admin, fmt.Sprintf("/pardon %d", spammer.ID)))
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		match, err := federation.Lookup(env.db, partner.ID, spammer.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the pardon did not take precedence over the decision of the group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	env.tg.Push(env.tg.JoinRequest(partner, spammer))
+	if _, ok := env.tg.WaitCall("approveChatJoinRequest", waitTimeout, env.forUser(partner.ID, spammer.ID)); !ok {
+		t.Fatal("join request of the pardoned user was not approved")
+	}
+
+	// spam the LLM missed and an admin confirmed is shared too
+	seller := api.User{ID: 318, FirstName: "Seller"}
+	missed := env.tg.Push(env.tg.Message(group, seller, "Selling followers and likes for any account, ask me how"))
+	confirm := env.tg.Command(group, admin, "/spam")
+	confirm.Message.ReplyToMessage = missed.Message
+	env.tg.Push(confirm)
+	env.expectSpamHandled(t, seller.ID, missed.Message.MessageID)
+	env.waitDecision(t, seller.ID, func(m *federation.Match) bool {
+		return m.Spam() && m.Decision.Source == event.SourceAdmin && m.Decision.ActorID == admin.ID
+	})
+}
+
+// waitDecision waits for a decision of the trust group on the user seen from the partner chat
+func (env *e2e) waitDecision(t *testing.T, userID int64, match func(*federation.Match) bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		m, err := federation.Lookup(env.db, partner.ID, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil && match(m) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the decision on user %d was not shared with the trust group", userID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (env *e2e) testAppeals(t *testing.T) {
+	// the account IDs of the joiners are far apart, not to look like a raid
+	admin := api.User{ID: 300, FirstName: "Admin"}
+
+	// an approved appeal lifts the ban and the trust is shared with the trust group
+	approved := api.User{ID: 1_000_320, FirstName: "Unlucky", LanguageCode: "en"}
+	request := env.appeal(t, approved)
+	env.tg.Push(env.tg.Callback(admin, request, fmt.Sprintf("appeal_ok;%d;%d", group.ID, approved.ID)))
+	if _, ok := env.tg.WaitCall("unbanChatMember", waitTimeout, env.forUser(group.ID, approved.ID)); !ok {
+		t.Fatal("the approved appellant was not unbanned")
+	}
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == approved.ID && strings.Contains(c.Params.Get("text"), "approved")
+	}); !ok {
+		t.Error("the approved appellant was not told")
+	}
+	env.waitDecision(t, approved.ID, func(m *federation.Match) bool {
+		return m.Trusted() && m.Decision.ChatID == group.ID && m.Decision.ActorID == admin.ID
+	})
+
+	// a denied appeal leaves the ban
+	denied := api.User{ID: 2_000_321, FirstName: "Persistent", LanguageCode: "en"}
+	request = env.appeal(t, denied)
+	env.tg.Push(env.tg.Callback(admin, request, fmt.Sprintf("appeal_no;%d;%d", group.ID, denied.ID)))
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == denied.ID && strings.Contains(c.Params.Get("text"), "denied")
+	}); !ok {
+		t.Fatal("the denied appellant was not told")
+	}
+	for _, c := range env.tg.Calls("unbanChatMember") {
+		if c.Int("user_id") == denied.ID {
+			t.Error("the denied appellant was unbanned")
+		}
+	}
+
+	// a pardon needs no appeal
+	env.tg.Push(env.tg.Command(group, admin, fmt.Sprintf("/pardon %d", denied.ID)))
+	if _, ok := env.tg.WaitCall("unbanChatMember", waitTimeout, env.forUser(group.ID, denied.ID)); !ok {
+		t.Fatal("the pardoned user was not unbanned")
+	}
+	env.waitDecision(t, denied.ID, func(m *federation.Match) bool { return m.Trusted() })
+}
+
+// appeal fails the challenge of the joiner, appeals the rejection and returns the request the admin received
+func (env *e2e) appeal(t *testing.T, joiner api.User) *api.Message {
+	t.Helper()
+	challenge := env.joinChallenge(t, joiner)
+	env.tg.Push(env.tg.Callback(joiner, challenge.message, challenge.wrong))
+
+	call, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == joiner.ID && strings.Contains(c.Params.Get("reply_markup"), "appeal")
+	})
+	if !ok {
+		t.Fatal("the rejected joiner was not offered an appeal")
+	}
+	if text := call.Params.Get("text"); !strings.Contains(text, "30 minutes") {
+		t.Errorf("the rejection does not tell the reject timeout: %q", text)
+	}
+	rejection := &api.Message{MessageID: call.MessageID, Chat: api.Chat{ID: joiner.ID, Type: "private"}}
+	env.tg.Push(env.tg.Callback(joiner, rejection, fmt.Sprintf("appeal;%d", group.ID)))
+
+	call, ok = env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == 300 && strings.Contains(c.Params.Get("reply_markup"), fmt.Sprintf("appeal_ok;%d;%d", group.ID, joiner.ID))
+	})
+	if !ok {
+		t.Fatal("the appeal was not sent to the admin")
+	}
+	return &api.Message{MessageID: call.MessageID, Chat: api.Chat{ID: 300, Type: "private"}, Text: call.Params.Get("text")}
+}
+
+func (env *e2e) testBlocklist(t *testing.T) {
+	operator := api.User{ID: operatorUser, FirstName: "Operator"}
+	private := api.Chat{ID: operator.ID, Type: "private"}
+	// the operator would be told the entry is already on the list if anyone could add it
+	regular := api.User{ID: regularUser, FirstName: "Regular"}
+	env.tg.Push(env.tg.Command(api.Chat{ID: regular.ID, Type: "private"}, regular, "/blocklist add url scam.example"))
+	env.tg.Push(env.tg.Command(private, operator, "/blocklist add url https://www.scam.example/"))
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == operator.ID && strings.Contains(c.Params.Get("text"), "is added")
+	}); !ok {
+		t.Fatal("blocklist entry was not added")
+	}
+
+	llmCalls := env.llmCalls.Load()
+	poster := api.User{ID: 302, FirstName: "Poster", UserName: "poster"}
+	u := env.tg.Push(env.tg.Message(group, poster, "great deals at promo.scam.example/today"))
+	env.expectSpamHandled(t, poster.ID, u.Message.MessageID)
+	if n := env.llmCalls.Load(); n != llmCalls {
+		t.Errorf("the LLM was asked %d times about a blocklisted message", n-llmCalls)
+	}
+}
+
+func (env *e2e) testLinkPolicy(t *testing.T) {
+	admin := api.User{ID: 300, FirstName: "Admin"}
+	env.tg.SetChatMember(group.ID, api.ChatMember{User: &admin, Status: "creator"})
+	policyUpdated := func() {
+		t.Helper()
+		if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+			return c.Int("chat_id") == group.ID && c.Params.Get("text") == "Link policy updated"
+		}); !ok {
+			t.Fatal("link policy was not updated")
+		}
+	}
+	env.tg.Push(env.tg.Command(group, admin, "/links deny evil.example"))
+	policyUpdated()
+
+	shortened := env.tg.Push(env.tg.Message(group, api.User{ID: 303, FirstName: "Shortener"}, "look https://bit.ly/promo"))
+	if _, ok := env.tg.WaitCall("deleteMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == group.ID && c.Int("message_id") == int64(shortened.Message.MessageID)
+	}); !ok {
+		t.Error("message with a shortened denied link was not deleted")
+	}
+
+	env.tg.Push(env.tg.Command(group, admin, "/links mode untrusted"))
+	hidden := env.tg.Message(group, api.User{ID: 304, FirstName: "Newcomer"}, "click here")
+	hidden.Message.Entities = []api.MessageEntity{{Type: "text_link", Offset: 0, Length: 5, URL: "https://ok.example"}}
+	env.tg.Push(hidden)
+	if _, ok := env.tg.WaitCall("deleteMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == group.ID && c.Int("message_id") == int64(hidden.Message.MessageID)
+	}); !ok {
+		t.Error("hidden link of an untrusted member was not deleted")
+	}
+
+	for _, c := range env.tg.Calls("banChatMember") {
+		if c.Int("user_id") == 303 || c.Int("user_id") == 304 {
+			t.Error("link policy banned the author")
+		}
+	}
+}
+
+func (env *e2e) testStrictLinks(t *testing.T) {
+	admin := api.User{ID: 300, FirstName: "Admin"}
+	env.tg.SetChatMember(partner.ID, api.ChatMember{User: &admin, Status: "creator"})
+	env.tg.Push(env.tg.Command(partner, admin, "/links deny evil.example"))
+	env.tg.Push(env.tg.Command(partner, admin, "/privacy strict"))
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == partner.ID && c.Params.Get("text") == "Privacy mode is strict"
+	}); !ok {
+		t.Fatal("privacy mode was not set")
+	}
+	defer env.tg.Push(env.tg.Command(partner, admin, "/privacy default"))
+
+	resolverCalls := env.resolverCalls.Load()
+	shortener := api.User{ID: 306, FirstName: "Shortener"}
+	shortened := env.tg.Push(env.tg.Message(partner, shortener, "look https://bit.ly/promo"))
+	// the first message is checked after the link policy
+	deadline := time.Now().Add(waitTimeout)
+	for env.lolsHits(shortener.ID) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := env.lolsHits(shortener.ID); n != 1 {
+		t.Fatalf("lols.bot was asked %d times about the shortener", n)
+	}
+	if n := env.resolverCalls.Load(); n != resolverCalls {
+		t.Errorf("the resolver was asked %d times in the strict mode", n-resolverCalls)
+	}
+	for _, c := range env.tg.Calls("deleteMessage") {
+		if c.Int("chat_id") == partner.ID && c.Int("message_id") == int64(shortened.Message.MessageID) {
+			t.Error("message was deleted by the unshortened link")
+		}
+	}
+}
+
+func (env *e2e) testMediaRules(t *testing.T) {
+	// a sticker cant be checked, so the next message of the user is checked again
+	sticker := api.User{ID: 305, FirstName: "Sticker"}
+	u := env.tg.Message(group, sticker, "")
+	u.Message.Sticker = &api.Sticker{FileID: "sticker", Emoji: "👋"}
+	env.tg.Push(u)
+	env.tg.Push(env.tg.Message(group, sticker, "hi all"))
+	deadline := time.Now().Add(waitTimeout)
+	for env.lolsHits(sticker.ID) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := env.lolsHits(sticker.ID); n != 2 {
+		t.Errorf("lols.bot was asked %d times about the sticker user, want 2", n)
+	}
+
+	executable := env.tg.Message(group, api.User{ID: 306, FirstName: "Invoice"}, "")
+	executable.Message.Document = &api.Document{FileID: "doc", FileName: "invoice.pdf.exe"}
+	env.tg.Push(executable)
+	env.expectSpamHandled(t, 306, executable.Message.MessageID)
+
+	contact := env.tg.Message(group, api.User{ID: 307, FirstName: "Contact"}, "")
+	contact.Message.Contact = &api.Contact{PhoneNumber: "+10000000000", FirstName: "Manager"}
+	env.tg.Push(contact)
+	if _, ok := env.tg.WaitCall("deleteMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == group.ID && c.Int("message_id") == int64(contact.Message.MessageID)
+	}); !ok {
+		t.Error("shared contact was not deleted")
+	}
+	for _, c := range env.tg.Calls("banChatMember") {
+		if c.Int("user_id") == 305 || c.Int("user_id") == 307 {
+			t.Error("a media rule banned the author of a message that is not spam")
+		}
+	}
+}
+
+func (env *e2e) testVision(t *testing.T) {
+	admin := api.User{ID: 300, FirstName: "Admin"}
+	env.tg.SetChatMember(group.ID, api.ChatMember{User: &admin, Status: "creator"})
+	env.tg.Push(env.tg.Command(group, admin, "/vision on"))
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == group.ID && c.Params.Get("text") == "Image checks are on"
+	}); !ok {
+		t.Fatal("image checks were not turned on")
+	}
+
+	photo := func(from api.User, fileID, image string) api.Update {
+		env.tg.SetFile(fileID, []byte("\x89PNG\r\n\x1a\n"+image))
+		u := env.tg.Message(group, from, "")
+		u.Message.Photo = []api.PhotoSize{
+			{FileID: fileID + "-thumb", Width: 90, Height: 90, FileSize: 1 << 30},
+			{FileID: fileID, Width: 800, Height: 800, FileSize: len(image) + 8},
+		}
+		return env.tg.Push(u)
+	}
+	ad := photo(api.User{ID: 308, FirstName: "Picture"}, "ad", "earn on crypto, DM me")
+	env.expectSpamHandled(t, 308, ad.Message.MessageID)
+
+	// a clean picture makes the user trusted, so the next message is not checked
+	cat := api.User{ID: 309, FirstName: "Cat"}
+	photo(cat, "cat", "a cat on a sofa")
+	env.tg.Push(env.tg.Message(group, cat, "look at my cat"))
+	marker := env.tg.Push(env.tg.Message(group, api.User{ID: 310, FirstName: "Marker"}, "marker"))
+	if _, ok := env.waitLols(marker.Message.From.ID); !ok {
+		t.Fatal("the marker message was not checked")
+	}
+	if n := env.lolsHits(cat.ID); n != 1 {
+		t.Errorf("lols.bot was asked %d times about the user with a clean picture, want 1", n)
+	}
+	for _, c := range env.tg.Calls("banChatMember") {
+		if c.Int("user_id") == cat.ID {
+			t.Error("the user with a clean picture was banned")
+		}
+	}
+}
+
+func (env *e2e) testEditedSpam(t *testing.T) {
+	trust := func(user api.User) *api.Message {
+		t.Helper()
+		u := env.tg.Push(env.tg.Message(group, user, "hi all, glad to be here"))
+		deadline := time.Now().Add(waitTimeout)
+		for time.Now().Before(deadline) {
+			if ok, _ := env.db.IsMember(group.ID, user.ID); ok {
+				return u.Message
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("user %d was not trusted", user.ID)
+		return nil
+	}
+	late, switcher := api.User{ID: 311, FirstName: "Late"}, api.User{ID: 312, FirstName: "Switcher"}
+	lateMessage, switcherMessage := trust(late), trust(switcher)
+
+	// edits later than the edit window are not rescanned
+	lateEdit := env.tg.Edit(lateMessage, "earn on crypto, DM me")
+	lateEdit.EditedMessage.Date -= int((48 * time.Hour).Seconds())
+	env.tg.Push(lateEdit)
+
+	env.tg.Push(env.tg.Edit(switcherMessage, "earn on crypto, DM me"))
+	env.expectSpamHandled(t, switcher.ID, switcherMessage.MessageID)
+	if ok, err := env.db.IsMember(group.ID, switcher.ID); err != nil || ok {
+		t.Errorf("the trust of the user who edited a message into spam was not revoked: %v %v", ok, err)
+	}
+	for _, c := range env.tg.Calls("banChatMember") {
+		if c.Int("user_id") == late.ID {
+			t.Error("a message edited after the edit window was rescanned")
+		}
+	}
+}
+
+func (env *e2e) testSpamWave(t *testing.T) {
+	admin := api.User{ID: 300, FirstName: "Admin"}
+	env.tg.SetChatMember(group.ID, api.ChatMember{User: &admin, Status: "creator"})
+	waitTrusted := func(user api.User) {
+		t.Helper()
+		deadline := time.Now().Add(waitTimeout)
+		for time.Now().Before(deadline) {
+			if ok, _ := env.db.IsMember(group.ID, user.ID); ok {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("user %d was not trusted", user.ID)
+	}
+
+	// the LLM verdict on the first message of the wave covers the rest of it
+	first := env.tg.Push(env.tg.Message(group, api.User{ID: 313, FirstName: "Wave"}, "Earn 500 dollars a day on crypto from home, write me in private messages"))
+	env.expectSpamHandled(t, 313, first.Message.MessageID)
+	llmCalls := env.llmCalls.Load()
+	next := env.tg.Push(env.tg.Message(group, api.User{ID: 314, FirstName: "Wave"}, "💰 EARN 700 dollars a day on crypto from home!! Write me in private messages"))
+	env.expectSpamHandled(t, 314, next.Message.MessageID)
+	if n := env.llmCalls.Load(); n != llmCalls {
+		t.Errorf("the LLM was asked %d times about a variation of known spam", n-llmCalls)
+	}
+
+	// spam the LLM missed is confirmed by an admin
+	betting := api.User{ID: 315, FirstName: "Betting"}
+	missed := env.tg.Push(env.tg.Message(group, betting, "Visit my profile for the best betting tips and free bonuses every single day"))
+	waitTrusted(betting)
+	confirm := env.tg.Command(group, admin, "/spam")
+	confirm.Message.ReplyToMessage = missed.Message
+	env.tg.Push(confirm)
+	env.expectSpamHandled(t, betting.ID, missed.Message.MessageID)
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == group.ID && strings.HasPrefix(c.Params.Get("text"), "Spammer is banned, the variations")
+	}); !ok {
+		t.Fatal("the confirmed spam was not remembered")
+	}
+	llmCalls = env.llmCalls.Load()
+	variation := env.tg.Push(env.tg.Message(group, api.User{ID: 316, FirstName: "Betting"}, "Visit my profile for the best betting tips and free bonus every day!"))
+	env.expectSpamHandled(t, 316, variation.Message.MessageID)
+	if n := env.llmCalls.Load(); n != llmCalls {
+		t.Errorf("the LLM was asked %d times about a variation of confirmed spam", n-llmCalls)
+	}
+
+	// a pardon takes the fingerprint back
+	env.tg.Push(env.tg.Command(group, admin, fmt.Sprintf("/pardon %d", betting.ID)))
+	if _, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == group.ID && c.Params.Get("text") == "User is pardoned and trusted now"
+	}); !ok {
+		t.Fatal("the user was not pardoned")
+	}
+	tipster := api.User{ID: 317, FirstName: "Tipster"}
+	env.tg.Push(env.tg.Message(group, tipster, "Visit my profile for the best betting tips and free bonuses every single day"))
+	waitTrusted(tipster)
+}
+
+type challenge struct {
+	message      *api.Message
+	right, wrong string
+}
+
+// joinChallenge sends a join request and returns the challenge the bot sent to the joiner
+func (env *e2e) joinChallenge(t *testing.T, joiner api.User) challenge {
+	t.Helper()
+	env.tg.Push(env.tg.JoinRequest(group, joiner))
+
+	if _, ok := env.tg.WaitCall("restrictChatMember", waitTimeout, env.forUser(group.ID, joiner.ID)); !ok {
+		t.Fatal("joiner was not restricted")
+	}
+	call, ok := env.tg.WaitCall("sendMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == joiner.ID && c.Params.Get("reply_markup") != ""
+	})
+	if !ok {
+		t.Fatal("challenge was not sent")
+	}
+
+	var keyboard api.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(call.Params.Get("reply_markup")), &keyboard); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := resources.FS.ReadFile("gatekeeper/challenges/en.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := map[string]string{}
+	if err := yaml.Unmarshal(raw, &variants); err != nil {
+		t.Fatal(err)
+	}
+
+	// the text names the right variant, the longest name found wins over names contained in it
+	var c challenge
+	var rightName string
+	for _, row := range keyboard.InlineKeyboard {
+		for _, button := range row {
+			name := variants[button.Text]
+			if strings.Contains(call.Params.Get("text"), name) && len(name) > len(rightName) {
+				if c.right != "" {
+					c.wrong = c.right
+				}
+				c.right, rightName = *button.CallbackData, name
+			} else {
+				c.wrong = *button.CallbackData
+			}
+		}
+	}
+	if c.right == "" || c.wrong == "" {
+		t.Fatalf("cant tell the right answer of %q", call.Params.Get("text"))
+	}
+	c.message = &api.Message{MessageID: call.MessageID, Chat: api.Chat{ID: joiner.ID, Type: "private"}}
+	return c
+}
+
+func (env *e2e) expectSpamHandled(t *testing.T, userID int64, messageID int) {
+	t.Helper()
+	if _, ok := env.tg.WaitCall("deleteMessage", waitTimeout, func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == group.ID && c.Int("message_id") == int64(messageID)
+	}); !ok {
+		t.Error("spam message was not deleted")
+	}
+	if _, ok := env.tg.WaitCall("banChatMember", waitTimeout, env.forUser(group.ID, userID)); !ok {
+		t.Error("spammer was not banned")
+	}
+}
+
+func (env *e2e) forUser(chatID, userID int64) func(telegramtest.Call) bool {
+	return func(c telegramtest.Call) bool {
+		return c.Int("chat_id") == chatID && c.Int("user_id") == userID
+	}
+}
+
+func (env *e2e) lolsHits(userID int64) int32 {
+	counter, ok := env.lolsHit.Load(fmt.Sprint(userID))
+	if !ok {
+		return 0
+	}
+	return counter.(*atomic.Int32).Load()
+}
+
+func (env *e2e) waitLols(userID int64) (int32, bool) {
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		if n := env.lolsHits(userID); n > 0 {
+			return n, true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 0, false
+}
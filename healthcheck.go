@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const defaultAdminAddr = ":9110"
+
+// runHealthcheck probes the readiness endpoint of a running instance, so that
+// images without a shell can use `ngbot healthcheck` as their HEALTHCHECK.
+// It deliberately avoids loading the full config, which requires secrets.
+func runHealthcheck(args []string) int {
+	url := ""
+	if len(args) > 0 {
+		url = args[0]
+	} else {
+		addr := os.Getenv("NG_ADMIN_ADDR")
+		if addr == "" {
+			addr = defaultAdminAddr
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid NG_ADMIN_ADDR %q: %v\n", addr, err)
+			return 1
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		url = "http://" + net.JoinHostPort(host, port) + "/readyz"
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "healthcheck failed: %s\n", resp.Status)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,208 @@
+package audit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/event"
+)
+
+// Recorder persists moderation actions published on the bus and mirrors them into chat log channels
+type Recorder struct {
+	s    bot.Service
+	subs []*event.Subscription
+}
+
+func NewRecorder(s bot.Service) *Recorder {
+	r := &Recorder{s: s}
+	bus := s.GetBus()
+	r.subs = append(r.subs,
+		event.Subscribe(bus, "audit.user_banned", func(e event.UserBanned) error {
+			return r.Record(&db.Action{
+				ChatID:     e.ChatID,
+				ActorID:    e.ActorID,
+				TargetID:   e.UserID,
+				TargetName: e.UserName,
+				Action:     db.ActionBan,
+				Reason:     e.Reason,
+				Source:     e.Source,
+			})
+		}),
+		event.Subscribe(bus, "audit.user_unbanned", func(e event.UserUnbanned) error {
+			action := db.ActionUnban
+			if e.Pardoned {
+				action = db.ActionPardon
+			}
+			return r.Record(&db.Action{
+				ChatID:     e.ChatID,
+				ActorID:    e.ActorID,
+				TargetID:   e.UserID,
+				TargetName: e.UserName,
+				Action:     action,
+				Reason:     e.Reason,
+				Source:     e.Source,
+			})
+		}),
+		event.Subscribe(bus, "audit.join_declined", func(e event.JoinDeclined) error {
+			return r.Record(&db.Action{
+				ChatID:     e.ChatID,
+				TargetID:   e.UserID,
+				TargetName: e.UserName,
+				Action:     db.ActionDecline,
+				Reason:     e.Reason,
+				Source:     e.Source,
+			})
+		}),
+		event.Subscribe(bus, "audit.message_deleted", func(e event.MessageDeleted) error {
+			return r.Record(&db.Action{
+				ChatID:     e.ChatID,
+				TargetID:   e.UserID,
+				TargetName: e.UserName,
+				Action:     db.ActionDelete,
+				Reason:     e.Reason,
+				Source:     e.Source,
+				Excerpt:    r.s.GetPrivacy(e.ChatID).Excerpt(e.Content),
+			})
+		}),
+		event.Subscribe(bus, "audit.spam_detected", func(e event.SpamDetected) error {
+			return r.Record(&db.Action{
+				ChatID:     e.ChatID,
+				TargetID:   e.UserID,
+				TargetName: e.UserName,
+				Action:     db.ActionSpamVerdict,
+				Reason:     e.Verdict,
+				Source:     e.Source,
+				Excerpt:    r.s.GetPrivacy(e.ChatID).Excerpt(e.Content),
+			})
+		}),
+		event.Subscribe(bus, "audit.lockdown_started", func(e event.LockdownStarted) error {
+			return r.Record(&db.Action{
+				ChatID: e.ChatID,
+				Action: db.ActionLockdown,
+				Reason: e.Signal,
+				Source: event.SourceRaid,
+			})
+		}),
+		event.Subscribe(bus, "audit.lockdown_ended", func(e event.LockdownEnded) error {
+			reason := "quiet period"
+			if e.ActorID != 0 {
+				reason = "lifted"
+			}
+			return r.Record(&db.Action{
+				ChatID:  e.ChatID,
+				ActorID: e.ActorID,
+				Action:  db.ActionUnlock,
+				Reason:  fmt.Sprintf("%s, %d joins held off", reason, e.Blocked),
+				Source:  event.SourceRaid,
+			})
+		}),
+		event.Subscribe(bus, "audit.reputation_matched", func(e event.ReputationMatched) error {
+			return r.Record(&db.Action{
+				ChatID:     e.ChatID,
+				TargetID:   e.UserID,
+				TargetName: e.UserName,
+				Action:     db.ActionFederation,
+				Reason:     fmt.Sprintf("%s (%s): %s", e.Verdict, e.Action, e.Provenance),
+				Source:     event.SourceFederation,
+			})
+		}),
+	)
+	return r
+}
+
+// Record stores the action and posts it to the chat's log channel, if one is configured
+func (r *Recorder) Record(action *db.Action) error {
+	entry := r.getLogEntry().WithFields(log.Fields{
+		"method":  "Record",
+		"chat_id": action.ChatID,
+		"action":  action.Action,
+	})
+	if err := r.s.GetDB().InsertAction(action); err != nil {
+		return errors.WithMessage(err, "cant record action")
+	}
+	entry.Trace("action recorded")
+
+	settings, err := r.s.GetSettings(action.ChatID)
+	if err != nil {
+		entry.WithError(err).Warn("cant get chat settings")
+		return nil
+	}
+	if settings == nil || settings.LogChannelID == 0 {
+		return nil
+	}
+	msg := api.NewMessage(settings.LogChannelID, Format(action))
+	msg.ParseMode = api.ModeHTML
+	msg.DisableNotification = true
+	msg.LinkPreviewOptions = api.LinkPreviewOptions{IsDisabled: true}
+	if _, err := r.s.GetBot().Send(msg); err != nil {
+		entry.WithError(err).Warn("cant post to log channel")
+	}
+	return nil
+}
+
+// Stop detaches the recorder from the bus
+func (r *Recorder) Stop() {
+	for _, sub := range r.subs {
+		sub.Unsubscribe()
+	}
+	r.subs = nil
+}
+
+func (r *Recorder) getLogEntry() *log.Entry {
+	return log.WithField("context", "audit")
+}
+
+// Format renders the action as an HTML message for a log channel or a history reply
+func Format(action *db.Action) string {
+	icons := map[string]string{
+		db.ActionBan:         "🚫",
+		db.ActionDecline:     "✋",
+		db.ActionDelete:      "🗑",
+		db.ActionSpamVerdict: "🧪",
+		db.ActionUnban:       "✅",
+		db.ActionPardon:      "🕊",
+		db.ActionLockdown:    "🔒",
+		db.ActionUnlock:      "🔓",
+		db.ActionFederation:  "🤝",
+	}
+	icon, ok := icons[action.Action]
+	if !ok {
+		icon = "ℹ️"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s <b>%s</b> · %s · <code>%d</code>\n", icon, escape(action.Action), escape(action.Source), action.ChatID)
+	// chat wide actions have no target
+	if action.TargetID != 0 {
+		name := action.TargetName
+		if name == "" {
+			name = fmt.Sprint(action.TargetID)
+		}
+		fmt.Fprintf(&sb, "👤 <a href=\"tg://user?id=%d\">%s</a> (<code>%d</code>)", action.TargetID, escape(name), action.TargetID)
+		if action.ActorID != 0 {
+			fmt.Fprintf(&sb, " by <code>%d</code>", action.ActorID)
+		}
+		sb.WriteString("\n")
+	} else if action.ActorID != 0 {
+		fmt.Fprintf(&sb, "👮 <code>%d</code>\n", action.ActorID)
+	}
+	if action.Reason != "" {
+		fmt.Fprintf(&sb, "📝 %s\n", escape(action.Reason))
+	}
+	if action.Excerpt != "" {
+		fmt.Fprintf(&sb, "💬 <i>%s</i>\n", escape(action.Excerpt))
+	}
+	fmt.Fprintf(&sb, "🕒 %s", action.CreatedAt.UTC().Format(time.DateTime))
+	return sb.String()
+}
+
+func escape(s string) string {
+	return api.EscapeText(api.ModeHTML, s)
+}
@@ -0,0 +1,246 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/metrics"
+)
+
+const (
+	// ErrorContinue logs the error and passes the update on to the next handler
+	ErrorContinue ErrorPolicy = "continue"
+	// ErrorStop aborts the pipeline, Process returns the error
+	ErrorStop ErrorPolicy = "stop"
+	// ErrorRetry calls the handler again with a backoff, then continues
+	ErrorRetry ErrorPolicy = "retry"
+
+	retryAttempts = 3
+	retryBackoff  = 500 * time.Millisecond
+
+	// limiterSweep is how often the rate limiter drops the buckets of idle chats
+	limiterSweep = 10 * time.Minute
+)
+
+type (
+	// HandlerFunc adapts a function to Handler
+	HandlerFunc func(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error)
+
+	// Middleware wraps the named handler
+	Middleware func(name string, next Handler) Handler
+
+	// ErrorPolicy decides what a handler error does to the rest of the pipeline
+	ErrorPolicy string
+
+	// ErrorPolicer is implemented by handlers with a policy other than ErrorContinue
+	ErrorPolicer interface {
+		ErrorPolicy() ErrorPolicy
+	}
+
+	traceKey struct{}
+
+	// Trace identifies the update and the handler in logs
+	Trace struct {
+		UpdateID int
+		Handler  string
+	}
+)
+
+func (f HandlerFunc) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+	return f(ctx, u, chat, user)
+}
+
+// ParseErrorPolicy returns the policy by name, false if it is unknown
+func ParseErrorPolicy(s string) (ErrorPolicy, bool) {
+	p := ErrorPolicy(s)
+	return p, slices.Contains([]ErrorPolicy{ErrorContinue, ErrorStop, ErrorRetry}, p)
+}
+
+func policyOf(h Handler) ErrorPolicy {
+	if p, ok := h.(ErrorPolicer); ok {
+		if policy, ok := ParseErrorPolicy(string(p.ErrorPolicy())); ok {
+			return policy
+		}
+	}
+	return ErrorContinue
+}
+
+// Tracing puts the Trace of the handler call into the context, see LogEntry
+func Tracing() Middleware {
+	return func(name string, next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+			ctx = context.WithValue(ctx, traceKey{}, Trace{UpdateID: u.UpdateID, Handler: name})
+			return next.Handle(ctx, u, chat, user)
+		})
+	}
+}
+
+// TraceFrom returns the Trace set by the Tracing middleware
+func TraceFrom(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(traceKey{}).(Trace)
+	return t, ok
+}
+
+// LogEntry returns a log entry carrying the trace fields of the context
+func LogEntry(ctx context.Context) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if t, ok := TraceFrom(ctx); ok {
+		entry = entry.WithFields(log.Fields{"update_id": t.UpdateID, "handler": t.Handler})
+	}
+	return entry
+}
+
+// Logging logs every handler call at trace level and handler errors at error level
+func Logging() Middleware {
+	return func(name string, next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+			entry := LogEntry(ctx).WithFields(log.Fields{"context": "pipeline", "type": UpdateType(u), "handler": name})
+			if chat != nil {
+				entry = entry.WithField("chat_id", chat.ID)
+			}
+			start := time.Now()
+			proceed, err := next.Handle(ctx, u, chat, user)
+			entry = entry.WithFields(log.Fields{"proceed": proceed, "duration": time.Since(start)})
+			if err != nil {
+				entry.WithError(err).Error("handler failed")
+			} else {
+				entry.Trace("handled")
+			}
+			return proceed, err
+		})
+	}
+}
+
+// Metrics observes the handler duration and outcome
+func Metrics() Middleware {
+	return func(name string, next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+			updateType := UpdateType(u)
+			start := time.Now()
+			proceed, err := next.Handle(ctx, u, chat, user)
+			metrics.HandlerDuration.WithLabelValues(updateType, name).Observe(time.Since(start).Seconds())
+			metrics.UpdatesProcessed.WithLabelValues(updateType, name, handlingResult(proceed, err)).Inc()
+			return proceed, err
+		})
+	}
+}
+
+// Recovery turns a handler panic into an error, the update loop keeps running
+func Recovery() Middleware {
+	return func(name string, next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (proceed bool, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					LogEntry(ctx).WithField("stack", string(debug.Stack())).Debug("handler panic stack")
+					proceed, err = true, fmt.Errorf("panic: %v", r)
+				}
+			}()
+			return next.Handle(ctx, u, chat, user)
+		})
+	}
+}
+
+// ChatEnabled skips handlers in chats where the bot was disabled, except the exempt ones
+func ChatEnabled(s Service, exempt ...string) Middleware {
+	return func(name string, next Handler) Handler {
+		if slices.Contains(exempt, name) {
+			return next
+		}
+		return HandlerFunc(func(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+			if chat != nil {
+				if settings, err := s.GetSettings(chat.ID); err == nil && settings != nil && !settings.Enabled {
+					return true, nil
+				}
+			}
+			return next.Handle(ctx, u, chat, user)
+		})
+	}
+}
+
+// RateLimit lets a handler take up to NG_RATE_LIMIT updates of a chat per second, with bursts of NG_RATE_BURST,
+// and skips the rest. The limits are read when the handlers are enabled. The exempt handlers take every update,
+// a flood is what the moderation handlers must see.
+func RateLimit(exempt ...string) Middleware {
+	return func(name string, next Handler) Handler {
+		cfg := config.Get()
+		if cfg.RateLimit <= 0 || slices.Contains(exempt, name) {
+			return next
+		}
+		limiter := &chatLimiter{rate: cfg.RateLimit, burst: float64(max(cfg.RateBurst, 1)), buckets: map[int64]*bucket{}, swept: time.Now()}
+		return HandlerFunc(func(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+			if chat != nil && !limiter.allow(chat.ID) {
+				metrics.UpdatesDropped.WithLabelValues(UpdateType(u), "rate_limited").Inc()
+				LogEntry(ctx).WithField("chat_id", chat.ID).Debug("rate limited")
+				return true, nil
+			}
+			return next.Handle(ctx, u, chat, user)
+		})
+	}
+}
+
+type (
+	// chatLimiter keeps a bucket per chat, dropping the ones refilled while idle
+	chatLimiter struct {
+		mutex   sync.Mutex
+		rate    float64
+		burst   float64
+		buckets map[int64]*bucket
+		swept   time.Time
+	}
+
+	bucket struct {
+		tokens  float64
+		updated time.Time
+	}
+)
+
+func (l *chatLimiter) allow(chatID int64) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) > limiterSweep {
+		for id, b := range l.buckets {
+			// a full bucket is no different from a new one
+			if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, id)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[chatID]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[chatID] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// withErrorPolicy applies the retry policy, the other policies are handled by Process
+func withErrorPolicy(ctx context.Context, policy ErrorPolicy, h Handler, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+	proceed, err := h.Handle(ctx, u, chat, user)
+	for attempt := 1; err != nil && policy == ErrorRetry && attempt < retryAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return proceed, errors.WithMessage(err, ctx.Err().Error())
+		case <-time.After(time.Duration(attempt) * retryBackoff):
+		}
+		proceed, err = h.Handle(ctx, u, chat, user)
+	}
+	return proceed, err
+}
@@ -0,0 +1,95 @@
+package bot_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+)
+
+// step is a handler with an error policy that counts its calls
+type step struct {
+	policy bot.ErrorPolicy
+	fail   int
+	panics bool
+	calls  int
+}
+
+func (s *step) Handle(context.Context, *api.Update, *api.Chat, *api.User) (bool, error) {
+	s.calls++
+	if s.panics {
+		panic("broken")
+	}
+	if s.calls <= s.fail {
+		return true, errors.New("failed")
+	}
+	return true, nil
+}
+
+func (s *step) ErrorPolicy() bot.ErrorPolicy { return s.policy }
+
+func process(t *testing.T, handlers ...*step) error {
+	t.Helper()
+	up := bot.NewUpdateProcessor(context.Background(), nil)
+	t.Cleanup(up.Shutdown)
+	up.Use(bot.Recovery())
+	var names []string
+	for i, h := range handlers {
+		name := "step" + string(rune('a'+i))
+		up.RegisterUpdateHandler(name, h)
+		names = append(names, name)
+	}
+	up.SetEnabledHandlers(names)
+	return up.Process(&api.Update{UpdateID: 1, Message: &api.Message{
+		MessageID: 1,
+		Date:      int(time.Now().Unix()),
+		Chat:      api.Chat{ID: -100, Type: "supergroup"},
+		From:      &api.User{ID: 1},
+	}})
+}
+
+func TestErrorPolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		first     *step
+		wantErr   bool
+		wantCalls int
+		wantNext  int
+	}{
+		{"continue", &step{fail: 1}, false, 1, 1},
+		{"unknown policy continues", &step{policy: "ignore", fail: 1}, false, 1, 1},
+		{"stop", &step{policy: bot.ErrorStop, fail: 1}, true, 1, 0},
+		{"retry succeeds", &step{policy: bot.ErrorRetry, fail: 1}, false, 2, 1},
+		{"retry gives up", &step{policy: bot.ErrorRetry, fail: 5}, false, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &step{}
+			err := process(t, tt.first, next)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v", err)
+			}
+			if tt.first.calls != tt.wantCalls || next.calls != tt.wantNext {
+				t.Errorf("got %d calls and %d of the next handler", tt.first.calls, next.calls)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	next := &step{}
+	if err := process(t, &step{panics: true}, next); err != nil || next.calls != 1 {
+		t.Errorf("continue after panic: %v, %d calls of the next handler", err, next.calls)
+	}
+
+	next = &step{}
+	err := process(t, &step{policy: bot.ErrorStop, panics: true}, next)
+	if err == nil || !strings.Contains(err.Error(), "panic: broken") || next.calls != 0 {
+		t.Errorf("stop after panic: %v, %d calls of the next handler", err, next.calls)
+	}
+}
@@ -4,12 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 
+	"github.com/iamwavecut/ngbot/internal/config"
 	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/event"
+	"github.com/iamwavecut/ngbot/internal/metrics"
+	"github.com/iamwavecut/ngbot/internal/privacy"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -22,19 +28,27 @@ type ServiceDB interface {
 	GetDB() db.Client
 }
 
+type ServiceBus interface {
+	GetBus() *event.Bus
+}
+
 type Service interface {
 	ServiceBot
 	ServiceDB
+	ServiceBus
 	IsMember(ctx context.Context, chatID, userID int64) (bool, error)
 	InsertMember(ctx context.Context, chatID, userID int64) error
+	DeleteMember(ctx context.Context, chatID, userID int64) error
 	GetSettings(chatID int64) (*db.Settings, error)
 	SetSettings(settings *db.Settings) error
+	GetPrivacy(chatID int64) privacy.Policy
 	Shutdown(ctx context.Context) error
 }
 
 type service struct {
-	bot             *api.BotAPI
+	bot             atomic.Pointer[api.BotAPI]
 	dbClient        db.Client
+	bus             *event.Bus
 	memberCache     map[int64][]int64
 	settingsCache   map[int64]*db.Settings
 	cacheMutex      sync.RWMutex
@@ -44,11 +58,11 @@ type service struct {
 	cancel          context.CancelFunc
 }
 
-func NewService(ctx context.Context, bot *api.BotAPI, dbClient db.Client, log *logrus.Entry) *service {
+func NewService(ctx context.Context, bot *api.BotAPI, dbClient db.Client, bus *event.Bus, log *logrus.Entry) *service {
 	ctx, cancel := context.WithCancel(ctx)
 	s := &service{
-		bot:             bot,
 		dbClient:        dbClient,
+		bus:             bus,
 		memberCache:     make(map[int64][]int64),
 		settingsCache:   make(map[int64]*db.Settings),
 		cacheExpiration: 5 * time.Minute,
@@ -56,6 +70,7 @@ func NewService(ctx context.Context, bot *api.BotAPI, dbClient db.Client, log *l
 		ctx:             ctx,
 		cancel:          cancel,
 	}
+	s.bot.Store(bot)
 
 	go func() {
 		if err := s.warmupCache(); err != nil {
@@ -66,13 +81,22 @@ func NewService(ctx context.Context, bot *api.BotAPI, dbClient db.Client, log *l
 }
 
 func (s *service) GetBot() *api.BotAPI {
-	return s.bot
+	return s.bot.Load()
+}
+
+// SetBot swaps the Bot API client, e.g. after the token was rotated
+func (s *service) SetBot(bot *api.BotAPI) {
+	s.bot.Store(bot)
 }
 
 func (s *service) GetDB() db.Client {
 	return s.dbClient
 }
 
+func (s *service) GetBus() *event.Bus {
+	return s.bus
+}
+
 func (s *service) IsMember(ctx context.Context, chatID, userID int64) (bool, error) {
 	select {
 	case <-ctx.Done():
@@ -83,20 +107,23 @@ func (s *service) IsMember(ctx context.Context, chatID, userID int64) (bool, err
 			for _, member := range chatMembers {
 				if member == userID {
 					s.cacheMutex.RUnlock()
+					metrics.CacheHit("members", true)
 					return true, nil
 				}
 			}
 		}
 		s.cacheMutex.RUnlock()
+		metrics.CacheHit("members", false)
 
 		isMember, err := s.dbClient.IsMember(chatID, userID)
 		if err != nil {
 			return false, err
 		}
 
-		s.cacheMutex.Lock()
-		defer s.cacheMutex.Unlock()
-		s.memberCache[chatID] = append(s.memberCache[chatID], userID)
+		// only members are cached, a user who is not trusted yet must be checked again
+		if isMember {
+			s.cacheMember(chatID, userID)
+		}
 
 		return isMember, nil
 	}
@@ -112,9 +139,34 @@ func (s *service) InsertMember(ctx context.Context, chatID, userID int64) error
 			return err
 		}
 
+		s.cacheMember(chatID, userID)
+
+		return nil
+	}
+}
+
+// cacheMember adds the member to the cache once, the same user is trusted again e.g. after a repeated check
+func (s *service) cacheMember(chatID, userID int64) {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	if !slices.Contains(s.memberCache[chatID], userID) {
+		s.memberCache[chatID] = append(s.memberCache[chatID], userID)
+	}
+}
+
+// DeleteMember revokes the trust, the next message of the user is checked again
+func (s *service) DeleteMember(ctx context.Context, chatID, userID int64) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		if err := s.dbClient.DeleteMember(chatID, userID); err != nil {
+			return err
+		}
+
 		s.cacheMutex.Lock()
 		defer s.cacheMutex.Unlock()
-		s.memberCache[chatID] = append(s.memberCache[chatID], userID)
+		s.memberCache[chatID] = slices.DeleteFunc(s.memberCache[chatID], func(id int64) bool { return id == userID })
 
 		return nil
 	}
@@ -124,25 +176,27 @@ func (s *service) GetSettings(chatID int64) (*db.Settings, error) {
 	s.cacheMutex.RLock()
 	if settings, ok := s.settingsCache[chatID]; ok {
 		s.cacheMutex.RUnlock()
-		return settings, nil
+		metrics.CacheHit("settings", true)
+		return withOverrides(settings), nil
 	}
 	s.cacheMutex.RUnlock()
+	metrics.CacheHit("settings", false)
 
 	settings, err := s.dbClient.GetSettings(chatID)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			settings = &db.Settings{
-				ID:               chatID,
-				Enabled:          true,
-				ChallengeTimeout: 3 * time.Minute,
-				RejectTimeout:    10 * time.Minute,
-				Language:         "en",
-			}
-			if err := s.SetSettings(settings); err != nil {
-				return nil, fmt.Errorf("error setting default settings: %w", err)
-			}
-		} else {
-			return nil, fmt.Errorf("error fetching settings from database: %w", err)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error fetching settings from database: %w", err)
+	}
+	// the client reports a chat without settings as nil settings
+	if settings == nil {
+		settings = &db.Settings{
+			ID:               chatID,
+			Enabled:          true,
+			ChallengeTimeout: config.Get().ChallengeTimeout,
+			RejectTimeout:    config.Get().RejectTimeout,
+			Language:         config.Get().DefaultLanguage,
+		}
+		if err := s.SetSettings(settings); err != nil {
+			return nil, fmt.Errorf("error setting default settings: %w", err)
 		}
 	}
 
@@ -150,22 +204,116 @@ func (s *service) GetSettings(chatID int64) (*db.Settings, error) {
 	s.settingsCache[chatID] = settings
 	s.cacheMutex.Unlock()
 
-	return settings, nil
+	return withOverrides(settings), nil
+}
+
+// withOverrides applies the chat overrides from the config file on a copy of the stored settings,
+// so that a caller changing the settings never changes the cached ones
+func withOverrides(settings *db.Settings) *db.Settings {
+	overridden := *settings
+	o, ok := config.Get().ForChat(settings.ID)
+	if !ok {
+		return &overridden
+	}
+	if o.Language != "" {
+		overridden.Language = o.Language
+	}
+	if o.Privacy != "" {
+		overridden.Privacy = o.Privacy
+	}
+	if o.ChallengeTimeout != 0 {
+		overridden.ChallengeTimeout = o.ChallengeTimeout
+	}
+	if o.RejectTimeout != 0 {
+		overridden.RejectTimeout = o.RejectTimeout
+	}
+	if o.LogChannelID != 0 {
+		overridden.LogChannelID = o.LogChannelID
+	}
+	return &overridden
 }
 
+// SetSettings stores the settings, the fields overridden in the config file keep their stored values
 func (s *service) SetSettings(settings *db.Settings) error {
-	err := s.dbClient.SetSettings(settings)
+	persisted, err := s.withoutOverrides(settings)
 	if err != nil {
 		return err
 	}
+	if err := s.dbClient.SetSettings(persisted); err != nil {
+		return err
+	}
 
 	s.cacheMutex.Lock()
 	defer s.cacheMutex.Unlock()
-	s.settingsCache[settings.ID] = settings
+	s.settingsCache[settings.ID] = persisted
 
 	return nil
 }
 
+// withoutOverrides returns a copy of the settings with the stored values of the overridden fields,
+// the settings come from GetSettings and carry the overrides, which must not outlive the config file
+func (s *service) withoutOverrides(settings *db.Settings) (*db.Settings, error) {
+	persisted := *settings
+	o, ok := config.Get().ForChat(settings.ID)
+	if !ok {
+		return &persisted, nil
+	}
+	s.cacheMutex.RLock()
+	stored, cached := s.settingsCache[settings.ID]
+	s.cacheMutex.RUnlock()
+	if !cached {
+		var err error
+		if stored, err = s.dbClient.GetSettings(settings.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("error fetching settings from database: %w", err)
+		}
+	}
+	if stored == nil {
+		stored = &db.Settings{
+			ChallengeTimeout: config.Get().ChallengeTimeout,
+			RejectTimeout:    config.Get().RejectTimeout,
+			Language:         config.Get().DefaultLanguage,
+		}
+	}
+	if o.Language != "" {
+		persisted.Language = stored.Language
+	}
+	if o.Privacy != "" {
+		persisted.Privacy = stored.Privacy
+	}
+	if o.ChallengeTimeout != 0 {
+		persisted.ChallengeTimeout = stored.ChallengeTimeout
+	}
+	if o.RejectTimeout != 0 {
+		persisted.RejectTimeout = stored.RejectTimeout
+	}
+	if o.LogChannelID != 0 {
+		persisted.LogChannelID = stored.LogChannelID
+	}
+	return &persisted, nil
+}
+
+// GetPrivacy resolves the chat privacy policy against the deployment one, failing closed on errors
+func (s *service) GetPrivacy(chatID int64) privacy.Policy {
+	deployment := privacy.Mode(config.Get().Privacy)
+	settings, err := s.GetSettings(chatID)
+	if err != nil || settings == nil {
+		return privacy.For(privacy.ModeStrict)
+	}
+	return privacy.Effective(deployment, privacy.Mode(settings.Privacy))
+}
+
+// CachedPrivacy returns the privacy mode of a chat with cached settings, without a database lookup,
+// see config.ChatPrivacy
+func (s *service) CachedPrivacy(chatID int64) (privacy.Mode, bool) {
+	s.cacheMutex.RLock()
+	settings, ok := s.settingsCache[chatID]
+	s.cacheMutex.RUnlock()
+	if !ok {
+		return privacy.ModeInherit, false
+	}
+	return privacy.Mode(withOverrides(settings).Privacy), true
+}
+
 func (s *service) warmupCache() error {
 	members, err := s.dbClient.GetAllMembers()
 	if err != nil {
@@ -200,7 +348,6 @@ func (s *service) getLogEntry() *logrus.Entry {
 
 func (s *service) Shutdown(ctx context.Context) error {
 	s.cancel()
-	s.dbClient.Close()
 	s.memberCache = nil
 	s.settingsCache = nil
 	return nil
@@ -2,7 +2,11 @@ package bot
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -10,6 +14,8 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/infra"
+	"github.com/iamwavecut/ngbot/internal/metrics"
 )
 
 type (
@@ -18,36 +24,92 @@ type (
 	}
 
 	UpdateProcessor struct {
-		s              Service
-		updateHandlers []Handler
-		ctx            context.Context
-		cancel         context.CancelFunc
+		s             Service
+		registered    map[string]Handler
+		routes        map[string][]namedHandler
+		middleware    []Middleware
+		handlersMutex sync.RWMutex
+		ctx           context.Context
+		cancel        context.CancelFunc
+	}
+
+	namedHandler struct {
+		name    string
+		handler Handler
+		policy  ErrorPolicy
+		// types the handler consumes, every type if empty
+		types []string
 	}
 )
 
-var registeredHandlers = make(map[string]Handler)
+func NewUpdateProcessor(ctx context.Context, s Service) *UpdateProcessor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &UpdateProcessor{
+		s:          s,
+		registered: make(map[string]Handler),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
 
-func RegisterUpdateHandler(title string, handler Handler) {
-	registeredHandlers[title] = handler
+// RegisterUpdateHandler makes the handler available to SetEnabledHandlers under the title
+func (up *UpdateProcessor) RegisterUpdateHandler(title string, handler Handler) {
+	up.handlersMutex.Lock()
+	defer up.handlersMutex.Unlock()
+	up.registered[title] = handler
 }
 
-func NewUpdateProcessor(ctx context.Context, s Service) *UpdateProcessor {
-	enabledHandlers := make([]Handler, 0)
-	for _, handlerName := range config.Get().EnabledHandlers {
-		if _, ok := registeredHandlers[handlerName]; !ok || registeredHandlers[handlerName] == nil {
+// Use wraps every handler enabled afterwards in the middleware, the first one is the outermost
+func (up *UpdateProcessor) Use(middleware ...Middleware) {
+	up.handlersMutex.Lock()
+	defer up.handlersMutex.Unlock()
+	up.middleware = append(up.middleware, middleware...)
+}
+
+// SetEnabledHandlers replaces the handler chain, in the given order
+func (up *UpdateProcessor) SetEnabledHandlers(names []string) {
+	up.handlersMutex.Lock()
+	defer up.handlersMutex.Unlock()
+
+	enabledHandlers := make([]namedHandler, 0, len(names))
+	for _, handlerName := range names {
+		handler, ok := up.registered[handlerName]
+		if !ok || handler == nil {
 			log.Warnf("no registered handler: %s", handlerName)
 			continue
 		}
-		enabledHandlers = append(enabledHandlers, registeredHandlers[handlerName])
+		nh := namedHandler{name: handlerName, handler: handler, policy: policyOf(handler)}
+		if c, ok := handler.(Consumer); ok {
+			nh.types = c.UpdateTypes()
+		}
+		for i := len(up.middleware) - 1; i >= 0; i-- {
+			nh.handler = up.middleware[i](handlerName, nh.handler)
+		}
+		enabledHandlers = append(enabledHandlers, nh)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	return &UpdateProcessor{
-		s:              s,
-		updateHandlers: enabledHandlers,
-		ctx:            ctx,
-		cancel:         cancel,
+	up.routes = make(map[string][]namedHandler, len(UpdateTypes))
+	for _, updateType := range UpdateTypes {
+		for _, nh := range enabledHandlers {
+			if len(nh.types) == 0 || slices.Contains(nh.types, updateType) {
+				up.routes[updateType] = append(up.routes[updateType], nh)
+			}
+		}
+	}
+}
+
+// AllowedUpdates returns the update types consumed by the enabled handlers, to request only those from Telegram
+func (up *UpdateProcessor) AllowedUpdates() []string {
+	up.handlersMutex.RLock()
+	defer up.handlersMutex.RUnlock()
+
+	allowed := make([]string, 0, len(UpdateTypes))
+	for _, updateType := range UpdateTypes {
+		if len(up.routes[updateType]) > 0 {
+			allowed = append(allowed, updateType)
+		}
 	}
+	return allowed
 }
 
 func (up *UpdateProcessor) Process(u *api.Update) error {
@@ -59,52 +121,52 @@ func (up *UpdateProcessor) Process(u *api.Update) error {
 	case <-up.ctx.Done():
 		return up.ctx.Err()
 	default:
-		var updateTime time.Time
-		switch {
-		case u.Message != nil:
-			updateTime = time.Unix(int64(u.Message.Date), 0)
-		case u.ChannelPost != nil:
-			updateTime = time.Unix(int64(u.ChannelPost.Date), 0)
-		default:
-			return nil
+		updateType := UpdateType(u)
+		if maxAge, ok := Staleness[updateType]; ok {
+			if updateTime, ok := UpdateTime(u); ok && time.Since(updateTime) > maxAge {
+				metrics.UpdatesDropped.WithLabelValues(updateType, "stale").Inc()
+				return nil
+			}
 		}
 
-		if time.Since(updateTime) > time.Minute {
+		up.handlersMutex.RLock()
+		handlers := up.routes[updateType]
+		up.handlersMutex.RUnlock()
+		if len(handlers) == 0 {
+			metrics.UpdatesDropped.WithLabelValues(updateType, "unrouted").Inc()
 			return nil
 		}
 
-		chat := u.FromChat()
-		if chat == nil && u.ChatJoinRequest != nil {
-			chat = &u.ChatJoinRequest.Chat
-		}
-
-		user := u.SentFrom()
-		if user == nil && u.ChatJoinRequest != nil {
-			user = &u.ChatJoinRequest.From
-		}
-
-		for _, handler := range up.updateHandlers {
-			if handler == nil {
-				continue
-			}
-			select {
-			case <-up.ctx.Done():
+		chat := UpdateChat(u)
+		user := UpdateUser(u)
+		for _, nh := range handlers {
+			if up.ctx.Err() != nil {
 				return up.ctx.Err()
-			default:
-				proceed, err := handler.Handle(up.ctx, u, chat, user)
-				if err != nil {
-					return errors.WithMessage(err, "handling error")
-				}
-				if !proceed {
-					log.Trace("not proceeding")
-					return nil
-				}
+			}
+			proceed, err := withErrorPolicy(up.ctx, nh.policy, nh.handler, u, chat, user)
+			if err != nil && nh.policy == ErrorStop {
+				return errors.WithMessagef(err, "handler %s", nh.name)
+			}
+			if err == nil && !proceed {
+				log.Trace("not proceeding")
+				return nil
 			}
 		}
 		return nil
 	}
 }
 
+func handlingResult(proceed bool, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case proceed:
+		return "proceed"
+	default:
+		return "stop"
+	}
+}
+
 func (up *UpdateProcessor) Shutdown() {
 	up.cancel()
 }
@@ -116,6 +178,20 @@ func DeleteChatMessage(bot *api.BotAPI, chatID int64, messageID int) error {
 	return nil
 }
 
+// GetFileURL returns the download link of the file on the configured Bot API server,
+// the library always links to api.telegram.org
+func GetFileURL(bot *api.BotAPI, fileID string) (string, error) {
+	file, err := bot.GetFile(api.FileConfig{FileID: fileID})
+	if err != nil {
+		return "", errors.WithMessage(err, "cant get file")
+	}
+	endpoint := config.Get().TelegramAPIEndpoint
+	if i := strings.LastIndex(endpoint, "/bot%s/"); i >= 0 {
+		return fmt.Sprintf(endpoint[:i]+"/file"+endpoint[i:], bot.Token, file.FilePath), nil
+	}
+	return file.Link(bot.Token), nil
+}
+
 func BanUserFromChat(bot *api.BotAPI, userID int64, chatID int64) error {
 	if _, err := bot.Request(api.BanChatMemberConfig{
 		ChatMemberConfig: api.ChatMemberConfig{
@@ -132,7 +208,27 @@ func BanUserFromChat(bot *api.BotAPI, userID int64, chatID int64) error {
 	return nil
 }
 
+func UnbanUserFromChat(bot *api.BotAPI, userID int64, chatID int64) error {
+	if _, err := bot.Request(api.UnbanChatMemberConfig{
+		ChatMemberConfig: api.ChatMemberConfig{
+			ChatConfig: api.ChatConfig{
+				ChatID: chatID,
+			},
+			UserID: userID,
+		},
+		OnlyIfBanned: true,
+	}); err != nil {
+		return errors.WithMessage(err, "cant unban")
+	}
+	return nil
+}
+
 func RestrictChatting(bot *api.BotAPI, userID int64, chatID int64) error {
+	return RestrictChattingFor(bot, userID, chatID, 10*time.Minute)
+}
+
+// RestrictChattingFor takes every right to post from the user for the duration
+func RestrictChattingFor(bot *api.BotAPI, userID int64, chatID int64, duration time.Duration) error {
 	if _, err := bot.Request(api.RestrictChatMemberConfig{
 		ChatMemberConfig: api.ChatMemberConfig{
 			ChatConfig: api.ChatConfig{
@@ -140,7 +236,7 @@ func RestrictChatting(bot *api.BotAPI, userID int64, chatID int64) error {
 			},
 			UserID: userID,
 		},
-		UntilDate: time.Now().Add(10 * time.Minute).Unix(),
+		UntilDate: time.Now().Add(duration).Unix(),
 		Permissions: &api.ChatPermissions{
 			CanSendMessages:       false,
 			CanSendAudios:         false,
@@ -218,9 +314,14 @@ func DeclineJoinRequest(bot *api.BotAPI, userID int64, chatID int64) error {
 	return nil
 }
 
-func GetUpdatesChans(ctx context.Context, bot *api.BotAPI, config api.UpdateConfig) (api.UpdatesChannel, chan error) {
+// GetUpdatesChans long-polls for updates, beating the heartbeat after every successful poll.
+// Cancelling ctx aborts the poll in flight and stops the polling without reporting an error, so a poller can be replaced:
+// the update channel is closed once the poller is gone.
+func GetUpdatesChans(ctx context.Context, bot *api.BotAPI, config api.UpdateConfig, heartbeat *infra.Heartbeat) (api.UpdatesChannel, chan error) {
 	ch := make(chan api.Update, bot.Buffer)
-	chErr := make(chan error)
+	chErr := make(chan error, 1)
+	poller := *bot
+	poller.Client = contextClient{ctx: ctx, next: bot.Client}
 
 	go func() {
 		defer close(ch)
@@ -228,14 +329,16 @@ func GetUpdatesChans(ctx context.Context, bot *api.BotAPI, config api.UpdateConf
 		for {
 			select {
 			case <-ctx.Done():
-				chErr <- ctx.Err()
 				return
 			default:
-				updates, err := bot.GetUpdates(config)
+				updates, err := poller.GetUpdates(config)
 				if err != nil {
-					chErr <- err
+					if ctx.Err() == nil {
+						chErr <- err
+					}
 					return
 				}
+				heartbeat.Beat()
 
 				for _, update := range updates {
 					if update.UpdateID >= config.Offset {
@@ -243,7 +346,6 @@ func GetUpdatesChans(ctx context.Context, bot *api.BotAPI, config api.UpdateConf
 						select {
 						case ch <- update:
 						case <-ctx.Done():
-							chErr <- ctx.Err()
 							return
 						}
 					}
@@ -255,6 +357,16 @@ func GetUpdatesChans(ctx context.Context, bot *api.BotAPI, config api.UpdateConf
 	return ch, chErr
 }
 
+// contextClient makes the requests of a poller with its context
+type contextClient struct {
+	ctx  context.Context
+	next api.HTTPClient
+}
+
+func (c contextClient) Do(req *http.Request) (*http.Response, error) {
+	return c.next.Do(req.WithContext(c.ctx))
+}
+
 func GetUN(user *api.User) string {
 	if user == nil {
 		return ""
@@ -0,0 +1,150 @@
+package bot
+
+import (
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// UpdateTypes lists every Bot API update type the bot can receive
+var UpdateTypes = []string{
+	"message",
+	"edited_message",
+	"channel_post",
+	"edited_channel_post",
+	"message_reaction",
+	"message_reaction_count",
+	"inline_query",
+	"chosen_inline_result",
+	"callback_query",
+	"shipping_query",
+	"pre_checkout_query",
+	"poll",
+	"poll_answer",
+	"my_chat_member",
+	"chat_member",
+	"chat_join_request",
+}
+
+// Staleness is how old an update of the type may get before it is dropped unprocessed.
+// Types missing here carry no date and are never dropped.
+var Staleness = map[string]time.Duration{
+	"message":             time.Minute,
+	"edited_message":      time.Minute,
+	"channel_post":        time.Minute,
+	"edited_channel_post": time.Minute,
+	"message_reaction":    5 * time.Minute,
+	"my_chat_member":      10 * time.Minute,
+	"chat_member":         10 * time.Minute,
+	// join requests wait for a decision, a challenge is still useful after a restart
+	"chat_join_request": time.Hour,
+}
+
+// Consumer is implemented by handlers receiving only some update types, the others receive every type
+type Consumer interface {
+	UpdateTypes() []string
+}
+
+// UpdateType returns the Bot API name of the update payload, e.g. "message" or "callback_query"
+func UpdateType(u *api.Update) string {
+	switch {
+	case u == nil:
+		return "unknown"
+	case u.Message != nil:
+		return "message"
+	case u.EditedMessage != nil:
+		return "edited_message"
+	case u.ChannelPost != nil:
+		return "channel_post"
+	case u.EditedChannelPost != nil:
+		return "edited_channel_post"
+	case u.MessageReaction != nil:
+		return "message_reaction"
+	case u.MessageReactionCount != nil:
+		return "message_reaction_count"
+	case u.InlineQuery != nil:
+		return "inline_query"
+	case u.ChosenInlineResult != nil:
+		return "chosen_inline_result"
+	case u.CallbackQuery != nil:
+		return "callback_query"
+	case u.ShippingQuery != nil:
+		return "shipping_query"
+	case u.PreCheckoutQuery != nil:
+		return "pre_checkout_query"
+	case u.Poll != nil:
+		return "poll"
+	case u.PollAnswer != nil:
+		return "poll_answer"
+	case u.MyChatMember != nil:
+		return "my_chat_member"
+	case u.ChatMember != nil:
+		return "chat_member"
+	case u.ChatJoinRequest != nil:
+		return "chat_join_request"
+	}
+	return "unknown"
+}
+
+// UpdateTime returns when the update happened, false if its payload carries no date
+func UpdateTime(u *api.Update) (time.Time, bool) {
+	var date int64
+	switch {
+	case u.Message != nil:
+		date = int64(u.Message.Date)
+	case u.EditedMessage != nil:
+		date = int64(u.EditedMessage.EditDate)
+	case u.ChannelPost != nil:
+		date = int64(u.ChannelPost.Date)
+	case u.EditedChannelPost != nil:
+		date = int64(u.EditedChannelPost.EditDate)
+	case u.MessageReaction != nil:
+		date = u.MessageReaction.Date
+	case u.MyChatMember != nil:
+		date = int64(u.MyChatMember.Date)
+	case u.ChatMember != nil:
+		date = int64(u.ChatMember.Date)
+	case u.ChatJoinRequest != nil:
+		date = int64(u.ChatJoinRequest.Date)
+	}
+	if date == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(date, 0), true
+}
+
+// UpdateChat returns the chat of the update, also for the payloads api.Update.FromChat does not cover
+func UpdateChat(u *api.Update) *api.Chat {
+	if chat := u.FromChat(); chat != nil {
+		return chat
+	}
+	switch {
+	case u.MessageReaction != nil:
+		return &u.MessageReaction.Chat
+	case u.MyChatMember != nil:
+		return &u.MyChatMember.Chat
+	case u.ChatMember != nil:
+		return &u.ChatMember.Chat
+	case u.ChatJoinRequest != nil:
+		return &u.ChatJoinRequest.Chat
+	}
+	return nil
+}
+
+// UpdateUser returns the user behind the update, also for the payloads api.Update.SentFrom does not cover
+func UpdateUser(u *api.Update) *api.User {
+	if user := u.SentFrom(); user != nil {
+		return user
+	}
+	switch {
+	case u.MessageReaction != nil:
+		return u.MessageReaction.User
+	case u.MyChatMember != nil:
+		return &u.MyChatMember.From
+	case u.ChatMember != nil:
+		return &u.ChatMember.From
+	case u.ChatJoinRequest != nil:
+		return &u.ChatJoinRequest.From
+	}
+	return nil
+}
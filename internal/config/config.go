@@ -1,46 +1,267 @@
 package config
 
 import (
-	"context"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/sethvargo/go-envconfig"
 	log "github.com/sirupsen/logrus"
 )
 
 type (
+	// Config is assembled from defaults, an optional YAML file, NG_ prefixed env vars and flags, in that order
 	Config struct {
-		TelegramAPIToken string   `env:"TOKEN,required"`
-		DefaultLanguage  string   `env:"LANG,required"`
-		EnabledHandlers  []string `env:"HANDLERS,required"`
-		LogLevel         int      `env:"LOG_LEVEL,required"`
-		DotPath          string   `env:"DOT_PATH,default=~/.ngbot"`
-		OpenAI           OpenAI
+		TelegramAPIToken     string         `env:"TOKEN" yaml:"token"`
+		TelegramAPITokenFile string         `env:"TOKEN_FILE" yaml:"token_file"`
+		DefaultLanguage      string         `env:"LANG" yaml:"lang"`
+		EnabledHandlers      []string       `env:"HANDLERS" yaml:"handlers"`
+		LogLevel             int            `env:"LOG_LEVEL" yaml:"log_level"`
+		LogLevels            map[string]int `env:"LOG_LEVELS" yaml:"log_levels"`
+		LogFormat            string         `env:"LOG_FORMAT" yaml:"log_format"`
+		Privacy              string         `env:"PRIVACY" yaml:"privacy"`
+		DotPath              string         `env:"DOT_PATH" yaml:"dot_path"`
+		AdminAddr            string         `env:"ADMIN_ADDR" yaml:"admin_addr"`
+		// Pprof serves the profiling endpoints on the admin listener, they are unauthenticated
+		Pprof bool `env:"PPROF" yaml:"pprof"`
+		// TelegramAPIEndpoint is a format with the token and the method, for local Bot API servers and tests
+		TelegramAPIEndpoint string `env:"TELEGRAM_API_ENDPOINT" yaml:"telegram_api_endpoint"`
+		LolsURL             string `env:"LOLS_URL" yaml:"lols_url"`
+		// LinkResolver unshortens redirector links: empty follows the redirects, "off" keeps them, a URL asks that resolver service
+		LinkResolver string `env:"LINK_RESOLVER" yaml:"link_resolver"`
+		// Shorteners are the redirector domains whose links are unshortened
+		Shorteners []string `env:"SHORTENERS" yaml:"shorteners"`
+		// OCRCommand reads the text of images in first messages, it gets the image on stdin and prints the text, empty turns OCR off
+		OCRCommand string `env:"OCR_COMMAND" yaml:"ocr_command"`
+		// ImageLimit is the largest image in bytes downloaded for the checks
+		ImageLimit int `env:"IMAGE_LIMIT" yaml:"image_limit"`
+		// DBPath is the SQLite database file, relative paths are inside ~/.ngbot
+		DBPath           string            `env:"DB_PATH" yaml:"db_path"`
+		HealthCheckLLM   bool              `env:"HEALTH_CHECK_LLM" yaml:"health_check_llm"`
+		ChallengeTimeout time.Duration     `env:"CHALLENGE_TIMEOUT" yaml:"challenge_timeout"`
+		RejectTimeout    time.Duration     `env:"REJECT_TIMEOUT" yaml:"reject_timeout"`
+		ErrorPolicies    map[string]string `env:"ERROR_POLICIES" yaml:"error_policies"`
+		RateLimit        float64           `env:"RATE_LIMIT" yaml:"rate_limit"`
+		RateBurst        int               `env:"RATE_BURST" yaml:"rate_burst"`
+		// Operators are the user IDs allowed to manage the blocklist and the allowlist of the process
+		Operators []int64                 `env:"OPERATORS" yaml:"operators"`
+		OpenAI    OpenAI                  `yaml:"openai"`
+		LLM       LLM                     `yaml:"llm"`
+		SpamIndex SpamIndex               `yaml:"spam_index"`
+		Chats     map[int64]ChatOverrides `yaml:"chats"`
+		Bots      []Bot                   `yaml:"bots"`
+		Plugins   []ExternalPlugin        `yaml:"plugins"`
+		// PluginSettings holds values of the settings declared in plugin manifests, by plugin name
+		PluginSettings map[string]map[string]string `yaml:"plugin_settings"`
+	}
+
+	// Bot is one of the Telegram bots served by the process, see Config.BotList
+	Bot struct {
+		Name      string   `yaml:"name"`
+		Token     string   `yaml:"token"`
+		TokenFile string   `yaml:"token_file"`
+		Handlers  []string `yaml:"handlers"`
+		// Namespace separates chat settings of the bot, defaults to Name
+		Namespace *string `yaml:"namespace"`
+	}
+
+	// ExternalPlugin runs a plugin as a subprocess speaking JSON-RPC over stdin and stdout
+	ExternalPlugin struct {
+		Name    string   `yaml:"name"`
+		Command []string `yaml:"command"`
+		// Timeout limits every call to the plugin
+		Timeout time.Duration `yaml:"timeout"`
 	}
 
 	OpenAI struct {
-		APIKey  string `env:"OPENAI_API_KEY,required"`
-		Model   string `env:"OPENAI_MODEL,default=gpt-4o-mini"`
-		BaseURL string `env:"OPENAI_BASE_URL,default=https://api.openai.com/v1"`
+		APIKey     string `env:"OPENAI_API_KEY" yaml:"api_key"`
+		APIKeyFile string `env:"OPENAI_API_KEY_FILE" yaml:"api_key_file"`
+		Model      string `env:"OPENAI_MODEL" yaml:"model"`
+		BaseURL    string `env:"OPENAI_BASE_URL" yaml:"base_url"`
+		// VisionModel classifies the photos of first messages in the chats that turned it on, empty uses Model
+		VisionModel string `env:"OPENAI_VISION_MODEL" yaml:"vision_model"`
+		// VisionDetail is the image detail level: low costs a fixed small number of tokens, high and auto cost more
+		VisionDetail string `env:"OPENAI_VISION_DETAIL" yaml:"vision_detail"`
+		// VisionDailyLimit caps the photos classified per chat a day, 0 lifts the cap
+		VisionDailyLimit int `env:"OPENAI_VISION_DAILY_LIMIT" yaml:"vision_daily_limit"`
+	}
+
+	// LLM configures the gateway to the LLM providers, see Config.LLMProviders
+	LLM struct {
+		// Providers are tried in order, the next one is asked when a provider fails or times out
+		Providers []LLMProvider `yaml:"providers"`
+		// Timeout limits a call to a provider without its own timeout
+		Timeout time.Duration `env:"LLM_TIMEOUT" yaml:"timeout"`
+		// DailyTokens and DailyCost cap the spending of all chats a UTC day, ChatDailyTokens and ChatDailyCost of every chat, 0 lifts a cap
+		DailyTokens     int64   `env:"LLM_DAILY_TOKENS" yaml:"daily_tokens"`
+		DailyCost       float64 `env:"LLM_DAILY_COST" yaml:"daily_cost"`
+		ChatDailyTokens int64   `env:"LLM_CHAT_DAILY_TOKENS" yaml:"chat_daily_tokens"`
+		ChatDailyCost   float64 `env:"LLM_CHAT_DAILY_COST" yaml:"chat_daily_cost"`
+		// CacheSize is the number of verdicts kept for repeated messages, 0 turns the cache off
+		CacheSize int           `env:"LLM_CACHE_SIZE" yaml:"cache_size"`
+		CacheTTL  time.Duration `env:"LLM_CACHE_TTL" yaml:"cache_ttl"`
+	}
+
+	// SpamIndex configures the fingerprints of recent spam, which catch the variations of a spam wave without the LLM
+	SpamIndex struct {
+		// Size bounds the fingerprints kept in memory and in the database, 0 turns the index off
+		Size int `env:"SPAM_INDEX_SIZE" yaml:"size"`
+		// Similarity is the smallest share of the fingerprint a near duplicate has in common with the spam
+		Similarity float64 `env:"SPAM_INDEX_SIMILARITY" yaml:"similarity"`
+		// TTL is how long a fingerprint is kept
+		TTL time.Duration `env:"SPAM_INDEX_TTL" yaml:"ttl"`
+	}
+
+	// LLMProvider is an OpenAI compatible API: OpenAI itself, a llama.cpp server, Ollama and the like
+	LLMProvider struct {
+		Name       string `yaml:"name"`
+		BaseURL    string `yaml:"base_url"`
+		APIKey     string `yaml:"api_key"`
+		APIKeyFile string `yaml:"api_key_file"`
+		Model      string `yaml:"model"`
+		// VisionModel classifies photos, empty uses Model
+		VisionModel string        `yaml:"vision_model"`
+		Timeout     time.Duration `yaml:"timeout"`
+		// PromptPrice and CompletionPrice are the prices of a million tokens, in the currency of the cost caps
+		PromptPrice     float64 `yaml:"prompt_price"`
+		CompletionPrice float64 `yaml:"completion_price"`
+	}
+
+	// ChatOverrides pins chat settings from the config file, zero values keep the stored ones
+	ChatOverrides struct {
+		Language         string        `yaml:"lang"`
+		Privacy          string        `yaml:"privacy"`
+		ChallengeTimeout time.Duration `yaml:"challenge_timeout"`
+		RejectTimeout    time.Duration `yaml:"reject_timeout"`
+		LogChannelID     int64         `yaml:"log_channel_id"`
 	}
 )
 
-var once sync.Once
-var globalConfig = &Config{}
+// DefaultBotName names the bot configured with the top-level token
+const DefaultBotName = "default"
 
+var (
+	current  atomic.Pointer[Config]
+	initOnce sync.Once
+)
+
+// Default returns the configuration used for keys that are set nowhere else
+func Default() *Config {
+	return &Config{
+		DefaultLanguage:     "en",
+		EnabledHandlers:     []string{"admin", "raid", "gatekeeper", "reactor"},
+		LogLevel:            int(log.InfoLevel),
+		LogFormat:           LogFormatText,
+		Privacy:             "standard",
+		DotPath:             "~/.ngbot",
+		TelegramAPIEndpoint: "https://api.telegram.org/bot%s/%s",
+		LolsURL:             "https://api.lols.bot",
+		Shorteners: []string{
+			"bit.ly", "tinyurl.com", "t.co", "goo.gl", "cutt.ly", "is.gd", "rb.gy", "ow.ly",
+			"shorturl.at", "tiny.cc", "clck.ru", "v.gd", "rebrand.ly", "s.id", "t.ly",
+		},
+		ImageLimit:       5 << 20,
+		DBPath:           "bot.db",
+		ChallengeTimeout: 3 * time.Minute,
+		RejectTimeout:    10 * time.Minute,
+		LLM: LLM{
+			Timeout:   15 * time.Second,
+			CacheSize: 10000,
+			CacheTTL:  24 * time.Hour,
+		},
+		SpamIndex: SpamIndex{
+			Size:       10000,
+			Similarity: 0.6,
+			TTL:        7 * 24 * time.Hour,
+		},
+		OpenAI: OpenAI{
+			Model:            "gpt-4o-mini",
+			BaseURL:          "https://api.openai.com/v1",
+			VisionDetail:     "low",
+			VisionDailyLimit: 100,
+		},
+	}
+}
+
+// Init loads the configuration using the command line arguments and makes it current
+func Init(args []string) (Config, error) {
+	cfg, err := load(args)
+	if err != nil {
+		return Config{}, err
+	}
+	current.Store(cfg)
+	return *cfg, nil
+}
+
+// Get returns the current configuration, loading it from env when Init was not called
 func Get() Config {
-	once.Do(func() {
-		cfg := &Config{}
-		envcfg := envconfig.Config{
-			Lookuper: envconfig.PrefixLookuper("NG_", envconfig.OsLookuper()),
-			Target:   cfg,
+	if cfg := current.Load(); cfg != nil {
+		return *cfg
+	}
+	initOnce.Do(func() {
+		if current.Load() != nil {
+			return
 		}
-		if err := envconfig.ProcessWith(context.Background(), &envcfg); err != nil {
+		if _, err := Init(nil); err != nil {
 			log.WithError(err).Fatalln("cant load config")
-
 		}
 		log.Traceln("loaded config")
-		globalConfig = cfg
 	})
-	return *globalConfig
+	return *current.Load()
+}
+
+// BotList returns the bots to run: the configured ones, or a single bot from the top-level token
+func (c Config) BotList() []Bot {
+	if len(c.Bots) == 0 {
+		legacyNamespace := ""
+		return []Bot{{
+			Name:      DefaultBotName,
+			Token:     c.TelegramAPIToken,
+			TokenFile: c.TelegramAPITokenFile,
+			Handlers:  c.EnabledHandlers,
+			Namespace: &legacyNamespace,
+		}}
+	}
+	bots := make([]Bot, 0, len(c.Bots))
+	for _, b := range c.Bots {
+		if len(b.Handlers) == 0 {
+			b.Handlers = c.EnabledHandlers
+		}
+		bots = append(bots, b)
+	}
+	return bots
+}
+
+// LLMProviders returns the providers to ask: the configured ones, or a single one from the openai section
+func (c Config) LLMProviders() []LLMProvider {
+	if len(c.LLM.Providers) == 0 {
+		return []LLMProvider{{
+			Name:        "openai",
+			BaseURL:     c.OpenAI.BaseURL,
+			APIKey:      c.OpenAI.APIKey,
+			APIKeyFile:  c.OpenAI.APIKeyFile,
+			Model:       c.OpenAI.Model,
+			VisionModel: c.OpenAI.VisionModel,
+		}}
+	}
+	return c.LLM.Providers
+}
+
+// SettingsNamespace returns the namespace of the bot chat settings
+func (b Bot) SettingsNamespace() string {
+	if b.Namespace != nil {
+		return *b.Namespace
+	}
+	return b.Name
+}
+
+// IsOperator reports whether the user is one of the operators
+func (c Config) IsOperator(userID int64) bool {
+	return slices.Contains(c.Operators, userID)
+}
+
+// ForChat returns the overrides configured for the chat, if any
+func (c Config) ForChat(chatID int64) (ChatOverrides, bool) {
+	o, ok := c.Chats[chatID]
+	return o, ok
 }
@@ -0,0 +1,365 @@
+package config
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sethvargo/go-envconfig"
+	"gopkg.in/yaml.v2"
+
+	"github.com/iamwavecut/ngbot/internal/privacy"
+)
+
+const (
+	envPrefix     = "NG_"
+	configPathEnv = envPrefix + "CONFIG"
+	// buildSecretsEnv lists the secrets that were passed to the image build, see Dockerfile
+	buildSecretsEnv = envPrefix + "BUILD_SECRETS"
+)
+
+// source remembers where the current config came from, so that it can be reloaded
+type source struct {
+	args []string
+	path string
+}
+
+var lastSource source
+
+func load(args []string) (*Config, error) {
+	src, flagValues, err := parseFlags(args)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if src.path != "" {
+		if err := loadFile(src.path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := context.Background()
+	if err := envconfig.ProcessWith(ctx, &envconfig.Config{
+		Target:           cfg,
+		Lookuper:         envconfig.PrefixLookuper(envPrefix, envconfig.OsLookuper()),
+		DefaultOverwrite: true,
+	}); err != nil {
+		return nil, errors.WithMessage(err, "invalid environment")
+	}
+	if err := envconfig.ProcessWith(ctx, &envconfig.Config{
+		Target:           cfg,
+		Lookuper:         envconfig.MapLookuper(flagValues),
+		DefaultOverwrite: true,
+	}); err != nil {
+		return nil, errors.WithMessage(err, "invalid flags")
+	}
+	if err := cfg.readSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	lastSource = src
+	return cfg, nil
+}
+
+// parseFlags registers a --kebab-case flag for every env key, plus --config for the file path.
+// Secrets, the keys with a *_FILE variant, are refused: the command line shows up in the process list.
+func parseFlags(args []string) (source, map[string]string, error) {
+	src := source{args: args}
+	values := map[string]string{}
+	fs := flag.NewFlagSet("ngbot", flag.ContinueOnError)
+	fs.StringVar(&src.path, "config", os.Getenv(configPathEnv), "path to the YAML config file, "+configPathEnv)
+	keys := envKeys(reflect.TypeOf(Config{}))
+	for _, key := range keys {
+		key := key
+		if slices.Contains(keys, key+"_FILE") {
+			fs.Func(flagName(key), "not accepted, use --"+flagName(key+"_FILE")+" or "+envPrefix+key, func(string) error {
+				return errors.Errorf("secrets are visible in the process list, use --%s or %s%s", flagName(key+"_FILE"), envPrefix, key)
+			})
+			continue
+		}
+		fs.Func(flagName(key), "overrides "+envPrefix+key, func(v string) error {
+			values[key] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return src, nil, errors.WithMessage(err, "invalid flags")
+	}
+	return src, values, nil
+}
+
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithMessage(err, "cant read config file")
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return errors.WithMessagef(err, "invalid config file %s", path)
+	}
+	return nil
+}
+
+// readSecretFiles resolves the *_FILE secrets, the files are read again on every reload
+func (c *Config) readSecretFiles() error {
+	secrets := []struct {
+		env   string
+		path  string
+		value *string
+	}{
+		{"TOKEN", c.TelegramAPITokenFile, &c.TelegramAPIToken},
+		{"OPENAI_API_KEY", c.OpenAI.APIKeyFile, &c.OpenAI.APIKey},
+	}
+	for _, s := range secrets {
+		if s.path == "" {
+			continue
+		}
+		if *s.value != "" {
+			return errors.Errorf("both %s%s and %s%s_FILE are set, use only one", envPrefix, s.env, envPrefix, s.env)
+		}
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return errors.WithMessagef(err, "cant read %s%s_FILE", envPrefix, s.env)
+		}
+		*s.value = strings.TrimSpace(string(data))
+	}
+	for i := range c.LLM.Providers {
+		p := &c.LLM.Providers[i]
+		if p.APIKeyFile == "" {
+			continue
+		}
+		if p.APIKey != "" {
+			return errors.Errorf("both llm.providers.%s.api_key and llm.providers.%s.api_key_file are set, use only one", p.Name, p.Name)
+		}
+		data, err := os.ReadFile(p.APIKeyFile)
+		if err != nil {
+			return errors.WithMessagef(err, "cant read llm.providers.%s.api_key_file", p.Name)
+		}
+		p.APIKey = strings.TrimSpace(string(data))
+	}
+	for i := range c.Bots {
+		b := &c.Bots[i]
+		if b.TokenFile == "" {
+			continue
+		}
+		if b.Token != "" {
+			return errors.Errorf("both bots.%s.token and bots.%s.token_file are set, use only one", b.Name, b.Name)
+		}
+		data, err := os.ReadFile(b.TokenFile)
+		if err != nil {
+			return errors.WithMessagef(err, "cant read bots.%s.token_file", b.Name)
+		}
+		b.Token = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// SecretFiles returns the paths of the secrets read from files
+func (c Config) SecretFiles() []string {
+	var paths []string
+	candidates := []string{c.TelegramAPITokenFile, c.OpenAI.APIKeyFile}
+	for _, b := range c.Bots {
+		candidates = append(candidates, b.TokenFile)
+	}
+	for _, p := range c.LLM.Providers {
+		candidates = append(candidates, p.APIKeyFile)
+	}
+	for _, path := range candidates {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func envKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("env")
+		if !ok {
+			if f.Type.Kind() == reflect.Struct {
+				keys = append(keys, envKeys(f.Type)...)
+			}
+			continue
+		}
+		keys = append(keys, strings.Split(tag, ",")[0])
+	}
+	return keys
+}
+
+func flagName(envKey string) string {
+	return strings.ReplaceAll(strings.ToLower(envKey), "_", "-")
+}
+
+// Validate reports every invalid key at once, naming both the env var and the file key
+func (c Config) Validate() error {
+	var problems []string
+	add := func(env, key, problem string) {
+		problems = append(problems, fmt.Sprintf("%s%s (%s): %s", envPrefix, env, key, problem))
+	}
+
+	buildSecrets := strings.Fields(os.Getenv(buildSecretsEnv))
+	requireSecret := func(env, key, value string) {
+		if value != "" {
+			return
+		}
+		if slices.Contains(buildSecrets, env) {
+			add(env, key, "was only passed as a build argument, build-time secrets are not baked into the image, "+
+				"provide it at runtime with "+envPrefix+env+" or "+envPrefix+env+"_FILE")
+			return
+		}
+		add(env, key, "is required, set it or "+envPrefix+env+"_FILE")
+	}
+	if len(c.Bots) == 0 {
+		requireSecret("TOKEN", "token", c.TelegramAPIToken)
+	} else if c.TelegramAPIToken != "" {
+		add("TOKEN", "token", "is not used when bots are configured, set the token of every bot instead")
+	}
+	names := map[string]bool{}
+	for i, b := range c.Bots {
+		switch {
+		case b.Name == "":
+			problems = append(problems, fmt.Sprintf("bots.%d.name: is required", i))
+		case names[b.Name]:
+			problems = append(problems, fmt.Sprintf("bots.%d.name: duplicate name %q", i, b.Name))
+		}
+		names[b.Name] = true
+		if b.Token == "" {
+			problems = append(problems, fmt.Sprintf("bots.%d.token: is required, set it or token_file", i))
+		}
+	}
+	// local providers need no key, the openai section is only used without providers
+	if len(c.LLM.Providers) == 0 {
+		requireSecret("OPENAI_API_KEY", "openai.api_key", c.OpenAI.APIKey)
+	}
+	providers := map[string]bool{}
+	for i, p := range c.LLM.Providers {
+		switch {
+		case p.Name == "":
+			problems = append(problems, fmt.Sprintf("llm.providers.%d.name: is required", i))
+		case providers[p.Name]:
+			problems = append(problems, fmt.Sprintf("llm.providers.%d.name: duplicate name %q", i, p.Name))
+		}
+		providers[p.Name] = true
+		if u, err := url.Parse(p.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("llm.providers.%d.base_url: must be an http(s) URL", i))
+		}
+		if p.Model == "" {
+			problems = append(problems, fmt.Sprintf("llm.providers.%d.model: is required", i))
+		}
+		if p.Timeout < 0 || p.PromptPrice < 0 || p.CompletionPrice < 0 {
+			problems = append(problems, fmt.Sprintf("llm.providers.%d: timeout and prices must not be negative", i))
+		}
+	}
+	if c.LLM.Timeout <= 0 {
+		add("LLM_TIMEOUT", "llm.timeout", "must be positive")
+	}
+	if c.LLM.DailyTokens < 0 || c.LLM.DailyCost < 0 || c.LLM.ChatDailyTokens < 0 || c.LLM.ChatDailyCost < 0 {
+		add("LLM_DAILY_TOKENS", "llm.daily_tokens", "the daily caps must not be negative")
+	}
+	if c.LLM.CacheSize < 0 || c.LLM.CacheTTL < 0 {
+		add("LLM_CACHE_SIZE", "llm.cache_size", "cache size and ttl must not be negative")
+	}
+	if c.SpamIndex.Size < 0 {
+		add("SPAM_INDEX_SIZE", "spam_index.size", "must not be negative")
+	}
+	if c.SpamIndex.Similarity <= 0 || c.SpamIndex.Similarity > 1 {
+		add("SPAM_INDEX_SIMILARITY", "spam_index.similarity", "must be above 0 and at most 1")
+	}
+	if c.SpamIndex.TTL <= 0 {
+		add("SPAM_INDEX_TTL", "spam_index.ttl", "must be positive")
+	}
+	if c.DefaultLanguage == "" {
+		add("LANG", "lang", "is required")
+	}
+	if len(c.EnabledHandlers) == 0 {
+		add("HANDLERS", "handlers", "at least one handler is required")
+	}
+	if c.LogLevel < 0 || c.LogLevel > 6 {
+		add("LOG_LEVEL", "log_level", "must be between 0 and 6")
+	}
+	for ctx, lvl := range c.LogLevels {
+		if lvl < 0 || lvl > 6 {
+			add("LOG_LEVELS", "log_levels", fmt.Sprintf("level of %q must be between 0 and 6", ctx))
+		}
+	}
+	if !strings.EqualFold(c.LogFormat, LogFormatText) && !strings.EqualFold(c.LogFormat, LogFormatJSON) {
+		add("LOG_FORMAT", "log_format", fmt.Sprintf("unknown format %q", c.LogFormat))
+	}
+	if mode, ok := privacy.ParseMode(c.Privacy); !ok || mode == privacy.ModeInherit {
+		add("PRIVACY", "privacy", fmt.Sprintf("unknown mode %q", c.Privacy))
+	}
+	if strings.Count(c.TelegramAPIEndpoint, "%s") != 2 {
+		add("TELEGRAM_API_ENDPOINT", "telegram_api_endpoint", "must contain %s for the token and %s for the method")
+	}
+	if c.LinkResolver != "" && c.LinkResolver != "off" {
+		if u, err := url.Parse(c.LinkResolver); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("LINK_RESOLVER", "link_resolver", "must be empty, off or an http(s) URL")
+		}
+	}
+	if !slices.Contains([]string{"low", "high", "auto"}, c.OpenAI.VisionDetail) {
+		add("OPENAI_VISION_DETAIL", "openai.vision_detail", "must be low, high or auto")
+	}
+	if c.OpenAI.VisionDailyLimit < 0 {
+		add("OPENAI_VISION_DAILY_LIMIT", "openai.vision_daily_limit", "must not be negative")
+	}
+	if c.ImageLimit <= 0 {
+		add("IMAGE_LIMIT", "image_limit", "must be positive")
+	}
+	if c.DBPath == "" {
+		add("DB_PATH", "db_path", "is required")
+	}
+	if c.ChallengeTimeout <= 0 {
+		add("CHALLENGE_TIMEOUT", "challenge_timeout", "must be positive")
+	}
+	if c.RejectTimeout <= 0 {
+		add("REJECT_TIMEOUT", "reject_timeout", "must be positive")
+	}
+	for handler, policy := range c.ErrorPolicies {
+		if !slices.Contains([]string{"continue", "stop", "retry"}, policy) {
+			add("ERROR_POLICIES", "error_policies", fmt.Sprintf("unknown policy %q of %q, use continue, stop or retry", policy, handler))
+		}
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		add("RATE_LIMIT", "rate_limit", "rate limit and burst must not be negative")
+	}
+	for chatID, o := range c.Chats {
+		if _, ok := privacy.ParseMode(o.Privacy); !ok {
+			problems = append(problems, fmt.Sprintf("chats.%d.privacy: unknown mode %q", chatID, o.Privacy))
+		}
+		if o.ChallengeTimeout < 0 || o.RejectTimeout < 0 {
+			problems = append(problems, fmt.Sprintf("chats.%d: timeouts must not be negative", chatID))
+		}
+	}
+	plugins := map[string]bool{}
+	for i, p := range c.Plugins {
+		switch {
+		case p.Name == "":
+			problems = append(problems, fmt.Sprintf("plugins.%d.name: is required", i))
+		case plugins[p.Name]:
+			problems = append(problems, fmt.Sprintf("plugins.%d.name: duplicate name %q", i, p.Name))
+		}
+		plugins[p.Name] = true
+		if len(p.Command) == 0 {
+			problems = append(problems, fmt.Sprintf("plugins.%d.command: is required", i))
+		}
+		if p.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("plugins.%d.timeout: must not be negative", i))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
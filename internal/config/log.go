@@ -0,0 +1,231 @@
+package config
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/privacy"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	redacted = privacy.Redacted
+)
+
+var (
+	// contentFields are log fields that may carry user message content
+	contentFields = []string{"message", "text", "content", "caption", "excerpt"}
+
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\b\d{6,12}:[A-Za-z0-9_-]{30,}\b`), // telegram bot token
+		regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{16,}\b`),       // openai-style api key
+	}
+
+	logLevels = &contextLevels{}
+)
+
+type (
+	// contextLevels holds the per-subsystem thresholds, keyed by the "context" log field
+	contextLevels struct {
+		mu       sync.RWMutex
+		fallback log.Level
+		levels   map[string]log.Level
+	}
+
+	// levelFilter drops entries above the level configured for their context
+	levelFilter struct {
+		log.Formatter
+		levels *contextLevels
+	}
+
+	// RedactionHook scrubs secrets and, if enabled, message content from every entry.
+	// Content allowed by the deployment is still redacted for chats with a stricter mode, found by the chat_id field.
+	RedactionHook struct {
+		mu            sync.RWMutex
+		secrets       []string
+		deployment    privacy.Mode
+		redactContent bool
+		chats         map[string]ChatPrivacy
+	}
+
+	// ChatPrivacy returns the privacy mode chosen by a chat, false if it is not known without a lookup.
+	// It is called for log entries, so it must neither log nor block.
+	ChatPrivacy func(chatID int64) (privacy.Mode, bool)
+)
+
+var redactionHook = &RedactionHook{}
+
+// SetupLogging applies format, levels and redaction from the config to the standard logger
+func SetupLogging(cfg Config) {
+	var formatter log.Formatter = &NbFormatter{}
+	if strings.EqualFold(cfg.LogFormat, LogFormatJSON) {
+		formatter = NewJSONFormatter()
+	}
+	log.SetOutput(os.Stdout)
+	log.SetReportCaller(true)
+	log.SetFormatter(&levelFilter{Formatter: formatter, levels: logLevels})
+	ApplyLogLevels(cfg)
+
+	redactionHook.SetDeployment(privacy.Mode(cfg.Privacy))
+	log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	log.AddHook(redactionHook)
+}
+
+// ApplyLogLevels updates the global and per-context levels, safe to call at runtime
+func ApplyLogLevels(cfg Config) {
+	levels := make(map[string]log.Level, len(cfg.LogLevels))
+	max := log.Level(cfg.LogLevel)
+	for ctx, lvl := range cfg.LogLevels {
+		levels[strings.ToLower(ctx)] = log.Level(lvl)
+		if log.Level(lvl) > max {
+			max = log.Level(lvl)
+		}
+	}
+	logLevels.mu.Lock()
+	logLevels.fallback = log.Level(cfg.LogLevel)
+	logLevels.levels = levels
+	logLevels.mu.Unlock()
+
+	log.SetLevel(max)
+}
+
+// LevelFor returns the effective level of a logging context, e.g. "bot_api"
+func LevelFor(context string) log.Level {
+	return logLevels.get(context)
+}
+
+// SetChatPrivacy makes the redaction hook apply the modes of the chats of the named bot, nil forgets the bot
+func SetChatPrivacy(bot string, modes ChatPrivacy) {
+	redactionHook.SetChatPrivacy(bot, modes)
+}
+
+// RegisterSecret makes the redaction hook scrub the value from all log output
+func RegisterSecret(secret string) {
+	redactionHook.AddSecret(secret)
+}
+
+func (c *contextLevels) get(context string) log.Level {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if lvl, ok := c.levels[context]; ok {
+		return lvl
+	}
+	return c.fallback
+}
+
+func (f *levelFilter) Format(entry *log.Entry) ([]byte, error) {
+	context, _ := entry.Data["context"].(string)
+	if entry.Level > f.levels.get(context) {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+func (h *RedactionHook) AddSecret(secret string) {
+	if len(secret) < 8 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.secrets {
+		if s == secret {
+			return
+		}
+	}
+	h.secrets = append(h.secrets, secret)
+}
+
+// SetDeployment redacts content unless the deployment mode allows logging it
+func (h *RedactionHook) SetDeployment(mode privacy.Mode) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deployment = mode
+	h.redactContent = !privacy.For(mode).LogContent
+}
+
+func (h *RedactionHook) SetChatPrivacy(bot string, modes ChatPrivacy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if modes == nil {
+		delete(h.chats, bot)
+		return
+	}
+	if h.chats == nil {
+		h.chats = map[string]ChatPrivacy{}
+	}
+	h.chats[bot] = modes
+}
+
+func (h *RedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *RedactionHook) Fire(entry *log.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	entry.Message = h.scrub(entry.Message)
+	redactContent := h.redactContent || h.chatForbidsContent(entry.Data["chat_id"])
+	for k, v := range entry.Data {
+		if redactContent && isContentField(k) {
+			entry.Data[k] = redacted
+			continue
+		}
+		switch val := v.(type) {
+		case string:
+			entry.Data[k] = h.scrub(val)
+		case error:
+			if scrubbed := h.scrub(val.Error()); scrubbed != val.Error() {
+				entry.Data[k] = scrubbed
+			}
+		}
+	}
+	return nil
+}
+
+// chatForbidsContent reports whether any bot serving the chat has it in a mode not logging content,
+// a chat of unknown mode does not log content either
+func (h *RedactionHook) chatForbidsContent(field any) bool {
+	chatID, ok := field.(int64)
+	if !ok || len(h.chats) == 0 {
+		return false
+	}
+	known := false
+	for _, modes := range h.chats {
+		mode, ok := modes(chatID)
+		if !ok {
+			continue
+		}
+		known = true
+		if !privacy.Effective(h.deployment, mode).LogContent {
+			return true
+		}
+	}
+	return !known
+}
+
+func (h *RedactionHook) scrub(s string) string {
+	for _, secret := range h.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+func isContentField(key string) bool {
+	key = strings.ToLower(key)
+	for _, f := range contentFields {
+		if key == f {
+			return true
+		}
+	}
+	return false
+}
@@ -3,9 +3,11 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -42,17 +44,12 @@ func (f *NbFormatter) Format(entry *log.Entry) ([]byte, error) {
 
 	output := fmt.Sprintf("\x1b[%dm%s\x1b[0m=%s", cyan, "level", level)
 	output += fmt.Sprintf(" \x1b[%dm%s\x1b[0m=\x1b[%dm%s\x1b[0m", cyan, "ts", lightYellow, entry.Time.Format("2006-01-02 15:04:05.000"))
-	_, file, line, ok := runtime.Caller(6)
-	if ok {
-		shortFile := file[strings.LastIndex(file, "/")+1:]
-		output += fmt.Sprintf(" \x1b[%dm%s\x1b[0m=\x1b[%dm%s:%d\x1b[0m", cyan, "source", lightYellow, shortFile, line)
+	if entry.HasCaller() {
+		output += fmt.Sprintf(" \x1b[%dm%s\x1b[0m=\x1b[%dm%s\x1b[0m", cyan, "source", lightYellow, shortCaller(entry.Caller))
 	}
 
 	for k, val := range entry.Data {
-		var s string
-		if m, err := json.Marshal(val); err == nil {
-			s = string(m)
-		}
+		s := formatValue(val)
 		if s == "" {
 			continue
 		}
@@ -69,3 +66,46 @@ func (f *NbFormatter) Format(entry *log.Entry) ([]byte, error) {
 	output = strings.Replace(output, "\n", "\\n", -1) + "\n"
 	return []byte(output), nil
 }
+
+// NewJSONFormatter returns a one-object-per-line formatter for log shippers
+func NewJSONFormatter() log.Formatter {
+	return &log.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+		FieldMap: log.FieldMap{
+			log.FieldKeyTime:  "ts",
+			log.FieldKeyFunc:  "func",
+			log.FieldKeyFile:  "source",
+			log.FieldKeyLevel: "level",
+			log.FieldKeyMsg:   "msg",
+		},
+		CallerPrettyfier: func(frame *runtime.Frame) (string, string) {
+			return "", shortCaller(frame)
+		},
+	}
+}
+
+func shortCaller(frame *runtime.Frame) string {
+	return fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+}
+
+// formatValue renders primitives directly and falls back to JSON for composite values
+func formatValue(val any) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return strconv.Quote(v)
+	case error:
+		return strconv.Quote(v.Error())
+	case fmt.Stringer:
+		return strconv.Quote(v.String())
+	case bool:
+		return strconv.FormatBool(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	}
+	if m, err := json.Marshal(val); err == nil {
+		return string(m)
+	}
+	return strconv.Quote(fmt.Sprintf("%+v", val))
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const watchInterval = 5 * time.Second
+
+// Subscriber is notified after a reload changed the current config
+type Subscriber func(prev, next Config)
+
+var (
+	reloadMutex sync.Mutex
+	subsMutex   sync.RWMutex
+	subscribers []Subscriber
+
+	// safeKeys are the Config fields applied on reload, everything else needs a restart
+	safeKeys = []string{
+		"LogLevel",
+		"LogLevels",
+		"DefaultLanguage",
+		"EnabledHandlers",
+		"ChallengeTimeout",
+		"RejectTimeout",
+		"ErrorPolicies",
+		"RateLimit",
+		"RateBurst",
+		"Chats",
+		"OpenAI.Model",
+		"OpenAI.VisionModel",
+		"OpenAI.VisionDetail",
+		"OpenAI.VisionDailyLimit",
+		// the reactor swaps its link resolver and text extractor
+		"LinkResolver",
+		"Shorteners",
+		"OCRCommand",
+		"ImageLimit",
+		// plugins read their settings on use
+		"PluginSettings",
+		// secrets only change at runtime when read from files, subscribers swap the clients
+		"TelegramAPIToken",
+		"OpenAI.APIKey",
+		// bot tokens and handlers, adding or removing bots needs a restart
+		"Bots",
+		// the gateway swaps the providers, the spending and the cached verdicts carry over
+		"LLM",
+		// the spam index reads its limits on use
+		"SpamIndex",
+	}
+)
+
+// OnReload registers a subscriber for config changes
+func OnReload(fn Subscriber) {
+	subsMutex.Lock()
+	defer subsMutex.Unlock()
+	subscribers = append(subscribers, fn)
+}
+
+// Reload reads every source again and applies the hot reloadable keys
+func Reload() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	entry := log.WithFields(log.Fields{"context": "config", "method": "Reload"})
+
+	loaded, err := load(lastSource.args)
+	if err != nil {
+		return errors.WithMessage(err, "config was not reloaded")
+	}
+	prev := Get()
+	next := prev
+	for _, key := range safeKeys {
+		field(&next, key).Set(field(loaded, key))
+	}
+	if ignored := changedKeys(next, *loaded); len(ignored) > 0 {
+		entry.WithField("keys", ignored).Warn("some changes require a restart to take effect")
+	}
+	if reflect.DeepEqual(prev, next) {
+		entry.Debug("config unchanged")
+		return nil
+	}
+	current.Store(&next)
+	entry.WithField("keys", changedKeys(prev, next)).Info("config reloaded")
+
+	subsMutex.RLock()
+	defer subsMutex.RUnlock()
+	for _, fn := range subscribers {
+		fn(prev, next)
+	}
+	return nil
+}
+
+// Watch reloads the config on SIGHUP and when the config file or a secret file changes, until ctx is done
+func Watch(ctx context.Context) {
+	entry := log.WithFields(log.Fields{"context": "config", "method": "Watch"})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	modTimes := watchedFiles()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			entry.Info("SIGHUP received, reloading config")
+		case <-ticker.C:
+			changed := ""
+			for path, modTime := range modTimes {
+				if !fileModTime(path).Equal(modTime) {
+					changed = path
+					break
+				}
+			}
+			if changed == "" {
+				continue
+			}
+			entry.WithField("path", changed).Info("watched file changed, reloading config")
+		}
+		if err := Reload(); err != nil {
+			entry.WithError(err).Error("cant reload config")
+		}
+		modTimes = watchedFiles()
+	}
+}
+
+// watchedFiles maps the config and secret files to their modification times
+func watchedFiles() map[string]time.Time {
+	paths := Get().SecretFiles()
+	if lastSource.path != "" {
+		paths = append(paths, lastSource.path)
+	}
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		modTimes[path] = fileModTime(path)
+	}
+	return modTimes
+}
+
+// fileModTime follows symlinks, so the atomic swaps done by Kubernetes secret mounts are noticed too
+func fileModTime(path string) time.Time {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// field resolves a dotted field path such as "OpenAI.Model"
+func field(cfg *Config, path string) reflect.Value {
+	v := reflect.ValueOf(cfg).Elem()
+	for _, name := range strings.Split(path, ".") {
+		v = v.FieldByName(name)
+	}
+	return v
+}
+
+func changedKeys(a, b Config) []string {
+	var keys []string
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < av.NumField(); i++ {
+		name := av.Type().Field(i).Name
+		if av.Field(i).Kind() == reflect.Struct {
+			for j := 0; j < av.Field(i).NumField(); j++ {
+				if !reflect.DeepEqual(av.Field(i).Field(j).Interface(), bv.Field(i).Field(j).Interface()) {
+					keys = append(keys, name+"."+av.Field(i).Type().Field(j).Name)
+				}
+			}
+			continue
+		}
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
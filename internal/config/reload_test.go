@@ -0,0 +1,104 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+)
+
+const file = `
+token: "1:first"
+log_level: 4
+db_path: first.db
+openai:
+  api_key: key
+  model: first
+`
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(file)
+	if _, err := config.Init([]string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	var prev, next config.Config
+	config.OnReload(func(p, n config.Config) {
+		calls++
+		prev, next = p, n
+	})
+
+	// nothing changed, nobody is notified
+	if err := config.Reload(); err != nil || calls != 0 {
+		t.Fatalf("reloaded unchanged config: %v, %d calls", err, calls)
+	}
+
+	// the safe keys are applied, the others wait for a restart
+	write(`
+token: "1:second"
+log_level: 5
+db_path: second.db
+openai:
+  api_key: key
+  model: second
+`)
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("%d calls", calls)
+	}
+	if prev.LogLevel != 4 || prev.OpenAI.Model != "first" || prev.TelegramAPIToken != "1:first" {
+		t.Errorf("previous config %+v", prev)
+	}
+	if next.LogLevel != 5 || next.OpenAI.Model != "second" || next.TelegramAPIToken != "1:second" {
+		t.Errorf("next config %+v", next)
+	}
+	if next.DBPath != "first.db" || config.Get().DBPath != "first.db" {
+		t.Errorf("db path changed to %q without a restart", next.DBPath)
+	}
+	if got := config.Get(); got.LogLevel != 5 {
+		t.Errorf("current log level %d", got.LogLevel)
+	}
+
+	// a broken file keeps the current config
+	write("log_level: [")
+	if err := config.Reload(); err == nil || calls != 1 || config.Get().LogLevel != 5 {
+		t.Errorf("broken file: %v, %d calls", err, calls)
+	}
+}
+
+func TestReloadSecretFile(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("1:first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NG_OPENAI_API_KEY", "key")
+	cfg, err := config.Init([]string{"--token-file", token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TelegramAPIToken != "1:first" || !slices.Contains(cfg.SecretFiles(), token) {
+		t.Fatalf("token %q from %v", cfg.TelegramAPIToken, cfg.SecretFiles())
+	}
+
+	// a rotated secret is read again
+	if err := os.WriteFile(token, []byte("1:second\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Get().TelegramAPIToken; got != "1:second" {
+		t.Errorf("token %q", got)
+	}
+}
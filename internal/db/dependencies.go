@@ -1,7 +1,15 @@
 package db
 
+import (
+	"context"
+	"time"
+)
+
 type Client interface {
 	Close() error
+	Namespaced(namespace string) Client
+	Ping(ctx context.Context) error
+	PendingMigrations() (int, error)
 	SetSettings(settings *Settings) error
 	GetSettings(chatID int64) (*Settings, error)
 	GetAllSettings() (map[int64]*Settings, error)
@@ -12,4 +20,33 @@ type Client interface {
 	GetMembers(chatID int64) ([]int64, error)
 	GetAllMembers() (map[int64][]int64, error)
 	IsMember(chatID int64, userID int64) (bool, error)
+	// GetMember returns nil when the user is not a trusted member
+	GetMember(chatID int64, userID int64) (*Member, error)
+	InsertAction(action *Action) error
+	GetActions(filter ActionFilter) ([]*Action, error)
+	CreateTrustGroup(group *TrustGroup) error
+	GetTrustGroup(name string) (*TrustGroup, error)
+	SetTrustMember(member *TrustMember) error
+	GetTrustMember(chatID int64) (*TrustMember, error)
+	GetTrustMembers(group string) ([]*TrustMember, error)
+	DeleteTrustMember(chatID int64) error
+	InsertReputation(r *Reputation) error
+	GetReputation(group string, userID int64, limit int) ([]*Reputation, error)
+	InsertListEntries(entries []*ListEntry) (int, error)
+	DeleteListEntry(id int64) (bool, error)
+	GetListEntries(list string) ([]*ListEntry, error)
+	GetLinkPolicy(chatID int64) (*LinkPolicy, error)
+	SetLinkPolicy(policy *LinkPolicy) error
+	// InsertSpamFingerprint stores the fingerprint in the namespace of the client
+	InsertSpamFingerprint(fp *SpamFingerprint) error
+	// GetSpamFingerprints returns up to limit of the latest fingerprints of every namespace created after since, the oldest first
+	GetSpamFingerprints(since time.Time, limit int) ([]*SpamFingerprint, error)
+	// DeleteSpamFingerprints drops the fingerprints of the user found in the chat or with the scope, in the namespace of the client
+	DeleteSpamFingerprints(chatID, userID int64, scope string) (int, error)
+	// PruneSpamFingerprints drops the fingerprints created before the time and all but the latest keep
+	PruneSpamFingerprints(before time.Time, keep int) error
+	// AddLLMSpending adds the spending to the one of the chat on the day, it is shared by every namespace
+	AddLLMSpending(spending *LLMSpending) error
+	// GetLLMSpending returns the spending of every chat on the day
+	GetLLMSpending(day string) ([]*LLMSpending, error)
 }
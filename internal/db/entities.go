@@ -13,12 +13,129 @@ type (
 		Enabled          bool          `db:"enabled"`
 		ChallengeTimeout time.Duration `db:"challenge_timeout"`
 		RejectTimeout    time.Duration `db:"reject_timeout"`
+		LogChannelID     int64         `db:"log_channel_id"`
+		Privacy          string        `db:"privacy"`
+		// Vision sends the photos of first messages to the vision model
+		Vision bool `db:"vision"`
+	}
+
+	// Member is a trusted member of a chat, TrustedAt is nil for members trusted before it was recorded
+	Member struct {
+		ChatID    int64      `db:"chat_id"`
+		UserID    int64      `db:"user_id"`
+		TrustedAt *time.Time `db:"trusted_at"`
+	}
+
+	Action struct {
+		ID         int64     `db:"id"`
+		ChatID     int64     `db:"chat_id"`
+		ActorID    int64     `db:"actor_id"`
+		TargetID   int64     `db:"target_id"`
+		TargetName string    `db:"target_name"`
+		Action     string    `db:"action"`
+		Reason     string    `db:"reason"`
+		Source     string    `db:"source"`
+		Excerpt    string    `db:"excerpt"`
+		CreatedAt  time.Time `db:"created_at"`
+	}
+
+	// TrustGroup is a named group of chats sharing spam bans and trust decisions, chats join it with the code
+	TrustGroup struct {
+		Name        string    `db:"name"`
+		Code        string    `db:"code"`
+		OwnerChatID int64     `db:"owner_chat_id"`
+		CreatedAt   time.Time `db:"created_at"`
+	}
+
+	// TrustMember is a chat in a trust group, Action is what the chat does with the spam bans of the group
+	TrustMember struct {
+		ChatID   int64     `db:"chat_id"`
+		Group    string    `db:"group_name"`
+		Action   string    `db:"action"`
+		JoinedAt time.Time `db:"joined_at"`
+	}
+
+	// Reputation is a spam ban or trust decision shared within a trust group, with where it comes from
+	Reputation struct {
+		ID        int64     `db:"id"`
+		Group     string    `db:"group_name"`
+		UserID    int64     `db:"user_id"`
+		Verdict   string    `db:"verdict"`
+		ChatID    int64     `db:"chat_id"`
+		ActorID   int64     `db:"actor_id"`
+		Source    string    `db:"source"`
+		Reason    string    `db:"reason"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+
+	// ListEntry is a pattern of an operator blocklist or allowlist
+	ListEntry struct {
+		ID        int64     `db:"id"`
+		List      string    `db:"list"`
+		Kind      string    `db:"kind"`
+		Pattern   string    `db:"pattern"`
+		CreatedBy int64     `db:"created_by"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+
+	// LinkPolicy limits the links posted in a chat
+	LinkPolicy struct {
+		ChatID int64  `db:"chat_id"`
+		Mode   string `db:"mode"`
+		// Allowed and Denied are space separated domains
+		Allowed string `db:"allowed"`
+		Denied  string `db:"denied"`
+	}
+
+	// SpamFingerprint is the MinHash signature of a spam message, the text can't be told from it.
+	// Namespace is the one of the bot that found the spam, an empty Scope applies the fingerprint to every chat of every bot,
+	// any other only to the chats of the bot with the same scope.
+	SpamFingerprint struct {
+		ID        int64     `db:"id"`
+		Signature []byte    `db:"signature"`
+		Namespace string    `db:"namespace"`
+		Scope     string    `db:"scope"`
+		ChatID    int64     `db:"chat_id"`
+		UserID    int64     `db:"user_id"`
+		Source    string    `db:"source"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+
+	// LLMSpending is what the LLM calls made for a chat cost on a UTC day, formatted as time.DateOnly
+	LLMSpending struct {
+		Day    string  `db:"day"`
+		ChatID int64   `db:"chat_id"`
+		Tokens int64   `db:"tokens"`
+		Cost   float64 `db:"cost"`
+	}
+
+	// ActionFilter narrows down the moderation history, zero values are ignored
+	ActionFilter struct {
+		ChatID     int64
+		TargetID   int64
+		TargetName string
+		Since      time.Time
+		Until      time.Time
+		Limit      int
 	}
 )
 
 const (
-	defaultChallengeTimeout = 3 * time.Minute
-	defaultRejectTimeout    = 10 * time.Minute
+	ActionBan         = "ban"
+	ActionDecline     = "decline"
+	ActionDelete      = "delete"
+	ActionSpamVerdict = "spam_verdict"
+	ActionUnban       = "unban"
+	ActionPardon      = "pardon"
+	ActionLockdown    = "lockdown"
+	ActionUnlock      = "unlock"
+	ActionFederation  = "federation"
+
+	VerdictSpam  = "spam"
+	VerdictTrust = "trust"
+
+	ListBlock = "block"
+	ListAllow = "allow"
 )
 
 // TODO: Fixme!!!
@@ -52,10 +169,10 @@ func (cm *Settings) GetLanguage() (string, error) {
 // GetChallengeTimeout Returns chat entry challenge timeout duration
 func (cm *Settings) GetChallengeTimeout() time.Duration {
 	if cm == nil {
-		return defaultChallengeTimeout
+		return config.Get().ChallengeTimeout
 	}
 	if cm.ChallengeTimeout == 0 {
-		cm.ChallengeTimeout = defaultChallengeTimeout
+		cm.ChallengeTimeout = config.Get().ChallengeTimeout
 	}
 	return cm.ChallengeTimeout
 }
@@ -63,10 +180,10 @@ func (cm *Settings) GetChallengeTimeout() time.Duration {
 // GetRejectTimeout Returns chat entry reject timeout duration
 func (cm *Settings) GetRejectTimeout() time.Duration {
 	if cm == nil {
-		return defaultRejectTimeout
+		return config.Get().RejectTimeout
 	}
 	if cm.RejectTimeout == 0 {
-		cm.RejectTimeout = defaultRejectTimeout
+		cm.RejectTimeout = config.Get().RejectTimeout
 	}
 
 	return cm.RejectTimeout
@@ -1,13 +1,17 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/iamwavecut/ngbot/internal/db"
 	"github.com/iamwavecut/ngbot/internal/infra"
+	"github.com/iamwavecut/ngbot/internal/metrics"
 	"github.com/iamwavecut/ngbot/resources"
 
 	"github.com/jmoiron/sqlx"
@@ -16,49 +20,79 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+var l = log.WithField("context", "db")
+
 type sqliteClient struct {
-	db    *sqlx.DB
-	mutex sync.RWMutex
+	db        *sqlx.DB
+	mutex     *sync.RWMutex
+	namespace string
 }
 
+// NewSQLiteClient opens and migrates the database, a relative dbPath is inside the work dir
 func NewSQLiteClient(dbPath string) *sqliteClient {
-	dbx, err := sqlx.Open("sqlite", filepath.Join(infra.GetWorkDir(), dbPath))
+	if !filepath.IsAbs(dbPath) {
+		dbPath = filepath.Join(infra.GetWorkDir(), dbPath)
+	}
+	dbx, err := sqlx.Open("sqlite", dbPath)
 	if err != nil {
-		log.WithError(err).Fatal("Failed to open database")
+		l.WithError(err).Fatal("Failed to open database")
 	}
 	dbx.SetMaxOpenConns(42)
 
-	migrationsSource := &migrate.EmbedFileSystemMigrationSource{
-		FileSystem: resources.FS,
-		Root:       "migrations",
-	}
+	migrationsSource := getMigrationsSource()
 
 	if _, _, err := migrate.PlanMigration(dbx.DB, "sqlite3", migrationsSource, migrate.Up, 0); err != nil {
-		log.WithError(err).Fatal("Failed to plan migration")
+		l.WithError(err).Fatal("Failed to plan migration")
 	}
 
 	if n, err := migrate.Exec(dbx.DB, "sqlite3", migrationsSource, migrate.Up); err != nil {
-		log.WithError(err).WithField("migration", migrationsSource).Fatal("Failed to execute migration")
+		l.WithError(err).WithField("migration", migrationsSource).Fatal("Failed to execute migration")
 	} else if n > 0 {
-		log.Infof("Applied %d migrations", n)
+		l.Infof("Applied %d migrations", n)
+	}
+
+	return &sqliteClient{db: dbx, mutex: &sync.RWMutex{}}
+}
+
+// Namespaced returns a view sharing the connection, which keeps chat settings apart from other bots
+func (c *sqliteClient) Namespaced(namespace string) db.Client {
+	return &sqliteClient{db: c.db, mutex: c.mutex, namespace: namespace}
+}
+
+func getMigrationsSource() *migrate.EmbedFileSystemMigrationSource {
+	return &migrate.EmbedFileSystemMigrationSource{
+		FileSystem: resources.FS,
+		Root:       "migrations",
 	}
+}
 
-	return &sqliteClient{db: dbx}
+func (c *sqliteClient) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// PendingMigrations returns the number of embedded migrations not yet applied
+func (c *sqliteClient) PendingMigrations() (int, error) {
+	planned, _, err := migrate.PlanMigration(c.db.DB, "sqlite3", getMigrationsSource(), migrate.Up, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to plan migrations: %w", err)
+	}
+	return len(planned), nil
 }
 
 func (c *sqliteClient) GetSettings(chatID int64) (*db.Settings, error) {
+	defer metrics.ObserveDBQuery("get_settings")()
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
 	res := &db.Settings{}
-	query := "SELECT id, language, enabled, challenge_timeout, reject_timeout FROM chats WHERE id = ?"
-	err := c.db.QueryRowx(query, chatID).StructScan(res)
+	query := "SELECT id, language, enabled, challenge_timeout, reject_timeout, log_channel_id, privacy, vision FROM chats WHERE namespace = ? AND id = ?"
+	err := c.db.QueryRowx(query, c.namespace, chatID).StructScan(res)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.WithField("chatID", chatID).Debug("No settings found for chat")
+			l.WithField("chatID", chatID).Debug("No settings found for chat")
 			return nil, nil
 		}
-		log.WithError(err).WithFields(log.Fields{
+		l.WithError(err).WithFields(log.Fields{
 			"chatID": chatID,
 			"query":  query,
 			"result": res,
@@ -66,7 +100,7 @@ func (c *sqliteClient) GetSettings(chatID int64) (*db.Settings, error) {
 		}).Error("Failed to get settings")
 		return nil, fmt.Errorf("failed to get settings for chat %d: %w", chatID, err)
 	}
-	log.WithFields(log.Fields{
+	l.WithFields(log.Fields{
 		"chatID":   chatID,
 		"settings": res,
 	}).Debug("Successfully retrieved settings")
@@ -74,11 +108,12 @@ func (c *sqliteClient) GetSettings(chatID int64) (*db.Settings, error) {
 }
 
 func (c *sqliteClient) GetAllSettings() (map[int64]*db.Settings, error) {
+	defer metrics.ObserveDBQuery("get_all_settings")()
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
-	query := "SELECT id, language, enabled, challenge_timeout, reject_timeout FROM chats"
-	rows, err := c.db.Queryx(query)
+	query := "SELECT id, language, enabled, challenge_timeout, reject_timeout, log_channel_id, privacy, vision FROM chats WHERE namespace = ?"
+	rows, err := c.db.Queryx(query, c.namespace)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query all settings: %w", err)
 	}
@@ -101,31 +136,47 @@ func (c *sqliteClient) GetAllSettings() (map[int64]*db.Settings, error) {
 }
 
 func (c *sqliteClient) SetSettings(settings *db.Settings) error {
+	defer metrics.ObserveDBQuery("set_settings")()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	query := `
-		INSERT INTO chats (id, language, enabled, challenge_timeout, reject_timeout) 
-		VALUES (:id, :language, :enabled, :challenge_timeout, :reject_timeout)
-		ON CONFLICT(id) DO UPDATE SET 
+		INSERT INTO chats (namespace, id, language, enabled, challenge_timeout, reject_timeout, log_channel_id, privacy, vision) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(namespace, id) DO UPDATE SET 
 		language=excluded.language,
 		enabled=excluded.enabled, 
 		challenge_timeout=excluded.challenge_timeout, 
-		reject_timeout=excluded.reject_timeout;
+		reject_timeout=excluded.reject_timeout,
+		log_channel_id=excluded.log_channel_id,
+		privacy=excluded.privacy,
+		vision=excluded.vision;
 	`
-	_, err := c.db.NamedExec(query, settings)
+	_, err := c.db.Exec(query,
+		c.namespace,
+		settings.ID,
+		settings.Language,
+		settings.Enabled,
+		settings.ChallengeTimeout,
+		settings.RejectTimeout,
+		settings.LogChannelID,
+		settings.Privacy,
+		settings.Vision,
+	)
 	return err
 }
 
 func (c *sqliteClient) InsertMember(chatID, userID int64) error {
+	defer metrics.ObserveDBQuery("insert_member")()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	_, err := c.db.Exec("INSERT OR IGNORE INTO chat_members (chat_id, user_id) VALUES (?, ?)", chatID, userID)
+	_, err := c.db.Exec("INSERT OR IGNORE INTO chat_members (chat_id, user_id, trusted_at) VALUES (?, ?, ?)", chatID, userID, time.Now().UTC())
 	return err
 }
 
 func (c *sqliteClient) InsertMembers(chatID int64, userIDs []int64) error {
+	defer metrics.ObserveDBQuery("insert_members")()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -135,14 +186,15 @@ func (c *sqliteClient) InsertMembers(chatID int64, userIDs []int64) error {
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Preparex("INSERT OR IGNORE INTO chat_members (chat_id, user_id) VALUES (?, ?)")
+	stmt, err := tx.Preparex("INSERT OR IGNORE INTO chat_members (chat_id, user_id, trusted_at) VALUES (?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
+	now := time.Now().UTC()
 	for _, userID := range userIDs {
-		if _, err = stmt.Exec(chatID, userID); err != nil {
+		if _, err = stmt.Exec(chatID, userID, now); err != nil {
 			return err
 		}
 	}
@@ -150,7 +202,24 @@ func (c *sqliteClient) InsertMembers(chatID int64, userIDs []int64) error {
 	return tx.Commit()
 }
 
+func (c *sqliteClient) GetMember(chatID, userID int64) (*db.Member, error) {
+	defer metrics.ObserveDBQuery("get_member")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	res := &db.Member{}
+	err := c.db.Get(res, "SELECT chat_id, user_id, trusted_at FROM chat_members WHERE chat_id = ? AND user_id = ?", chatID, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 func (c *sqliteClient) DeleteMember(chatID, userID int64) error {
+	defer metrics.ObserveDBQuery("delete_member")()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -159,6 +228,7 @@ func (c *sqliteClient) DeleteMember(chatID, userID int64) error {
 }
 
 func (c *sqliteClient) DeleteMembers(chatID int64, userIDs []int64) error {
+	defer metrics.ObserveDBQuery("delete_members")()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -172,6 +242,7 @@ func (c *sqliteClient) DeleteMembers(chatID int64, userIDs []int64) error {
 }
 
 func (c *sqliteClient) GetMembers(chatID int64) ([]int64, error) {
+	defer metrics.ObserveDBQuery("get_members")()
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
@@ -181,6 +252,7 @@ func (c *sqliteClient) GetMembers(chatID int64) ([]int64, error) {
 }
 
 func (c *sqliteClient) GetAllMembers() (map[int64][]int64, error) {
+	defer metrics.ObserveDBQuery("get_all_members")()
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
@@ -203,6 +275,7 @@ func (c *sqliteClient) GetAllMembers() (map[int64][]int64, error) {
 }
 
 func (c *sqliteClient) IsMember(chatID, userID int64) (bool, error) {
+	defer metrics.ObserveDBQuery("is_member")()
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
@@ -211,6 +284,405 @@ func (c *sqliteClient) IsMember(chatID, userID int64) (bool, error) {
 	return count > 0, err
 }
 
+func (c *sqliteClient) InsertAction(action *db.Action) error {
+	defer metrics.ObserveDBQuery("insert_action")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if action.CreatedAt.IsZero() {
+		action.CreatedAt = time.Now()
+	}
+	action.CreatedAt = action.CreatedAt.UTC()
+	query := `
+		INSERT INTO actions (chat_id, actor_id, target_id, target_name, action, reason, source, excerpt, created_at)
+		VALUES (:chat_id, :actor_id, :target_id, :target_name, :action, :reason, :source, :excerpt, :created_at)
+	`
+	res, err := c.db.NamedExec(query, action)
+	if err != nil {
+		return fmt.Errorf("failed to insert action: %w", err)
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		action.ID = id
+	}
+	return nil
+}
+
+func (c *sqliteClient) GetActions(filter db.ActionFilter) ([]*db.Action, error) {
+	defer metrics.ObserveDBQuery("get_actions")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var (
+		where []string
+		args  []any
+	)
+	if filter.ChatID != 0 {
+		where = append(where, "chat_id = ?")
+		args = append(args, filter.ChatID)
+	}
+	if filter.TargetID != 0 {
+		where = append(where, "target_id = ?")
+		args = append(args, filter.TargetID)
+	}
+	if filter.TargetName != "" {
+		where = append(where, "target_name = ? COLLATE NOCASE")
+		args = append(args, filter.TargetName)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+
+	query := "SELECT id, chat_id, actor_id, target_id, target_name, action, reason, source, excerpt, created_at FROM actions"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	var res []*db.Action
+	if err := c.db.Select(&res, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query actions: %w", err)
+	}
+	return res, nil
+}
+
+func (c *sqliteClient) CreateTrustGroup(group *db.TrustGroup) error {
+	defer metrics.ObserveDBQuery("create_trust_group")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if group.CreatedAt.IsZero() {
+		group.CreatedAt = time.Now()
+	}
+	group.CreatedAt = group.CreatedAt.UTC()
+	query := "INSERT INTO trust_groups (namespace, name, code, owner_chat_id, created_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err := c.db.Exec(query, c.namespace, group.Name, group.Code, group.OwnerChatID, group.CreatedAt); err != nil {
+		return fmt.Errorf("failed to create trust group %s: %w", group.Name, err)
+	}
+	return nil
+}
+
+func (c *sqliteClient) GetTrustGroup(name string) (*db.TrustGroup, error) {
+	defer metrics.ObserveDBQuery("get_trust_group")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	res := &db.TrustGroup{}
+	query := "SELECT name, code, owner_chat_id, created_at FROM trust_groups WHERE namespace = ? AND name = ?"
+	if err := c.db.QueryRowx(query, c.namespace, name).StructScan(res); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get trust group %s: %w", name, err)
+	}
+	return res, nil
+}
+
+func (c *sqliteClient) SetTrustMember(member *db.TrustMember) error {
+	defer metrics.ObserveDBQuery("set_trust_member")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if member.JoinedAt.IsZero() {
+		member.JoinedAt = time.Now()
+	}
+	member.JoinedAt = member.JoinedAt.UTC()
+	query := `
+		INSERT INTO trust_members (namespace, chat_id, group_name, action, joined_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(namespace, chat_id) DO UPDATE SET
+			action = excluded.action,
+			joined_at = CASE WHEN trust_members.group_name = excluded.group_name THEN trust_members.joined_at ELSE excluded.joined_at END,
+			group_name = excluded.group_name
+	`
+	if _, err := c.db.Exec(query, c.namespace, member.ChatID, member.Group, member.Action, member.JoinedAt); err != nil {
+		return fmt.Errorf("failed to set trust member %d: %w", member.ChatID, err)
+	}
+	return nil
+}
+
+func (c *sqliteClient) GetTrustMember(chatID int64) (*db.TrustMember, error) {
+	defer metrics.ObserveDBQuery("get_trust_member")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	res := &db.TrustMember{}
+	query := "SELECT chat_id, group_name, action, joined_at FROM trust_members WHERE namespace = ? AND chat_id = ?"
+	if err := c.db.QueryRowx(query, c.namespace, chatID).StructScan(res); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get trust member %d: %w", chatID, err)
+	}
+	return res, nil
+}
+
+func (c *sqliteClient) GetTrustMembers(group string) ([]*db.TrustMember, error) {
+	defer metrics.ObserveDBQuery("get_trust_members")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var res []*db.TrustMember
+	query := "SELECT chat_id, group_name, action, joined_at FROM trust_members WHERE namespace = ? AND group_name = ? ORDER BY joined_at"
+	if err := c.db.Select(&res, query, c.namespace, group); err != nil {
+		return nil, fmt.Errorf("failed to query trust members of %s: %w", group, err)
+	}
+	return res, nil
+}
+
+func (c *sqliteClient) DeleteTrustMember(chatID int64) error {
+	defer metrics.ObserveDBQuery("delete_trust_member")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, err := c.db.Exec("DELETE FROM trust_members WHERE namespace = ? AND chat_id = ?", c.namespace, chatID)
+	return err
+}
+
+func (c *sqliteClient) InsertReputation(r *db.Reputation) error {
+	defer metrics.ObserveDBQuery("insert_reputation")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	r.CreatedAt = r.CreatedAt.UTC()
+	query := `
+		INSERT INTO reputation (namespace, group_name, user_id, verdict, chat_id, actor_id, source, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := c.db.Exec(query, c.namespace, r.Group, r.UserID, r.Verdict, r.ChatID, r.ActorID, r.Source, r.Reason, r.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert reputation: %w", err)
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		r.ID = id
+	}
+	return nil
+}
+
+// GetReputation returns the decisions on the user within the group, latest first
+func (c *sqliteClient) GetReputation(group string, userID int64, limit int) ([]*db.Reputation, error) {
+	defer metrics.ObserveDBQuery("get_reputation")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if limit <= 0 {
+		limit = 50
+	}
+	var res []*db.Reputation
+	query := `
+		SELECT id, group_name, user_id, verdict, chat_id, actor_id, source, reason, created_at FROM reputation
+		WHERE namespace = ? AND group_name = ? AND user_id = ?
+		ORDER BY created_at DESC, id DESC LIMIT ?
+	`
+	if err := c.db.Select(&res, query, c.namespace, group, userID, limit); err != nil {
+		return nil, fmt.Errorf("failed to query reputation of %d: %w", userID, err)
+	}
+	return res, nil
+}
+
+// InsertListEntries adds the entries in one transaction and returns how many were new
+func (c *sqliteClient) InsertListEntries(entries []*db.ListEntry) (int, error) {
+	defer metrics.ObserveDBQuery("insert_list_entries")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := "INSERT OR IGNORE INTO list_entries (list, kind, pattern, created_by, created_at) VALUES (?, ?, ?, ?, ?)"
+	added := 0
+	for _, e := range entries {
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = time.Now()
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		res, err := tx.Exec(query, e.List, e.Kind, e.Pattern, e.CreatedBy, e.CreatedAt)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert list entry: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+			if id, err := res.LastInsertId(); err == nil {
+				e.ID = id
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit list entries: %w", err)
+	}
+	return added, nil
+}
+
+func (c *sqliteClient) DeleteListEntry(id int64) (bool, error) {
+	defer metrics.ObserveDBQuery("delete_list_entry")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	res, err := c.db.Exec("DELETE FROM list_entries WHERE id = ?", id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete list entry %d: %w", id, err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// GetListEntries returns the entries of the list, of both lists when list is empty
+func (c *sqliteClient) GetListEntries(list string) ([]*db.ListEntry, error) {
+	defer metrics.ObserveDBQuery("get_list_entries")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var res []*db.ListEntry
+	query := "SELECT id, list, kind, pattern, created_by, created_at FROM list_entries WHERE ? = '' OR list = ? ORDER BY id"
+	if err := c.db.Select(&res, query, list, list); err != nil {
+		return nil, fmt.Errorf("failed to query list entries: %w", err)
+	}
+	return res, nil
+}
+
+func (c *sqliteClient) GetLinkPolicy(chatID int64) (*db.LinkPolicy, error) {
+	defer metrics.ObserveDBQuery("get_link_policy")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	res := &db.LinkPolicy{}
+	query := "SELECT chat_id, mode, allowed, denied FROM link_policies WHERE namespace = ? AND chat_id = ?"
+	if err := c.db.QueryRowx(query, c.namespace, chatID).StructScan(res); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get link policy of chat %d: %w", chatID, err)
+	}
+	return res, nil
+}
+
+func (c *sqliteClient) SetLinkPolicy(policy *db.LinkPolicy) error {
+	defer metrics.ObserveDBQuery("set_link_policy")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	query := `
+		INSERT INTO link_policies (namespace, chat_id, mode, allowed, denied) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(namespace, chat_id) DO UPDATE SET mode = excluded.mode, allowed = excluded.allowed, denied = excluded.denied
+	`
+	if _, err := c.db.Exec(query, c.namespace, policy.ChatID, policy.Mode, policy.Allowed, policy.Denied); err != nil {
+		return fmt.Errorf("failed to set link policy of chat %d: %w", policy.ChatID, err)
+	}
+	return nil
+}
+
+func (c *sqliteClient) InsertSpamFingerprint(fp *db.SpamFingerprint) error {
+	defer metrics.ObserveDBQuery("insert_spam_fingerprint")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if fp.CreatedAt.IsZero() {
+		fp.CreatedAt = time.Now()
+	}
+	fp.CreatedAt = fp.CreatedAt.UTC()
+	fp.Namespace = c.namespace
+	query := "INSERT INTO spam_fingerprints (signature, namespace, scope, chat_id, user_id, source, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	res, err := c.db.Exec(query, fp.Signature, fp.Namespace, fp.Scope, fp.ChatID, fp.UserID, fp.Source, fp.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert spam fingerprint: %w", err)
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		fp.ID = id
+	}
+	return nil
+}
+
+func (c *sqliteClient) GetSpamFingerprints(since time.Time, limit int) ([]*db.SpamFingerprint, error) {
+	defer metrics.ObserveDBQuery("get_spam_fingerprints")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var res []*db.SpamFingerprint
+	query := `
+		SELECT * FROM (
+			SELECT id, signature, namespace, scope, chat_id, user_id, source, created_at FROM spam_fingerprints
+			WHERE created_at >= ? ORDER BY id DESC LIMIT ?
+		) ORDER BY id
+	`
+	if err := c.db.Select(&res, query, since.UTC(), limit); err != nil {
+		return nil, fmt.Errorf("failed to query spam fingerprints: %w", err)
+	}
+	return res, nil
+}
+
+func (c *sqliteClient) DeleteSpamFingerprints(chatID, userID int64, scope string) (int, error) {
+	defer metrics.ObserveDBQuery("delete_spam_fingerprints")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	query := `
+		DELETE FROM spam_fingerprints
+		WHERE namespace = ? AND user_id = ? AND (chat_id = ? OR (scope <> '' AND scope = ?))
+	`
+	res, err := c.db.Exec(query, c.namespace, userID, chatID, scope)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete spam fingerprints of user %d: %w", userID, err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (c *sqliteClient) PruneSpamFingerprints(before time.Time, keep int) error {
+	defer metrics.ObserveDBQuery("prune_spam_fingerprints")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	query := `
+		DELETE FROM spam_fingerprints
+		WHERE created_at < ? OR id NOT IN (SELECT id FROM spam_fingerprints ORDER BY id DESC LIMIT ?)
+	`
+	if _, err := c.db.Exec(query, before.UTC(), keep); err != nil {
+		return fmt.Errorf("failed to prune spam fingerprints: %w", err)
+	}
+	return nil
+}
+
+func (c *sqliteClient) AddLLMSpending(spending *db.LLMSpending) error {
+	defer metrics.ObserveDBQuery("add_llm_spending")()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	query := `
+		INSERT INTO llm_spending (day, chat_id, tokens, cost) VALUES (?, ?, ?, ?)
+		ON CONFLICT(day, chat_id) DO UPDATE SET tokens = tokens + excluded.tokens, cost = cost + excluded.cost
+	`
+	if _, err := c.db.Exec(query, spending.Day, spending.ChatID, spending.Tokens, spending.Cost); err != nil {
+		return fmt.Errorf("failed to add llm spending of chat %d: %w", spending.ChatID, err)
+	}
+	return nil
+}
+
+func (c *sqliteClient) GetLLMSpending(day string) ([]*db.LLMSpending, error) {
+	defer metrics.ObserveDBQuery("get_llm_spending")()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var res []*db.LLMSpending
+	if err := c.db.Select(&res, "SELECT day, chat_id, tokens, cost FROM llm_spending WHERE day = ?", day); err != nil {
+		return nil, fmt.Errorf("failed to query llm spending of %s: %w", day, err)
+	}
+	return res, nil
+}
+
 func (c *sqliteClient) Close() error {
 	return c.db.Close()
 }
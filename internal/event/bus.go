@@ -1,75 +1,259 @@
 package event
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultQueueSize = 1024
 )
 
 type (
-	bus struct {
-		q chan Queueable
+	// Event is anything that can be published on the Bus
+	Event interface {
+		Type() string
 	}
 
-	Queueable interface {
-		Process()
-		IsProcessed() bool
-		Drop()
-		IsDropped() bool
-		Expired() bool
-		Type() string
+	// Envelope wraps a published event with delivery metadata
+	Envelope struct {
+		Event       Event
+		PublishedAt time.Time
+		ExpireAt    time.Time
+	}
+
+	// DeadLetter describes an event that could not be delivered to a subscriber
+	DeadLetter struct {
+		Envelope     Envelope
+		Subscription string
+		Reason       string
+		Err          error
+	}
+
+	// Stats is a snapshot of the bus counters
+	Stats struct {
+		Published     uint64
+		Delivered     uint64
+		Unrouted      uint64
+		Expired       uint64
+		DeadLettered  uint64
+		Subscriptions []SubscriptionStats
 	}
 
-	Base struct {
-		processed bool
-		dropped   bool
-		expireAt  time.Time
-		eventType string
+	SubscriptionStats struct {
+		Name     string
+		Queued   int
+		Capacity int
 	}
+
+	Bus struct {
+		mu         sync.RWMutex
+		subs       map[uint64]*Subscription
+		nextID     uint64
+		closed     bool
+		wg         sync.WaitGroup
+		deadLetter func(DeadLetter)
+		defaultTTL time.Duration
+
+		published    atomic.Uint64
+		delivered    atomic.Uint64
+		unrouted     atomic.Uint64
+		expired      atomic.Uint64
+		deadLettered atomic.Uint64
+
+		log *log.Entry
+	}
+
+	BusOption func(b *Bus)
+
+	PublishOption func(e *Envelope)
 )
 
-func CreateBase(eventType string, expiresAt time.Time) *Base {
-	return &Base{
-		expireAt:  expiresAt,
-		eventType: eventType,
+// WithDeadLetterHandler sets the function receiving undeliverable events
+func WithDeadLetterHandler(fn func(DeadLetter)) BusOption {
+	return func(b *Bus) {
+		b.deadLetter = fn
 	}
 }
 
-func (b *Base) Process() {
-	b.processed = true
+// WithDefaultTTL sets the expiration applied to events published without an explicit TTL
+func WithDefaultTTL(ttl time.Duration) BusOption {
+	return func(b *Bus) {
+		b.defaultTTL = ttl
+	}
 }
 
-func (b *Base) IsProcessed() bool {
-	return b.processed
+// WithTTL makes the event expire if it was not handled within ttl
+func WithTTL(ttl time.Duration) PublishOption {
+	return func(e *Envelope) {
+		e.ExpireAt = e.PublishedAt.Add(ttl)
+	}
 }
 
-func (b *Base) Drop() {
-	b.dropped = true
+func NewBus(opts ...BusOption) *Bus {
+	b := &Bus{
+		subs: map[uint64]*Subscription{},
+		log:  log.WithField("context", "event_bus"),
+	}
+	b.deadLetter = func(dl DeadLetter) {
+		b.log.WithFields(log.Fields{
+			"event":        dl.Envelope.Event.Type(),
+			"subscription": dl.Subscription,
+			"reason":       dl.Reason,
+		}).WithError(dl.Err).Warn("dead letter")
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
-func (b *Base) IsDropped() bool {
-	return b.dropped
-}
+// Publish hands the event to every matching subscriber without blocking the caller
+func (b *Bus) Publish(ev Event, opts ...PublishOption) {
+	if ev == nil {
+		return
+	}
+	env := Envelope{
+		Event:       ev,
+		PublishedAt: time.Now(),
+	}
+	if b.defaultTTL > 0 {
+		env.ExpireAt = env.PublishedAt.Add(b.defaultTTL)
+	}
+	for _, opt := range opts {
+		opt(&env)
+	}
 
-func (b *Base) Expired() bool {
-	return b.expireAt.Sub(time.Now()) < 0
-}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		b.dead(env, "", "bus closed", nil)
+		return
+	}
+	b.published.Add(1)
 
-func (b *Base) Type() string {
-	return b.eventType
+	routed := false
+	for _, s := range b.subs {
+		if !s.match(ev) {
+			continue
+		}
+		routed = true
+		select {
+		case s.queue <- env:
+		default:
+			b.dead(env, s.name, "queue full", nil)
+		}
+	}
+	if !routed {
+		b.unrouted.Add(1)
+	}
 }
 
-var Bus = &bus{q: make(chan Queueable, 100000)}
+// Subscribe registers fn for every published event assignable to T.
+// Each subscription gets its own bounded queue and delivery goroutine.
+func Subscribe[T Event](b *Bus, name string, fn func(T) error, opts ...SubscribeOption) *Subscription {
+	s := &Subscription{
+		name:      name,
+		queueSize: defaultQueueSize,
+		bus:       b,
+		match: func(ev Event) bool {
+			_, ok := ev.(T)
+			return ok
+		},
+		handle: func(ev Event) error {
+			return fn(ev.(T))
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.queue = make(chan Envelope, s.queueSize)
 
-// NQ adds an event to the queue
-func (b *bus) NQ(event Queueable) {
-	go func() { b.q <- event }()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(s.queue)
+		return s
+	}
+	b.nextID++
+	s.id = b.nextID
+	b.subs[s.id] = s
+	b.wg.Add(1)
+	go s.run()
+	return s
 }
 
-// DQ returns the next event from the queue or nil if the queue is empty
-func (b *bus) DQ() Queueable {
+// Stats returns a snapshot of the bus counters and subscription queues
+func (b *Bus) Stats() Stats {
+	st := Stats{
+		Published:    b.published.Load(),
+		Delivered:    b.delivered.Load(),
+		Unrouted:     b.unrouted.Load(),
+		Expired:      b.expired.Load(),
+		DeadLettered: b.deadLettered.Load(),
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subs {
+		st.Subscriptions = append(st.Subscriptions, SubscriptionStats{
+			Name:     s.name,
+			Queued:   len(s.queue),
+			Capacity: cap(s.queue),
+		})
+	}
+	return st
+}
+
+// Close stops accepting events and waits for subscribers to drain their queues
+func (b *Bus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	for id, s := range b.subs {
+		close(s.queue)
+		delete(b.subs, id)
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
 	select {
-	case q := <-b.q:
-		return q
-	default:
+	case <-done:
 		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("event bus drain: %w", ctx.Err())
+	}
+}
+
+func (b *Bus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s.id]; !ok {
+		return
+	}
+	delete(b.subs, s.id)
+	close(s.queue)
+}
+
+func (b *Bus) dead(env Envelope, subscription, reason string, err error) {
+	b.deadLettered.Add(1)
+	if b.deadLetter != nil {
+		b.deadLetter(DeadLetter{
+			Envelope:     env,
+			Subscription: subscription,
+			Reason:       reason,
+			Err:          err,
+		})
 	}
 }
@@ -0,0 +1,158 @@
+package event_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iamwavecut/ngbot/internal/event"
+)
+
+type ping struct{ n int }
+
+func (ping) Type() string { return "ping" }
+
+// recorder collects the dead letters of a bus
+type recorder struct {
+	mutex   sync.Mutex
+	reasons []string
+}
+
+func (r *recorder) record(dl event.DeadLetter) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reasons = append(r.reasons, dl.Reason)
+}
+
+func (r *recorder) got() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.reasons...)
+}
+
+// blocking subscribes a handler that signals every event on entered and waits for release
+func blocking(bus *event.Bus, size int) (entered chan int, release chan struct{}) {
+	entered, release = make(chan int, 16), make(chan struct{})
+	event.Subscribe(bus, "blocking", func(p ping) error {
+		entered <- p.n
+		<-release
+		return nil
+	}, event.WithQueueSize(size))
+	return entered, release
+}
+
+func TestQueueFull(t *testing.T) {
+	dead := &recorder{}
+	bus := event.NewBus(event.WithDeadLetterHandler(dead.record))
+	entered, release := blocking(bus, 1)
+
+	bus.Publish(ping{1})
+	<-entered
+	// the handler holds the first event, the second one fills the queue
+	bus.Publish(ping{2})
+	bus.Publish(ping{3})
+	if got := dead.got(); len(got) != 1 || got[0] != "queue full" {
+		t.Fatalf("dead letters %v", got)
+	}
+
+	close(release)
+	if err := bus.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if st := bus.Stats(); st.Published != 3 || st.Delivered != 2 || st.DeadLettered != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dead := &recorder{}
+	bus := event.NewBus(event.WithDeadLetterHandler(dead.record))
+	entered, release := blocking(bus, 10)
+
+	bus.Publish(ping{1})
+	<-entered
+	bus.Publish(ping{2}, event.WithTTL(time.Millisecond))
+	bus.Publish(ping{3})
+	time.Sleep(10 * time.Millisecond)
+
+	close(release)
+	if err := bus.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := dead.got(); len(got) != 1 || got[0] != "expired" {
+		t.Fatalf("dead letters %v", got)
+	}
+	if st := bus.Stats(); st.Expired != 1 || st.Delivered != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestHandlerFailure(t *testing.T) {
+	dead := &recorder{}
+	bus := event.NewBus(event.WithDeadLetterHandler(dead.record))
+	event.Subscribe(bus, "failing", func(p ping) error {
+		if p.n == 1 {
+			return errors.New("failed")
+		}
+		panic("broken")
+	})
+	bus.Publish(ping{1})
+	bus.Publish(ping{2})
+	if err := bus.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := dead.got(); len(got) != 2 || got[0] != "handler error" || got[1] != "handler error" {
+		t.Errorf("dead letters %v", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dead := &recorder{}
+	bus := event.NewBus(event.WithDeadLetterHandler(dead.record))
+	var mutex sync.Mutex
+	var handled []int
+	event.Subscribe(bus, "slow", func(p ping) error {
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled = append(handled, p.n)
+		return nil
+	})
+	for i := range 5 {
+		bus.Publish(ping{i})
+	}
+
+	// the queued events are handled before Close returns
+	if err := bus.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	if len(handled) != 5 {
+		t.Errorf("handled %v", handled)
+	}
+	mutex.Unlock()
+
+	bus.Publish(ping{5})
+	if got := dead.got(); len(got) != 1 || got[0] != "bus closed" {
+		t.Errorf("dead letters %v", got)
+	}
+	if err := bus.Close(context.Background()); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	bus := event.NewBus()
+	entered, release := blocking(bus, 1)
+	defer close(release)
+	bus.Publish(ping{1})
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := bus.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline exceeded", err)
+	}
+}
@@ -0,0 +1,119 @@
+package event
+
+const (
+	SourceGatekeeper = "gatekeeper"
+	SourceReactor    = "reactor"
+	SourceAdmin      = "admin"
+	SourceRaid       = "raid"
+	SourceFederation = "federation"
+
+	ChallengeFailWrongAnswer = "wrong_answer"
+	ChallengeFailTimeout     = "timeout"
+)
+
+type (
+	ChallengeStarted struct {
+		ChatID     int64
+		CommChatID int64
+		UserID     int64
+		UserName   string
+	}
+
+	ChallengePassed struct {
+		ChatID   int64
+		UserID   int64
+		UserName string
+		ByAdmin  bool
+	}
+
+	ChallengeFailed struct {
+		ChatID   int64
+		UserID   int64
+		UserName string
+		Reason   string
+	}
+
+	SpamDetected struct {
+		ChatID    int64
+		UserID    int64
+		UserName  string
+		MessageID int
+		Source    string
+		Verdict   string
+		// Content is the raw message text, consumers must pass it through the chat privacy policy
+		Content string
+	}
+
+	MessageDeleted struct {
+		ChatID    int64
+		UserID    int64
+		UserName  string
+		MessageID int
+		Source    string
+		Reason    string
+		Content   string
+	}
+
+	JoinDeclined struct {
+		ChatID   int64
+		UserID   int64
+		UserName string
+		Source   string
+		Reason   string
+	}
+
+	UserBanned struct {
+		ChatID   int64
+		UserID   int64
+		UserName string
+		ActorID  int64
+		Source   string
+		Reason   string
+	}
+
+	UserUnbanned struct {
+		ChatID   int64
+		UserID   int64
+		UserName string
+		ActorID  int64
+		Source   string
+		Reason   string
+		Pardoned bool
+	}
+
+	LockdownStarted struct {
+		ChatID int64
+		Signal string
+	}
+
+	LockdownEnded struct {
+		ChatID int64
+		// ActorID is the admin who lifted the lockdown, zero when it ended after the quiet period
+		ActorID int64
+		Blocked int
+	}
+
+	// ReputationMatched is a joiner the trust group of the chat has a decision on
+	ReputationMatched struct {
+		ChatID   int64
+		UserID   int64
+		UserName string
+		Group    string
+		Verdict  string
+		// Action is what the chat does with spam decisions of the group
+		Action     string
+		Provenance string
+	}
+)
+
+func (ChallengeStarted) Type() string  { return "challenge_started" }
+func (ChallengePassed) Type() string   { return "challenge_passed" }
+func (ChallengeFailed) Type() string   { return "challenge_failed" }
+func (SpamDetected) Type() string      { return "spam_detected" }
+func (MessageDeleted) Type() string    { return "message_deleted" }
+func (JoinDeclined) Type() string      { return "join_declined" }
+func (UserBanned) Type() string        { return "user_banned" }
+func (UserUnbanned) Type() string      { return "user_unbanned" }
+func (LockdownStarted) Type() string   { return "lockdown_started" }
+func (LockdownEnded) Type() string     { return "lockdown_ended" }
+func (ReputationMatched) Type() string { return "reputation_matched" }
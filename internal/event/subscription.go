@@ -0,0 +1,67 @@
+package event
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	Subscription struct {
+		id        uint64
+		name      string
+		queueSize int
+		queue     chan Envelope
+		bus       *Bus
+		match     func(Event) bool
+		handle    func(Event) error
+	}
+
+	SubscribeOption func(s *Subscription)
+)
+
+// WithQueueSize bounds the number of events waiting for the subscriber
+func WithQueueSize(size int) SubscribeOption {
+	return func(s *Subscription) {
+		if size > 0 {
+			s.queueSize = size
+		}
+	}
+}
+
+func (s *Subscription) Name() string {
+	return s.name
+}
+
+// Unsubscribe stops delivery; events already queued are still handled
+func (s *Subscription) Unsubscribe() {
+	s.bus.unsubscribe(s)
+}
+
+func (s *Subscription) run() {
+	defer s.bus.wg.Done()
+	l := s.bus.log.WithField("subscription", s.name)
+	l.Trace("subscriber go")
+
+	for env := range s.queue {
+		if !env.ExpireAt.IsZero() && time.Now().After(env.ExpireAt) {
+			s.bus.expired.Add(1)
+			s.bus.dead(env, s.name, "expired", nil)
+			continue
+		}
+		if err := s.deliver(env); err != nil {
+			s.bus.dead(env, s.name, "handler error", err)
+			continue
+		}
+		s.bus.delivered.Add(1)
+	}
+	l.Trace("subscriber stopped")
+}
+
+func (s *Subscription) deliver(env Envelope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handle(env.Event)
+}
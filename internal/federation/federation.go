@@ -0,0 +1,175 @@
+// Package federation shares spam bans and trust decisions between the chats of a trust group
+package federation
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/event"
+)
+
+const (
+	// ActionPreBan bans or declines joiners the group has a spam decision on
+	ActionPreBan = "pre_ban"
+	// ActionChallenge makes joiners the group has a spam decision on pass a challenge
+	ActionChallenge = "challenge"
+	// ActionWatch only records the decisions of the group
+	ActionWatch = "watch"
+
+	// lookupDepth is how many of the latest decisions are looked through for one by a current member
+	lookupDepth = 20
+)
+
+type (
+	// Federation records the spam bans and pardons of trust group members as decisions of their group
+	Federation struct {
+		s    bot.Service
+		subs []*event.Subscription
+	}
+
+	// Match is the latest decision of the trust group on a user
+	Match struct {
+		Group string
+		// Action is what the chat does with spam decisions of the group
+		Action   string
+		Decision *db.Reputation
+	}
+)
+
+// Actions lists the actions a chat can take on spam decisions of its group
+func Actions() []string {
+	return []string{ActionPreBan, ActionChallenge, ActionWatch}
+}
+
+// IsAction reports whether the chat can take the action
+func IsAction(action string) bool {
+	for _, a := range Actions() {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func New(s bot.Service) *Federation {
+	f := &Federation{s: s}
+	bus := s.GetBus()
+	f.subs = append(f.subs,
+		event.Subscribe(bus, "federation.user_banned", func(e event.UserBanned) error {
+			// failed challenges are not spam and federated bans are already known to the group,
+			// spam confirmed by an admin is shared like the pardons
+			if e.Source != event.SourceReactor && e.Source != event.SourceAdmin {
+				return nil
+			}
+			return f.record(db.VerdictSpam, e.ChatID, e.UserID, e.ActorID, e.Source, e.Reason)
+		}),
+		event.Subscribe(bus, "federation.user_unbanned", func(e event.UserUnbanned) error {
+			if !e.Pardoned {
+				return nil
+			}
+			return f.record(db.VerdictTrust, e.ChatID, e.UserID, e.ActorID, e.Source, e.Reason)
+		}),
+	)
+	return f
+}
+
+// Stop detaches the federation from the bus
+func (f *Federation) Stop() {
+	for _, sub := range f.subs {
+		sub.Unsubscribe()
+	}
+	f.subs = nil
+}
+
+func (f *Federation) record(verdict string, chatID, userID, actorID int64, source, reason string) error {
+	member, err := f.s.GetDB().GetTrustMember(chatID)
+	if err != nil {
+		return errors.WithMessage(err, "cant get trust member")
+	}
+	if member == nil {
+		return nil
+	}
+	f.getLogEntry().WithFields(log.Fields{
+		"method":  "record",
+		"chat_id": chatID,
+		"user_id": userID,
+		"group":   member.Group,
+		"verdict": verdict,
+	}).Info("sharing decision with the trust group")
+	return errors.WithMessage(f.s.GetDB().InsertReputation(&db.Reputation{
+		Group:   member.Group,
+		UserID:  userID,
+		Verdict: verdict,
+		ChatID:  chatID,
+		ActorID: actorID,
+		Source:  source,
+		Reason:  reason,
+	}), "cant record reputation")
+}
+
+func (f *Federation) getLogEntry() *log.Entry {
+	return log.WithField("context", "federation")
+}
+
+// Lookup returns the latest decision on the user made in another chat of the trust group, nil when there is none.
+// Decisions of chats that left the group no longer count. A decision made in the chat itself takes precedence,
+// so that a pardon or an appeal there is not undone by the group: the group is only asked about users the chat has not decided on.
+func Lookup(client db.Client, chatID, userID int64) (*Match, error) {
+	member, err := client.GetTrustMember(chatID)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant get trust member")
+	}
+	if member == nil {
+		return nil, nil
+	}
+	decisions, err := client.GetReputation(member.Group, userID, lookupDepth)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant get reputation")
+	}
+	if len(decisions) == 0 {
+		return nil, nil
+	}
+	members, err := client.GetTrustMembers(member.Group)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant get trust members")
+	}
+	current := map[int64]bool{}
+	for _, m := range members {
+		current[m.ChatID] = true
+	}
+	for _, decision := range decisions {
+		if decision.ChatID == chatID {
+			return nil, nil
+		}
+	}
+	for _, decision := range decisions {
+		if current[decision.ChatID] {
+			return &Match{Group: member.Group, Action: member.Action, Decision: decision}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *Match) Spam() bool {
+	return m.Decision.Verdict == db.VerdictSpam
+}
+
+func (m *Match) Trusted() bool {
+	return m.Decision.Verdict == db.VerdictTrust
+}
+
+// Provenance tells where the decision comes from
+func (m *Match) Provenance() string {
+	provenance := fmt.Sprintf("%s in chat %d by %s", m.Decision.Verdict, m.Decision.ChatID, m.Decision.Source)
+	if m.Decision.ActorID != 0 {
+		provenance += fmt.Sprintf(" (admin %d)", m.Decision.ActorID)
+	}
+	if m.Decision.Reason != "" {
+		provenance += ": " + m.Decision.Reason
+	}
+	return fmt.Sprintf("%s, trust group %s, %s", provenance, m.Group, m.Decision.CreatedAt.UTC().Format("2006-01-02 15:04"))
+}
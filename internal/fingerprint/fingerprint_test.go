@@ -0,0 +1,151 @@
+package fingerprint_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/db/sqlite"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
+)
+
+const spam = "🔥 Earn $500 a day from home! No experience needed, write me in private messages to learn how to start making money today"
+
+func TestOf(t *testing.T) {
+	sig, ok := fingerprint.Of(spam)
+	if !ok {
+		t.Fatal("no fingerprint")
+	}
+	cases := []struct {
+		name string
+		text string
+		near bool
+	}{
+		{"case and emoji", "EARN $500 A DAY FROM HOME!! no experience needed, write me in private messages to learn how to start making money today 👉", true},
+		{"changed amount", "💰 Earn $700 a day from home! No experience needed, write me in private messages to learn how to start making money today", true},
+		{"appended contact", spam + " @promo_bot", true},
+		{"reworded", "Earn 500$ a day from home. No experience needed - write me in DM to learn how to start making money today", true},
+		{"invisible characters", "Earn $500 a day from​ home! No experience needed, write me in private‍ messages to learn how to start making money today", true},
+		{"same topic", "Earn money working from home, contact me in private messages", false},
+		{"unrelated", "Hi everyone, does anyone know a good place to buy a used bike in the city center? Thanks in advance", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			other, ok := fingerprint.Of(c.text)
+			if !ok {
+				t.Fatal("no fingerprint")
+			}
+			if s := fingerprint.Similarity(sig, other); (s >= 0.6) != c.near {
+				t.Errorf("similarity %.2f, near duplicate %v", s, c.near)
+			}
+		})
+	}
+
+	if _, ok := fingerprint.Of("join my channel!"); ok {
+		t.Error("short text got a fingerprint")
+	}
+	if parsed, err := fingerprint.Parse(sig.Bytes()); err != nil || parsed != sig {
+		t.Errorf("signature did not survive encoding: %v", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	client := sqlite.NewSQLiteClient(filepath.Join(t.TempDir(), "bot.db"))
+	defer client.Close()
+	limits := config.SpamIndex{Size: 2, Similarity: 0.6, TTL: time.Hour}
+	now := time.Now()
+
+	index := fingerprint.New(client)
+	added, err := index.Add(spam, &db.SpamFingerprint{ChatID: 1, UserID: 10, Source: "llm", CreatedAt: now}, limits)
+	if err != nil || !added {
+		t.Fatalf("added %v: %v", added, err)
+	}
+	if added, _ := index.Add(spam+"!!!", &db.SpamFingerprint{ChatID: 2, UserID: 11, Source: "llm", CreatedAt: now}, limits); added {
+		t.Error("known fingerprint added again")
+	}
+
+	variation := "Earn $700 a day from home!! No experience needed, write me in private messages to learn how to start making money today"
+	match, similarity, err := index.Match(variation, "", limits, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match == nil || match.UserID != 10 || similarity < limits.Similarity {
+		t.Fatalf("got %+v at %.2f", match, similarity)
+	}
+	if match, _, _ := index.Match(spam, "", limits, now.Add(2*time.Hour)); match != nil {
+		t.Error("expired fingerprint matched")
+	}
+
+	// a restarted bot loads the fingerprints from the database
+	if match, _, _ := fingerprint.New(client).Match(variation, "", limits, now); match == nil {
+		t.Error("fingerprint was not persisted")
+	}
+
+	// the oldest fingerprints over the size are dropped
+	for i, text := range []string{
+		"Buy cheap followers and likes for your channel, the best prices only this week, write to the bot",
+		"Crypto signals with guaranteed profit every single day, join the private group through the link in bio",
+	} {
+		if _, err := index.Add(text, &db.SpamFingerprint{ChatID: 1, UserID: int64(20 + i), Source: "admin", CreatedAt: now}, limits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if match, _, _ := index.Match(spam, "", limits, now); match != nil {
+		t.Error("fingerprint over the size matched")
+	}
+	if match, _, _ := fingerprint.New(client).Match(spam, "", limits, now); match != nil {
+		t.Error("fingerprint over the size was not pruned")
+	}
+
+	crypto := "Crypto signals with guaranteed profit every day, join the private group through the link in bio"
+	if removed, err := index.Forget(2, 21, ""); err != nil || removed != 0 {
+		t.Fatalf("removed %d of another chat: %v", removed, err)
+	}
+	if removed, err := index.Forget(1, 21, ""); err != nil || removed != 1 {
+		t.Fatalf("removed %d: %v", removed, err)
+	}
+	if match, _, _ := index.Match(crypto, "", limits, now); match != nil {
+		t.Error("forgotten fingerprint matched")
+	}
+}
+
+func TestScope(t *testing.T) {
+	client := sqlite.NewSQLiteClient(filepath.Join(t.TempDir(), "bot.db"))
+	defer client.Close()
+	limits := config.SpamIndex{Size: 10, Similarity: 0.6, TTL: time.Hour}
+	now := time.Now()
+
+	index := fingerprint.New(client)
+	first, second := index.Namespaced("first"), index.Namespaced("second")
+	if added, err := first.Add(spam, &db.SpamFingerprint{Scope: "chat:1", ChatID: 1, UserID: 10, Source: "admin", CreatedAt: now}, limits); err != nil || !added {
+		t.Fatalf("added %v: %v", added, err)
+	}
+	cases := []struct {
+		name  string
+		index *fingerprint.Index
+		scope string
+		match bool
+	}{
+		{"same chat", first, "chat:1", true},
+		{"other chat", first, "chat:2", false},
+		{"other bot", second, "chat:1", false},
+	}
+	for _, c := range cases {
+		if match, _, _ := c.index.Match(spam, c.scope, limits, now); (match != nil) != c.match {
+			t.Errorf("%s: matched %v", c.name, match != nil)
+		}
+	}
+
+	// a pardon by the other bot keeps the fingerprint
+	if removed, _ := second.Forget(1, 10, "chat:1"); removed != 0 {
+		t.Errorf("other bot removed %d", removed)
+	}
+	if removed, _ := first.Forget(1, 10, "chat:1"); removed != 1 {
+		t.Errorf("removed %d", removed)
+	}
+	if match, _, _ := first.Match(spam, "chat:1", limits, now); match != nil {
+		t.Error("forgotten fingerprint matched")
+	}
+}
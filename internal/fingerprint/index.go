@@ -0,0 +1,168 @@
+package fingerprint
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+)
+
+type (
+	// Index keeps the fingerprints of recent spam of all chats, the latest ones up to the size in memory and in the database.
+	// The fingerprints a bot adds are recorded in its namespace, see Namespaced.
+	Index struct {
+		client    db.Client
+		namespace string
+		*store
+	}
+
+	// store is shared by the namespaced views of an index
+	store struct {
+		mutex sync.RWMutex
+		// entries are the oldest first, nil until loaded
+		entries []entry
+	}
+
+	entry struct {
+		*db.SpamFingerprint
+		signature Signature
+	}
+)
+
+func New(client db.Client) *Index {
+	return &Index{client: client, store: &store{}}
+}
+
+// Namespaced returns a view of the index for a bot, sharing the fingerprints
+func (i *Index) Namespaced(namespace string) *Index {
+	return &Index{client: i.client.Namespaced(namespace), namespace: namespace, store: i.store}
+}
+
+// Scope returns the scope of the fingerprints an admin adds in the chat: its trust group, or the chat alone
+func Scope(client db.Client, chatID int64) (string, error) {
+	member, err := client.GetTrustMember(chatID)
+	if err != nil {
+		return "", errors.WithMessage(err, "cant get trust member")
+	}
+	if member != nil {
+		return "group:" + member.Group, nil
+	}
+	return fmt.Sprintf("chat:%d", chatID), nil
+}
+
+// Match returns the most similar fingerprint of spam the text is a near duplicate of, nil when there is none.
+// The fingerprints of every chat are matched, except those of other scopes or other bots.
+func (i *Index) Match(text, scope string, limits config.SpamIndex, now time.Time) (*db.SpamFingerprint, float64, error) {
+	sig, ok := Of(text)
+	if !ok || limits.Size == 0 {
+		return nil, 0, nil
+	}
+	if err := i.load(limits, now); err != nil {
+		return nil, 0, err
+	}
+	since := now.Add(-limits.TTL)
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	var closest *db.SpamFingerprint
+	var similarity float64
+	for _, e := range i.entries {
+		if e.CreatedAt.Before(since) || !i.applies(e, scope) {
+			continue
+		}
+		if s := Similarity(sig, e.signature); s >= limits.Similarity && s > similarity {
+			closest, similarity = e.SpamFingerprint, s
+		}
+	}
+	return closest, similarity, nil
+}
+
+// Add fingerprints the spam text as found by the source in the chat, reporting false for a text too short
+// to fingerprint and for a fingerprint already known in the scope of the spam. The oldest fingerprints over the size are dropped.
+func (i *Index) Add(text string, spam *db.SpamFingerprint, limits config.SpamIndex) (bool, error) {
+	sig, ok := Of(text)
+	if !ok || limits.Size == 0 {
+		return false, nil
+	}
+	if spam.CreatedAt.IsZero() {
+		spam.CreatedAt = time.Now()
+	}
+	if err := i.load(limits, spam.CreatedAt); err != nil {
+		return false, err
+	}
+	spam.Signature = sig.Bytes()
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if slices.ContainsFunc(i.entries, func(e entry) bool { return e.signature == sig && i.applies(e, spam.Scope) }) {
+		return false, nil
+	}
+	if err := i.client.InsertSpamFingerprint(spam); err != nil {
+		return false, errors.WithMessage(err, "cant store spam fingerprint")
+	}
+	since := spam.CreatedAt.Add(-limits.TTL)
+	if err := i.client.PruneSpamFingerprints(since, limits.Size); err != nil {
+		return true, errors.WithMessage(err, "cant prune spam fingerprints")
+	}
+	i.entries = slices.DeleteFunc(append(i.entries, entry{spam, sig}), func(e entry) bool {
+		return e.CreatedAt.Before(since)
+	})
+	if over := len(i.entries) - limits.Size; over > 0 {
+		i.entries = slices.Delete(i.entries, 0, over)
+	}
+	return true, nil
+}
+
+// Forget drops the fingerprints of the messages of the user found by the bot in the chat or added with the scope,
+// e.g. after a pardon, and returns how many there were
+func (i *Index) Forget(chatID, userID int64, scope string) (int, error) {
+	removed, err := i.client.DeleteSpamFingerprints(chatID, userID, scope)
+	if err != nil {
+		return 0, errors.WithMessage(err, "cant forget spam fingerprints")
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.entries = slices.DeleteFunc(i.entries, func(e entry) bool {
+		return e.Namespace == i.namespace && e.UserID == userID && (e.ChatID == chatID || e.Scope != "" && e.Scope == scope)
+	})
+	return removed, nil
+}
+
+// applies reports whether the fingerprint applies to the chats of the bot with the scope
+func (i *Index) applies(e entry, scope string) bool {
+	return e.Scope == "" || e.Namespace == i.namespace && e.Scope == scope
+}
+
+// load reads the latest fingerprints from the database on first use
+func (i *Index) load(limits config.SpamIndex, now time.Time) error {
+	i.mutex.RLock()
+	loaded := i.entries != nil
+	i.mutex.RUnlock()
+	if loaded {
+		return nil
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.entries != nil {
+		return nil
+	}
+	stored, err := i.client.GetSpamFingerprints(now.Add(-limits.TTL), limits.Size)
+	if err != nil {
+		return errors.WithMessage(err, "cant load spam fingerprints")
+	}
+	i.entries = make([]entry, 0, len(stored))
+	for _, fp := range stored {
+		sig, err := Parse(fp.Signature)
+		if err != nil {
+			log.WithFields(log.Fields{"context": "fingerprint", "method": "load", "id": fp.ID}).WithError(err).Warn("skipping spam fingerprint")
+			continue
+		}
+		i.entries = append(i.entries, entry{fp, sig})
+	}
+	return nil
+}
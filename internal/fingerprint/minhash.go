@@ -0,0 +1,93 @@
+// Package fingerprint finds the variations of known spam: it keeps the MinHash signatures of recent spam messages,
+// and a message sharing most of its signature with one of them is a near duplicate
+package fingerprint
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// size is the number of hash functions, every one adds 4 bytes to a signature and 1/size to the precision
+	size = 64
+	// shingle is the length in runes of the overlapping pieces of the text that are compared
+	shingle = 4
+	// minWords keeps short texts out, their signatures match by coincidence
+	minWords = 5
+)
+
+// Signature estimates the share of the pieces two texts have in common, see Similarity
+type Signature [size]uint32
+
+// Of returns the signature of the text. Case, punctuation, emoji and invisible characters are ignored,
+// ok is false when the text has too few words to be told apart from others.
+func Of(text string) (sig Signature, ok bool) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) < minWords {
+		return sig, false
+	}
+	runes := []rune(strings.Join(words, " "))
+	for i := range sig {
+		sig[i] = ^uint32(0)
+	}
+	for i := 0; i+shingle <= len(runes); i++ {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(string(runes[i : i+shingle])))
+		piece := h.Sum64()
+		for j := range sig {
+			// the hash functions differ in the constant added to the piece
+			if v := uint32(mix(piece+uint64(j)*0x9e3779b97f4a7c15) >> 32); v < sig[j] {
+				sig[j] = v
+			}
+		}
+	}
+	return sig, true
+}
+
+// Similarity is the share of the hash functions with the same minimum, it estimates the Jaccard index of the pieces
+func Similarity(a, b Signature) float64 {
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / size
+}
+
+// Bytes encodes the signature for the database
+func (s Signature) Bytes() []byte {
+	res := make([]byte, 0, size*4)
+	for _, v := range s {
+		res = binary.BigEndian.AppendUint32(res, v)
+	}
+	return res
+}
+
+// Parse decodes a signature stored by Bytes
+func Parse(b []byte) (Signature, error) {
+	var sig Signature
+	if len(b) != size*4 {
+		return sig, errors.Errorf("signature of %d bytes, want %d", len(b), size*4)
+	}
+	for i := range sig {
+		sig[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	return sig, nil
+}
+
+// mix spreads the bits of the hash of a short piece over the whole word, the splitmix64 finalizer
+func mix(v uint64) uint64 {
+	v ^= v >> 30
+	v *= 0xbf58476d1ce4e5b9
+	v ^= v >> 27
+	v *= 0x94d049bb133111eb
+	v ^= v >> 31
+	return v
+}
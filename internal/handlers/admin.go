@@ -3,30 +3,58 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
 
 	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/iamwavecut/tool"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iamwavecut/ngbot/internal/audit"
 	"github.com/iamwavecut/ngbot/internal/bot"
 	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/event"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
 	"github.com/iamwavecut/ngbot/internal/i18n"
+	"github.com/iamwavecut/ngbot/internal/links"
+	"github.com/iamwavecut/ngbot/internal/lists"
+	"github.com/iamwavecut/ngbot/internal/media"
+	"github.com/iamwavecut/ngbot/internal/privacy"
+)
+
+const (
+	historyLimit = 20
+	// maxMessageLength is the limit of Telegram on the text of a message, in UTF-16 code units
+	maxMessageLength = 4096
 )
 
 type Admin struct {
 	s         bot.Service
+	lists     *lists.Lists
+	spam      *fingerprint.Index
 	languages []string
+
+	appealsMutex sync.Mutex
+	appeals      map[appealKey]time.Time
 }
 
-func NewAdmin(s bot.Service) *Admin {
+func NewAdmin(s bot.Service, lists *lists.Lists, spam *fingerprint.Index) *Admin {
 	entry := log.WithField("object", "Admin").WithField("method", "NewAdmin")
 	entry.Debug("creating new admin handler")
 
 	a := &Admin{
 		s:         s,
+		lists:     lists,
+		spam:      spam,
 		languages: i18n.GetLanguagesList(),
+		appeals:   map[appealKey]time.Time{},
 	}
 
 	return a
@@ -43,6 +71,11 @@ func (a *Admin) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user
 
 	b := a.s.GetBot()
 
+	if u.CallbackQuery != nil && isAppealCallback(u.CallbackQuery.Data) {
+		entry.Debug("processing appeal callback")
+		return false, a.handleAppealCallback(ctx, u.CallbackQuery)
+	}
+
 	switch {
 	case
 		u.Message == nil,
@@ -55,6 +88,19 @@ func (a *Admin) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user
 
 	entry.Debugf("processing command: %s", m.Command())
 
+	// operator commands work in any chat, the private one with the bot included
+	switch m.Command() {
+	case "blocklist", "allowlist":
+		if !config.Get().IsOperator(user.ID) || a.lists == nil {
+			break
+		}
+		list := db.ListBlock
+		if m.Command() == "allowlist" {
+			list = db.ListAllow
+		}
+		return false, a.editList(ctx, chat, user, m, list)
+	}
+
 	chatMember, err := b.GetChatMember(api.GetChatMemberConfig{
 		ChatConfigWithUser: api.ChatConfigWithUser{
 			UserID: user.ID,
@@ -76,13 +122,16 @@ func (a *Admin) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user
 	}
 	entry.Debugf("user is admin: %v", isAdmin)
 
-	settings, err := a.s.GetDB().GetSettings(chat.ID)
+	settings, err := a.s.GetSettings(chat.ID)
 	if tool.Try(err) {
 		if errors.Cause(err) != sql.ErrNoRows {
 			entry.WithError(err).Error("can't get chat settings")
 			return true, errors.WithMessage(err, "cant get chat settings")
 		}
 	}
+	if settings == nil {
+		settings = &db.Settings{ID: chat.ID, Enabled: true}
+	}
 	if settings.Language == "" {
 		settings.Language = config.Get().DefaultLanguage
 	}
@@ -119,7 +168,7 @@ func (a *Admin) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user
 		}
 
 		settings.Language = argument
-		err = a.s.GetDB().SetSettings(settings)
+		err = a.s.SetSettings(settings)
 		if tool.Try(err) {
 			entry.WithError(err).Error("can't update chat language")
 			return false, errors.WithMessage(err, "cant update chat language")
@@ -133,6 +182,70 @@ func (a *Admin) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user
 
 		return false, nil
 
+	case "logchannel":
+		entry = entry.WithField("command", "logchannel")
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.setLogChannel(chat, user, settings, m.CommandArguments())
+
+	case "privacy":
+		entry = entry.WithField("command", "privacy")
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.setPrivacy(chat, settings, m.CommandArguments())
+
+	case "links":
+		entry = entry.WithField("command", "links")
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.setLinkPolicy(chat, settings, m.CommandArguments())
+
+	case "vision":
+		entry = entry.WithField("command", "vision")
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.setVision(chat, settings, m.CommandArguments())
+
+	case "history":
+		entry = entry.WithField("command", "history")
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.showHistory(chat, settings, m.CommandArguments())
+
+	case "federation":
+		entry = entry.WithField("command", "federation")
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.federation(chat, user, settings, m)
+
+	case "spam":
+		entry = entry.WithField("command", "spam")
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.confirmSpam(ctx, chat, user, settings, m)
+
+	case "unban", "pardon":
+		entry = entry.WithField("command", m.Command())
+		if !isAdmin {
+			entry.Debug("user is not admin, ignoring command")
+			break
+		}
+		return false, a.liftBan(ctx, chat, user, settings, m, m.Command() == "pardon")
+
 	case "start":
 		entry.Debug("start command received")
 
@@ -143,6 +256,419 @@ func (a *Admin) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user
 	return true, nil
 }
 
+func (a *Admin) setLogChannel(chat *api.Chat, admin *api.User, settings *db.Settings, argument string) error {
+	entry := a.getLogEntry().WithField("method", "setLogChannel")
+	b := a.s.GetBot()
+	argument = strings.TrimSpace(argument)
+
+	switch argument {
+	case "":
+		text := i18n.Get("Log channel is not set", settings.Language)
+		if settings.LogChannelID != 0 {
+			text = fmt.Sprintf(i18n.Get("Log channel is %d", settings.Language), settings.LogChannelID)
+		}
+		_, _ = b.Send(api.NewMessage(chat.ID, text))
+		return nil
+	case "off":
+		settings.LogChannelID = 0
+	default:
+		channelID, err := strconv.ParseInt(argument, 10, 64)
+		if err != nil {
+			_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Usage: /logchannel <channel id> or /logchannel off", settings.Language)))
+			return nil
+		}
+		if !isChannelAdmin(a.s, channelID, admin.ID) {
+			_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("You must be an admin of this channel", settings.Language)))
+			return nil
+		}
+		probe := api.NewMessage(channelID, fmt.Sprintf(i18n.Get("Moderation log for \"%s\" is connected", settings.Language), chat.Title))
+		probe.DisableNotification = true
+		if _, err := b.Send(probe); err != nil {
+			entry.WithError(err).Warn("cant post to log channel")
+			_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("I can't post to this channel, make sure I'm an admin there", settings.Language)))
+			return nil
+		}
+		settings.LogChannelID = channelID
+	}
+
+	if err := a.s.SetSettings(settings); err != nil {
+		return errors.WithMessage(err, "cant update log channel")
+	}
+	_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Log channel updated", settings.Language)))
+	return nil
+}
+
+func (a *Admin) setPrivacy(chat *api.Chat, settings *db.Settings, argument string) error {
+	b := a.s.GetBot()
+	argument = strings.TrimSpace(argument)
+
+	if argument == "" {
+		policy := a.s.GetPrivacy(chat.ID)
+		_, _ = b.Send(api.NewMessage(chat.ID, fmt.Sprintf(i18n.Get("Privacy mode is %s", settings.Language), policy.Mode)))
+		return nil
+	}
+	if argument == "default" {
+		argument = string(privacy.ModeInherit)
+	}
+	mode, ok := privacy.ParseMode(argument)
+	if !ok {
+		modes := make([]string, 0, 4)
+		for _, m := range privacy.Modes() {
+			modes = append(modes, string(m))
+		}
+		modes = append(modes, "default")
+		msg := api.NewMessage(
+			chat.ID,
+			i18n.Get("You should use one of the following options", settings.Language)+": `"+strings.Join(modes, "`, `")+"`",
+		)
+		msg.ParseMode = api.ModeMarkdown
+		_, _ = b.Send(msg)
+		return nil
+	}
+
+	settings.Privacy = string(mode)
+	if err := a.s.SetSettings(settings); err != nil {
+		return errors.WithMessage(err, "cant update privacy mode")
+	}
+	// the deployment mode may be stricter than the requested one
+	policy := a.s.GetPrivacy(chat.ID)
+	_, _ = b.Send(api.NewMessage(chat.ID, fmt.Sprintf(i18n.Get("Privacy mode is %s", settings.Language), policy.Mode)))
+	return nil
+}
+
+// setVision turns the spam checks of photos by the vision model on or off: /vision [on | off]
+func (a *Admin) setVision(chat *api.Chat, settings *db.Settings, argument string) error {
+	b := a.s.GetBot()
+	switch strings.TrimSpace(argument) {
+	case "":
+	case "on", "off":
+		settings.Vision = strings.TrimSpace(argument) == "on"
+		if err := a.s.SetSettings(settings); err != nil {
+			return errors.WithMessage(err, "cant update image checks")
+		}
+	default:
+		_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Usage: /vision on or /vision off", settings.Language)))
+		return nil
+	}
+
+	text := i18n.Get("Image checks are off", settings.Language)
+	if settings.Vision {
+		text = i18n.Get("Image checks are on", settings.Language)
+		if !a.s.GetPrivacy(chat.ID).RemoteLLM {
+			text += ". " + i18n.Get("The privacy mode keeps the images from the LLM", settings.Language)
+		}
+	}
+	_, _ = b.Send(api.NewMessage(chat.ID, text))
+	return nil
+}
+
+// confirmSpam deletes the replied message, bans its author and fingerprints the text,
+// so that the variations of the message are banned in every chat without the LLM: /spam as a reply
+func (a *Admin) confirmSpam(ctx context.Context, chat *api.Chat, admin *api.User, settings *db.Settings, m *api.Message) error {
+	entry := a.getLogEntry().WithField("method", "confirmSpam")
+	b := a.s.GetBot()
+	target := m.ReplyToMessage
+	if target == nil || target.From == nil || target.From.ID == b.Self.ID {
+		_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Usage: reply to the spam message with /spam", settings.Language)))
+		return nil
+	}
+	spammer := target.From
+	if isChatAdmin(a.s, chat.ID, spammer.ID) {
+		_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Admins can't be banned as spammers", settings.Language)))
+		return nil
+	}
+	entry = entry.WithFields(log.Fields{"chat_id": chat.ID, "user_id": spammer.ID})
+	content := media.Describe(target, config.Get().ImageLimit).Text
+
+	a.s.GetBus().Publish(event.SpamDetected{
+		ChatID:    chat.ID,
+		UserID:    spammer.ID,
+		UserName:  bot.GetUN(spammer),
+		MessageID: target.MessageID,
+		Source:    event.SourceAdmin,
+		Verdict:   "confirmed by admin",
+		Content:   content,
+	})
+	if err := bot.DeleteChatMessage(b, chat.ID, target.MessageID); err != nil {
+		entry.WithError(err).Warn("cant delete spam message")
+	} else {
+		a.s.GetBus().Publish(event.MessageDeleted{
+			ChatID:    chat.ID,
+			UserID:    spammer.ID,
+			UserName:  bot.GetUN(spammer),
+			MessageID: target.MessageID,
+			Source:    event.SourceAdmin,
+			Reason:    "confirmed spam",
+			Content:   content,
+		})
+	}
+	if err := a.s.DeleteMember(ctx, chat.ID, spammer.ID); err != nil {
+		entry.WithError(err).Warn("cant revoke trust")
+	}
+	if err := bot.BanUserFromChat(b, spammer.ID, chat.ID); err != nil {
+		entry.WithError(err).Warn("cant ban spammer")
+		_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("I can't ban this user, check my permissions", settings.Language)))
+		return nil
+	}
+	a.s.GetBus().Publish(event.UserBanned{
+		ChatID:   chat.ID,
+		UserID:   spammer.ID,
+		UserName: bot.GetUN(spammer),
+		ActorID:  admin.ID,
+		Source:   event.SourceAdmin,
+		Reason:   "confirmed spam",
+	})
+
+	text := i18n.Get("Spammer is banned", settings.Language)
+	if a.spam != nil {
+		added, err := a.rememberSpam(chat.ID, spammer.ID, content)
+		if err != nil {
+			entry.WithError(err).Warn("cant remember spam fingerprint")
+		}
+		if added {
+			text = i18n.Get("Spammer is banned, the variations of the message will be banned too", settings.Language)
+		}
+	}
+	_, _ = b.Send(api.NewMessage(chat.ID, text))
+	return nil
+}
+
+// setLinkPolicy edits the link policy: /links [mode <mode> | allow <domains> | deny <domains> | remove <domains>]
+func (a *Admin) setLinkPolicy(chat *api.Chat, settings *db.Settings, arguments string) error {
+	b := a.s.GetBot()
+	stored, err := a.s.GetDB().GetLinkPolicy(chat.ID)
+	if err != nil {
+		return errors.WithMessage(err, "cant get link policy")
+	}
+	policy := links.FromDB(chat.ID, stored)
+
+	fields := strings.Fields(arguments)
+	if len(fields) == 0 {
+		none := i18n.Get("none", settings.Language)
+		allowed, denied := strings.Join(policy.Allowed, " "), strings.Join(policy.Denied, " ")
+		if allowed == "" {
+			allowed = none
+		}
+		if denied == "" {
+			denied = none
+		}
+		text := fmt.Sprintf(i18n.Get("Link policy: %s\nAllowed domains: %s\nDenied domains: %s", settings.Language), policy.Mode, allowed, denied)
+		_, _ = b.Send(api.NewMessage(chat.ID, text))
+		return nil
+	}
+
+	var domains []string
+	for _, d := range fields[1:] {
+		if domain := links.NormalizeDomain(d); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	without := func(list []string) []string {
+		return slices.DeleteFunc(list, func(d string) bool { return slices.Contains(domains, d) })
+	}
+	switch {
+	case fields[0] == "mode" && len(fields) == 2 && slices.Contains(links.Modes(), fields[1]):
+		policy.Mode = fields[1]
+	case fields[0] == "allow" && len(domains) > 0:
+		policy.Denied = without(policy.Denied)
+		policy.Allowed = append(without(policy.Allowed), domains...)
+	case fields[0] == "deny" && len(domains) > 0:
+		policy.Allowed = without(policy.Allowed)
+		policy.Denied = append(without(policy.Denied), domains...)
+	case fields[0] == "remove" && len(domains) > 0:
+		policy.Allowed = without(policy.Allowed)
+		policy.Denied = without(policy.Denied)
+	default:
+		msg := api.NewMessage(chat.ID, i18n.Get("Usage: /links mode <off|untrusted|all>, /links allow <domains>, /links deny <domains> or /links remove <domains>", settings.Language))
+		_, _ = b.Send(msg)
+		return nil
+	}
+
+	if err := a.s.GetDB().SetLinkPolicy(policy.ToDB()); err != nil {
+		return errors.WithMessage(err, "cant update link policy")
+	}
+	_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Link policy updated", settings.Language)))
+	return nil
+}
+
+func (a *Admin) showHistory(chat *api.Chat, settings *db.Settings, arguments string) error {
+	b := a.s.GetBot()
+	filter := db.ActionFilter{
+		ChatID: chat.ID,
+		Limit:  historyLimit,
+	}
+	for _, arg := range strings.Fields(arguments) {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			filter.TargetName = strings.TrimPrefix(arg, "@")
+		case isNumeric(arg):
+			filter.TargetID, _ = strconv.ParseInt(arg, 10, 64)
+		default:
+			window, err := parseWindow(arg)
+			if err != nil {
+				_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Usage: /history [user id or @username] [time window, e.g. 24h or 7d]", settings.Language)))
+				return nil
+			}
+			filter.Since = time.Now().Add(-window)
+		}
+	}
+
+	actions, err := a.s.GetDB().GetActions(filter)
+	if err != nil {
+		return errors.WithMessage(err, "cant get actions")
+	}
+	if len(actions) == 0 {
+		_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("No moderation actions found", settings.Language)))
+		return nil
+	}
+
+	// the records are split over as many messages as the length limit needs
+	var pages []string
+	var page strings.Builder
+	for _, action := range actions {
+		record := audit.Format(action)
+		if page.Len() > 0 && len(utf16.Encode([]rune(page.String()+"\n\n"+record))) > maxMessageLength {
+			pages = append(pages, page.String())
+			page.Reset()
+		}
+		if page.Len() > 0 {
+			page.WriteString("\n\n")
+		}
+		page.WriteString(record)
+	}
+	pages = append(pages, page.String())
+
+	for _, text := range pages {
+		msg := api.NewMessage(chat.ID, text)
+		msg.ParseMode = api.ModeHTML
+		msg.DisableNotification = true
+		if _, err := b.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Admin) liftBan(ctx context.Context, chat *api.Chat, admin *api.User, settings *db.Settings, m *api.Message, pardon bool) error {
+	entry := a.getLogEntry().WithFields(log.Fields{"method": "liftBan", "pardon": pardon})
+	b := a.s.GetBot()
+
+	targetID, targetName, err := a.resolveTarget(chat.ID, m)
+	if err != nil {
+		entry.WithError(err).Debug("cant resolve target")
+		_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("Usage: reply to a message or pass user id or @username", settings.Language)))
+		return nil
+	}
+
+	if err := a.unban(ctx, chat.ID, targetID, targetName, admin.ID, pardon, "manual"); err != nil {
+		entry.WithError(err).Warn("cant lift ban")
+		_, _ = b.Send(api.NewMessage(chat.ID, i18n.Get("I can't unban this user, check my permissions", settings.Language)))
+		return nil
+	}
+
+	text := i18n.Get("User is unbanned", settings.Language)
+	if pardon {
+		text = i18n.Get("User is pardoned and trusted now", settings.Language)
+	}
+	_, _ = b.Send(api.NewMessage(chat.ID, text))
+	return nil
+}
+
+// rememberSpam fingerprints spam confirmed by an admin. The admin decides for the chat or its trust group,
+// not for the other chats of the bot.
+func (a *Admin) rememberSpam(chatID, userID int64, content string) (bool, error) {
+	scope, err := fingerprint.Scope(a.s.GetDB(), chatID)
+	if err != nil {
+		return false, err
+	}
+	fp := &db.SpamFingerprint{Scope: scope, ChatID: chatID, UserID: userID, Source: event.SourceAdmin}
+	return a.spam.Add(content, fp, config.Get().SpamIndex)
+}
+
+// forgetSpam drops the fingerprints of the messages of the user found in the chat or added for its trust group
+func (a *Admin) forgetSpam(chatID, userID int64) error {
+	scope, err := fingerprint.Scope(a.s.GetDB(), chatID)
+	if err != nil {
+		return err
+	}
+	_, err = a.spam.Forget(chatID, userID, scope)
+	return err
+}
+
+// unban lifts the ban and, for a pardon, marks the user as a trusted member
+func (a *Admin) unban(ctx context.Context, chatID, userID int64, userName string, actorID int64, pardon bool, reason string) error {
+	if err := bot.UnbanUserFromChat(a.s.GetBot(), userID, chatID); err != nil {
+		return err
+	}
+	if pardon {
+		if err := a.s.InsertMember(ctx, chatID, userID); err != nil {
+			return errors.WithMessage(err, "cant mark user trusted")
+		}
+		// the messages of a pardoned user were no spam here, their variations must not be banned
+		if a.spam != nil {
+			if err := a.forgetSpam(chatID, userID); err != nil {
+				a.getLogEntry().WithField("method", "unban").WithError(err).Warn("cant forget spam fingerprints")
+			}
+		}
+	}
+	a.s.GetBus().Publish(event.UserUnbanned{
+		ChatID:   chatID,
+		UserID:   userID,
+		UserName: userName,
+		ActorID:  actorID,
+		Source:   event.SourceAdmin,
+		Reason:   reason,
+		Pardoned: pardon,
+	})
+	return nil
+}
+
+func (a *Admin) resolveTarget(chatID int64, m *api.Message) (int64, string, error) {
+	if m.ReplyToMessage != nil && m.ReplyToMessage.From != nil {
+		return m.ReplyToMessage.From.ID, bot.GetUN(m.ReplyToMessage.From), nil
+	}
+	argument := strings.TrimSpace(m.CommandArguments())
+	if userID, err := strconv.ParseInt(argument, 10, 64); err == nil {
+		return userID, "", nil
+	}
+	if name, ok := strings.CutPrefix(argument, "@"); ok && name != "" {
+		actions, err := a.s.GetDB().GetActions(db.ActionFilter{
+			ChatID:     chatID,
+			TargetName: name,
+			Limit:      1,
+		})
+		if err != nil {
+			return 0, "", err
+		}
+		if len(actions) == 0 {
+			return 0, "", errors.Errorf("no records for @%s", name)
+		}
+		return actions[0].TargetID, name, nil
+	}
+	return 0, "", errors.New("no target")
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 64)
+	return err == nil
+}
+
+// parseWindow understands Go durations plus a "d" suffix for days
+func parseWindow(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.Errorf("invalid window %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid window %q", s)
+	}
+	return d, nil
+}
+
 func (a *Admin) getLogEntry() *log.Entry {
 	return log.WithField("context", "admin")
 }
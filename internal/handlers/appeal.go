@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/i18n"
+)
+
+const (
+	appealPrefix        = "appeal"
+	appealApprovePrefix = "appeal_ok"
+	appealDenyPrefix    = "appeal_no"
+
+	appealCooldown = time.Hour
+)
+
+type appealKey struct {
+	chatID int64
+	userID int64
+}
+
+func isAppealCallback(data string) bool {
+	return strings.HasPrefix(data, appealPrefix+";") ||
+		strings.HasPrefix(data, appealApprovePrefix+";") ||
+		strings.HasPrefix(data, appealDenyPrefix+";")
+}
+
+// NewAppealKeyboard is attached to the private message a rejected joiner receives
+func NewAppealKeyboard(chatID int64, lang string) api.InlineKeyboardMarkup {
+	return api.NewInlineKeyboardMarkup(api.NewInlineKeyboardRow(
+		api.NewInlineKeyboardButtonData(i18n.Get("Appeal", lang), fmt.Sprintf("%s;%d", appealPrefix, chatID)),
+	))
+}
+
+func (a *Admin) handleAppealCallback(ctx context.Context, cq *api.CallbackQuery) error {
+	entry := a.getLogEntry().WithFields(log.Fields{"method": "handleAppealCallback", "data": cq.Data})
+	parts := strings.Split(cq.Data, ";")
+	ids := make([]int64, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			entry.WithError(err).Warn("invalid appeal callback data")
+			return nil
+		}
+		ids = append(ids, id)
+	}
+
+	switch {
+	case parts[0] == appealPrefix && len(ids) == 1:
+		return a.submitAppeal(cq, ids[0])
+	case parts[0] == appealApprovePrefix && len(ids) == 2:
+		return a.resolveAppeal(ctx, cq, ids[0], ids[1], true)
+	case parts[0] == appealDenyPrefix && len(ids) == 2:
+		return a.resolveAppeal(ctx, cq, ids[0], ids[1], false)
+	}
+	entry.Warn("unknown appeal callback")
+	return nil
+}
+
+func (a *Admin) submitAppeal(cq *api.CallbackQuery, chatID int64) error {
+	entry := a.getLogEntry().WithFields(log.Fields{"method": "submitAppeal", "chat_id": chatID, "user_id": cq.From.ID})
+	b := a.s.GetBot()
+	lang := a.getUserLanguage(cq.From)
+	key := appealKey{chatID: chatID, userID: cq.From.ID}
+
+	a.appealsMutex.Lock()
+	// the appeals past the cooldown are forgotten, those never resolved included
+	for k, submitted := range a.appeals {
+		if time.Since(submitted) >= appealCooldown {
+			delete(a.appeals, k)
+		}
+	}
+	if _, ok := a.appeals[key]; ok {
+		a.appealsMutex.Unlock()
+		_, _ = b.Request(api.NewCallback(cq.ID, i18n.Get("Your appeal is already being reviewed", lang)))
+		return nil
+	}
+	a.appeals[key] = time.Now()
+	a.appealsMutex.Unlock()
+
+	chat, err := b.GetChat(api.ChatInfoConfig{ChatConfig: api.ChatConfig{ChatID: chatID}})
+	if err != nil {
+		return errors.WithMessage(err, "cant get appealed chat")
+	}
+
+	text := fmt.Sprintf(
+		"📨 <a href=\"tg://user?id=%d\">%s</a> (<code>%d</code>) appeals the rejection in <b>%s</b>",
+		cq.From.ID,
+		api.EscapeText(api.ModeHTML, bot.GetFullName(cq.From)),
+		cq.From.ID,
+		api.EscapeText(api.ModeHTML, chat.Title),
+	)
+	kb := api.NewInlineKeyboardMarkup(api.NewInlineKeyboardRow(
+		api.NewInlineKeyboardButtonData("✅ Approve", fmt.Sprintf("%s;%d;%d", appealApprovePrefix, chatID, cq.From.ID)),
+		api.NewInlineKeyboardButtonData("❌ Deny", fmt.Sprintf("%s;%d;%d", appealDenyPrefix, chatID, cq.From.ID)),
+	))
+
+	delivered := 0
+	for _, recipient := range a.appealRecipients(chatID) {
+		msg := api.NewMessage(recipient, text)
+		msg.ParseMode = api.ModeHTML
+		msg.ReplyMarkup = kb
+		if _, err := b.Send(msg); err != nil {
+			entry.WithError(err).WithField("recipient", recipient).Debug("cant deliver appeal")
+			continue
+		}
+		delivered++
+	}
+
+	if delivered == 0 {
+		a.appealsMutex.Lock()
+		delete(a.appeals, key)
+		a.appealsMutex.Unlock()
+		_, _ = b.Request(api.NewCallbackWithAlert(cq.ID, i18n.Get("I couldn't reach the admins, please try again later", lang)))
+		return nil
+	}
+
+	entry.WithField("recipients", delivered).Info("appeal submitted")
+	_, _ = b.Request(api.NewCallback(cq.ID, i18n.Get("Your appeal has been sent to the admins", lang)))
+	if cq.Message != nil {
+		_, _ = b.Request(api.NewEditMessageReplyMarkup(cq.Message.Chat.ID, cq.Message.MessageID, api.InlineKeyboardMarkup{
+			InlineKeyboard: [][]api.InlineKeyboardButton{},
+		}))
+	}
+	return nil
+}
+
+func (a *Admin) resolveAppeal(ctx context.Context, cq *api.CallbackQuery, chatID, userID int64, approve bool) error {
+	entry := a.getLogEntry().WithFields(log.Fields{
+		"method":  "resolveAppeal",
+		"chat_id": chatID,
+		"user_id": userID,
+		"approve": approve,
+	})
+	b := a.s.GetBot()
+	lang := a.getUserLanguage(cq.From)
+
+	if !isChatAdmin(a.s, chatID, cq.From.ID) {
+		_, _ = b.Request(api.NewCallback(cq.ID, i18n.Get("Only chat admins can decide on appeals", lang)))
+		return nil
+	}
+
+	a.appealsMutex.Lock()
+	delete(a.appeals, appealKey{chatID: chatID, userID: userID})
+	a.appealsMutex.Unlock()
+
+	settings, _ := a.s.GetSettings(chatID)
+	userLang := config.Get().DefaultLanguage
+	if settings != nil && settings.Language != "" {
+		userLang = settings.Language
+	}
+
+	result := "❌ denied"
+	notice := i18n.Get("Your appeal was denied", userLang)
+	if approve {
+		if err := a.unban(ctx, chatID, userID, "", cq.From.ID, true, "appeal approved"); err != nil {
+			entry.WithError(err).Warn("cant lift ban on appeal")
+			_, _ = b.Request(api.NewCallbackWithAlert(cq.ID, i18n.Get("I can't unban this user, check my permissions", lang)))
+			return nil
+		}
+		result = "✅ approved"
+		notice = i18n.Get("Your appeal was approved, you can join the chat again", userLang)
+	}
+	entry.Info("appeal resolved")
+
+	if _, err := b.Send(api.NewMessage(userID, notice)); err != nil {
+		entry.WithError(err).Debug("cant notify appellant")
+	}
+	_, _ = b.Request(api.NewCallback(cq.ID, result))
+	if cq.Message != nil {
+		edit := api.NewEditMessageText(
+			cq.Message.Chat.ID,
+			cq.Message.MessageID,
+			fmt.Sprintf("%s\n%s by %s", cq.Message.Text, result, bot.GetUN(cq.From)),
+		)
+		_, _ = b.Request(edit)
+	}
+	return nil
+}
+
+// appealRecipients returns the chat's log channel, or every human admin when there is none
+func (a *Admin) appealRecipients(chatID int64) []int64 {
+	if settings, err := a.s.GetSettings(chatID); err == nil && settings != nil && settings.LogChannelID != 0 {
+		return []int64{settings.LogChannelID}
+	}
+	return chatAdmins(a.s, chatID)
+}
+
+// chatAdmins returns the human admins who can restrict members
+func chatAdmins(s bot.Service, chatID int64) []int64 {
+	admins, err := s.GetBot().GetChatAdministrators(api.ChatAdministratorsConfig{
+		ChatConfig: api.ChatConfig{ChatID: chatID},
+	})
+	if err != nil {
+		log.WithField("context", "admin").WithError(err).Warn("cant get chat administrators")
+		return nil
+	}
+	var recipients []int64
+	for _, admin := range admins {
+		if admin.User == nil || admin.User.IsBot {
+			continue
+		}
+		if admin.IsCreator() || admin.CanRestrictMembers {
+			recipients = append(recipients, admin.User.ID)
+		}
+	}
+	return recipients
+}
+
+func isChatAdmin(s bot.Service, chatID, userID int64) bool {
+	chatMember, err := s.GetBot().GetChatMember(api.GetChatMemberConfig{
+		ChatConfigWithUser: api.ChatConfigWithUser{
+			ChatConfig: api.ChatConfig{ChatID: chatID},
+			UserID:     userID,
+		},
+	})
+	if err != nil {
+		return false
+	}
+	return chatMember.IsCreator() || chatMember.IsAdministrator() && chatMember.CanRestrictMembers
+}
+
+// isChannelAdmin reports whether the user may post to the channel, so the moderation log can't be sent to a channel of someone else
+func isChannelAdmin(s bot.Service, channelID, userID int64) bool {
+	chatMember, err := s.GetBot().GetChatMember(api.GetChatMemberConfig{
+		ChatConfigWithUser: api.ChatConfigWithUser{
+			ChatConfig: api.ChatConfig{ChatID: channelID},
+			UserID:     userID,
+		},
+	})
+	if err != nil {
+		return false
+	}
+	return chatMember.IsCreator() || chatMember.IsAdministrator() && chatMember.CanPostMessages
+}
+
+func (a *Admin) getUserLanguage(user *api.User) string {
+	for _, lang := range a.languages {
+		if user != nil && lang == user.LanguageCode {
+			return lang
+		}
+	}
+	return config.Get().DefaultLanguage
+}
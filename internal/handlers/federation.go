@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/federation"
+	"github.com/iamwavecut/ngbot/internal/i18n"
+)
+
+var trustGroupName = regexp.MustCompile(`^[a-z0-9_-]{3,32}$`)
+
+// federation manages the trust group of the chat: /federation [create <name> | join <code> | leave | code | action <action> | user <id>]
+func (a *Admin) federation(chat *api.Chat, admin *api.User, settings *db.Settings, m *api.Message) error {
+	b := a.s.GetBot()
+	client := a.s.GetDB()
+	lang := settings.Language
+	subcommand, argument, _ := strings.Cut(strings.TrimSpace(m.CommandArguments()), " ")
+	argument = strings.TrimSpace(argument)
+
+	member, err := client.GetTrustMember(chat.ID)
+	if err != nil {
+		return errors.WithMessage(err, "cant get trust member")
+	}
+	reply := func(text string) {
+		_, _ = b.Send(api.NewMessage(chat.ID, text))
+	}
+	usage := func() {
+		reply(i18n.Get("Usage: /federation create <name>, join <code>, leave, code, action <pre_ban|challenge|watch> or user <id>", lang))
+	}
+
+	switch subcommand {
+	case "":
+		if member == nil {
+			reply(i18n.Get("This chat is not in a trust group", lang))
+			return nil
+		}
+		members, err := client.GetTrustMembers(member.Group)
+		if err != nil {
+			return errors.WithMessage(err, "cant get trust members")
+		}
+		reply(fmt.Sprintf(i18n.Get("Trust group %s, %d chats, spam decisions of the group: %s", lang), member.Group, len(members), member.Action))
+
+	case "create":
+		name := strings.ToLower(argument)
+		if !trustGroupName.MatchString(name) {
+			reply(i18n.Get("Trust group names are 3 to 32 latin letters, digits, dashes or underscores", lang))
+			return nil
+		}
+		if member != nil {
+			reply(i18n.Get("Leave the current trust group first", lang))
+			return nil
+		}
+		existing, err := client.GetTrustGroup(name)
+		if err != nil {
+			return errors.WithMessage(err, "cant get trust group")
+		}
+		if existing != nil {
+			reply(i18n.Get("This trust group name is taken", lang))
+			return nil
+		}
+		secret := make([]byte, 8)
+		if _, err := rand.Read(secret); err != nil {
+			return errors.WithMessage(err, "cant generate join code")
+		}
+		group := &db.TrustGroup{Name: name, Code: name + ":" + hex.EncodeToString(secret), OwnerChatID: chat.ID}
+		if err := client.CreateTrustGroup(group); err != nil {
+			return errors.WithMessage(err, "cant create trust group")
+		}
+		if err := client.SetTrustMember(&db.TrustMember{ChatID: chat.ID, Group: name, Action: federation.ActionChallenge}); err != nil {
+			return errors.WithMessage(err, "cant join trust group")
+		}
+		a.getLogEntry().WithFields(log.Fields{"method": "federation", "chat_id": chat.ID, "group": name}).Info("trust group created")
+		if a.sendJoinCode(admin, group, lang) {
+			reply(fmt.Sprintf(i18n.Get("Trust group %s is created, I sent you the join code in private", lang), name))
+		} else {
+			reply(fmt.Sprintf(i18n.Get("Trust group %s is created. Start a private chat with me and send /federation code here to get the join code", lang), name))
+		}
+
+	case "code":
+		if member == nil {
+			reply(i18n.Get("This chat is not in a trust group", lang))
+			return nil
+		}
+		group, err := client.GetTrustGroup(member.Group)
+		if err != nil || group == nil {
+			return errors.WithMessage(err, "cant get trust group")
+		}
+		if !a.sendJoinCode(admin, group, lang) {
+			reply(i18n.Get("Start a private chat with me first", lang))
+		}
+
+	case "join":
+		// the code is a secret, it should not stay in the chat history
+		_ = bot.DeleteChatMessage(b, chat.ID, m.MessageID)
+		name, _, _ := strings.Cut(argument, ":")
+		group, err := client.GetTrustGroup(name)
+		if err != nil {
+			return errors.WithMessage(err, "cant get trust group")
+		}
+		if group == nil || subtle.ConstantTimeCompare([]byte(group.Code), []byte(argument)) != 1 {
+			reply(i18n.Get("The join code is not valid", lang))
+			return nil
+		}
+		action := federation.ActionChallenge
+		if member != nil && member.Group == group.Name {
+			action = member.Action
+		}
+		if err := client.SetTrustMember(&db.TrustMember{ChatID: chat.ID, Group: group.Name, Action: action}); err != nil {
+			return errors.WithMessage(err, "cant join trust group")
+		}
+		a.getLogEntry().WithFields(log.Fields{"method": "federation", "chat_id": chat.ID, "group": group.Name}).Info("chat joined trust group")
+		reply(fmt.Sprintf(i18n.Get("Joined trust group %s", lang), group.Name))
+
+	case "leave":
+		if member == nil {
+			reply(i18n.Get("This chat is not in a trust group", lang))
+			return nil
+		}
+		if err := client.DeleteTrustMember(chat.ID); err != nil {
+			return errors.WithMessage(err, "cant leave trust group")
+		}
+		reply(fmt.Sprintf(i18n.Get("Left trust group %s", lang), member.Group))
+
+	case "action":
+		if member == nil {
+			reply(i18n.Get("This chat is not in a trust group", lang))
+			return nil
+		}
+		if !federation.IsAction(argument) {
+			msg := api.NewMessage(
+				chat.ID,
+				i18n.Get("You should use one of the following options", lang)+": `"+strings.Join(federation.Actions(), "`, `")+"`",
+			)
+			msg.ParseMode = api.ModeMarkdown
+			_, _ = b.Send(msg)
+			return nil
+		}
+		member.Action = argument
+		if err := client.SetTrustMember(member); err != nil {
+			return errors.WithMessage(err, "cant update trust group action")
+		}
+		reply(fmt.Sprintf(i18n.Get("Spam decisions of the trust group: %s", lang), member.Action))
+
+	case "user":
+		if member == nil {
+			reply(i18n.Get("This chat is not in a trust group", lang))
+			return nil
+		}
+		userID, err := strconv.ParseInt(argument, 10, 64)
+		if err != nil {
+			usage()
+			return nil
+		}
+		decisions, err := client.GetReputation(member.Group, userID, historyLimit)
+		if err != nil {
+			return errors.WithMessage(err, "cant get reputation")
+		}
+		if len(decisions) == 0 {
+			reply(i18n.Get("The trust group has no decisions on this user", lang))
+			return nil
+		}
+		lines := make([]string, 0, len(decisions))
+		for _, decision := range decisions {
+			match := federation.Match{Group: member.Group, Action: member.Action, Decision: decision}
+			lines = append(lines, "• "+match.Provenance())
+		}
+		reply(strings.Join(lines, "\n"))
+
+	default:
+		usage()
+	}
+	return nil
+}
+
+// sendJoinCode sends the join code to the admin in private, so that members of the chat cannot use it
+func (a *Admin) sendJoinCode(admin *api.User, group *db.TrustGroup, lang string) bool {
+	text := fmt.Sprintf(i18n.Get("Join code of trust group %s, send it to admins of the chats that should join: /federation join %s", lang), group.Name, group.Code)
+	if _, err := a.s.GetBot().Send(api.NewMessage(admin.ID, text)); err != nil {
+		a.getLogEntry().WithError(err).WithField("method", "sendJoinCode").Debug("cant send join code")
+		return false
+	}
+	return true
+}
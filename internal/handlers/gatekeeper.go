@@ -30,12 +30,15 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/iamwavecut/tool"
 
 	"github.com/iamwavecut/ngbot/internal/config"
 	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/event"
+	"github.com/iamwavecut/ngbot/internal/federation"
 	"github.com/iamwavecut/ngbot/resources"
 
 	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -47,13 +50,14 @@ import (
 	"github.com/iamwavecut/ngbot/internal/bot"
 	"github.com/iamwavecut/ngbot/internal/i18n"
 	"github.com/iamwavecut/ngbot/internal/infra"
+	"github.com/iamwavecut/ngbot/internal/plugin"
+	"github.com/iamwavecut/ngbot/internal/risk"
 )
 
 const (
 	captchaSize = 5
-
-	defaultChallengeTimeout = 3 * time.Minute
-	defaultRejectTimeout    = 10 * time.Minute
+	// captchaSizeHard is the number of options of the challenge for risky joiners
+	captchaSizeHard = 8
 
 	updateTypeCallbackQuery   updateType = "callback_query"
 	updateTypeChatJoinRequest updateType = "chat_join_request"
@@ -74,7 +78,11 @@ type challengedUser struct {
 }
 
 type Gatekeeper struct {
-	s          bot.Service
+	s         bot.Service
+	setting   plugin.Setting
+	permitted plugin.Permitted
+	// mutex guards joiners, newcomers, restricted and the challenge message IDs, the challenge timers use them too
+	mutex      sync.Mutex
 	joiners    map[int64]map[int64]*challengedUser
 	newcomers  map[int64]map[int64]struct{}
 	restricted map[int64]map[int64]struct{}
@@ -103,12 +111,14 @@ var privateChallengeKeys = []string{
 	"Hi there, %s! Welcome to the group \"%s\"! We need one more thing from you to confirm that you're human - pick %s. If you can't, we might have to let you go. Thanks for your cooperation!",
 }
 
-func NewGatekeeper(s bot.Service) *Gatekeeper {
+func NewGatekeeper(s bot.Service, setting plugin.Setting, permitted plugin.Permitted) *Gatekeeper {
 	entry := log.WithFields(log.Fields{"object": "Gatekeeper", "method": "NewGatekeeper"})
 	entry.Debug("creating new gatekeeper")
 
 	g := &Gatekeeper{
-		s: s,
+		s:         s,
+		setting:   setting,
+		permitted: permitted,
 
 		joiners:    map[int64]map[int64]*challengedUser{},
 		Variants:   map[string]map[string]string{},
@@ -166,6 +176,10 @@ func (g *Gatekeeper) Handle(ctx context.Context, u *api.Update, chat *api.Chat,
 	case updateTypeCallbackQuery:
 		return false, g.handleChallenge(ctx, u, chat, user)
 	case updateTypeChatJoinRequest:
+		// join requests are left to the admins when the bot cannot approve or decline them
+		if !g.permitted(chat.ID, plugin.PermissionInviteUsers) {
+			return true, nil
+		}
 		return true, g.handleChatJoinRequest(ctx, u)
 	// case updateTypeNewChatMembers:
 	// return true, g.handleNewChatMembers(ctx, u, chat)
@@ -195,12 +209,12 @@ func (g *Gatekeeper) fetchAndValidateSettings(chatID int64) (*db.Settings, error
 	entry.Debug("Entering fetchAndValidateSettings method")
 
 	settings, err := g.s.GetDB().GetSettings(chatID)
-	if err != nil {
+	if err != nil || settings == nil {
 		settings = &db.Settings{
 			Enabled:          true,
-			ChallengeTimeout: defaultChallengeTimeout,
-			RejectTimeout:    defaultRejectTimeout,
-			Language:         "en",
+			ChallengeTimeout: config.Get().ChallengeTimeout,
+			RejectTimeout:    config.Get().RejectTimeout,
+			Language:         config.Get().DefaultLanguage,
 			ID:               chatID,
 		}
 		if err := g.s.GetDB().SetSettings(settings); err != nil {
@@ -329,6 +343,7 @@ func (g *Gatekeeper) handleChallenge(_ context.Context, u *api.Update, chat *api
 			cu.successFunc()
 		}
 		entry.WithFields(log.Fields{"user": bot.GetUN(cu.user), "chatID": cu.targetChat.ID}).Info("Adding user to newcomers list for chat")
+		g.mutex.Lock()
 		if _, ok := g.newcomers[cu.targetChat.ID]; !ok {
 			entry.WithField("chatID", cu.targetChat.ID).Info("Initializing newcomers map for target chat")
 			g.newcomers[cu.targetChat.ID] = map[int64]struct{}{}
@@ -342,21 +357,42 @@ func (g *Gatekeeper) handleChallenge(_ context.Context, u *api.Update, chat *api
 			entry.WithField("chatID", cu.targetChat.ID).Info("Initializing restricted map for target chat")
 			g.restricted[cu.targetChat.ID] = map[int64]struct{}{}
 		}
+		g.mutex.Unlock()
 		entry.WithFields(log.Fields{"user": bot.GetUN(cu.user), "chatID": cu.commChat.ID}).Info("Removing challenged user from chat")
 		g.removeChallengedUser(cu.user.ID, cu.commChat.ID)
+		g.s.GetBus().Publish(event.ChallengePassed{
+			ChatID:   cu.targetChat.ID,
+			UserID:   cu.user.ID,
+			UserName: bot.GetUN(cu.user),
+			ByAdmin:  isAdmin && user.ID != cu.user.ID,
+		})
 
 	case cu.successUUID != challengeUUID:
 		entry.WithField("user", bot.GetUN(cu.user)).Info("failed challenge for user")
 
-		if _, err := b.Request(api.NewCallbackWithAlert(cq.ID, fmt.Sprintf(i18n.Get("Oops, it looks like you missed the deadline to join \"%s\", but don't worry! You can try again in %s minutes. Keep trying, I believe in you!", lang), cu.targetChat.Title, 10))); err != nil {
+		settings, err := g.s.GetSettings(cu.targetChat.ID)
+		if err != nil {
+			entry.WithError(err).Warn("cant get chat settings, using default timeouts")
+		}
+		retry := minutes(settings.GetRejectTimeout())
+		if _, err := b.Request(api.NewCallbackWithAlert(cq.ID, fmt.Sprintf(i18n.Get("Oops, it looks like you missed the deadline to join \"%s\", but don't worry! You can try again in %s minutes. Keep trying, I believe in you!", lang), cu.targetChat.Title, retry))); err != nil {
 			entry.WithError(err).Error("cant answer callback query")
 		}
 
 		if !isPublic {
 			entry.WithField("user", bot.GetUN(cu.user)).Info("declining join request for user")
-			_ = bot.DeclineJoinRequest(b, cu.user.ID, cu.targetChat.ID)
-			msg := api.NewMessage(cu.commChat.ID, fmt.Sprintf(i18n.Get("Oops, it looks like you missed the deadline to join \"%s\", but don't worry! You can try again in %s minutes. Keep trying, I believe in you!", lang), cu.targetChat.Title, 10))
+			if err := bot.DeclineJoinRequest(b, cu.user.ID, cu.targetChat.ID); err == nil {
+				g.s.GetBus().Publish(event.JoinDeclined{
+					ChatID:   cu.targetChat.ID,
+					UserID:   cu.user.ID,
+					UserName: bot.GetUN(cu.user),
+					Source:   event.SourceGatekeeper,
+					Reason:   event.ChallengeFailWrongAnswer,
+				})
+			}
+			msg := api.NewMessage(cu.commChat.ID, fmt.Sprintf(i18n.Get("Oops, it looks like you missed the deadline to join \"%s\", but don't worry! You can try again in %s minutes. Keep trying, I believe in you!", lang), cu.targetChat.Title, retry))
 			msg.ParseMode = api.ModeMarkdown
+			msg.ReplyMarkup = NewAppealKeyboard(cu.targetChat.ID, lang)
 			_ = tool.Err(b.Send(msg))
 		}
 		if cu.joinMessageID != 0 {
@@ -371,9 +407,23 @@ func (g *Gatekeeper) handleChallenge(_ context.Context, u *api.Update, chat *api
 			entry.WithError(err).Error("cant delete join message")
 		}
 
+		g.s.GetBus().Publish(event.ChallengeFailed{
+			ChatID:   cu.targetChat.ID,
+			UserID:   cu.user.ID,
+			UserName: bot.GetUN(cu.user),
+			Reason:   event.ChallengeFailWrongAnswer,
+		})
 		entry.WithFields(log.Fields{"user": bot.GetUN(cu.user), "chatID": cu.targetChat.ID}).Info("Banning user from chat")
 		if err := bot.BanUserFromChat(b, cu.user.ID, cu.targetChat.ID); err != nil {
 			entry.WithError(err).Error("cant kick failed")
+		} else {
+			g.s.GetBus().Publish(event.UserBanned{
+				ChatID:   cu.targetChat.ID,
+				UserID:   cu.user.ID,
+				UserName: bot.GetUN(cu.user),
+				Source:   event.SourceGatekeeper,
+				Reason:   event.ChallengeFailWrongAnswer,
+			})
 		}
 
 		// stop timer anyway
@@ -431,6 +481,15 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 		return errors.New("target or comm is nil")
 	}
 	b := g.s.GetBot()
+	settings, err := g.s.GetSettings(target.ID)
+	if err != nil {
+		entry.WithError(err).Warn("cant get chat settings, using default timeouts")
+	}
+	challengeTimeout := settings.GetChallengeTimeout()
+	var bio string
+	if u.ChatJoinRequest != nil {
+		bio = u.ChatJoinRequest.Bio
+	}
 
 	for _, ju := range jus {
 		if ju.IsBot {
@@ -438,6 +497,39 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 			continue
 		}
 
+		assessment := g.assess(&ju, bio, settings)
+		decision := risk.Thresholds{
+			Challenge: g.setting.Int("risk_challenge"),
+			Hard:      g.setting.Int("risk_hard"),
+			Decline:   g.setting.Int("risk_decline"),
+		}.Decide(assessment.Score)
+		source, reason := event.SourceGatekeeper, fmt.Sprintf("risk score %d: %s", assessment.Score, strings.Join(assessment.Reasons, ", "))
+		if match := g.matchReputation(target.ID, &ju); match != nil {
+			switch {
+			case match.Spam() && match.Action == federation.ActionPreBan:
+				decision = risk.DecisionDecline
+				source, reason = event.SourceFederation, match.Provenance()
+			case match.Spam() && match.Action == federation.ActionChallenge && decision == risk.DecisionNone:
+				decision = risk.DecisionStandard
+			case match.Trusted() && match.Action != federation.ActionWatch:
+				decision = risk.DecisionNone
+			}
+		}
+		entry.WithFields(log.Fields{
+			"user":     bot.GetUN(&ju),
+			"score":    assessment.Score,
+			"reasons":  assessment.Reasons,
+			"decision": decision,
+		}).Info("Assessed joiner risk")
+		switch decision {
+		case risk.DecisionNone:
+			g.admit(&ju, target, comm)
+			continue
+		case risk.DecisionDecline:
+			g.decline(&ju, target, comm, source, reason)
+			continue
+		}
+
 		entry.WithFields(log.Fields{
 			"user":   bot.GetUN(&ju),
 			"chatID": target.ID,
@@ -449,7 +541,7 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 				},
 				UserID: ju.ID,
 			},
-			UntilDate: time.Now().Add(3 * time.Minute).Unix(),
+			UntilDate: time.Now().Add(challengeTimeout).Unix(),
 			Permissions: &api.ChatPermissions{
 				CanSendMessages:       false,
 				CanSendAudios:         false,
@@ -470,7 +562,7 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 			entry.WithError(err).Error("Failed to restrict user")
 		}
 
-		challengeCtx, cancel := context.WithTimeout(ctx, 4*time.Minute)
+		challengeCtx, cancel := context.WithTimeout(ctx, challengeTimeout+time.Minute)
 
 		cu := &challengedUser{
 			user:        &ju,
@@ -486,16 +578,18 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 			"user": bot.GetUN(cu.user),
 			"chat": cu.commChat.ID,
 		}).Info("Adding challenged user to joiners list")
+		g.mutex.Lock()
 		if _, ok := g.joiners[cu.commChat.ID]; !ok {
 			g.joiners[cu.commChat.ID] = map[int64]*challengedUser{}
 		}
 		g.joiners[cu.commChat.ID][cu.user.ID] = cu
+		g.mutex.Unlock()
 		commLang := g.getLanguage(cu.commChat, cu.user)
 
 		go func() {
 			entry.WithField("user", bot.GetUN(cu.user)).Info("Setting timer")
-			timeout := time.NewTimer(3 * time.Minute)
-			defer delete(g.joiners[cu.commChat.ID], cu.user.ID)
+			timeout := time.NewTimer(challengeTimeout)
+			defer g.removeChallengedUser(cu.user.ID, cu.commChat.ID)
 
 			select {
 			case <-challengeCtx.Done():
@@ -505,12 +599,21 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 
 			case <-timeout.C:
 				entry.WithField("user", bot.GetUN(cu.user)).Info("Challenge timed out")
-				if cu.challengeMessageID != 0 {
+				g.s.GetBus().Publish(event.ChallengeFailed{
+					ChatID:   cu.targetChat.ID,
+					UserID:   cu.user.ID,
+					UserName: bot.GetUN(cu.user),
+					Reason:   event.ChallengeFailTimeout,
+				})
+				g.mutex.Lock()
+				challengeMessageID := cu.challengeMessageID
+				g.mutex.Unlock()
+				if challengeMessageID != 0 {
 					entry.WithFields(log.Fields{
-						"messageID": cu.challengeMessageID,
+						"messageID": challengeMessageID,
 						"chatID":    cu.commChat.ID,
 					}).Info("Deleting challenge message from chat")
-					if err := bot.DeleteChatMessage(b, cu.commChat.ID, cu.challengeMessageID); err != nil {
+					if err := bot.DeleteChatMessage(b, cu.commChat.ID, challengeMessageID); err != nil {
 						entry.WithError(err).Error("Failed to delete challenge message")
 					}
 				}
@@ -532,6 +635,14 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 				if err := bot.BanUserFromChat(b, cu.user.ID, cu.targetChat.ID); err != nil {
 					entry.WithError(err).Error("Failed to ban user")
 					errs = append(errs, errors.Wrap(err, "failed to ban user"))
+				} else {
+					g.s.GetBus().Publish(event.UserBanned{
+						ChatID:   cu.targetChat.ID,
+						UserID:   cu.user.ID,
+						UserName: bot.GetUN(cu.user),
+						Source:   event.SourceGatekeeper,
+						Reason:   event.ChallengeFailTimeout,
+					})
 				}
 
 				if len(errs) > 0 {
@@ -558,13 +669,26 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 					entry.WithField("user", bot.GetUN(cu.user)).Info("Declining join request")
 					if err := bot.DeclineJoinRequest(b, cu.user.ID, cu.targetChat.ID); err != nil {
 						entry.WithError(err).Debug("Decline failed")
+					} else {
+						g.s.GetBus().Publish(event.JoinDeclined{
+							ChatID:   cu.targetChat.ID,
+							UserID:   cu.user.ID,
+							UserName: bot.GetUN(cu.user),
+							Source:   event.SourceGatekeeper,
+							Reason:   event.ChallengeFailTimeout,
+						})
 					}
 					entry.WithField("user", bot.GetUN(cu.user)).Info("Sending timeout message")
-					sentMsg, err := b.Send(api.NewMessage(cu.commChat.ID, i18n.Get("Your answer is WRONG. Try again in 10 minutes", commLang)))
+					// the appeal button is usable until the joiner can try again
+					rejectTimeout := settings.GetRejectTimeout()
+					msg := api.NewMessage(cu.commChat.ID, fmt.Sprintf(i18n.Get("Your answer is WRONG. Try again in %s minutes", commLang), minutes(rejectTimeout)))
+					msg.ReplyMarkup = NewAppealKeyboard(cu.targetChat.ID, commLang)
+					sentMsg, err := b.Send(msg)
 					if err != nil {
 						entry.WithError(err).Error("Failed to send timeout message")
+						return
 					}
-					time.AfterFunc(10*time.Minute, func() {
+					time.AfterFunc(rejectTimeout, func() {
 						entry.WithFields(log.Fields{
 							"messageID": sentMsg.MessageID,
 							"chatID":    cu.commChat.ID,
@@ -577,7 +701,11 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 		}()
 
 		entry.Debug("Creating captcha buttons")
-		buttons, correctVariant := g.createCaptchaButtons(cu, commLang)
+		size := captchaSize
+		if decision == risk.DecisionHard {
+			size = captchaSizeHard
+		}
+		buttons, correctVariant := g.createCaptchaButtons(cu, commLang, size)
 
 		var keys []string
 		isPublic := cu.commChat.ID == cu.targetChat.ID
@@ -602,17 +730,31 @@ func (g *Gatekeeper) handleJoin(ctx context.Context, u *api.Update, jus []api.Us
 			msg.DisableNotification = true
 		}
 
-		kb := api.NewInlineKeyboardMarkup(
-			api.NewInlineKeyboardRow(buttons...),
-		)
-		msg.ReplyMarkup = kb
+		// the hard challenge is split into even rows of at most captchaSize buttons
+		rowCount := (len(buttons) + captchaSize - 1) / captchaSize
+		rowSize := (len(buttons) + rowCount - 1) / rowCount
+		var rows [][]api.InlineKeyboardButton
+		for len(buttons) > 0 {
+			n := min(rowSize, len(buttons))
+			rows = append(rows, api.NewInlineKeyboardRow(buttons[:n]...))
+			buttons = buttons[n:]
+		}
+		msg.ReplyMarkup = api.NewInlineKeyboardMarkup(rows...)
 		entry.Debug("Sending challenge message")
 		sentMsg, err := b.Send(msg)
 		if err != nil {
 			entry.WithError(err).Error("Failed to send challenge message")
 			return errors.WithMessage(err, "cant send")
 		}
+		g.mutex.Lock()
 		cu.challengeMessageID = sentMsg.MessageID
+		g.mutex.Unlock()
+		g.s.GetBus().Publish(event.ChallengeStarted{
+			ChatID:     cu.targetChat.ID,
+			CommChatID: cu.commChat.ID,
+			UserID:     cu.user.ID,
+			UserName:   bot.GetUN(cu.user),
+		})
 	}
 	entry.Debug("Exiting handleChallenge method")
 	return nil
@@ -626,6 +768,8 @@ func (g *Gatekeeper) extractChallengedUser(userID int64, chatID int64) *challeng
 	})
 	entry.Debug("Entering method")
 
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
 	joiner := g.findChallengedUser(userID, chatID)
 	if joiner == nil || joiner.user == nil {
 		entry.Info("No challenged user found")
@@ -638,6 +782,7 @@ func (g *Gatekeeper) extractChallengedUser(userID int64, chatID int64) *challeng
 	return joiner
 }
 
+// findChallengedUser looks the joiner up, the caller holds the mutex
 func (g *Gatekeeper) findChallengedUser(userID int64, chatID int64) *challengedUser {
 	entry := g.getLogEntry().WithFields(log.Fields{
 		"method": "findChallengedUser",
@@ -668,6 +813,8 @@ func (g *Gatekeeper) removeChallengedUser(userID int64, chatID int64) {
 	})
 	entry.Debug("Entering method")
 
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
 	if _, ok := g.joiners[chatID]; !ok {
 		entry.Trace("No challenges for chat")
 		return
@@ -700,7 +847,7 @@ func (g *Gatekeeper) createCaptchaIndex(lang string) [][2]string {
 	return captchaIndex
 }
 
-func (g *Gatekeeper) createCaptchaButtons(cu *challengedUser, lang string) ([]api.InlineKeyboardButton, [2]string) {
+func (g *Gatekeeper) createCaptchaButtons(cu *challengedUser, lang string, size int) ([]api.InlineKeyboardButton, [2]string) {
 	entry := g.getLogEntry().WithFields(log.Fields{
 		"method": "createCaptchaButtons",
 		"lang":   lang,
@@ -708,9 +855,10 @@ func (g *Gatekeeper) createCaptchaButtons(cu *challengedUser, lang string) ([]ap
 	entry.Debug("Entering method")
 
 	captchaIndex := g.createCaptchaIndex(lang)
-	captchaRandomSet := make([][2]string, 0, captchaSize)
-	usedIDs := make(map[int]struct{}, captchaSize)
-	for len(captchaRandomSet) < captchaSize {
+	size = min(size, len(captchaIndex))
+	captchaRandomSet := make([][2]string, 0, size)
+	usedIDs := make(map[int]struct{}, size)
+	for len(captchaRandomSet) < size {
 		ID := rand.Intn(len(captchaIndex))
 		if _, ok := usedIDs[ID]; ok {
 			continue
@@ -718,7 +866,7 @@ func (g *Gatekeeper) createCaptchaButtons(cu *challengedUser, lang string) ([]ap
 		captchaRandomSet = append(captchaRandomSet, captchaIndex[ID])
 		usedIDs[ID] = struct{}{}
 	}
-	correctVariant := captchaRandomSet[rand.Intn(captchaSize-1)+1]
+	correctVariant := captchaRandomSet[rand.Intn(size-1)+1]
 	var buttons []api.InlineKeyboardButton
 	for _, v := range captchaRandomSet {
 		result := strconv.FormatInt(cu.user.ID, 10) + ";" + uuid.New()
@@ -732,6 +880,104 @@ func (g *Gatekeeper) createCaptchaButtons(cu *challengedUser, lang string) ([]ap
 	return buttons, correctVariant
 }
 
+// assess scores the joiner, a failed profile photo lookup leaves that signal out
+func (g *Gatekeeper) assess(user *api.User, bio string, settings *db.Settings) risk.Assessment {
+	profile := risk.Profile{User: user, Bio: bio, Photos: risk.PhotosUnknown}
+	if settings != nil {
+		profile.ChatLanguage = settings.Language
+	}
+	photos, err := g.s.GetBot().GetUserProfilePhotos(api.UserProfilePhotosConfig{UserID: user.ID, Limit: 1})
+	if err != nil {
+		g.getLogEntry().WithError(err).WithField("method", "assess").Debug("cant get profile photos")
+	} else {
+		profile.Photos = photos.TotalCount
+	}
+	return risk.Assess(profile, int64(g.setting.Int("new_account_id")))
+}
+
+// admit lets a low risk joiner in without a challenge
+func (g *Gatekeeper) admit(user *api.User, target, comm *api.Chat) {
+	entry := g.getLogEntry().WithFields(log.Fields{"method": "admit", "user": bot.GetUN(user), "chatID": target.ID})
+	if comm.ID == target.ID {
+		entry.Debug("Low risk member joined")
+		return
+	}
+	entry.Info("Approving low risk join request")
+	if err := bot.ApproveJoinRequest(g.s.GetBot(), user.ID, target.ID); err != nil {
+		entry.WithError(err).Error("Failed to approve join request")
+	}
+}
+
+// matchReputation looks up the decision of the trust group on the joiner, spam decisions a chat pre-bans are recorded as bans instead
+func (g *Gatekeeper) matchReputation(chatID int64, user *api.User) *federation.Match {
+	match, err := federation.Lookup(g.s.GetDB(), chatID, user.ID)
+	if err != nil {
+		g.getLogEntry().WithError(err).WithField("method", "matchReputation").Warn("cant look up trust group decisions")
+		return nil
+	}
+	if match == nil {
+		return nil
+	}
+	if !match.Spam() || match.Action != federation.ActionPreBan {
+		g.s.GetBus().Publish(event.ReputationMatched{
+			ChatID:     chatID,
+			UserID:     user.ID,
+			UserName:   bot.GetUN(user),
+			Group:      match.Group,
+			Verdict:    match.Decision.Verdict,
+			Action:     match.Action,
+			Provenance: match.Provenance(),
+		})
+	}
+	return match
+}
+
+// decline rejects a joiner right away, the joiner can still appeal a declined join request
+func (g *Gatekeeper) decline(user *api.User, target, comm *api.Chat, source, reason string) {
+	entry := g.getLogEntry().WithFields(log.Fields{"method": "decline", "user": bot.GetUN(user), "chatID": target.ID})
+	b := g.s.GetBot()
+
+	if comm.ID == target.ID {
+		entry.Info("Banning high risk member")
+		if err := bot.BanUserFromChat(b, user.ID, target.ID); err != nil {
+			entry.WithError(err).Error("Failed to ban high risk member")
+			return
+		}
+		g.s.GetBus().Publish(event.UserBanned{
+			ChatID:   target.ID,
+			UserID:   user.ID,
+			UserName: bot.GetUN(user),
+			Source:   source,
+			Reason:   reason,
+		})
+		return
+	}
+
+	entry.Info("Declining high risk join request")
+	if err := bot.DeclineJoinRequest(b, user.ID, target.ID); err != nil {
+		entry.WithError(err).Error("Failed to decline join request")
+		return
+	}
+	g.s.GetBus().Publish(event.JoinDeclined{
+		ChatID:   target.ID,
+		UserID:   user.ID,
+		UserName: bot.GetUN(user),
+		Source:   source,
+		Reason:   reason,
+	})
+	lang := g.getLanguage(comm, user)
+	msg := api.NewMessage(comm.ID, fmt.Sprintf(i18n.Get("Your request to join \"%s\" was declined automatically. If this is a mistake, you can appeal.", lang), target.Title))
+	msg.ReplyMarkup = NewAppealKeyboard(target.ID, lang)
+	if _, err := b.Send(msg); err != nil {
+		entry.WithError(err).Debug("Failed to notify declined joiner")
+	}
+}
+
+// minutes formats the duration in whole minutes for the messages, rounded up
+func minutes(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Minute - 1) / time.Minute))
+}
+
 func (g *Gatekeeper) getLogEntry() *log.Entry {
 	return log.WithField("context", "gatekeeper")
 }
@@ -743,7 +989,7 @@ func (g *Gatekeeper) getLanguage(chat *api.Chat, user *api.User) string {
 	})
 	entry.Debug("Entering method")
 
-	if settings, err := g.s.GetDB().GetSettings(chat.ID); !tool.Try(err) {
+	if settings, err := g.s.GetSettings(chat.ID); !tool.Try(err) && settings != nil {
 		entry.Debug("Using language from chat settings")
 		return settings.Language
 	}
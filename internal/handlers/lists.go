@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/i18n"
+	"github.com/iamwavecut/ngbot/internal/lists"
+)
+
+const (
+	// importLimit caps the size of an imported list file
+	importLimit = 1 << 20
+	// messageLimit keeps a reply within the Telegram message length
+	messageLimit = 4000
+)
+
+// editList runs the operator commands of a list: /blocklist [kind], add <kind> <pattern>, remove <id>,
+// or import [kind] in reply to a text file
+func (a *Admin) editList(ctx context.Context, chat *api.Chat, operator *api.User, m *api.Message, list string) error {
+	entry := a.getLogEntry().WithFields(log.Fields{"method": "editList", "list": list, "operator": operator.ID})
+	b := a.s.GetBot()
+	lang := config.Get().DefaultLanguage
+	reply := func(text string) {
+		_, _ = b.Send(api.NewMessage(chat.ID, text))
+	}
+	kinds := make([]string, 0, len(lists.Kinds()))
+	for _, k := range lists.Kinds() {
+		kinds = append(kinds, string(k))
+	}
+	usage := func() {
+		reply(fmt.Sprintf(i18n.Get("Usage: /%s [kind], /%s add <kind> <pattern>, /%s remove <id>, or /%s import [kind] in reply to a text file. Kinds: %s", lang),
+			m.Command(), m.Command(), m.Command(), m.Command(), strings.Join(kinds, ", ")))
+	}
+
+	subcommand, arguments, _ := strings.Cut(strings.TrimSpace(m.CommandArguments()), " ")
+	arguments = strings.TrimSpace(arguments)
+	switch subcommand {
+	case "add":
+		name, pattern, _ := strings.Cut(arguments, " ")
+		kind, ok := lists.ParseKind(name)
+		if !ok || strings.TrimSpace(pattern) == "" {
+			usage()
+			return nil
+		}
+		added, err := a.lists.Add([]*db.ListEntry{{List: list, Kind: string(kind), Pattern: pattern, CreatedBy: operator.ID}})
+		if err != nil {
+			entry.WithError(err).Debug("cant add entry")
+			reply(err.Error())
+			return nil
+		}
+		entry.WithField("kind", kind).Info("list entry added")
+		if added == 0 {
+			reply(i18n.Get("The entry is already on the list", lang))
+			return nil
+		}
+		reply(i18n.Get("The entry is added", lang))
+
+	case "remove":
+		id, err := strconv.ParseInt(strings.TrimPrefix(arguments, "#"), 10, 64)
+		if err != nil {
+			usage()
+			return nil
+		}
+		removed, err := a.lists.Remove(id)
+		if err != nil {
+			return errors.WithMessage(err, "cant remove list entry")
+		}
+		if !removed {
+			reply(i18n.Get("There is no such entry", lang))
+			return nil
+		}
+		entry.WithField("id", id).Info("list entry removed")
+		reply(i18n.Get("The entry is removed", lang))
+
+	case "import":
+		var kind lists.Kind
+		if arguments != "" {
+			k, ok := lists.ParseKind(arguments)
+			if !ok {
+				usage()
+				return nil
+			}
+			kind = k
+		}
+		if m.ReplyToMessage == nil || m.ReplyToMessage.Document == nil {
+			usage()
+			return nil
+		}
+		entries, errs, err := a.readListFile(ctx, m.ReplyToMessage.Document, list, kind)
+		if err != nil {
+			entry.WithError(err).Warn("cant read list file")
+			reply(i18n.Get("I can't read this file", lang))
+			return nil
+		}
+		for _, e := range entries {
+			e.CreatedBy = operator.ID
+		}
+		added, err := a.lists.Add(entries)
+		if err != nil {
+			return errors.WithMessage(err, "cant import list entries")
+		}
+		entry.WithFields(log.Fields{"added": added, "invalid": len(errs)}).Info("list imported")
+		text := fmt.Sprintf(i18n.Get("Imported %d new entries, %d lines are invalid", lang), added, len(errs))
+		for _, err := range errs {
+			text += "\n" + err.Error()
+		}
+		reply(truncate(text, messageLimit))
+
+	default:
+		var kind lists.Kind
+		if subcommand != "" {
+			k, ok := lists.ParseKind(subcommand)
+			if !ok {
+				usage()
+				return nil
+			}
+			kind = k
+		}
+		entries, err := a.lists.Entries(list)
+		if err != nil {
+			return errors.WithMessage(err, "cant get list entries")
+		}
+		lines := make([]string, 0, len(entries))
+		for _, e := range entries {
+			if kind == "" || e.Kind == string(kind) {
+				lines = append(lines, fmt.Sprintf("#%d %s %s", e.ID, e.Kind, e.Pattern))
+			}
+		}
+		if len(lines) == 0 {
+			reply(i18n.Get("The list is empty", lang))
+			return nil
+		}
+		reply(truncate(strings.Join(lines, "\n"), messageLimit))
+	}
+	return nil
+}
+
+func (a *Admin) readListFile(ctx context.Context, doc *api.Document, list string, kind lists.Kind) ([]*db.ListEntry, []error, error) {
+	if doc.FileSize > importLimit {
+		return nil, nil, errors.Errorf("file is larger than %d bytes", importLimit)
+	}
+	url, err := a.s.GetBot().GetFileDirectURL(doc.FileID)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "cant get file url")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "cant create request")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "cant download file")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("file download failed with status %d", resp.StatusCode)
+	}
+	entries, errs := lists.Import(io.LimitReader(resp.Body, importLimit), list, kind)
+	return entries, errs, nil
+}
+
+// truncate cuts the text to at most limit bytes on a line boundary
+func truncate(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := strings.LastIndex(text[:limit], "\n")
+	if cut <= 0 {
+		cut = limit
+	}
+	return text[:cut] + "\n…"
+}
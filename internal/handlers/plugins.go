@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/links"
+	"github.com/iamwavecut/ngbot/internal/media"
+	"github.com/iamwavecut/ngbot/internal/plugin"
+)
+
+// reactorPlugin applies the reloaded link resolver and OCR command, the LLM gateway reloads on its own
+type reactorPlugin struct {
+	*Reactor
+}
+
+func (r reactorPlugin) Reload(cfg config.Config) {
+	r.SetLinkResolver(links.NewResolver(cfg.LinkResolver))
+	r.SetTextExtractor(media.NewCommandExtractor(cfg.OCRCommand))
+}
+
+func init() {
+	plugin.MustRegister("admin", plugin.Simple(plugin.Manifest{
+		Name:  "admin",
+		Order: 10,
+		// commands must work before the bot is promoted, appeals report their own errors
+		UpdateTypes: []string{"message", "callback_query"},
+	}, func(deps plugin.Deps) (bot.Handler, error) {
+		return NewAdmin(deps.Service, deps.Lists, deps.Spam), nil
+	}))
+
+	plugin.MustRegister("raid", func() plugin.Plugin { return &raidPlugin{} })
+
+	plugin.MustRegister("gatekeeper", plugin.Simple(plugin.Manifest{
+		Name:  "gatekeeper",
+		Order: 20,
+		// challenges are answered in any chat, join requests check the right to approve them
+		UpdateTypes: []string{"message", "callback_query", "chat_join_request"},
+		Settings: []plugin.SettingSpec{
+			{Key: "risk_challenge", Type: plugin.SettingInt, Default: "0", Description: "lowest joiner risk score that is challenged, lower ones are let in, 0 challenges everyone"},
+			{Key: "risk_hard", Type: plugin.SettingInt, Default: "50", Description: "lowest risk score for the harder challenge, 0 turns it off"},
+			{Key: "risk_decline", Type: plugin.SettingInt, Default: "80", Description: "lowest risk score that is declined right away, 0 turns it off"},
+			{Key: "new_account_id", Type: plugin.SettingInt, Default: "7000000000", Description: "lowest user ID of recently registered accounts"},
+		},
+	}, func(deps plugin.Deps) (bot.Handler, error) {
+		return NewGatekeeper(deps.Service, deps.Setting, deps.Permitted), nil
+	}))
+
+	plugin.MustRegister("reactor", plugin.Simple(plugin.Manifest{
+		Name:        "reactor",
+		Order:       30,
+		Permissions: []plugin.Permission{plugin.PermissionDeleteMessages, plugin.PermissionRestrictMembers},
+		UpdateTypes: []string{"message", "edited_message"},
+		Settings: []plugin.SettingSpec{
+			{Key: "edit_scope", Type: plugin.SettingString, Default: editScopeProbation, Description: "whose edited messages are rescanned: off, probation (users not trusted yet or on probation) or all"},
+			{Key: "edit_window", Type: plugin.SettingDuration, Default: "24h", Description: "edits made later than this after the post are not rescanned, 0 rescans every edit"},
+			{Key: "probation", Type: plugin.SettingDuration, Default: "72h", Description: "how long a newly trusted member stays on probation"},
+			{Key: "media_executable", Type: plugin.SettingString, Default: media.ActionBan, Description: "action on a first message with an executable document: ban, delete or check"},
+			{Key: "media_contact", Type: plugin.SettingString, Default: media.ActionDelete, Description: "action on a first message sharing a contact"},
+			{Key: "media_location", Type: plugin.SettingString, Default: media.ActionDelete, Description: "action on a first message sharing a location or venue"},
+			{Key: "media_forward", Type: plugin.SettingString, Default: media.ActionCheck, Description: "action on a first message forwarded from a channel or group"},
+			{Key: "media_story", Type: plugin.SettingString, Default: media.ActionDelete, Description: "action on a first message forwarding a story"},
+		},
+	}, func(deps plugin.Deps) (bot.Handler, error) {
+		return reactorPlugin{NewReactor(deps.Service, deps.LLM, deps.Lists, deps.Spam, deps.Setting)}, nil
+	}))
+}
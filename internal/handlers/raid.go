@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/event"
+	"github.com/iamwavecut/ngbot/internal/i18n"
+	"github.com/iamwavecut/ngbot/internal/plugin"
+	"github.com/iamwavecut/ngbot/internal/raid"
+)
+
+// quietCheckInterval is how often lockdowns are checked for the quiet period
+const quietCheckInterval = 30 * time.Second
+
+var raidManifest = plugin.Manifest{
+	Name: "raid",
+	// before the gatekeeper, so that no challenges are sent during a lockdown
+	Order: 15,
+	// raids are detected and reported without rights, declining and muting joiners check them
+	UpdateTypes: []string{"message", "chat_join_request"},
+	Settings: []plugin.SettingSpec{
+		{Key: "window", Type: plugin.SettingDuration, Default: "1m", Description: "time span the signals look at"},
+		{Key: "joins", Type: plugin.SettingInt, Default: "10", Description: "joins within the window"},
+		{Key: "id_cluster", Type: plugin.SettingInt, Default: "5", Description: "joiners with close account IDs"},
+		{Key: "id_span", Type: plugin.SettingInt, Default: "50000", Description: "largest account ID difference within a cluster"},
+		{Key: "similar_names", Type: plugin.SettingInt, Default: "5", Description: "joiners with similar names"},
+		{Key: "identical_messages", Type: plugin.SettingInt, Default: "3", Description: "joiners sending the same first message"},
+		{Key: "quiet_period", Type: plugin.SettingDuration, Default: "10m", Description: "time without joins that ends a lockdown"},
+	},
+}
+
+// Raid locks a chat down when the joins look like a raid: join requests are declined and new members muted
+type Raid struct {
+	s         bot.Service
+	setting   plugin.Setting
+	permitted plugin.Permitted
+	detector  *raid.Detector
+}
+
+func NewRaid(s bot.Service, setting plugin.Setting, permitted plugin.Permitted) *Raid {
+	return &Raid{
+		s:         s,
+		setting:   setting,
+		permitted: permitted,
+		detector:  raid.NewDetector(),
+	}
+}
+
+// raidPlugin runs the quiet period checks next to the handler
+type raidPlugin struct {
+	*Raid
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (p *raidPlugin) Manifest() plugin.Manifest { return raidManifest }
+
+func (p *raidPlugin) Init(deps plugin.Deps) error {
+	p.Raid = NewRaid(deps.Service, deps.Setting, deps.Permitted)
+	return nil
+}
+
+func (p *raidPlugin) Start(ctx context.Context) error {
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		p.watchQuiet(ctx)
+	}()
+	return nil
+}
+
+func (p *raidPlugin) Stop(context.Context) error {
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+	}
+	return nil
+}
+
+func (r *Raid) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+	if chat == nil || user == nil {
+		return true, nil
+	}
+
+	switch {
+	case u.ChatJoinRequest != nil:
+		return r.handleJoinRequest(u.ChatJoinRequest), nil
+	case u.Message == nil:
+		return true, nil
+	case len(u.Message.NewChatMembers) > 0:
+		return r.handleNewMembers(chat, u.Message.NewChatMembers), nil
+	case u.Message.IsCommand() && u.Message.Command() == "unlock":
+		return r.unlock(chat, user), nil
+	case !user.IsBot:
+		text := u.Message.Text
+		if text == "" {
+			text = u.Message.Caption
+		}
+		if signal, tripped := r.detector.FirstMessage(chat.ID, user.ID, text, r.thresholds()); tripped {
+			r.lockdownStarted(chat, signal)
+		}
+	}
+	return true, nil
+}
+
+func (r *Raid) handleJoinRequest(req *api.ChatJoinRequest) bool {
+	entry := r.getLogEntry().WithFields(log.Fields{"method": "handleJoinRequest", "chat_id": req.Chat.ID})
+	if signal, tripped := r.detector.Join(req.Chat.ID, req.From.ID, bot.GetFullName(&req.From), r.thresholds()); tripped {
+		r.lockdownStarted(&req.Chat, signal)
+	}
+	if !r.detector.Locked(req.Chat.ID) || !r.permitted(req.Chat.ID, plugin.PermissionInviteUsers) {
+		return true
+	}
+	// declines are counted in the lockdown instead of flooding the moderation log
+	if err := bot.DeclineJoinRequest(r.s.GetBot(), req.From.ID, req.Chat.ID); err != nil {
+		entry.WithError(err).Warn("cant decline join request")
+	}
+	return false
+}
+
+func (r *Raid) handleNewMembers(chat *api.Chat, members []api.User) bool {
+	entry := r.getLogEntry().WithFields(log.Fields{"method": "handleNewMembers", "chat_id": chat.ID})
+	for _, member := range members {
+		if member.IsBot {
+			continue
+		}
+		if signal, tripped := r.detector.Join(chat.ID, member.ID, bot.GetFullName(&member), r.thresholds()); tripped {
+			r.lockdownStarted(chat, signal)
+		}
+	}
+	if !r.detector.Locked(chat.ID) || !r.permitted(chat.ID, plugin.PermissionRestrictMembers) {
+		return true
+	}
+	for _, member := range members {
+		if member.IsBot {
+			continue
+		}
+		if err := bot.RestrictChattingFor(r.s.GetBot(), member.ID, chat.ID, r.setting.Duration("quiet_period")); err != nil {
+			entry.WithError(err).Warn("cant restrict new member")
+		}
+	}
+	return false
+}
+
+func (r *Raid) unlock(chat *api.Chat, user *api.User) bool {
+	if !isChatAdmin(r.s, chat.ID, user.ID) {
+		return true
+	}
+	lang := r.getLanguage(chat.ID)
+	ld, ok := r.detector.Unlock(chat.ID)
+	if !ok {
+		_, _ = r.s.GetBot().Send(api.NewMessage(chat.ID, i18n.Get("The chat is not locked down", lang)))
+		return false
+	}
+	r.lockdownEnded(ld, user.ID)
+	return false
+}
+
+// lockdownStarted posts a single notice to the chat and alerts the admins in private
+func (r *Raid) lockdownStarted(chat *api.Chat, signal raid.Signal) {
+	entry := r.getLogEntry().WithFields(log.Fields{"method": "lockdownStarted", "chat_id": chat.ID, "signal": signal})
+	entry.Warn("raid detected, locking the chat down")
+	b := r.s.GetBot()
+	lang := r.getLanguage(chat.ID)
+
+	notice := api.NewMessage(chat.ID, i18n.Get("🚨 Raid detected, the chat is locked down: join requests are declined and new members are muted. Admins can lift it with /unlock", lang))
+	if _, err := b.Send(notice); err != nil {
+		entry.WithError(err).Warn("cant post lockdown notice")
+	}
+
+	alert := fmt.Sprintf(
+		i18n.Get("🚨 Raid detected in <b>%s</b> (%s), the chat is locked down until there are no joins for %s. Send /unlock in the chat to lift it earlier.", lang),
+		api.EscapeText(api.ModeHTML, chat.Title),
+		signal,
+		r.setting.Duration("quiet_period"),
+	)
+	for _, admin := range chatAdmins(r.s, chat.ID) {
+		msg := api.NewMessage(admin, alert)
+		msg.ParseMode = api.ModeHTML
+		if _, err := b.Send(msg); err != nil {
+			entry.WithError(err).WithField("admin", admin).Debug("cant alert admin")
+		}
+	}
+
+	r.s.GetBus().Publish(event.LockdownStarted{ChatID: chat.ID, Signal: string(signal)})
+}
+
+func (r *Raid) lockdownEnded(ld raid.Lockdown, actorID int64) {
+	r.getLogEntry().WithFields(log.Fields{
+		"method":  "lockdownEnded",
+		"chat_id": ld.ChatID,
+		"blocked": ld.Blocked,
+	}).Info("lockdown ended")
+	lang := r.getLanguage(ld.ChatID)
+	text := fmt.Sprintf(i18n.Get("Lockdown is over, %d join attempts were held off", lang), ld.Blocked)
+	_, _ = r.s.GetBot().Send(api.NewMessage(ld.ChatID, text))
+	r.s.GetBus().Publish(event.LockdownEnded{ChatID: ld.ChatID, ActorID: actorID, Blocked: ld.Blocked})
+}
+
+func (r *Raid) watchQuiet(ctx context.Context) {
+	ticker := time.NewTicker(quietCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, ld := range r.detector.Quiet(r.setting.Duration("quiet_period")) {
+				r.lockdownEnded(ld, 0)
+			}
+		}
+	}
+}
+
+func (r *Raid) thresholds() raid.Thresholds {
+	return raid.Thresholds{
+		Window:            r.setting.Duration("window"),
+		Joins:             r.setting.Int("joins"),
+		IDCluster:         r.setting.Int("id_cluster"),
+		IDSpan:            int64(r.setting.Int("id_span")),
+		SimilarNames:      r.setting.Int("similar_names"),
+		IdenticalMessages: r.setting.Int("identical_messages"),
+	}
+}
+
+func (r *Raid) getLanguage(chatID int64) string {
+	if settings, err := r.s.GetSettings(chatID); err == nil && settings != nil && settings.Language != "" {
+		return settings.Language
+	}
+	return config.Get().DefaultLanguage
+}
+
+func (r *Raid) getLogEntry() *log.Entry {
+	return log.WithField("context", "raid")
+}
@@ -2,12 +2,15 @@ package handlers
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"reflect"
-	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/pkg/errors"
@@ -17,11 +20,48 @@ import (
 	"github.com/iamwavecut/ngbot/internal/bot"
 	"github.com/iamwavecut/ngbot/internal/config"
 	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/event"
+	"github.com/iamwavecut/ngbot/internal/federation"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
 	"github.com/iamwavecut/ngbot/internal/i18n"
+	"github.com/iamwavecut/ngbot/internal/links"
+	"github.com/iamwavecut/ngbot/internal/lists"
+	"github.com/iamwavecut/ngbot/internal/llm"
+	"github.com/iamwavecut/ngbot/internal/media"
+	"github.com/iamwavecut/ngbot/internal/metrics"
+	"github.com/iamwavecut/ngbot/internal/plugin"
 	"github.com/iamwavecut/tool"
 )
 
-var flaggedEmojis = []string{"💩", "👎", "🖕", "🤮", "🤬", "😡", "💀", "☠️", "🤢", "👿"}
+const (
+	spamPrompt = `
+		Вы система обнаружения спама.
+		Отвечайте 'SPAM', если сообщение является спамом, или 'NOT_SPAM', если не является.
+		Не предоставляйте никакой другой информации. Обращайте особое внимание на сообщения, которые 
+		содержат предложения о заработке и наборы на удаленную работу или участие в операциях с 
+		криптовалютами. В подавляющем большинстве они являются спамом! Спаммеры часто любят смешивать 
+		буквы кириллического и латинского алфавита, чтобы обмануть спам системы, обращайте на такие 
+		сообщения повышенное внимание.
+	`
+	visionPrompt = `
+		Сообщение содержит изображение. Прочитайте текст на изображении и оценивайте его вместе с подписью:
+		спаммеры часто прячут рекламу в картинку, чтобы обойти проверку текста.
+	`
+	// visionMaxTokens is enough for the verdict, the answer of a chatty model is cut instead of paid for
+	visionMaxTokens = 5
+
+	// editScopeOff leaves edited messages alone
+	editScopeOff = "off"
+	// editScopeProbation rescans the edits of users who are not trusted yet or were trusted within the probation period
+	editScopeProbation = "probation"
+	// editScopeAll rescans the edits of everyone but the admins
+	editScopeAll = "all"
+
+	// lolsTimeout bounds the lols.bot lookup, a stalled lookup must not hold the updates of the chat
+	lolsTimeout = 5 * time.Second
+)
+
+var lolsClient = &http.Client{Timeout: lolsTimeout}
 
 type banInfo struct {
 	OK         bool    `json:"ok"`
@@ -33,24 +73,51 @@ type banInfo struct {
 }
 
 type Reactor struct {
-	s      bot.Service
-	llmAPI *openai.Client
-	model  string
+	s       bot.Service
+	lists   *lists.Lists
+	setting plugin.Setting
+	llm     *llm.Gateway
+	spam    *fingerprint.Index
+	// resolver holds a linkResolver, its Resolver is nil when unshortening is off
+	resolver atomic.Value
+	// extractor holds a textExtractor, its TextExtractor is nil when image text is not read
+	extractor atomic.Value
+	// vision caps the photos sent to the vision model
+	vision media.Budget
 }
 
-func NewReactor(s bot.Service, llmAPI *openai.Client, model string) *Reactor {
+type (
+	linkResolver  struct{ links.Resolver }
+	textExtractor struct{ media.TextExtractor }
+)
+
+func NewReactor(s bot.Service, gateway *llm.Gateway, lists *lists.Lists, spam *fingerprint.Index, setting plugin.Setting) *Reactor {
 	log.WithFields(log.Fields{
 		"scope":  "Reactor",
 		"method": "NewReactor",
 	}).Debug("creating new Reactor")
 	r := &Reactor{
-		s:      s,
-		llmAPI: llmAPI,
-		model:  model,
+		s:       s,
+		lists:   lists,
+		setting: setting,
+		llm:     gateway,
+		spam:    spam,
 	}
+	r.SetLinkResolver(links.NewResolver(config.Get().LinkResolver))
+	r.SetTextExtractor(media.NewCommandExtractor(config.Get().OCRCommand))
 	return r
 }
 
+// SetLinkResolver swaps the resolver of redirector links, nil turns unshortening off
+func (r *Reactor) SetLinkResolver(resolver links.Resolver) {
+	r.resolver.Store(linkResolver{resolver})
+}
+
+// SetTextExtractor swaps the reader of image text, nil leaves images without a caption unchecked
+func (r *Reactor) SetTextExtractor(extractor media.TextExtractor) {
+	r.extractor.Store(textExtractor{extractor})
+}
+
 func (r *Reactor) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
 	entry := r.getLogEntry().
 		WithFields(log.Fields{
@@ -80,11 +147,11 @@ func (r *Reactor) Handle(ctx context.Context, u *api.Update, chat *api.Chat, use
 		}
 	}
 	entry.Debug("Checking update type")
-	if u.Message == nil && u.MessageReaction == nil {
-		entry.Debug("Update is not about message or reaction, not proceeding")
+	if u.Message == nil && u.EditedMessage == nil {
+		entry.Debug("Update is not about message, not proceeding")
 		return false, nil
 	}
-	entry.Debug("Update is about message or reaction, proceeding")
+	entry.Debug("Update is about message, proceeding")
 
 	if chat == nil {
 		entry.Warn("No chat")
@@ -106,9 +173,9 @@ func (r *Reactor) Handle(ctx context.Context, u *api.Update, chat *api.Chat, use
 		entry.Debug("Settings are nil, using default settings")
 		settings = &db.Settings{
 			Enabled:          true,
-			ChallengeTimeout: defaultChallengeTimeout,
-			RejectTimeout:    defaultRejectTimeout,
-			Language:         "ru",
+			ChallengeTimeout: config.Get().ChallengeTimeout,
+			RejectTimeout:    config.Get().RejectTimeout,
+			Language:         config.Get().DefaultLanguage,
 			ID:               chat.ID,
 		}
 
@@ -123,63 +190,62 @@ func (r *Reactor) Handle(ctx context.Context, u *api.Update, chat *api.Chat, use
 		return true, nil
 	}
 
-	b := r.s.GetBot()
-	if b == nil {
-		entry.Warn("Bot is nil")
-		return false, errors.New("nil bot")
-	}
-
-	if u.MessageReaction != nil {
-		entry.Debug("Processing message reaction")
-		for _, react := range u.MessageReaction.NewReaction {
-			flags := map[string]int{}
-			emoji := react.Emoji
-			if react.Type == api.StickerTypeCustomEmoji {
-				entry.Debug("processing custom emoji")
-				emojiStickers, err := b.GetCustomEmojiStickers(api.GetCustomEmojiStickersConfig{
-					CustomEmojiIDs: []string{react.CustomEmoji},
-				})
-				if err != nil {
-					entry.WithError(err).Warn("custom emoji get error")
-					continue
-				}
-				if len(emojiStickers) > 0 {
-					emoji = emojiStickers[0].Emoji
-				}
-			}
-			if slices.Contains(flaggedEmojis, emoji) {
-				entry.WithField("emoji", emoji).Debug("flagged emoji detected")
-				flags[emoji]++
-			}
-
-			for _, flagged := range flags {
-				if flagged >= 5 {
-					entry.Warn("user reached flag threshold, attempting to ban")
-					if err := bot.BanUserFromChat(b, user.ID, chat.ID); err != nil {
-						entry.WithFields(log.Fields{
-							"user": bot.GetFullName(user),
-							"chat": chat.Title,
-						}).Error("cant ban user in chat")
-					}
-					return true, nil
-				}
-			}
-		}
-	}
-
 	if u.Message != nil {
 		entry.Debug("handling new message")
-		if err := r.handleFirstMessage(ctx, u, chat, user); err != nil {
+		if err := r.handleMessage(ctx, u, chat, user); err != nil {
 			entry.WithError(err).Error("error handling new message")
 		}
 	}
 
+	if u.EditedMessage != nil {
+		entry.Debug("handling edited message")
+		if err := r.handleEdit(ctx, chat, user, u.EditedMessage); err != nil {
+			entry.WithError(err).Error("error handling edited message")
+		}
+	}
+
 	return true, nil
 }
 
-func (r *Reactor) handleFirstMessage(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) error {
-	entry := r.getLogEntry().WithField("method", "handleFirstMessage")
-	entry.Debug("handling first message")
+// handleEdit rescans an edited message, catching a clean first message edited into spam after the user got trusted.
+// The link policy applies to every edit, edits made later than the edit window after the post are left alone.
+func (r *Reactor) handleEdit(ctx context.Context, chat *api.Chat, user *api.User, m *api.Message) error {
+	entry := r.getLogEntry().WithFields(log.Fields{"method": "handleEdit", "chat_id": chat.ID, "user_id": user.ID, "message_id": m.MessageID})
+	scope := r.setting("edit_scope")
+	if scope == editScopeOff {
+		return nil
+	}
+	if window := r.setting.Duration("edit_window"); window > 0 && time.Duration(m.EditDate-m.Date)*time.Second > window {
+		entry.Debug("edited after the edit window, not rescanning")
+		return nil
+	}
+
+	member, err := r.s.GetDB().GetMember(chat.ID, user.ID)
+	if err != nil {
+		return errors.WithMessage(err, "cant get member")
+	}
+	if removed, err := r.enforceLinkPolicy(ctx, chat, user, m, member != nil); err != nil {
+		entry.WithError(err).Warn("cant enforce link policy")
+	} else if removed {
+		return nil
+	}
+
+	onProbation := member == nil || (member.TrustedAt != nil && time.Since(*member.TrustedAt) < r.setting.Duration("probation"))
+	if !onProbation && scope != editScopeAll {
+		entry.Debug("user is trusted, not rescanning")
+		return nil
+	}
+	if (m.SenderChat != nil && m.SenderChat.ID == chat.ID) || isChatAdmin(r.s, chat.ID, user.ID) {
+		return nil
+	}
+	entry.WithField("trusted", member != nil).Info("rescanning edited message")
+	return errors.WithMessage(r.checkFirstMessage(ctx, chat, user, m), "cant rescan edited message")
+}
+
+// handleMessage enforces the link policy on every message and checks the first message of a user
+func (r *Reactor) handleMessage(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) error {
+	entry := r.getLogEntry().WithField("method", "handleMessage")
+	entry.Debug("handling message")
 	m := u.Message
 
 	entry.Debug("checking if user is a member")
@@ -187,6 +253,11 @@ func (r *Reactor) handleFirstMessage(ctx context.Context, u *api.Update, chat *a
 	if err != nil {
 		return errors.WithMessage(err, "cant check if member")
 	}
+	if removed, err := r.enforceLinkPolicy(ctx, chat, user, m, isMember); err != nil {
+		entry.WithError(err).Warn("cant enforce link policy")
+	} else if removed {
+		return nil
+	}
 	if isMember {
 		entry.Debug("user is already a member")
 		return nil
@@ -211,24 +282,62 @@ func (r *Reactor) checkFirstMessage(ctx context.Context, chat *api.Chat, user *a
 	entry.Debug("checking first message")
 	b := r.s.GetBot()
 
-	messageContent := m.Text
-	if messageContent == "" && m.Caption != "" {
-		messageContent = m.Caption
-	}
-
-	if messageContent == "" {
-		entry.Warn("empty message content, skipping spam check")
+	content := media.Describe(m, config.Get().ImageLimit)
+	if content.Kind == "" {
+		entry.Debug("service message, skipping spam check")
 		return nil
 	}
+	// the image is downloaded once for OCR and the vision model
+	loadImage := sync.OnceValues(func() ([]byte, error) { return r.downloadImage(ctx, content.Image) })
+	if content.Image != nil {
+		if text, err := r.readImage(ctx, loadImage); err != nil {
+			entry.WithError(err).Warn("cant read image text")
+		} else if text != "" {
+			content.Text = strings.TrimSpace(content.Text + "\n" + text)
+		}
+	}
+	messageContent := content.Text
+	policy := r.s.GetPrivacy(chat.ID)
 
-	banSpammer := func(chatID, userID int64, messageID int) (bool, error) {
+	banSpammer := func(chatID, userID int64, messageID int, source, verdict string) (bool, error) {
 		entry.Info("spam detected, banning user")
+		r.s.GetBus().Publish(event.SpamDetected{
+			ChatID:    chatID,
+			UserID:    userID,
+			UserName:  bot.GetUN(user),
+			MessageID: messageID,
+			Source:    source,
+			Verdict:   verdict,
+			Content:   messageContent,
+		})
 		var errs []error
 		if err := bot.DeleteChatMessage(b, chatID, messageID); err != nil {
 			errs = append(errs, errors.Wrap(err, "failed to delete message"))
+		} else {
+			r.s.GetBus().Publish(event.MessageDeleted{
+				ChatID:    chatID,
+				UserID:    userID,
+				UserName:  bot.GetUN(user),
+				MessageID: messageID,
+				Source:    source,
+				Reason:    verdict,
+				Content:   messageContent,
+			})
+		}
+		// a member on probation who edited a message into spam loses the trust
+		if err := r.s.DeleteMember(ctx, chatID, userID); err != nil {
+			entry.WithError(err).Warn("cant revoke trust")
 		}
 		if err := bot.BanUserFromChat(b, userID, chatID); err != nil {
 			errs = append(errs, errors.Wrap(err, "failed to ban user"))
+		} else {
+			r.s.GetBus().Publish(event.UserBanned{
+				ChatID:   chatID,
+				UserID:   userID,
+				UserName: bot.GetUN(user),
+				Source:   source,
+				Reason:   verdict,
+			})
 		}
 		if len(errs) > 0 {
 			lang := r.getLanguage(chat, user)
@@ -256,8 +365,57 @@ func (r *Reactor) checkFirstMessage(ctx context.Context, chat *api.Chat, user *a
 		return true, nil
 	}
 
+	done, exempt, err := r.checkLists(ctx, chat, user, m, messageContent, banSpammer)
+	if done || err != nil {
+		return err
+	}
+
+	// the gatekeeper records the match when the user joins
+	match, err := federation.Lookup(r.s.GetDB(), chat.ID, user.ID)
+	if err != nil {
+		entry.WithError(err).Warn("cant look up trust group decisions")
+	}
+	switch {
+	case match == nil, match.Action == federation.ActionWatch:
+	case match.Spam() && match.Action == federation.ActionPreBan:
+		entry.WithField("group", match.Group).Info("trust group decided on spam, banning")
+		if _, err := banSpammer(chat.ID, user.ID, m.MessageID, event.SourceFederation, match.Provenance()); err != nil {
+			return errors.Wrap(err, "failed to ban spammer")
+		}
+		return nil
+	case match.Trusted():
+		entry.WithField("group", match.Group).Info("trust group trusts the user, skipping spam check")
+		if err := r.s.InsertMember(ctx, chat.ID, user.ID); err != nil {
+			return errors.Wrap(err, "failed to insert member")
+		}
+		return nil
+	}
+
+	if finding, ok := r.mediaRules().Check(m); ok {
+		entry = entry.WithFields(log.Fields{"rule": finding.Rule, "action": finding.Action})
+		verdict := "media: " + finding.Rule
+		if finding.Action == media.ActionBan {
+			metrics.SpamVerdicts.WithLabelValues("media", "spam").Inc()
+			entry.Info("first message breaks a media rule, banning")
+			if _, err := banSpammer(chat.ID, user.ID, m.MessageID, event.SourceReactor, verdict); err != nil {
+				return errors.Wrap(err, "failed to ban spammer")
+			}
+			return nil
+		}
+		metrics.SpamVerdicts.WithLabelValues("media", "deleted").Inc()
+		entry.Info("first message breaks a media rule, deleting")
+		if err := r.deleteMessage(chat, user, m, verdict, messageContent); err != nil {
+			return errors.WithMessage(err, "cant delete message")
+		}
+		return nil
+	}
+
+	if done, err := r.checkFingerprints(chat, user, m, messageContent, banSpammer); done || err != nil {
+		return err
+	}
+
 	entry.Debug("checking if user is banned")
-	url := fmt.Sprintf("https://api.lols.bot/account?id=%d", user.ID)
+	url := fmt.Sprintf("%s/account?id=%d", strings.TrimSuffix(config.Get().LolsURL, "/"), user.ID)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		entry.WithError(err).Error("failed to create request")
@@ -265,9 +423,11 @@ func (r *Reactor) checkFirstMessage(ctx context.Context, chat *api.Chat, user *a
 	}
 	req.Header.Set("accept", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	lolsStart := time.Now()
+	resp, err := lolsClient.Do(req)
+	metrics.LolsDuration.Observe(time.Since(lolsStart).Seconds())
 	if err != nil {
+		metrics.LolsErrors.Inc()
 		entry.WithError(err).Error("failed to send request")
 		return errors.WithMessage(err, "failed to send request")
 	}
@@ -275,19 +435,21 @@ func (r *Reactor) checkFirstMessage(ctx context.Context, chat *api.Chat, user *a
 
 	banCheck := banInfo{}
 	if err := json.NewDecoder(resp.Body).Decode(&banCheck); err != nil {
+		metrics.LolsErrors.Inc()
 		entry.WithError(err).Error("failed to decode response")
 		return errors.WithMessage(err, "failed to decode response")
 	}
 
 	if banCheck.Banned {
+		metrics.SpamVerdicts.WithLabelValues("lols", "spam").Inc()
 		entry = entry.WithFields(log.Fields{
 			"chat_id":    chat.ID,
 			"user_id":    user.ID,
 			"message_id": m.MessageID,
-			"user_name":  bot.GetUN(user), // Add the username to the log
-			"message":    messageContent,  // Add the banned message content to the log
+			"user_name":  bot.GetUN(user),
+			"message":    policy.Loggable(messageContent),
 		})
-		success, err := banSpammer(chat.ID, user.ID, m.MessageID)
+		success, err := banSpammer(chat.ID, user.ID, m.MessageID, event.SourceReactor, "lols.bot")
 		if err != nil {
 			entry.WithError(err).Error("Failed to execute ban action on spammer")
 			return errors.Wrap(err, "failed to ban spammer")
@@ -300,39 +462,78 @@ func (r *Reactor) checkFirstMessage(ctx context.Context, chat *api.Chat, user *a
 		return nil
 	}
 
-	entry.Info("sending first message to OpenAI for spam check", r.model)
-	llmResp, err := r.llmAPI.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: r.model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role: openai.ChatMessageRoleSystem,
-					Content: `
-						Вы система обнаружения спама.
-						Отвечайте 'SPAM', если сообщение является спамом, или 'NOT_SPAM', если не является.
-						Не предоставляйте никакой другой информации. Обращайте особое внимание на сообщения, которые 
-						содержат предложения о заработке и наборы на удаленную работу или участие в операциях с 
-						криптовалютами. В подавляющем большинстве они являются спамом! Спаммеры часто любят смешивать 
-						буквы кириллического и латинского алфавита, чтобы обмануть спам системы, обращайте на такие 
-						сообщения повышенное внимание.
-					`,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: messageContent,
-				},
+	metrics.SpamVerdicts.WithLabelValues("lols", "not_spam").Inc()
+
+	if exempt {
+		entry.Info("allowlisted message is not sent to the LLM, the user stays untrusted")
+		return nil
+	}
+
+	if content.Image != nil && policy.RemoteLLM {
+		spam, checked, err := r.classifyImage(ctx, chat, messageContent, loadImage)
+		switch {
+		case err != nil:
+			entry.WithError(err).Warn("cant classify image, checking the text only")
+		case checked && spam:
+			metrics.SpamVerdicts.WithLabelValues("vision", "spam").Inc()
+			r.rememberSpam(chat, user, messageContent, "vision")
+			if _, err := banSpammer(chat.ID, user.ID, m.MessageID, event.SourceReactor, "llm vision"); err != nil {
+				return errors.Wrap(err, "failed to ban spammer")
+			}
+			return nil
+		case checked:
+			metrics.SpamVerdicts.WithLabelValues("vision", "not_spam").Inc()
+			entry.Info("photo passed spam check, inserting member")
+			if err := r.s.InsertMember(ctx, chat.ID, user.ID); err != nil {
+				return errors.Wrap(err, "failed to insert member")
+			}
+			return nil
+		}
+	}
+
+	if messageContent == "" {
+		metrics.SpamVerdicts.WithLabelValues("media", "unchecked").Inc()
+		entry.WithField("kind", content.Kind).Info("nothing to check in the message, the user stays untrusted")
+		return nil
+	}
+
+	if !policy.RemoteLLM {
+		metrics.SpamVerdicts.WithLabelValues("llm", "skipped").Inc()
+		// the local checks found nothing, which is no proof of a clean message, so the user stays untrusted
+		entry.WithField("privacy", policy.Mode).Info("remote classification is not allowed, the user stays untrusted")
+		return nil
+	}
+
+	entry.Info("sending first message to the LLM for spam check")
+	res, err := r.llm.Complete(ctx, llm.Request{
+		ChatID: chat.ID,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: spamPrompt,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: messageContent,
 			},
 		},
-	)
-
+		CacheKey: llm.Key("spam", messageContent),
+	})
+	if errors.Is(err, llm.ErrBudgetExceeded) {
+		metrics.SpamVerdicts.WithLabelValues("llm", "skipped").Inc()
+		entry.WithError(err).Warn("LLM budget is spent, the user stays untrusted")
+		return nil
+	}
 	if err != nil {
 		entry.WithError(err).Error("failed to create chat completion")
 		return errors.Wrap(err, "failed to create chat completion")
 	}
+	entry.WithFields(log.Fields{"provider": res.Provider, "model": res.Model, "cached": res.Cached}).Debug("got LLM verdict")
 
-	if len(llmResp.Choices) > 0 && llmResp.Choices[0].Message.Content == "SPAM" {
-		success, err := banSpammer(chat.ID, user.ID, m.MessageID)
+	if res.Content == "SPAM" {
+		metrics.SpamVerdicts.WithLabelValues("llm", "spam").Inc()
+		r.rememberSpam(chat, user, messageContent, "llm")
+		success, err := banSpammer(chat.ID, user.ID, m.MessageID, event.SourceReactor, "llm")
 		if err != nil {
 			entry.WithError(err).Error("failed to ban spammer")
 			return errors.Wrap(err, "failed to ban spammer")
@@ -341,7 +542,11 @@ func (r *Reactor) checkFirstMessage(ctx context.Context, chat *api.Chat, user *a
 			entry.Error("failed to ban spammer")
 			return errors.New("failed to ban spammer")
 		}
+		// the spammer must not fall through: it would be counted as a clean verdict and stored as a trusted member,
+		// whose messages are never checked again, e.g. after an unban
+		return nil
 	}
+	metrics.SpamVerdicts.WithLabelValues("llm", "not_spam").Inc()
 
 	entry.Debug("message passed spam check, inserting member")
 	if err := r.s.InsertMember(ctx, chat.ID, user.ID); err != nil {
@@ -353,14 +558,261 @@ func (r *Reactor) checkFirstMessage(ctx context.Context, chat *api.Chat, user *a
 	return nil
 }
 
+// checkLists bans blocklisted first messages and trusts allowlisted users, done reports whether the lists decided,
+// exempt whether the message matched the other allowlist entries, which spare it the LLM only
+func (r *Reactor) checkLists(
+	ctx context.Context,
+	chat *api.Chat,
+	user *api.User,
+	m *api.Message,
+	content string,
+	banSpammer func(chatID, userID int64, messageID int, source, verdict string) (bool, error),
+) (done, exempt bool, err error) {
+	entry := r.getLogEntry().WithField("method", "checkLists")
+	if r.lists == nil {
+		return false, false, nil
+	}
+	res, err := r.lists.Check(lists.Subject{UserID: user.ID, Username: user.UserName, Text: content, Links: links.Extract(m)})
+	if err != nil {
+		entry.WithError(err).Warn("cant check operator lists")
+		return false, false, nil
+	}
+	switch res.Verdict {
+	case lists.VerdictBlock:
+		metrics.SpamVerdicts.WithLabelValues("lists", "spam").Inc()
+		entry.WithFields(log.Fields{"entry": res.Entry.ID, "kind": res.Entry.Kind}).Info("blocklisted, banning")
+		verdict := fmt.Sprintf("blocklist %s #%d", res.Entry.Kind, res.Entry.ID)
+		if _, err := banSpammer(chat.ID, user.ID, m.MessageID, event.SourceReactor, verdict); err != nil {
+			return true, false, errors.Wrap(err, "failed to ban spammer")
+		}
+		return true, false, nil
+	case lists.VerdictAllow:
+		metrics.SpamVerdicts.WithLabelValues("lists", "not_spam").Inc()
+		entry.WithFields(log.Fields{"entry": res.Entry.ID, "kind": res.Entry.Kind}).Debug("allowlisted, trusting")
+		if err := r.s.InsertMember(ctx, chat.ID, user.ID); err != nil {
+			return true, false, errors.Wrap(err, "failed to insert member")
+		}
+		return true, false, nil
+	case lists.VerdictExempt:
+		metrics.SpamVerdicts.WithLabelValues("lists", "exempt").Inc()
+		entry.WithFields(log.Fields{"entry": res.Entry.ID, "kind": res.Entry.Kind}).Debug("allowlisted content, the rest of the checks apply")
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+// checkFingerprints bans a first message that is a near duplicate of recent spam, done reports whether it was one
+func (r *Reactor) checkFingerprints(
+	chat *api.Chat,
+	user *api.User,
+	m *api.Message,
+	content string,
+	banSpammer func(chatID, userID int64, messageID int, source, verdict string) (bool, error),
+) (done bool, err error) {
+	entry := r.getLogEntry().WithField("method", "checkFingerprints")
+	if r.spam == nil {
+		return false, nil
+	}
+	scope, err := fingerprint.Scope(r.s.GetDB(), chat.ID)
+	if err != nil {
+		entry.WithError(err).Warn("cant get spam fingerprint scope")
+		return false, nil
+	}
+	match, similarity, err := r.spam.Match(content, scope, config.Get().SpamIndex, time.Now())
+	if err != nil {
+		entry.WithError(err).Warn("cant check spam fingerprints")
+		return false, nil
+	}
+	if match == nil {
+		return false, nil
+	}
+	metrics.SpamVerdicts.WithLabelValues("fingerprint", "spam").Inc()
+	entry.WithFields(log.Fields{"fingerprint": match.ID, "similarity": similarity}).Info("near duplicate of spam, banning")
+	verdict := fmt.Sprintf("near duplicate of spam #%d", match.ID)
+	if _, err := banSpammer(chat.ID, user.ID, m.MessageID, event.SourceReactor, verdict); err != nil {
+		return true, errors.Wrap(err, "failed to ban spammer")
+	}
+	return true, nil
+}
+
+// rememberSpam fingerprints the text of a spam message, so that its variations are caught without the LLM.
+// Only verdicts on the content are remembered: lols.bot bans the author, whatever the message is.
+func (r *Reactor) rememberSpam(chat *api.Chat, user *api.User, content, source string) {
+	if r.spam == nil {
+		return
+	}
+	spam := &db.SpamFingerprint{ChatID: chat.ID, UserID: user.ID, Source: source}
+	if _, err := r.spam.Add(content, spam, config.Get().SpamIndex); err != nil {
+		r.getLogEntry().WithField("method", "rememberSpam").WithError(err).Warn("cant remember spam fingerprint")
+	}
+}
+
+// enforceLinkPolicy deletes a message breaking the link policy of the chat, trusted tells whether the author is a member.
+// Admins and the chat posting as itself are exempt.
+func (r *Reactor) enforceLinkPolicy(ctx context.Context, chat *api.Chat, user *api.User, m *api.Message, trusted bool) (bool, error) {
+	entry := r.getLogEntry().WithFields(log.Fields{"method": "enforceLinkPolicy", "chat_id": chat.ID, "user_id": user.ID})
+	stored, err := r.s.GetDB().GetLinkPolicy(chat.ID)
+	if err != nil {
+		return false, errors.WithMessage(err, "cant get link policy")
+	}
+	policy := links.FromDB(chat.ID, stored)
+	if !policy.Enforced() {
+		return false, nil
+	}
+	found := links.Extract(m)
+	if len(found) == 0 {
+		return false, nil
+	}
+	// unshortening sends the links to the redirector hosts or the resolver service, the strict mode keeps them local
+	if r.s.GetPrivacy(chat.ID).RemoteLLM {
+		var errs []error
+		found, errs = links.Unshorten(ctx, r.resolver.Load().(linkResolver).Resolver, config.Get().Shorteners, found)
+		for _, err := range errs {
+			entry.WithError(err).Debug("cant unshorten link")
+		}
+	}
+	violation, ok := policy.Check(found, trusted)
+	if !ok || (m.SenderChat != nil && m.SenderChat.ID == chat.ID) || isChatAdmin(r.s, chat.ID, user.ID) {
+		return false, nil
+	}
+
+	entry.WithField("rule", violation.Rule).Info("message breaks the link policy, deleting")
+	content := m.Text
+	if content == "" {
+		content = m.Caption
+	}
+	reason := fmt.Sprintf("link policy: %s %s", violation.Rule, links.Domain(violation.Link))
+	if err := r.deleteMessage(chat, user, m, reason, content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteMessage deletes the message and records it in the moderation log
+func (r *Reactor) deleteMessage(chat *api.Chat, user *api.User, m *api.Message, reason, content string) error {
+	if err := bot.DeleteChatMessage(r.s.GetBot(), chat.ID, m.MessageID); err != nil {
+		return errors.WithMessage(err, "cant delete message")
+	}
+	r.s.GetBus().Publish(event.MessageDeleted{
+		ChatID:    chat.ID,
+		UserID:    user.ID,
+		UserName:  bot.GetUN(user),
+		MessageID: m.MessageID,
+		Source:    event.SourceReactor,
+		Reason:    reason,
+		Content:   content,
+	})
+	return nil
+}
+
+// downloadImage fetches the photo, the size was checked against the image limit already
+func (r *Reactor) downloadImage(ctx context.Context, image *api.PhotoSize) ([]byte, error) {
+	url, err := bot.GetFileURL(r.s.GetBot(), image.FileID)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant get file url")
+	}
+	return media.Download(ctx, url, config.Get().ImageLimit)
+}
+
+// readImage returns the text of the image, empty when there is no text extractor
+func (r *Reactor) readImage(ctx context.Context, load func() ([]byte, error)) (string, error) {
+	extractor := r.extractor.Load().(textExtractor).TextExtractor
+	if extractor == nil {
+		return "", nil
+	}
+	data, err := load()
+	if err != nil {
+		return "", err
+	}
+	return extractor.ExtractText(ctx, data)
+}
+
+// classifyImage asks the vision model about the photo with the text of the message,
+// checked is false when the chat did not turn image checks on or used up the daily limit
+func (r *Reactor) classifyImage(ctx context.Context, chat *api.Chat, text string, load func() ([]byte, error)) (spam, checked bool, err error) {
+	entry := r.getLogEntry().WithFields(log.Fields{"method": "classifyImage", "chat_id": chat.ID})
+	settings, err := r.s.GetSettings(chat.ID)
+	if err != nil {
+		return false, false, errors.WithMessage(err, "cant get settings")
+	}
+	if settings == nil || !settings.Vision {
+		return false, false, nil
+	}
+	data, err := load()
+	if err != nil {
+		return false, false, errors.WithMessage(err, "cant download image")
+	}
+	key := llm.Key("vision", text, data)
+	// a known image costs nothing, so it doesn't spend the daily limit either
+	if res, ok := r.llm.Peek(key); ok {
+		return res.Content == "SPAM", true, nil
+	}
+	cfg := config.Get().OpenAI
+	if !r.vision.Take(chat.ID, cfg.VisionDailyLimit, time.Now()) {
+		metrics.SpamVerdicts.WithLabelValues("vision", "skipped").Inc()
+		entry.WithField("limit", cfg.VisionDailyLimit).Warn("daily image check limit reached")
+		return false, false, nil
+	}
+
+	var parts []openai.ChatMessagePart
+	if text != "" {
+		parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: text})
+	}
+	parts = append(parts, openai.ChatMessagePart{
+		Type: openai.ChatMessagePartTypeImageURL,
+		ImageURL: &openai.ChatMessageImageURL{
+			URL:    "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data),
+			Detail: openai.ImageURLDetail(cfg.VisionDetail),
+		},
+	})
+	entry.WithField("size", len(data)).Info("sending photo to the vision model for spam check")
+	res, err := r.llm.Complete(ctx, llm.Request{
+		ChatID:    chat.ID,
+		MaxTokens: visionMaxTokens,
+		Vision:    true,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: spamPrompt + visionPrompt},
+			{Role: openai.ChatMessageRoleUser, MultiContent: parts},
+		},
+		CacheKey: key,
+	})
+	if errors.Is(err, llm.ErrBudgetExceeded) {
+		metrics.SpamVerdicts.WithLabelValues("vision", "skipped").Inc()
+		entry.WithError(err).Warn("LLM budget is spent, the photo stays unchecked")
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, errors.WithMessage(err, "cant create chat completion")
+	}
+	return res.Content == "SPAM", true, nil
+}
+
+// mediaRules returns the actions of the media rules set in the plugin settings
+func (r *Reactor) mediaRules() media.Rules {
+	rules := media.DefaultRules()
+	if r.setting == nil {
+		return rules
+	}
+	for key, action := range map[string]*string{
+		"media_executable": &rules.Executable,
+		"media_contact":    &rules.Contact,
+		"media_location":   &rules.Location,
+		"media_forward":    &rules.Forward,
+		"media_story":      &rules.Story,
+	} {
+		*action = media.ParseAction(r.setting(key), *action)
+	}
+	return rules
+}
+
 func (r *Reactor) getLogEntry() *log.Entry {
-	return log.WithField("object", "Reactor")
+	return log.WithFields(log.Fields{"context": "reactor", "object": "Reactor"})
 }
 
 func (r *Reactor) getLanguage(chat *api.Chat, user *api.User) string {
 	entry := r.getLogEntry().WithField("method", "getLanguage")
 	entry.Debug("getting language for chat and user")
-	if settings, err := r.s.GetDB().GetSettings(chat.ID); !tool.Try(err) {
+	if settings, err := r.s.GetSettings(chat.ID); !tool.Try(err) && settings != nil {
 		entry.WithField("language", settings.Language).Debug("using language from chat settings")
 		return settings.Language
 	}
@@ -0,0 +1,67 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminServer is the optional HTTP listener for metrics, health and profiling endpoints
+type AdminServer struct {
+	mux *http.ServeMux
+	srv *http.Server
+}
+
+func NewAdminServer(addr string) *AdminServer {
+	mux := http.NewServeMux()
+	return &AdminServer{
+		mux: mux,
+		srv: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		},
+	}
+}
+
+// OK is a trivial probe handler
+func OK() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
+
+// EnableProfiling serves the pprof endpoints, which expose the command line and the memory of the process
+func (s *AdminServer) EnableProfiling() {
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func (s *AdminServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run serves until ctx is cancelled
+func (s *AdminServer) Run(ctx context.Context) error {
+	entry := log.WithFields(log.Fields{"context": "admin_server", "addr": s.srv.Addr})
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.srv.Shutdown(shutdownCtx)
+	}()
+
+	entry.Info("admin server listening")
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
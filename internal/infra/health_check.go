@@ -1,31 +1,165 @@
 package infra
 
 import (
-	"os"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
-const (
-	checkExecInterval = 5 * time.Second
+const healthCheckTimeout = 5 * time.Second
+
+type (
+	// Check returns nil when the component is healthy
+	Check func(ctx context.Context) error
+
+	// Health aggregates liveness and readiness checks
+	Health struct {
+		mu        sync.RWMutex
+		liveness  map[string]Check
+		readiness map[string]Check
+	}
+
+	// Heartbeat remembers when some recurring operation last succeeded
+	Heartbeat struct {
+		last atomic.Int64
+	}
+
+	healthReport struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
 )
 
-func MonitorExecutable() chan struct{} {
-	ch := make(chan struct{})
-	go func() {
-		exeFilename, _ := os.Executable()
-		log.Debug(exeFilename)
-		stat, _ := os.Stat(exeFilename)
-		originalTime := stat.ModTime()
-		for {
-			time.Sleep(checkExecInterval)
-			stat, _ := os.Stat(exeFilename)
-			if !originalTime.Equal(stat.ModTime()) {
-				ch <- struct{}{}
-				return
+func NewHealth() *Health {
+	return &Health{
+		liveness:  map[string]Check{},
+		readiness: map[string]Check{},
+	}
+}
+
+func (h *Health) AddLiveness(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness[name] = check
+}
+
+func (h *Health) AddReadiness(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness[name] = check
+}
+
+func (h *Health) LivenessHandler() http.Handler {
+	return h.handler(func() map[string]Check { return h.liveness })
+}
+
+func (h *Health) ReadinessHandler() http.Handler {
+	return h.handler(func() map[string]Check { return h.readiness })
+}
+
+func (h *Health) handler(checks func() map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		h.mu.RLock()
+		report, ok := run(ctx, checks())
+		h.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+func run(ctx context.Context, checks map[string]Check) (healthReport, bool) {
+	report := healthReport{Status: "ok", Checks: map[string]string{}}
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok = true
+	)
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			status := "ok"
+			if err := check(ctx); err != nil {
+				status = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = status
+			if status != "ok" {
+				ok = false
 			}
+		}(name, checks[name])
+	}
+	wg.Wait()
+	if !ok {
+		report.Status = "fail"
+	}
+	return report, ok
+}
+
+// Beat records a success
+func (hb *Heartbeat) Beat() {
+	if hb == nil {
+		return
+	}
+	hb.last.Store(time.Now().UnixNano())
+}
+
+// Last returns the time of the latest success, zero if there was none
+func (hb *Heartbeat) Last() time.Time {
+	if ns := hb.last.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Check fails if there was no success within maxAge
+func (hb *Heartbeat) Check(maxAge time.Duration) Check {
+	return func(context.Context) error {
+		last := hb.Last()
+		if last.IsZero() {
+			return fmt.Errorf("no success yet")
+		}
+		if age := time.Since(last); age > maxAge {
+			return fmt.Errorf("last success %s ago", age.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// Cached memoizes the check result for ttl, for checks that call remote services
+func Cached(ttl time.Duration, check Check) Check {
+	var (
+		mu      sync.Mutex
+		checked time.Time
+		result  error
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			return result
 		}
-	}()
-	return ch
+		result = check(ctx)
+		checked = time.Now()
+		return result
+	}
 }
@@ -0,0 +1,4 @@
+package links
+
+// NewRedirectResolver lets the tests reach the redirector on the loopback address
+var NewRedirectResolver = newRedirectResolver
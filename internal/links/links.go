@@ -0,0 +1,89 @@
+// Package links finds the links of a message, unshortens redirectors and enforces the link policy of a chat
+package links
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// schemePattern finds links with a scheme, Telegram marks the other ones with url entities
+var schemePattern = regexp.MustCompile(`(?i)\b(?:https?|tg)://[^\s<>"]+`)
+
+// Extract returns the links of the message: in the text or caption, behind text links and on inline buttons
+func Extract(m *api.Message) []string {
+	if m == nil {
+		return nil
+	}
+	var found []string
+	add := func(link string) {
+		link = strings.TrimRight(link, ".,;:!?)]}'\"")
+		if link != "" && !slices.Contains(found, link) {
+			found = append(found, link)
+		}
+	}
+	for _, part := range []struct {
+		text     string
+		entities []api.MessageEntity
+	}{{m.Text, m.Entities}, {m.Caption, m.CaptionEntities}} {
+		for _, link := range schemePattern.FindAllString(part.text, -1) {
+			add(link)
+		}
+		for _, e := range part.entities {
+			switch e.Type {
+			case "url":
+				add(entityText(part.text, e))
+			case "text_link":
+				add(e.URL)
+			}
+		}
+	}
+	if m.ReplyMarkup != nil {
+		for _, row := range m.ReplyMarkup.InlineKeyboard {
+			for _, button := range row {
+				if button.URL != nil {
+					add(*button.URL)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// Domain returns the host of the link without www, tg:// links are t.me ones
+func Domain(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	if strings.EqualFold(u.Scheme, "tg") {
+		return "t.me"
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// NormalizeDomain brings a domain given by an admin to the form Domain returns
+func NormalizeDomain(domain string) string {
+	return Domain(strings.TrimSpace(domain))
+}
+
+// MatchDomain reports whether the domain is the pattern or its subdomain
+func MatchDomain(domain, pattern string) bool {
+	return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+}
+
+// entityText cuts the entity out of the text, entity offsets count UTF-16 code units
+func entityText(text string, e api.MessageEntity) string {
+	units := utf16.Encode([]rune(text))
+	if e.Offset < 0 || e.Length <= 0 || e.Offset+e.Length > len(units) {
+		return ""
+	}
+	return string(utf16.Decode(units[e.Offset : e.Offset+e.Length]))
+}
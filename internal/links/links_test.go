@@ -0,0 +1,117 @@
+package links_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/iamwavecut/ngbot/internal/links"
+)
+
+func TestExtract(t *testing.T) {
+	button := "https://t.me/+Invite123"
+	m := &api.Message{
+		// the emoji takes two UTF-16 code units, which shifts the entity offsets
+		Text: "👋 join example.org or https://promo.example/x.",
+		Entities: []api.MessageEntity{
+			{Type: "url", Offset: 8, Length: 11},
+			{Type: "text_link", Offset: 3, Length: 4, URL: "https://hidden.example/"},
+		},
+		ReplyMarkup: &api.InlineKeyboardMarkup{InlineKeyboard: [][]api.InlineKeyboardButton{{{Text: "Join", URL: &button}}}},
+	}
+	got := links.Extract(m)
+	want := []string{"https://promo.example/x", "example.org", "https://hidden.example/", button}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := links.Policy{Mode: links.ModeUntrusted, Allowed: []string{"github.com"}, Denied: []string{"scam.example"}}
+	cases := []struct {
+		name    string
+		links   []string
+		trusted bool
+		rule    string
+	}{
+		{"no links", nil, false, ""},
+		{"allowed subdomain", []string{"https://gist.github.com/x"}, false, ""},
+		{"untrusted link", []string{"https://example.org"}, false, links.RuleNotAllowed},
+		{"trusted link", []string{"https://example.org"}, true, ""},
+		{"denied for trusted", []string{"www.Scam.Example/landing"}, true, links.RuleDenied},
+		{"telegram deep link", []string{"tg://join?invite=abc"}, false, links.RuleNotAllowed},
+	}
+	for _, c := range cases {
+		v, ok := policy.Check(c.links, c.trusted)
+		if ok != (c.rule != "") || v.Rule != c.rule {
+			t.Errorf("%s: got %q %v, want %q", c.name, v.Rule, ok, c.rule)
+		}
+	}
+
+	if _, ok := (links.Policy{Mode: links.ModeOff}).Check([]string{"https://example.org"}, false); ok {
+		t.Error("policy turned off rejected a link")
+	}
+}
+
+func TestUnshorten(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") != "https://bit.ly/abc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"url": "https://scam.example/landing"})
+	}))
+	defer service.Close()
+
+	resolver := links.NewResolver(service.URL)
+	got, errs := links.Unshorten(context.Background(), resolver, []string{"bit.ly"}, []string{
+		"https://bit.ly/abc",
+		"https://bit.ly/unknown",
+		"https://example.org",
+	})
+	want := []string{"https://scam.example/landing", "https://bit.ly/unknown", "https://example.org"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(errs) != 1 {
+		t.Errorf("got errors %v, want one for the unknown link", errs)
+	}
+
+	// a message full of redirector links gets only the first ones resolved
+	many := []string{"https://bit.ly/abc", "https://bit.ly/abc", "https://bit.ly/abc", "https://bit.ly/abc"}
+	got, errs = links.Unshorten(context.Background(), resolver, []string{"bit.ly"}, many)
+	if got[2] != "https://scam.example/landing" || got[3] != "https://bit.ly/abc" || len(errs) != 1 {
+		t.Errorf("got %q %v, want the last link kept", got, errs)
+	}
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/short":
+			http.Redirect(w, r, "/next", http.StatusFound)
+		case "/next":
+			http.Redirect(w, r, "/landing", http.StatusFound)
+		}
+	}))
+	defer redirector.Close()
+	loopback := links.NewRedirectResolver(func(net.IP) bool { return true })
+	got, errs = links.Unshorten(context.Background(), loopback, []string{"127.0.0.1"}, []string{redirector.URL + "/short"})
+	if len(errs) > 0 || len(got) != 1 || got[0] != redirector.URL+"/next" {
+		t.Errorf("got %q %v, want the first redirect target", got, errs)
+	}
+
+	// the bot does not reach its own network on behalf of a sender
+	u, _ := url.Parse(redirector.URL)
+	for _, link := range []string{redirector.URL + "/short", "http://localhost:" + u.Port() + "/short"} {
+		got, errs = links.Unshorten(context.Background(), links.NewResolver(""), []string{"127.0.0.1", "localhost"}, []string{link})
+		if len(errs) != 1 || got[0] != link {
+			t.Errorf("got %q %v, want %s refused", got, errs, link)
+		}
+	}
+}
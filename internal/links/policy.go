@@ -0,0 +1,73 @@
+package links
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/iamwavecut/ngbot/internal/db"
+)
+
+const (
+	// ModeOff only enforces the denied domains
+	ModeOff = "off"
+	// ModeUntrusted lets members who are not trusted yet post links to the allowed domains only
+	ModeUntrusted = "untrusted"
+	// ModeAll lets everyone but the admins post links to the allowed domains only
+	ModeAll = "all"
+
+	RuleDenied     = "denied domain"
+	RuleNotAllowed = "domain not allowed"
+)
+
+type (
+	// Policy limits the links posted in a chat, the denied domains apply to everyone but the admins
+	Policy struct {
+		ChatID  int64
+		Mode    string
+		Allowed []string
+		Denied  []string
+	}
+
+	// Violation is the first link breaking the policy
+	Violation struct {
+		Link string
+		Rule string
+	}
+)
+
+// Modes lists the policy modes
+func Modes() []string {
+	return []string{ModeOff, ModeUntrusted, ModeAll}
+}
+
+// FromDB returns the stored policy, a chat without one has the policy turned off
+func FromDB(chatID int64, p *db.LinkPolicy) Policy {
+	if p == nil {
+		return Policy{ChatID: chatID, Mode: ModeOff}
+	}
+	return Policy{ChatID: p.ChatID, Mode: p.Mode, Allowed: strings.Fields(p.Allowed), Denied: strings.Fields(p.Denied)}
+}
+
+func (p Policy) ToDB() *db.LinkPolicy {
+	return &db.LinkPolicy{ChatID: p.ChatID, Mode: p.Mode, Allowed: strings.Join(p.Allowed, " "), Denied: strings.Join(p.Denied, " ")}
+}
+
+// Enforced reports whether the policy can reject anything
+func (p Policy) Enforced() bool {
+	return p.Mode != ModeOff || len(p.Denied) > 0
+}
+
+// Check returns the first link breaking the policy, trusted tells whether the author is a trusted member
+func (p Policy) Check(links []string, trusted bool) (Violation, bool) {
+	restricted := p.Mode == ModeAll || (p.Mode == ModeUntrusted && !trusted)
+	for _, link := range links {
+		domain := Domain(link)
+		if slices.ContainsFunc(p.Denied, func(d string) bool { return MatchDomain(domain, d) }) {
+			return Violation{Link: link, Rule: RuleDenied}, true
+		}
+		if restricted && !slices.ContainsFunc(p.Allowed, func(d string) bool { return MatchDomain(domain, d) }) {
+			return Violation{Link: link, Rule: RuleNotAllowed}, true
+		}
+	}
+	return Violation{}, false
+}
@@ -0,0 +1,184 @@
+package links
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ResolverOff turns unshortening off
+	ResolverOff = "off"
+
+	resolveTimeout = 5 * time.Second
+	// unshortenTimeout bounds the resolution of all the links of a message
+	unshortenTimeout = 5 * time.Second
+	// maxUnshortened links of a message are resolved, the others are kept as they are
+	maxUnshortened = 3
+)
+
+// errPrivateAddress refuses to reach the network of the bot on behalf of a sender
+var errPrivateAddress = errors.New("private address")
+
+type (
+	// Resolver returns where a redirector link leads
+	Resolver interface {
+		Resolve(ctx context.Context, link string) (string, error)
+	}
+
+	// redirectResolver reads the first redirect itself, public addresses only
+	redirectResolver struct {
+		client *http.Client
+	}
+
+	// serviceResolver asks a resolver service: GET <endpoint>?url=<link> answers {"url": "<target>"}
+	serviceResolver struct {
+		endpoint string
+		client   *http.Client
+	}
+)
+
+// NewResolver returns the resolver for the setting: empty reads the redirect, "off" is nil, anything else is a resolver service URL
+func NewResolver(setting string) Resolver {
+	switch setting {
+	case "":
+		return newRedirectResolver(isPublic)
+	case ResolverOff:
+		return nil
+	default:
+		return &serviceResolver{endpoint: setting, client: &http.Client{Timeout: resolveTimeout}}
+	}
+}
+
+// newRedirectResolver dials only the addresses allowed, checked after the name is resolved so that DNS can't point it elsewhere
+func newRedirectResolver(allowed func(ip net.IP) bool) *redirectResolver {
+	dialer := &net.Dialer{
+		Timeout: resolveTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowed(ip) {
+				return errors.WithMessage(errPrivateAddress, host)
+			}
+			return nil
+		},
+	}
+	return &redirectResolver{client: &http.Client{
+		Timeout:   resolveTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: resolveTimeout},
+		// the target of a redirect is what the sender links to, the next hops are not visited
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// isPublic tells the addresses of the internet from those of the local and private networks
+func isPublic(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func (r *redirectResolver) Resolve(ctx context.Context, link string) (string, error) {
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+	var lastErr error
+	// some redirectors answer HEAD with an error
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, link, nil)
+		if err != nil {
+			return "", errors.WithMessage(err, "cant create request")
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			if errors.Is(err, errPrivateAddress) || ctx.Err() != nil {
+				return "", err
+			}
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			lastErr = errors.Errorf("status %d", resp.StatusCode)
+			continue
+		}
+		location, err := resp.Location()
+		if errors.Is(err, http.ErrNoLocation) {
+			return link, nil
+		}
+		if err != nil {
+			return "", errors.WithMessage(err, "invalid redirect")
+		}
+		return location.String(), nil
+	}
+	return "", errors.WithMessage(lastErr, "cant read redirect")
+}
+
+func (r *serviceResolver) Resolve(ctx context.Context, link string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.endpoint+"?url="+url.QueryEscape(link), nil)
+	if err != nil {
+		return "", errors.WithMessage(err, "cant create request")
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", errors.WithMessage(err, "cant ask resolver")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("resolver answered with status %d", resp.StatusCode)
+	}
+	var res struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", errors.WithMessage(err, "cant decode resolver answer")
+	}
+	if res.URL == "" {
+		return "", errors.New("resolver returned no url")
+	}
+	return res.URL, nil
+}
+
+// Unshorten replaces the links of the redirector domains with their targets, links that cant be resolved are kept.
+// Only the first few links are resolved, within a deadline, so that a message full of them does not hold the chat up.
+func Unshorten(ctx context.Context, r Resolver, shorteners []string, found []string) ([]string, []error) {
+	if r == nil {
+		return found, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, unshortenTimeout)
+	defer cancel()
+	var errs []error
+	resolved := 0
+	res := make([]string, 0, len(found))
+	for _, link := range found {
+		domain := Domain(link)
+		if !slices.ContainsFunc(shorteners, func(s string) bool { return MatchDomain(domain, s) }) {
+			res = append(res, link)
+			continue
+		}
+		if resolved == maxUnshortened {
+			errs = append(errs, errors.Errorf("cant resolve %s: too many redirector links", link))
+			res = append(res, link)
+			continue
+		}
+		resolved++
+		target, err := r.Resolve(ctx, link)
+		if err != nil {
+			errs = append(errs, errors.WithMessagef(err, "cant resolve %s", link))
+			res = append(res, link)
+			continue
+		}
+		res = append(res, target)
+	}
+	return res, errs
+}
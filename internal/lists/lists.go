@@ -0,0 +1,121 @@
+package lists
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/db"
+)
+
+// Lists keeps the compiled lists of the database, all edits go through it so that the checks see them right away
+type Lists struct {
+	client  db.Client
+	mutex   sync.RWMutex
+	matcher *Matcher
+}
+
+func New(client db.Client) *Lists {
+	return &Lists{client: client}
+}
+
+// Check matches the subject against the lists, loading them on first use
+func (l *Lists) Check(s Subject) (Result, error) {
+	l.mutex.RLock()
+	m := l.matcher
+	l.mutex.RUnlock()
+	if m == nil {
+		var err error
+		if m, err = l.reload(); err != nil {
+			return Result{}, err
+		}
+	}
+	return m.Check(s), nil
+}
+
+// Add stores the entries, normalizing their patterns, and returns how many of them were new
+func (l *Lists) Add(entries []*db.ListEntry) (int, error) {
+	for _, e := range entries {
+		pattern, err := Normalize(Kind(e.Kind), e.Pattern)
+		if err != nil {
+			return 0, err
+		}
+		e.Pattern = pattern
+	}
+	added, err := l.client.InsertListEntries(entries)
+	if err != nil {
+		return 0, errors.WithMessage(err, "cant add list entries")
+	}
+	_, err = l.reload()
+	return added, err
+}
+
+// Remove deletes the entry, reporting whether there was one
+func (l *Lists) Remove(id int64) (bool, error) {
+	removed, err := l.client.DeleteListEntry(id)
+	if err != nil || !removed {
+		return false, errors.WithMessage(err, "cant remove list entry")
+	}
+	_, err = l.reload()
+	return true, err
+}
+
+// Entries returns the entries of the list
+func (l *Lists) Entries(list string) ([]*db.ListEntry, error) {
+	return l.client.GetListEntries(list)
+}
+
+func (l *Lists) reload() (*Matcher, error) {
+	entries, err := l.client.GetListEntries("")
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant load lists")
+	}
+	m, errs := Compile(entries)
+	for _, err := range errs {
+		log.WithFields(log.Fields{"context": "lists", "method": "reload"}).WithError(err).Warn("skipping list entry")
+	}
+	l.mutex.Lock()
+	l.matcher = m
+	l.mutex.Unlock()
+	return m, nil
+}
+
+// Import reads entries from a text file with one pattern per line, lines are "<kind> <pattern>" when kind is empty.
+// Empty lines and lines starting with # are skipped, invalid lines are reported by their number.
+func Import(r io.Reader, list string, kind Kind) ([]*db.ListEntry, []error) {
+	var (
+		entries []*db.ListEntry
+		errs    []error
+	)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lineKind, pattern := kind, line
+		if kind == "" {
+			name, rest, _ := strings.Cut(line, " ")
+			k, ok := ParseKind(name)
+			if !ok {
+				errs = append(errs, errors.Errorf("line %d: unknown kind %q", n, name))
+				continue
+			}
+			lineKind, pattern = k, rest
+		}
+		normalized, err := Normalize(lineKind, pattern)
+		if err != nil {
+			errs = append(errs, errors.WithMessagef(err, "line %d", n))
+			continue
+		}
+		entries = append(entries, &db.ListEntry{List: list, Kind: string(lineKind), Pattern: normalized})
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, errors.WithMessage(err, "cant read file"))
+	}
+	return entries, errs
+}
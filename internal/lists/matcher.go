@@ -0,0 +1,283 @@
+// Package lists matches users and messages against the operator blocklist and allowlist
+package lists
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ngbot/internal/db"
+)
+
+const (
+	// KindUser is a user ID
+	KindUser Kind = "user"
+	// KindUsername is a regular expression matched against the username, without the @
+	KindUsername Kind = "username"
+	// KindContent is a regular expression matched against the message text
+	KindContent Kind = "content"
+	// KindURL is a domain, its subdomains included, or a link prefix when it has a path
+	KindURL Kind = "url"
+	// KindInvite is a Telegram invite link or its hash, * matches any invite link
+	KindInvite Kind = "invite"
+	// KindPhone is a phone number, a trailing * makes it a prefix
+	KindPhone Kind = "phone"
+	// KindWallet is a crypto wallet address
+	KindWallet Kind = "wallet"
+
+	VerdictNone  Verdict = ""
+	VerdictBlock Verdict = "block"
+	// VerdictAllow is given to allowlisted user IDs only, the one thing the sender can't choose
+	VerdictAllow Verdict = "allow"
+	// VerdictExempt is given to messages matching the other allowlist entries,
+	// they are spared the LLM but vouch for nobody, as a spammer can put any text in a message or pick any username
+	VerdictExempt Verdict = "exempt"
+)
+
+type (
+	// Kind tells how the pattern of an entry is matched
+	Kind string
+
+	Verdict string
+
+	// Subject is what the lists are checked against
+	Subject struct {
+		UserID   int64
+		Username string
+		Text     string
+		// Links are the hidden links of text_link entities
+		Links []string
+	}
+
+	// Result is the verdict of the lists and the entry that decided it
+	Result struct {
+		Verdict Verdict
+		Entry   *db.ListEntry
+	}
+
+	// Matcher holds the compiled entries of both lists
+	Matcher struct {
+		block []rule
+		allow []rule
+	}
+
+	rule struct {
+		entry *db.ListEntry
+		match func(f *features) bool
+	}
+
+	// features are extracted from the subject once for all the rules
+	features struct {
+		Subject
+		links   []string
+		invites []string
+		phones  []string
+		tokens  []string
+	}
+)
+
+var (
+	linkPattern   = regexp.MustCompile(`(?i)\b(?:https?://)?(?:[a-z0-9-]+\.)+[a-z]{2,}(?:/[^\s]*)?`)
+	invitePattern = regexp.MustCompile(`(?i)(?:t\.me|telegram\.me|telegram\.dog)/(?:\+|joinchat/)([\w-]+)|tg://join\?invite=([\w-]+)`)
+	phonePattern  = regexp.MustCompile(`\+?\d[\d\s().-]{6,}\d`)
+	nonDigits     = regexp.MustCompile(`\D`)
+)
+
+// Kinds lists the kinds of entries
+func Kinds() []Kind {
+	return []Kind{KindUser, KindUsername, KindContent, KindURL, KindInvite, KindPhone, KindWallet}
+}
+
+// ParseKind returns the kind by name
+func ParseKind(s string) (Kind, bool) {
+	for _, k := range Kinds() {
+		if string(k) == strings.ToLower(s) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Normalize brings the pattern to the form it is stored and matched in, it fails for patterns that can never match
+func Normalize(kind Kind, pattern string) (string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return "", errors.New("empty pattern")
+	}
+	switch kind {
+	case KindUser:
+		if _, err := strconv.ParseInt(pattern, 10, 64); err != nil {
+			return "", errors.Errorf("%q is not a user ID", pattern)
+		}
+		return pattern, nil
+	case KindUsername, KindContent:
+		if _, err := regexp.Compile("(?i)" + pattern); err != nil {
+			return "", errors.WithMessagef(err, "invalid regular expression %q", pattern)
+		}
+		return pattern, nil
+	case KindURL:
+		return normalizeLink(pattern), nil
+	case KindInvite:
+		if pattern == "*" {
+			return pattern, nil
+		}
+		if m := invitePattern.FindStringSubmatch(pattern); m != nil {
+			return m[1] + m[2], nil
+		}
+		return strings.TrimPrefix(pattern, "+"), nil
+	case KindPhone:
+		prefix := strings.HasSuffix(pattern, "*")
+		digits := nonDigits.ReplaceAllString(pattern, "")
+		if digits == "" {
+			return "", errors.Errorf("%q is not a phone number", pattern)
+		}
+		if prefix {
+			digits += "*"
+		}
+		return digits, nil
+	case KindWallet:
+		return strings.ToLower(pattern), nil
+	}
+	return "", errors.Errorf("unknown kind %q", kind)
+}
+
+// Compile builds the matcher, entries that do not compile are skipped and reported
+func Compile(entries []*db.ListEntry) (*Matcher, []error) {
+	m := &Matcher{}
+	var errs []error
+	for _, e := range entries {
+		match, err := compileRule(Kind(e.Kind), e.Pattern)
+		if err != nil {
+			errs = append(errs, errors.WithMessagef(err, "entry %d", e.ID))
+			continue
+		}
+		r := rule{entry: e, match: match}
+		switch e.List {
+		case db.ListBlock:
+			m.block = append(m.block, r)
+		case db.ListAllow:
+			m.allow = append(m.allow, r)
+		default:
+			errs = append(errs, errors.Errorf("entry %d: unknown list %q", e.ID, e.List))
+		}
+	}
+	return m, errs
+}
+
+// Check decides on the subject: an allowlisted user ID is let through whatever the message is,
+// otherwise any blocklist entry wins over the other entries of the allowlist, which only exempt the message
+func (m *Matcher) Check(s Subject) Result {
+	f := extract(s)
+	for _, r := range m.allow {
+		if Kind(r.entry.Kind) == KindUser && r.match(f) {
+			return Result{Verdict: VerdictAllow, Entry: r.entry}
+		}
+	}
+	for _, r := range m.block {
+		if r.match(f) {
+			return Result{Verdict: VerdictBlock, Entry: r.entry}
+		}
+	}
+	for _, r := range m.allow {
+		if Kind(r.entry.Kind) != KindUser && r.match(f) {
+			return Result{Verdict: VerdictExempt, Entry: r.entry}
+		}
+	}
+	return Result{Verdict: VerdictNone}
+}
+
+func compileRule(kind Kind, pattern string) (func(f *features) bool, error) {
+	pattern, err := Normalize(kind, pattern)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case KindUser:
+		id, _ := strconv.ParseInt(pattern, 10, 64)
+		return func(f *features) bool { return f.UserID == id }, nil
+	case KindUsername:
+		re := regexp.MustCompile("(?i)" + pattern)
+		return func(f *features) bool { return f.Username != "" && re.MatchString(f.Username) }, nil
+	case KindContent:
+		re := regexp.MustCompile("(?i)" + pattern)
+		return func(f *features) bool { return re.MatchString(f.Text) }, nil
+	case KindURL:
+		host, path, _ := strings.Cut(pattern, "/")
+		return func(f *features) bool {
+			for _, link := range f.links {
+				linkHost, linkPath, _ := strings.Cut(link, "/")
+				if linkHost != host && !strings.HasSuffix(linkHost, "."+host) {
+					continue
+				}
+				if path == "" || (linkHost == host && strings.HasPrefix(linkPath, path)) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case KindInvite:
+		return func(f *features) bool {
+			for _, hash := range f.invites {
+				if pattern == "*" || hash == pattern {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case KindPhone:
+		prefix, isPrefix := strings.CutSuffix(pattern, "*")
+		return func(f *features) bool {
+			for _, phone := range f.phones {
+				if phone == prefix || (isPrefix && strings.HasPrefix(phone, prefix)) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case KindWallet:
+		return func(f *features) bool {
+			for _, token := range f.tokens {
+				if token == pattern {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, errors.Errorf("unknown kind %q", kind)
+}
+
+func extract(s Subject) *features {
+	f := &features{Subject: s}
+	for _, link := range append(linkPattern.FindAllString(s.Text, -1), s.Links...) {
+		f.links = append(f.links, normalizeLink(link))
+	}
+	hidden := strings.Join(s.Links, " ")
+	for _, m := range invitePattern.FindAllStringSubmatch(s.Text+" "+hidden, -1) {
+		f.invites = append(f.invites, m[1]+m[2])
+	}
+	for _, phone := range phonePattern.FindAllString(s.Text, -1) {
+		f.phones = append(f.phones, nonDigits.ReplaceAllString(phone, ""))
+	}
+	for _, token := range strings.Fields(s.Text) {
+		f.tokens = append(f.tokens, strings.ToLower(strings.Trim(token, ".,;:!?()[]{}<>\"'`")))
+	}
+	return f
+}
+
+// normalizeLink strips the scheme, www and the trailing slash, and lowercases the host
+func normalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	if _, rest, ok := strings.Cut(link, "://"); ok {
+		link = rest
+	}
+	host, path, hasPath := strings.Cut(link, "/")
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	path = strings.TrimSuffix(path, "/")
+	if !hasPath || path == "" {
+		return host
+	}
+	return host + "/" + path
+}
@@ -0,0 +1,92 @@
+package lists_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/lists"
+)
+
+func entry(id int64, list string, kind lists.Kind, pattern string) *db.ListEntry {
+	return &db.ListEntry{ID: id, List: list, Kind: string(kind), Pattern: pattern}
+}
+
+func TestCheck(t *testing.T) {
+	matcher, errs := lists.Compile([]*db.ListEntry{
+		entry(1, db.ListBlock, lists.KindUser, "666"),
+		entry(2, db.ListBlock, lists.KindUsername, `^crypto_.*_bot$`),
+		entry(3, db.ListBlock, lists.KindContent, `free\s+money`),
+		entry(4, db.ListBlock, lists.KindURL, "scam.example"),
+		entry(5, db.ListBlock, lists.KindURL, "t.me/pumpchannel"),
+		entry(6, db.ListBlock, lists.KindInvite, "https://t.me/+AbCdEf123"),
+		entry(7, db.ListBlock, lists.KindPhone, "+234*"),
+		entry(8, db.ListBlock, lists.KindWallet, "0x52908400098527886E0F7030069857D2E4169EE7"),
+		entry(9, db.ListAllow, lists.KindUser, "42"),
+		entry(10, db.ListAllow, lists.KindURL, "github.com"),
+		entry(11, db.ListAllow, lists.KindUsername, "^friendly_"),
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	cases := []struct {
+		name    string
+		subject lists.Subject
+		verdict lists.Verdict
+		entry   int64
+	}{
+		{"clean", lists.Subject{UserID: 1, Text: "hello there"}, lists.VerdictNone, 0},
+		{"blocked user", lists.Subject{UserID: 666, Text: "hello"}, lists.VerdictBlock, 1},
+		{"blocked username", lists.Subject{UserID: 1, Username: "Crypto_Pump_Bot", Text: "hi"}, lists.VerdictBlock, 2},
+		{"content", lists.Subject{UserID: 1, Text: "Get FREE   money now"}, lists.VerdictBlock, 3},
+		{"subdomain", lists.Subject{UserID: 1, Text: "visit https://www.promo.scam.example/x"}, lists.VerdictBlock, 4},
+		{"lookalike domain", lists.Subject{UserID: 1, Text: "visit notscam.example"}, lists.VerdictNone, 0},
+		{"link prefix", lists.Subject{UserID: 1, Text: "see t.me/pumpchannel/12"}, lists.VerdictBlock, 5},
+		{"hidden invite", lists.Subject{UserID: 1, Text: "join us", Links: []string{"https://t.me/joinchat/AbCdEf123"}}, lists.VerdictBlock, 6},
+		{"other invite", lists.Subject{UserID: 1, Text: "t.me/+Other"}, lists.VerdictNone, 0},
+		{"phone prefix", lists.Subject{UserID: 1, Text: "call +234 (803) 555-0100"}, lists.VerdictBlock, 7},
+		{"wallet", lists.Subject{UserID: 1, Text: "send to 0x52908400098527886e0f7030069857d2e4169ee7."}, lists.VerdictBlock, 8},
+		{"allowed user wins", lists.Subject{UserID: 42, Text: "free money"}, lists.VerdictAllow, 9},
+		{"allowed link only exempts", lists.Subject{UserID: 1, Text: "fix in github.com/org/repo"}, lists.VerdictExempt, 10},
+		{"allowed username only exempts", lists.Subject{UserID: 1, Username: "friendly_bob", Text: "hi"}, lists.VerdictExempt, 11},
+		{"block wins over allowed username", lists.Subject{UserID: 1, Username: "friendly_bob", Text: "free money"}, lists.VerdictBlock, 3},
+		{"block wins over allowed link", lists.Subject{UserID: 1, Text: "free money at github.com/org/repo"}, lists.VerdictBlock, 3},
+	}
+	for _, c := range cases {
+		got := matcher.Check(c.subject)
+		if got.Verdict != c.verdict {
+			t.Errorf("%s: verdict %q, want %q", c.name, got.Verdict, c.verdict)
+			continue
+		}
+		if c.entry != 0 && got.Entry.ID != c.entry {
+			t.Errorf("%s: matched entry %d, want %d", c.name, got.Entry.ID, c.entry)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	file := strings.Join([]string{
+		"# spam domains",
+		"url https://Scam.example/",
+		"",
+		"phone +1 (555) 010-0000",
+		"content ([",
+		"color red",
+	}, "\n")
+	entries, errs := lists.Import(strings.NewReader(file), db.ListBlock, "")
+	if len(entries) != 2 {
+		t.Fatalf("imported %d entries, want 2", len(entries))
+	}
+	if entries[0].Pattern != "scam.example" || entries[1].Pattern != "15550100000" {
+		t.Errorf("patterns are not normalized: %q, %q", entries[0].Pattern, entries[1].Pattern)
+	}
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "line 5") || !strings.Contains(errs[1].Error(), "line 6") {
+		t.Errorf("got errors %v, want lines 5 and 6", errs)
+	}
+
+	entries, errs = lists.Import(strings.NewReader("100\nabc\n"), db.ListAllow, lists.KindUser)
+	if len(entries) != 1 || len(errs) != 1 {
+		t.Errorf("got %d entries and %v, want 1 entry and 1 error", len(entries), errs)
+	}
+}
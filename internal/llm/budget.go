@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/metrics"
+)
+
+// ErrBudgetExceeded is returned when the chat or all chats spent the daily budget
+var ErrBudgetExceeded = errors.New("daily LLM budget exceeded")
+
+type (
+	// Budget counts the tokens and the cost spent within a UTC day, by all chats and by every chat.
+	// The calls in flight hold a reservation of their estimated spending, so concurrent calls can't all pass the caps.
+	// The spending is kept in the database, when there is one, and carries over restarts.
+	Budget struct {
+		client db.Client
+		mutex  sync.Mutex
+		day    string
+		total  spending
+		chats  map[int64]spending
+	}
+
+	// Reservation is the spending held for a call until Spend reconciles it with the usage
+	Reservation struct {
+		chatID int64
+		day    string
+		spending
+	}
+
+	spending struct {
+		tokens int64
+		cost   float64
+	}
+)
+
+// Allow reserves the estimated spending of a call for the chat, or reports ErrBudgetExceeded when it would pass a cap of the limits
+func (b *Budget) Allow(chatID int64, limits config.LLM, tokens int64, cost float64, now time.Time) (*Reservation, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rollover(now)
+	if b.total.add(tokens, cost).over(limits.DailyTokens, limits.DailyCost) {
+		metrics.LLMBudgetRejections.WithLabelValues("global").Inc()
+		return nil, errors.WithMessage(ErrBudgetExceeded, "all chats")
+	}
+	if b.chats[chatID].add(tokens, cost).over(limits.ChatDailyTokens, limits.ChatDailyCost) {
+		metrics.LLMBudgetRejections.WithLabelValues("chat").Inc()
+		return nil, errors.WithMessagef(ErrBudgetExceeded, "chat %d", chatID)
+	}
+	b.total = b.total.add(tokens, cost)
+	b.chats[chatID] = b.chats[chatID].add(tokens, cost)
+	return &Reservation{chatID: chatID, day: b.day, spending: spending{tokens: tokens, cost: cost}}, nil
+}
+
+// Spend replaces the reservation with the usage of the call, zero usage releases it when the call failed
+func (b *Budget) Spend(r *Reservation, tokens int64, cost float64, now time.Time) {
+	b.mutex.Lock()
+	b.rollover(now)
+	if r.day == b.day {
+		b.total = b.total.add(-r.tokens, -r.cost)
+		b.chats[r.chatID] = b.chats[r.chatID].add(-r.tokens, -r.cost)
+	}
+	b.total = b.total.add(tokens, cost)
+	b.chats[r.chatID] = b.chats[r.chatID].add(tokens, cost)
+	day := b.day
+	b.mutex.Unlock()
+
+	if b.client == nil || (tokens == 0 && cost == 0) {
+		return
+	}
+	if err := b.client.AddLLMSpending(&db.LLMSpending{Day: day, ChatID: r.chatID, Tokens: tokens, Cost: cost}); err != nil {
+		log.WithFields(log.Fields{"context": "llm", "method": "Spend"}).WithError(err).Error("cant save the spending")
+	}
+}
+
+// rollover starts over on a new day with the spending already saved for it
+func (b *Budget) rollover(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if day == b.day && b.chats != nil {
+		return
+	}
+	b.day, b.total, b.chats = day, spending{}, map[int64]spending{}
+	if b.client == nil {
+		return
+	}
+	saved, err := b.client.GetLLMSpending(day)
+	if err != nil {
+		log.WithFields(log.Fields{"context": "llm", "method": "rollover"}).WithError(err).Error("cant load the spending, counting from zero")
+		return
+	}
+	for _, s := range saved {
+		b.total = b.total.add(s.Tokens, s.Cost)
+		b.chats[s.ChatID] = b.chats[s.ChatID].add(s.Tokens, s.Cost)
+	}
+}
+
+func (s spending) add(tokens int64, cost float64) spending {
+	return spending{tokens: s.tokens + tokens, cost: s.cost + cost}
+}
+
+// over reports whether a cap is passed, 0 lifts a cap
+func (s spending) over(tokens int64, cost float64) bool {
+	return (tokens > 0 && s.tokens > tokens) || (cost > 0 && s.cost > cost)
+}
@@ -0,0 +1,249 @@
+// Package llm is the gateway to the LLM providers: it fails over between them in order,
+// caps the daily spending and caches the answers to repeated messages
+package llm
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/pkg/errors"
+	"github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/metrics"
+)
+
+type (
+	// Request is a chat completion asked for on behalf of a chat
+	Request struct {
+		ChatID    int64
+		Messages  []openai.ChatCompletionMessage
+		MaxTokens int
+		// Vision asks the vision models of the providers
+		Vision bool
+		// CacheKey identifies requests with the same answer, see Key, empty skips the cache
+		CacheKey string
+	}
+
+	// Response is the answer of the first provider that did not fail
+	Response struct {
+		Content  string
+		Provider string
+		Model    string
+		Usage    openai.Usage
+		Cost     float64
+		// Cached tells the answer was given to an earlier request with the same key, it cost nothing now
+		Cached bool
+	}
+
+	// Gateway asks the configured providers, it is safe for concurrent use and swaps the providers on Reload
+	Gateway struct {
+		providers atomic.Pointer[[]provider]
+		limits    atomic.Pointer[config.LLM]
+		budget    Budget
+
+		cacheMutex sync.Mutex
+		cache      *expirable.LRU[string, Response]
+		cacheSize  int
+		cacheTTL   time.Duration
+	}
+
+	provider struct {
+		config.LLMProvider
+		client *openai.Client
+	}
+)
+
+// New returns the gateway to the providers of the config, the daily spending is kept in the database of the client
+func New(cfg config.Config, client db.Client) *Gateway {
+	g := &Gateway{budget: Budget{client: client}}
+	g.Reload(cfg)
+	return g
+}
+
+// Reload swaps the providers and the limits, the spending of the day carries over,
+// the cached answers too unless the cache was resized
+func (g *Gateway) Reload(cfg config.Config) {
+	configured := cfg.LLMProviders()
+	providers := make([]provider, 0, len(configured))
+	for _, p := range configured {
+		clientConfig := openai.DefaultConfig(p.APIKey)
+		clientConfig.BaseURL = p.BaseURL
+		providers = append(providers, provider{LLMProvider: p, client: openai.NewClientWithConfig(clientConfig)})
+	}
+	g.providers.Store(&providers)
+	limits := cfg.LLM
+	g.limits.Store(&limits)
+
+	g.cacheMutex.Lock()
+	defer g.cacheMutex.Unlock()
+	if g.cache == nil || limits.CacheSize != g.cacheSize || limits.CacheTTL != g.cacheTTL {
+		g.cache, g.cacheSize, g.cacheTTL = nil, limits.CacheSize, limits.CacheTTL
+		if limits.CacheSize > 0 {
+			g.cache = expirable.NewLRU[string, Response](limits.CacheSize, nil, limits.CacheTTL)
+		}
+	}
+}
+
+// Complete returns the cached answer to the request, or asks the providers in order while the budget allows.
+// It fails with ErrBudgetExceeded when the chat or all chats spent the daily budget.
+func (g *Gateway) Complete(ctx context.Context, req Request) (*Response, error) {
+	entry := log.WithFields(log.Fields{"context": "llm", "method": "Complete", "chat_id": req.ChatID})
+	if res, ok := g.cached(req.CacheKey); ok {
+		res.Cached = true
+		return &res, nil
+	}
+	limits := *g.limits.Load()
+	providers := *g.providers.Load()
+	tokens, cost := estimate(req, providers)
+	reservation, err := g.budget.Allow(req.ChatID, limits, tokens, cost, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	spent := false
+	defer func() {
+		if !spent {
+			g.budget.Spend(reservation, 0, 0, time.Now())
+		}
+	}()
+
+	var errs []string
+	for i, p := range providers {
+		model := p.Model
+		if req.Vision && p.VisionModel != "" {
+			model = p.VisionModel
+		}
+		timeout := p.Timeout
+		if timeout <= 0 {
+			timeout = limits.Timeout
+		}
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		resp, err := p.client.CreateChatCompletion(callCtx, openai.ChatCompletionRequest{
+			Model:     model,
+			Messages:  req.Messages,
+			MaxTokens: req.MaxTokens,
+		})
+		cancel()
+		if err != nil {
+			metrics.LLMDuration.WithLabelValues(model, "error").Observe(time.Since(start).Seconds())
+			if ctx.Err() != nil {
+				return nil, errors.WithMessage(ctx.Err(), "cant create chat completion")
+			}
+			errs = append(errs, p.Name+": "+err.Error())
+			if i < len(providers)-1 {
+				metrics.LLMFailovers.WithLabelValues(p.Name).Inc()
+				entry.WithError(err).WithField("provider", p.Name).Warn("provider failed, asking the next one")
+			}
+			continue
+		}
+		metrics.LLMDuration.WithLabelValues(model, "ok").Observe(time.Since(start).Seconds())
+		metrics.LLMTokens.WithLabelValues(model, "prompt").Add(float64(resp.Usage.PromptTokens))
+		metrics.LLMTokens.WithLabelValues(model, "completion").Add(float64(resp.Usage.CompletionTokens))
+
+		res := Response{Provider: p.Name, Model: model, Usage: resp.Usage, Cost: p.cost(resp.Usage)}
+		if len(resp.Choices) > 0 {
+			res.Content = strings.TrimSpace(resp.Choices[0].Message.Content)
+		}
+		metrics.LLMCost.WithLabelValues(p.Name).Add(res.Cost)
+		g.budget.Spend(reservation, int64(resp.Usage.TotalTokens), res.Cost, time.Now())
+		spent = true
+		g.store(req.CacheKey, res)
+		return &res, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no LLM providers are configured")
+	}
+	return nil, errors.Errorf("every LLM provider failed: %s", strings.Join(errs, "; "))
+}
+
+// Ping lists the models of the first provider
+func (g *Gateway) Ping(ctx context.Context) error {
+	providers := *g.providers.Load()
+	if len(providers) == 0 {
+		return errors.New("no LLM providers are configured")
+	}
+	_, err := providers[0].client.ListModels(ctx)
+	return err
+}
+
+// Peek returns the cached answer to the requests with the key without asking the providers, e.g. to skip a quota
+// spent on the calls. A miss is not counted, Complete counts it.
+func (g *Gateway) Peek(key string) (*Response, bool) {
+	g.cacheMutex.Lock()
+	cache := g.cache
+	g.cacheMutex.Unlock()
+	if key == "" || cache == nil {
+		return nil, false
+	}
+	res, ok := cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	metrics.CacheHit("llm", true)
+	res.Cached = true
+	return &res, true
+}
+
+func (g *Gateway) cached(key string) (Response, bool) {
+	g.cacheMutex.Lock()
+	cache := g.cache
+	g.cacheMutex.Unlock()
+	if key == "" || cache == nil {
+		return Response{}, false
+	}
+	res, ok := cache.Get(key)
+	metrics.CacheHit("llm", ok)
+	return res, ok
+}
+
+func (g *Gateway) store(key string, res Response) {
+	g.cacheMutex.Lock()
+	cache := g.cache
+	g.cacheMutex.Unlock()
+	if key != "" && cache != nil {
+		cache.Add(key, res)
+	}
+}
+
+// cost prices the usage, the prices are per million tokens
+func (p provider) cost(u openai.Usage) float64 {
+	return (float64(u.PromptTokens)*p.PromptPrice + float64(u.CompletionTokens)*p.CompletionPrice) / 1e6
+}
+
+const (
+	// completionEstimate is reserved for the answer of a request without MaxTokens, a verdict takes a few tokens
+	completionEstimate = 64
+	// imageEstimate is reserved for an image, the price of a detailed one of a common size
+	imageEstimate = 765
+)
+
+// estimate is the spending reserved for the request before the call: a token for every 4 bytes of the texts,
+// priced by the dearest provider, the usage replaces it afterwards
+func estimate(req Request, providers []provider) (int64, float64) {
+	var prompt int64
+	for _, m := range req.Messages {
+		prompt += int64(len(m.Content)+3) / 4
+		for _, part := range m.MultiContent {
+			if part.ImageURL != nil {
+				prompt += imageEstimate
+			}
+			prompt += int64(len(part.Text)+3) / 4
+		}
+	}
+	completion := int64(req.MaxTokens)
+	if completion <= 0 {
+		completion = completionEstimate
+	}
+	var cost float64
+	for _, p := range providers {
+		cost = max(cost, p.cost(openai.Usage{PromptTokens: int(prompt), CompletionTokens: int(completion)}))
+	}
+	return prompt + completion, cost
+}
@@ -0,0 +1,219 @@
+package llm_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db/sqlite"
+	"github.com/iamwavecut/ngbot/internal/llm"
+)
+
+// provider serves chat completions answering content, or fails with status when it is set
+func provider(t *testing.T, status int, content string, calls *atomic.Int32) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: " " + content + "\n"}}},
+			Usage:   openai.Usage{PromptTokens: 90, CompletionTokens: 10, TotalTokens: 100},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/v1"
+}
+
+func request(text string) llm.Request {
+	return llm.Request{
+		ChatID:   1,
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: text}},
+		CacheKey: llm.Key("spam", text),
+	}
+}
+
+func TestFailover(t *testing.T) {
+	var failing, working atomic.Int32
+	cfg := config.Config{LLM: config.LLM{Timeout: time.Second, Providers: []config.LLMProvider{
+		{Name: "down", BaseURL: provider(t, http.StatusBadRequest, "", &failing), Model: "a"},
+		{Name: "up", BaseURL: provider(t, 0, "SPAM", &working), Model: "b", PromptPrice: 1, CompletionPrice: 10},
+	}}}
+	res, err := llm.New(cfg, nil).Complete(context.Background(), request("buy now"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Content != "SPAM" || res.Provider != "up" || res.Model != "b" {
+		t.Errorf("got %+v", res)
+	}
+	if want := (90*1.0 + 10*10.0) / 1e6; res.Cost != want {
+		t.Errorf("cost %v, want %v", res.Cost, want)
+	}
+	if failing.Load() == 0 || working.Load() != 1 {
+		t.Errorf("calls: down %d, up %d", failing.Load(), working.Load())
+	}
+}
+
+func TestAllProvidersFail(t *testing.T) {
+	var calls atomic.Int32
+	cfg := config.Config{LLM: config.LLM{Timeout: time.Second, Providers: []config.LLMProvider{
+		{Name: "down", BaseURL: provider(t, http.StatusBadRequest, "", &calls), Model: "a"},
+	}}}
+	if _, err := llm.New(cfg, nil).Complete(context.Background(), request("hi")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var calls atomic.Int32
+	url := provider(t, 0, "NOT_SPAM", &calls)
+	cases := []struct {
+		name   string
+		limits config.LLM
+	}{
+		{"chat tokens", config.LLM{ChatDailyTokens: 100}},
+		{"chat cost", config.LLM{ChatDailyCost: 0.0001}},
+		{"global tokens", config.LLM{DailyTokens: 100}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.limits.Timeout = time.Second
+			c.limits.Providers = []config.LLMProvider{{Name: "p", BaseURL: url, Model: "m", PromptPrice: 1, CompletionPrice: 1}}
+			g := llm.New(config.Config{LLM: c.limits}, nil)
+			req := request("first")
+			req.CacheKey = ""
+			if _, err := g.Complete(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := g.Complete(context.Background(), req); !errors.Is(err, llm.ErrBudgetExceeded) {
+				t.Errorf("got %v, want the budget exceeded", err)
+			}
+			// the caps of a chat leave the other chats alone, the global cap does not
+			other := req
+			other.ChatID = 2
+			_, err := g.Complete(context.Background(), other)
+			if global := c.limits.DailyTokens > 0; global != errors.Is(err, llm.ErrBudgetExceeded) {
+				t.Errorf("other chat: %v", err)
+			}
+		})
+	}
+}
+
+func TestBudgetReservation(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: "NOT_SPAM"}}},
+			Usage:   openai.Usage{PromptTokens: 20, CompletionTokens: 10, TotalTokens: 30},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	g := llm.New(config.Config{LLM: config.LLM{Timeout: time.Second, ChatDailyTokens: 100, Providers: []config.LLMProvider{
+		{Name: "p", BaseURL: srv.URL + "/v1", Model: "m"},
+	}}}, nil)
+	req := request("first")
+	req.CacheKey = ""
+
+	done := make(chan error)
+	go func() {
+		_, err := g.Complete(context.Background(), req)
+		done <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the call in flight holds the estimate of its spending, a second one would pass the cap
+	if _, err := g.Complete(context.Background(), req); !errors.Is(err, llm.ErrBudgetExceeded) {
+		t.Errorf("got %v while the first call is in flight, want the budget exceeded", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// the usage replaced the estimate
+	if _, err := g.Complete(context.Background(), req); err != nil || calls.Load() != 2 {
+		t.Errorf("got %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestBudgetSaved(t *testing.T) {
+	var calls atomic.Int32
+	cfg := config.Config{LLM: config.LLM{Timeout: time.Second, ChatDailyTokens: 100, Providers: []config.LLMProvider{
+		{Name: "p", BaseURL: provider(t, 0, "NOT_SPAM", &calls), Model: "m"},
+	}}}
+	client := sqlite.NewSQLiteClient(filepath.Join(t.TempDir(), "bot.db"))
+	t.Cleanup(func() { _ = client.Close() })
+	req := request("first")
+	req.CacheKey = ""
+	if _, err := llm.New(cfg, client).Complete(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := client.GetLLMSpending(time.Now().UTC().Format(time.DateOnly))
+	if err != nil || len(saved) != 1 || saved[0].ChatID != 1 || saved[0].Tokens != 100 {
+		t.Fatalf("saved %+v, %v", saved, err)
+	}
+	// a restarted gateway counts the spending of the day
+	if _, err := llm.New(cfg, client).Complete(context.Background(), req); !errors.Is(err, llm.ErrBudgetExceeded) {
+		t.Errorf("got %v after a restart, want the budget exceeded", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	var calls atomic.Int32
+	cfg := config.Config{LLM: config.LLM{Timeout: time.Second, CacheSize: 10, CacheTTL: time.Hour, Providers: []config.LLMProvider{
+		{Name: "p", BaseURL: provider(t, 0, "SPAM", &calls), Model: "m"},
+	}}}
+	g := llm.New(cfg, nil)
+	if _, err := g.Complete(context.Background(), request("Buy  NOW")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := g.Complete(context.Background(), request("buy now​"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Cached || res.Content != "SPAM" || calls.Load() != 1 {
+		t.Errorf("got %+v after %d calls", res, calls.Load())
+	}
+
+	if res, ok := g.Peek(llm.Key("spam", "buy now")); !ok || !res.Cached || res.Content != "SPAM" {
+		t.Errorf("peeked %+v", res)
+	}
+	if _, ok := g.Peek(llm.Key("spam", "sell now")); ok || calls.Load() != 1 {
+		t.Errorf("peeked an unknown request after %d calls", calls.Load())
+	}
+
+	// a reload keeping the cache size keeps the answers
+	g.Reload(cfg)
+	if res, _ := g.Complete(context.Background(), request("buy now")); !res.Cached {
+		t.Error("cache was dropped on reload")
+	}
+}
+
+func TestKey(t *testing.T) {
+	if llm.Key("spam", "Hello   World‍") != llm.Key("spam", "hello world") {
+		t.Error("normalized texts have different keys")
+	}
+	if llm.Key("spam", "hello") == llm.Key("vision", "hello") {
+		t.Error("purposes share the key")
+	}
+	if llm.Key("vision", "", []byte{1}) == llm.Key("vision", "", []byte{2}) {
+		t.Error("attachments share the key")
+	}
+}
@@ -0,0 +1,33 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode"
+)
+
+// Key returns the cache key of a request about the text and the attachments, purpose separates prompts.
+// The text is normalized, so the waves of the same message with another case, spacing or invisible characters share the key.
+func Key(purpose, text string, attachments ...[]byte) string {
+	h := sha256.New()
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write([]byte(Normalize(text)))
+	for _, a := range attachments {
+		h.Write([]byte{0})
+		h.Write(a)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Normalize lowercases the text, drops invisible characters and collapses the whitespace
+func Normalize(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -0,0 +1,27 @@
+package media
+
+import (
+	"sync"
+	"time"
+)
+
+// Budget counts the paid checks of every chat within a UTC day, it starts over with the process
+type Budget struct {
+	mutex sync.Mutex
+	day   string
+	used  map[int64]int
+}
+
+// Take spends one check of the chat, reporting false when the chat used up the limit for today, 0 lifts the limit
+func (b *Budget) Take(chatID int64, limit int, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if day := now.UTC().Format(time.DateOnly); day != b.day || b.used == nil {
+		b.day, b.used = day, map[int64]int{}
+	}
+	if limit > 0 && b.used[chatID] >= limit {
+		return false
+	}
+	b.used[chatID]++
+	return true
+}
@@ -0,0 +1,159 @@
+// Package media describes the non-text content of a message for the spam checks and applies the rules on media
+package media
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	KindText      = "text"
+	KindPhoto     = "photo"
+	KindSticker   = "sticker"
+	KindAnimation = "animation"
+	KindVideo     = "video"
+	KindVoice     = "voice"
+	KindAudio     = "audio"
+	KindDocument  = "document"
+	KindContact   = "contact"
+	KindLocation  = "location"
+	KindPoll      = "poll"
+	KindStory     = "story"
+	KindOther     = "other"
+)
+
+type (
+	// Content is what the spam checks can read in a message
+	Content struct {
+		// Kind is the main content of the message, empty for service messages
+		Kind string
+		// Text joins the text or caption with the readable parts of the media: file names, contacts, venues, polls and the forward origin
+		Text string
+		// Image is the photo to read the text of, nil when there is none
+		Image *api.PhotoSize
+		// Forward is the origin of a forwarded message: channel, chat, user or hidden_user
+		Forward string
+	}
+)
+
+// Describe returns the content of the message, the image is the largest photo size of at most imageLimit bytes
+func Describe(m *api.Message, imageLimit int) Content {
+	if m == nil {
+		return Content{}
+	}
+	c := Content{Kind: kind(m)}
+	var parts []string
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	add(m.Text)
+	add(m.Caption)
+	switch {
+	case m.Document != nil:
+		add(m.Document.FileName)
+	case m.Contact != nil:
+		add(strings.Join([]string{m.Contact.FirstName, m.Contact.LastName, m.Contact.PhoneNumber}, " "))
+	case m.Venue != nil:
+		add(m.Venue.Title + " " + m.Venue.Address)
+	case m.Poll != nil:
+		add(m.Poll.Question)
+		for _, o := range m.Poll.Options {
+			add(o.Text)
+		}
+	}
+	if m.ForwardOrigin != nil {
+		c.Forward = m.ForwardOrigin.Type
+		if name := originName(m.ForwardOrigin); name != "" && len(parts) > 0 {
+			parts = append([]string{fmt.Sprintf("[forwarded from %s]", name)}, parts...)
+		}
+	}
+	c.Text = strings.Join(parts, "\n")
+	c.Image = LargestPhoto(m.Photo, imageLimit)
+	return c
+}
+
+// LargestPhoto returns the largest photo size of at most limit bytes, sizes of unknown size are skipped
+func LargestPhoto(sizes []api.PhotoSize, limit int) *api.PhotoSize {
+	var best *api.PhotoSize
+	for i := range sizes {
+		s := &sizes[i]
+		if s.FileSize <= 0 || s.FileSize > limit {
+			continue
+		}
+		if best == nil || s.Width*s.Height > best.Width*best.Height {
+			best = s
+		}
+	}
+	return best
+}
+
+// IsExecutable reports whether the file name has the extension of an executable, a script or an installer
+func IsExecutable(name string) bool {
+	return slices.Contains(executableExtensions, strings.ToLower(path.Ext(strings.TrimSpace(name))))
+}
+
+var executableExtensions = []string{
+	".exe", ".scr", ".com", ".pif", ".bat", ".cmd", ".msi", ".msix", ".apk", ".xapk", ".jar",
+	".js", ".jse", ".vbs", ".vbe", ".wsf", ".hta", ".ps1", ".lnk", ".dll", ".cpl", ".reg", ".dmg", ".pkg",
+}
+
+func kind(m *api.Message) string {
+	switch {
+	case m.Story != nil:
+		return KindStory
+	case m.Contact != nil:
+		return KindContact
+	case m.Location != nil, m.Venue != nil:
+		return KindLocation
+	case m.Document != nil:
+		return KindDocument
+	case len(m.Photo) > 0:
+		return KindPhoto
+	case m.Sticker != nil:
+		return KindSticker
+	case m.Animation != nil:
+		return KindAnimation
+	case m.Video != nil, m.VideoNote != nil:
+		return KindVideo
+	case m.Voice != nil:
+		return KindVoice
+	case m.Audio != nil:
+		return KindAudio
+	case m.Poll != nil:
+		return KindPoll
+	case m.Text != "":
+		return KindText
+	case m.Dice != nil, m.Game != nil, m.Giveaway != nil, m.Invoice != nil:
+		return KindOther
+	}
+	return ""
+}
+
+func originName(o *api.MessageOrigin) string {
+	var chat *api.Chat
+	switch o.Type {
+	case "channel":
+		chat = o.Chat
+	case "chat":
+		chat = o.SenderChat
+	case "user":
+		if o.SenderUser != nil {
+			return strings.TrimSpace(o.SenderUser.FirstName + " " + o.SenderUser.LastName)
+		}
+	case "hidden_user":
+		return o.SenderUserName
+	}
+	if chat == nil {
+		return ""
+	}
+	if chat.UserName != "" {
+		return fmt.Sprintf("%s @%s", chat.Title, chat.UserName)
+	}
+	return chat.Title
+}
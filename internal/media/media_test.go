@@ -0,0 +1,112 @@
+package media_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/iamwavecut/ngbot/internal/media"
+)
+
+func TestDescribe(t *testing.T) {
+	m := &api.Message{
+		Caption: "best offer",
+		Photo: []api.PhotoSize{
+			{FileID: "small", Width: 90, Height: 90, FileSize: 1000},
+			{FileID: "medium", Width: 320, Height: 320, FileSize: 20000},
+			{FileID: "large", Width: 1280, Height: 1280, FileSize: 300000},
+		},
+		ForwardOrigin: &api.MessageOrigin{Type: "channel", Chat: &api.Chat{Title: "Signals", UserName: "signals"}},
+	}
+	c := media.Describe(m, 100000)
+	if c.Kind != media.KindPhoto || c.Forward != "channel" {
+		t.Errorf("got kind %q forward %q", c.Kind, c.Forward)
+	}
+	if c.Text != "[forwarded from Signals @signals]\nbest offer" {
+		t.Errorf("got text %q", c.Text)
+	}
+	if c.Image == nil || c.Image.FileID != "medium" {
+		t.Errorf("got image %+v, want the largest one under the limit", c.Image)
+	}
+
+	if c := media.Describe(&api.Message{NewChatMembers: []api.User{{ID: 1}}}, 100000); c.Kind != "" {
+		t.Errorf("service message described as %q", c.Kind)
+	}
+	c = media.Describe(&api.Message{Contact: &api.Contact{FirstName: "Manager", PhoneNumber: "+1000"}}, 100000)
+	if c.Kind != media.KindContact || c.Text != "Manager  +1000" {
+		t.Errorf("got contact %q %q", c.Kind, c.Text)
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules := media.DefaultRules()
+	cases := []struct {
+		name   string
+		m      *api.Message
+		rule   string
+		action string
+	}{
+		{"text", &api.Message{Text: "hello"}, "", ""},
+		{"executable", &api.Message{Document: &api.Document{FileName: "Invoice.PDF.Exe"}}, media.RuleExecutable, media.ActionBan},
+		{"pdf", &api.Message{Document: &api.Document{FileName: "invoice.pdf"}}, "", ""},
+		{"contact", &api.Message{Contact: &api.Contact{PhoneNumber: "+1000"}}, media.RuleContact, media.ActionDelete},
+		{"venue", &api.Message{Venue: &api.Venue{Title: "Office"}}, media.RuleLocation, media.ActionDelete},
+		{"story", &api.Message{Story: &api.Story{}}, media.RuleStory, media.ActionDelete},
+		{"channel forward is checked", &api.Message{Text: "x", ForwardOrigin: &api.MessageOrigin{Type: "channel"}}, "", ""},
+		{"harshest wins", &api.Message{
+			Document:      &api.Document{FileName: "setup.apk"},
+			ForwardOrigin: &api.MessageOrigin{Type: "channel"},
+		}, media.RuleExecutable, media.ActionBan},
+	}
+	for _, c := range cases {
+		f, ok := rules.Check(c.m)
+		if ok != (c.rule != "") || f.Rule != c.rule || (ok && f.Action != c.action) {
+			t.Errorf("%s: got %+v %v, want %q %q", c.name, f, ok, c.rule, c.action)
+		}
+	}
+
+	rules.Forward = media.ParseAction("ban", media.ActionCheck)
+	if f, ok := rules.Check(&api.Message{ForwardOrigin: &api.MessageOrigin{Type: "chat"}}); !ok || f.Action != media.ActionBan {
+		t.Errorf("got %+v %v, want the forward banned", f, ok)
+	}
+	if got := media.ParseAction("kick", media.ActionDelete); got != media.ActionDelete {
+		t.Errorf("unknown action parsed as %q", got)
+	}
+}
+
+func TestCommandExtractor(t *testing.T) {
+	if media.NewCommandExtractor(" ") != nil {
+		t.Error("empty command made an extractor")
+	}
+	text, err := media.NewCommandExtractor("cat").ExtractText(context.Background(), []byte("EARN\n  1000$ daily\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "EARN 1000$ daily" {
+		t.Errorf("got %q", text)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var b media.Budget
+	day := time.Date(2024, 10, 1, 23, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if !b.Take(1, 2, day) {
+			t.Fatalf("check %d was refused", i+1)
+		}
+	}
+	if b.Take(1, 2, day) {
+		t.Error("check over the limit was allowed")
+	}
+	if !b.Take(2, 2, day) {
+		t.Error("another chat shares the limit")
+	}
+	if !b.Take(1, 2, day.Add(2*time.Hour)) {
+		t.Error("limit was not reset the next day")
+	}
+	if !b.Take(1, 0, day.Add(2*time.Hour)) {
+		t.Error("no limit refused a check")
+	}
+}
@@ -0,0 +1,80 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	extractTimeout = 20 * time.Second
+	// downloadTimeout bounds the whole download, a stalled file server must not hold the message check
+	downloadTimeout = 30 * time.Second
+)
+
+var downloadClient = &http.Client{Timeout: downloadTimeout}
+
+type (
+	// TextExtractor reads the text rendered into an image, by OCR or a vision model
+	TextExtractor interface {
+		ExtractText(ctx context.Context, image []byte) (string, error)
+	}
+
+	// commandExtractor runs a command with the image on stdin and reads the text from stdout, e.g. tesseract stdin stdout
+	commandExtractor struct {
+		command []string
+	}
+)
+
+// NewCommandExtractor returns the extractor running the command line, nil for an empty one
+func NewCommandExtractor(command string) TextExtractor {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	return &commandExtractor{command: fields}
+}
+
+func (e *commandExtractor) ExtractText(ctx context.Context, image []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, extractTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = bytes.NewReader(image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.WithMessagef(err, "cant run %s: %s", e.command[0], strings.TrimSpace(stderr.String()))
+	}
+	return strings.Join(strings.Fields(string(out)), " "), nil
+}
+
+// Download fetches the file at the URL, failing on files larger than limit bytes
+func Download(ctx context.Context, url string, limit int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant create request")
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant download file")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("file download failed with status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant read file")
+	}
+	if len(data) > limit {
+		return nil, errors.Errorf("file is larger than %d bytes", limit)
+	}
+	return data, nil
+}
@@ -0,0 +1,107 @@
+package media
+
+import (
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// ActionBan bans the author as a spammer
+	ActionBan = "ban"
+	// ActionDelete deletes the message, the author stays untrusted
+	ActionDelete = "delete"
+	// ActionCheck lets the message through to the spam checks
+	ActionCheck = "check"
+
+	RuleExecutable = "executable document"
+	RuleContact    = "shared contact"
+	RuleLocation   = "shared location"
+	RuleForward    = "forwarded channel post"
+	RuleStory      = "forwarded story"
+)
+
+type (
+	// Rules holds the action for every kind of first message the rules look at
+	Rules struct {
+		Executable string
+		Contact    string
+		Location   string
+		Forward    string
+		Story      string
+	}
+
+	// Finding is the rule a first message breaks
+	Finding struct {
+		Rule   string
+		Action string
+	}
+)
+
+// Actions lists the rule actions
+func Actions() []string {
+	return []string{ActionBan, ActionDelete, ActionCheck}
+}
+
+// DefaultRules ban executables and delete contacts, locations and stories, forwards go through the spam checks
+func DefaultRules() Rules {
+	return Rules{
+		Executable: ActionBan,
+		Contact:    ActionDelete,
+		Location:   ActionDelete,
+		Forward:    ActionCheck,
+		Story:      ActionDelete,
+	}
+}
+
+// Check returns the rule the first message breaks, rules with the check action are skipped
+func (r Rules) Check(m *api.Message) (Finding, bool) {
+	if m == nil {
+		return Finding{}, false
+	}
+	findings := []Finding{}
+	if m.Document != nil && IsExecutable(m.Document.FileName) {
+		findings = append(findings, Finding{Rule: RuleExecutable, Action: r.Executable})
+	}
+	if m.Story != nil {
+		findings = append(findings, Finding{Rule: RuleStory, Action: r.Story})
+	}
+	if m.Contact != nil {
+		findings = append(findings, Finding{Rule: RuleContact, Action: r.Contact})
+	}
+	if m.Location != nil || m.Venue != nil {
+		findings = append(findings, Finding{Rule: RuleLocation, Action: r.Location})
+	}
+	if m.ForwardOrigin != nil && (m.ForwardOrigin.Type == "channel" || m.ForwardOrigin.Type == "chat") {
+		findings = append(findings, Finding{Rule: RuleForward, Action: r.Forward})
+	}
+	// the harshest action wins
+	var res Finding
+	for _, f := range findings {
+		if rank(f.Action) > rank(res.Action) {
+			res = f
+		}
+	}
+	if rank(res.Action) <= rank(ActionCheck) {
+		return Finding{}, false
+	}
+	return res, true
+}
+
+// ParseAction returns the action, or fallback for an unknown one
+func ParseAction(action, fallback string) string {
+	if rank(action) == 0 {
+		return fallback
+	}
+	return action
+}
+
+func rank(action string) int {
+	switch action {
+	case ActionCheck:
+		return 1
+	case ActionDelete:
+		return 2
+	case ActionBan:
+		return 3
+	}
+	return 0
+}
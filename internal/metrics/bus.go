@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/iamwavecut/ngbot/internal/event"
+)
+
+type busCollector struct {
+	bus       *event.Bus
+	counters  *prometheus.Desc
+	queued    *prometheus.Desc
+	queueSize *prometheus.Desc
+}
+
+// ObserveBus counts domain events and exports the bus counters and queue lengths, labelled with the bot name
+func ObserveBus(bus *event.Bus, botName string) []*event.Subscription {
+	labels := prometheus.Labels{"bot": botName}
+	Registry.MustRegister(&busCollector{
+		bus: bus,
+		counters: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "event_bus", "events_total"),
+			"Event bus counters by state: published, delivered, unrouted, expired, dead_lettered.",
+			[]string{"state"}, labels,
+		),
+		queued: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "event_bus", "queued_events"),
+			"Events waiting in a subscription queue.",
+			[]string{"subscription"}, labels,
+		),
+		queueSize: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "event_bus", "queue_capacity"),
+			"Subscription queue capacity.",
+			[]string{"subscription"}, labels,
+		),
+	})
+
+	return []*event.Subscription{
+		event.Subscribe(bus, "metrics.challenge_started", func(event.ChallengeStarted) error {
+			Challenges.WithLabelValues("started").Inc()
+			return nil
+		}),
+		event.Subscribe(bus, "metrics.challenge_passed", func(event.ChallengePassed) error {
+			Challenges.WithLabelValues("passed").Inc()
+			return nil
+		}),
+		event.Subscribe(bus, "metrics.challenge_failed", func(e event.ChallengeFailed) error {
+			result := "failed"
+			if e.Reason == event.ChallengeFailTimeout {
+				result = "timed_out"
+			}
+			Challenges.WithLabelValues(result).Inc()
+			return nil
+		}),
+		event.Subscribe(bus, "metrics.lockdown_started", func(e event.LockdownStarted) error {
+			RaidLockdowns.WithLabelValues(e.Signal).Inc()
+			return nil
+		}),
+		event.Subscribe(bus, "metrics.reputation_matched", func(e event.ReputationMatched) error {
+			ReputationMatches.WithLabelValues(e.Verdict, e.Action).Inc()
+			return nil
+		}),
+	}
+}
+
+func (c *busCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.counters
+	ch <- c.queued
+	ch <- c.queueSize
+}
+
+func (c *busCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.bus.Stats()
+	for state, value := range map[string]uint64{
+		"published":     st.Published,
+		"delivered":     st.Delivered,
+		"unrouted":      st.Unrouted,
+		"expired":       st.Expired,
+		"dead_lettered": st.DeadLettered,
+	} {
+		ch <- prometheus.MustNewConstMetric(c.counters, prometheus.CounterValue, float64(value), state)
+	}
+	for _, sub := range st.Subscriptions {
+		ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(sub.Queued), sub.Name)
+		ch <- prometheus.MustNewConstMetric(c.queueSize, prometheus.GaugeValue, float64(sub.Capacity), sub.Name)
+	}
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ngbot"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	UpdatesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_processed_total",
+		Help:      "Updates passed to handlers, by update type, handler and outcome.",
+	}, []string{"type", "handler", "result"})
+
+	UpdatesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_dropped_total",
+		Help:      "Updates not passed to any handler, by update type and reason (stale, unrouted).",
+	}, []string{"type", "reason"})
+
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent by a handler on a single update.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"type", "handler"})
+
+	TelegramRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_retries_total",
+		Help:      "Repeated Bot API requests, by method and reason (flood_wait, server_error).",
+	}, []string{"method", "reason"})
+
+	TelegramLimiterWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "telegram_limiter_wait_seconds",
+		Help:      "Time a Bot API request waited for the rate limits, by lane (urgent, normal).",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 9),
+	}, []string{"lane"})
+
+	Challenges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "challenges_total",
+		Help:      "Gatekeeper challenges by result: started, passed, failed, timed_out.",
+	}, []string{"result"})
+
+	RaidLockdowns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "raid_lockdowns_total",
+		Help:      "Chat lockdowns started by the raid detector, by signal.",
+	}, []string{"signal"})
+
+	ReputationMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reputation_matches_total",
+		Help:      "Joiners with a trust group decision, by verdict and chat action.",
+	}, []string{"verdict", "action"})
+
+	SpamVerdicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spam_verdicts_total",
+		Help:      "Spam classification results by source.",
+	}, []string{"source", "verdict"})
+
+	LLMDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "llm_request_duration_seconds",
+		Help:      "LLM completion latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"model", "result"})
+
+	LLMTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_tokens_total",
+		Help:      "LLM tokens consumed, by model and kind (prompt, completion).",
+	}, []string{"model", "kind"})
+
+	LLMCost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_cost_total",
+		Help:      "LLM spending by provider, in the currency of the configured prices.",
+	}, []string{"provider"})
+
+	LLMFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_failovers_total",
+		Help:      "LLM calls passed on to the next provider, by the failed provider.",
+	}, []string{"provider"})
+
+	LLMBudgetRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_budget_rejections_total",
+		Help:      "LLM calls refused by the daily budget, by scope (global, chat).",
+	}, []string{"scope"})
+
+	LolsDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lols_request_duration_seconds",
+		Help:      "lols.bot lookup latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	LolsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lols_errors_total",
+		Help:      "Failed lols.bot lookups.",
+	})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database query latency, by query.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	}, []string{"query"})
+
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Service cache lookups, by cache and result (hit, miss).",
+	}, []string{"cache", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		UpdatesProcessed,
+		UpdatesDropped,
+		HandlerDuration,
+		TelegramRetries,
+		TelegramLimiterWait,
+		Challenges,
+		RaidLockdowns,
+		ReputationMatches,
+		SpamVerdicts,
+		LLMDuration,
+		LLMTokens,
+		LLMCost,
+		LLMFailovers,
+		LLMBudgetRejections,
+		LolsDuration,
+		LolsErrors,
+		DBQueryDuration,
+		CacheRequests,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveDBQuery starts a timer, call the returned func when the query is done
+func ObserveDBQuery(query string) func() {
+	start := time.Now()
+	return func() {
+		DBQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	}
+}
+
+// CacheHit counts a cache lookup result
+func CacheHit(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheRequests.WithLabelValues(cache, result).Inc()
+}
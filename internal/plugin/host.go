@@ -0,0 +1,322 @@
+package plugin
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
+	"github.com/iamwavecut/ngbot/internal/lists"
+	"github.com/iamwavecut/ngbot/internal/llm"
+)
+
+const (
+	permissionsTTL = 10 * time.Minute
+	myChatMember   = "my_chat_member"
+)
+
+type (
+	// Host owns the plugin instances of a single bot
+	Host struct {
+		s      bot.Service
+		llm    *llm.Gateway
+		lists  *lists.Lists
+		spam   *fingerprint.Index
+		mutex  sync.RWMutex
+		loaded map[string]*instance
+		perms  *permissionCache
+	}
+
+	instance struct {
+		plugin   Plugin
+		manifest Manifest
+	}
+
+	// gated declares the manifest update types and skips chats where the bot lacks the permissions of the manifest
+	gated struct {
+		host *Host
+		inst *instance
+	}
+
+	permissionCache struct {
+		mutex   sync.Mutex
+		members map[int64]cachedMember
+	}
+
+	cachedMember struct {
+		member    api.ChatMember
+		fetchedAt time.Time
+		// warned are the plugins that logged the missing rights since they were fetched
+		warned map[string]bool
+	}
+)
+
+func NewHost(s bot.Service, llm *llm.Gateway, lists *lists.Lists, spam *fingerprint.Index) *Host {
+	return &Host{
+		s:      s,
+		llm:    llm,
+		lists:  lists,
+		spam:   spam,
+		loaded: map[string]*instance{},
+		perms:  &permissionCache{members: map[int64]cachedMember{}},
+	}
+}
+
+// Apply loads and starts the named plugins, stops the others and returns the loaded names in manifest order
+func (h *Host) Apply(ctx context.Context, names []string) []string {
+	entry := h.getLogEntry().WithField("method", "Apply")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, name := range names {
+		if _, ok := h.loaded[name]; ok {
+			continue
+		}
+		inst, err := h.load(ctx, name)
+		if err != nil {
+			entry.WithError(err).WithField("plugin", name).Error("cant load plugin")
+			continue
+		}
+		h.loaded[name] = inst
+		entry.WithFields(log.Fields{"plugin": name, "order": inst.manifest.Order}).Info("plugin started")
+	}
+	for name, inst := range h.loaded {
+		if slices.Contains(names, name) {
+			continue
+		}
+		if err := inst.plugin.Stop(ctx); err != nil {
+			entry.WithError(err).WithField("plugin", name).Warn("plugin did not stop cleanly")
+		}
+		delete(h.loaded, name)
+		entry.WithField("plugin", name).Info("plugin stopped")
+	}
+
+	ordered := make([]string, 0, len(h.loaded))
+	for _, name := range names {
+		if _, ok := h.loaded[name]; ok && !slices.Contains(ordered, name) {
+			ordered = append(ordered, name)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return h.loaded[ordered[i]].manifest.Order < h.loaded[ordered[j]].manifest.Order
+	})
+	return ordered
+}
+
+func (h *Host) load(ctx context.Context, name string) (*instance, error) {
+	factory, ok := lookup(name)
+	if !ok {
+		return nil, errors.New("plugin is not registered")
+	}
+	p := factory()
+	settings := config.Get().PluginSettings[name]
+	if err := p.Init(Deps{
+		Service: h.s,
+		LLM:     h.llm,
+		Lists:   h.lists,
+		Spam:    h.spam,
+		Setting: func(key string) string {
+			idx := slices.IndexFunc(p.Manifest().Settings, func(s SettingSpec) bool { return s.Key == key })
+			if idx < 0 {
+				return ""
+			}
+			spec := p.Manifest().Settings[idx]
+			// a reload is not rejected for an invalid value, the default stands in for it
+			if value, ok := config.Get().PluginSettings[name][key]; ok && spec.Validate(value) == nil {
+				return value
+			}
+			return spec.Default
+		},
+		Permitted: func(chatID int64, required ...Permission) bool {
+			return len(h.lacking(chatID, name, required, "bot lacks permissions for the action")) == 0
+		},
+		Log: log.WithFields(log.Fields{"context": name, "plugin": name}),
+	}); err != nil {
+		return nil, errors.WithMessage(err, "init failed")
+	}
+
+	manifest := p.Manifest()
+	if err := checkManifest(name, manifest, settings); err != nil {
+		_ = p.Stop(ctx)
+		return nil, err
+	}
+	if err := p.Start(ctx); err != nil {
+		_ = p.Stop(ctx)
+		return nil, errors.WithMessage(err, "start failed")
+	}
+	return &instance{plugin: p, manifest: manifest}, nil
+}
+
+// checkManifest validates the manifest and the configured settings against it
+func checkManifest(name string, manifest Manifest, settings map[string]string) error {
+	if manifest.Name != name {
+		return errors.Errorf("manifest name %q does not match", manifest.Name)
+	}
+	for key, value := range settings {
+		idx := slices.IndexFunc(manifest.Settings, func(s SettingSpec) bool { return s.Key == key })
+		if idx < 0 {
+			return errors.Errorf("unknown setting %q", key)
+		}
+		if err := manifest.Settings[idx].Validate(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns the loaded plugin as an update handler, nil if it is not loaded
+func (h *Host) Handler(name string) bot.Handler {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	inst, ok := h.loaded[name]
+	if !ok {
+		return nil
+	}
+	return &gated{host: h, inst: inst}
+}
+
+// Manifests returns the manifests of the loaded plugins
+func (h *Host) Manifests() []Manifest {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	manifests := make([]Manifest, 0, len(h.loaded))
+	for _, inst := range h.loaded {
+		manifests = append(manifests, inst.manifest)
+	}
+	return manifests
+}
+
+// Reload hands the new config to the plugins implementing Reloader
+func (h *Host) Reload(cfg config.Config) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, inst := range h.loaded {
+		if r, ok := inst.plugin.(Reloader); ok {
+			r.Reload(cfg)
+		}
+	}
+}
+
+// Stop stops every loaded plugin
+func (h *Host) Stop(ctx context.Context) {
+	h.Apply(ctx, nil)
+}
+
+func (h *Host) getLogEntry() *log.Entry {
+	return log.WithFields(log.Fields{"context": "plugin", "object": "Host"})
+}
+
+func (g *gated) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+	m := g.inst.manifest
+	if u.MyChatMember != nil && chat != nil {
+		// the rights of the bot changed
+		g.host.perms.forget(chat.ID)
+		if !g.consumes(myChatMember) {
+			return true, nil
+		}
+	}
+	if len(m.Permissions) > 0 && chat != nil && (chat.IsGroup() || chat.IsSuperGroup()) {
+		if len(g.host.lacking(chat.ID, m.Name, m.Permissions, "bot lacks permissions, skipping plugin")) > 0 {
+			return true, nil
+		}
+	}
+	return g.inst.plugin.Handle(ctx, u, chat, user)
+}
+
+// UpdateTypes routes only the update types of the manifest to the plugin,
+// and the changes of the bot membership that invalidate the cached rights
+func (g *gated) UpdateTypes() []string {
+	types := g.inst.manifest.UpdateTypes
+	if len(types) == 0 || slices.Contains(types, myChatMember) {
+		return types
+	}
+	return append(slices.Clone(types), myChatMember)
+}
+
+func (g *gated) consumes(updateType string) bool {
+	types := g.inst.manifest.UpdateTypes
+	return len(types) == 0 || slices.Contains(types, updateType)
+}
+
+// ErrorPolicy returns the configured policy of the plugin, or the one of the manifest
+func (g *gated) ErrorPolicy() bot.ErrorPolicy {
+	if policy, ok := config.Get().ErrorPolicies[g.inst.manifest.Name]; ok {
+		return bot.ErrorPolicy(policy)
+	}
+	return g.inst.manifest.ErrorPolicy
+}
+
+// lacking returns the rights the bot lacks in the chat. They are logged as a warning once per plugin
+// until the rights are fetched again, so that a misconfigured chat does not flood the log.
+func (h *Host) lacking(chatID int64, name string, required []Permission, msg string) []Permission {
+	missing := h.missingPermissions(chatID, required)
+	if len(missing) == 0 {
+		return nil
+	}
+	entry := h.getLogEntry().WithFields(log.Fields{
+		"plugin":  name,
+		"chat_id": chatID,
+		"missing": missing,
+	})
+	if h.perms.warn(chatID, name) {
+		entry.Warn(msg)
+	} else {
+		entry.Debug(msg)
+	}
+	return missing
+}
+
+func (h *Host) missingPermissions(chatID int64, required []Permission) []Permission {
+	if len(required) == 0 {
+		return nil
+	}
+	h.perms.mutex.Lock()
+	cached, ok := h.perms.members[chatID]
+	h.perms.mutex.Unlock()
+
+	if !ok || time.Since(cached.fetchedAt) > permissionsTTL {
+		b := h.s.GetBot()
+		member, err := b.GetChatMember(api.GetChatMemberConfig{
+			ChatConfigWithUser: api.ChatConfigWithUser{
+				ChatConfig: api.ChatConfig{ChatID: chatID},
+				UserID:     b.Self.ID,
+			},
+		})
+		if err != nil {
+			// let the plugin try and report, rather than silently skipping it
+			h.getLogEntry().WithError(err).WithField("chat_id", chatID).Warn("cant get bot permissions")
+			return nil
+		}
+		cached = cachedMember{member: member, fetchedAt: time.Now(), warned: map[string]bool{}}
+		h.perms.mutex.Lock()
+		h.perms.members[chatID] = cached
+		h.perms.mutex.Unlock()
+	}
+	return missingPermissions(cached.member, required)
+}
+
+// warn reports whether the plugin has not logged the missing rights in the chat since they were fetched
+func (c *permissionCache) warn(chatID int64, name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, ok := c.members[chatID]
+	if !ok || cached.warned[name] {
+		return false
+	}
+	cached.warned[name] = true
+	return true
+}
+
+func (c *permissionCache) forget(chatID int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.members, chatID)
+}
@@ -0,0 +1,144 @@
+package plugin_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/plugin"
+	"github.com/iamwavecut/ngbot/internal/telegram/telegramtest"
+)
+
+// service serves the bot of the fake server, the host needs nothing else
+type service struct {
+	bot.Service
+	bot *api.BotAPI
+}
+
+func (s *service) GetBot() *api.BotAPI { return s.bot }
+
+// setup loads the plugin settings of the YAML and returns a host of a bot talking to a fake server
+func setup(t *testing.T, settings string) (*plugin.Host, *telegramtest.Server) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("token: "+telegramtest.Token+"\nopenai:\n  api_key: key\n"+settings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Init([]string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := telegramtest.NewServer()
+	t.Cleanup(srv.Close)
+	b, err := api.NewBotAPIWithAPIEndpoint(telegramtest.Token, srv.Endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := plugin.NewHost(&service{bot: b}, nil, nil, nil)
+	t.Cleanup(func() { host.Stop(context.Background()) })
+	return host, srv
+}
+
+// counting registers a plugin whose handler counts its calls
+func counting(t *testing.T, manifest plugin.Manifest) *int {
+	t.Helper()
+	calls := new(int)
+	err := plugin.Register(manifest.Name, plugin.Simple(manifest, func(plugin.Deps) (bot.Handler, error) {
+		return bot.HandlerFunc(func(context.Context, *api.Update, *api.Chat, *api.User) (bool, error) {
+			*calls++
+			return true, nil
+		}), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return calls
+}
+
+func TestApply(t *testing.T) {
+	host, _ := setup(t, "")
+	counting(t, plugin.Manifest{Name: "apply-late", Order: 2})
+	counting(t, plugin.Manifest{Name: "apply-early", Order: 1})
+
+	loaded := host.Apply(context.Background(), []string{"apply-late", "apply-missing", "apply-early"})
+	if !slices.Equal(loaded, []string{"apply-early", "apply-late"}) {
+		t.Errorf("loaded %v", loaded)
+	}
+
+	loaded = host.Apply(context.Background(), []string{"apply-late"})
+	if !slices.Equal(loaded, []string{"apply-late"}) || host.Handler("apply-early") != nil {
+		t.Errorf("loaded %v after stopping apply-early", loaded)
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	host, _ := setup(t, `
+plugin_settings:
+  settings-unknown:
+    colour: red
+  settings-invalid:
+    limit: many
+  settings-valid:
+    limit: "3"
+`)
+	limit := []plugin.SettingSpec{{Key: "limit", Type: plugin.SettingInt, Default: "1"}}
+	for _, name := range []string{"settings-unknown", "settings-invalid", "settings-valid"} {
+		counting(t, plugin.Manifest{Name: name, Settings: limit})
+	}
+
+	loaded := host.Apply(context.Background(), []string{"settings-unknown", "settings-invalid", "settings-valid"})
+	if !slices.Equal(loaded, []string{"settings-valid"}) {
+		t.Errorf("loaded %v", loaded)
+	}
+}
+
+func TestGated(t *testing.T) {
+	host, srv := setup(t, "")
+	calls := counting(t, plugin.Manifest{
+		Name:        "gated",
+		Permissions: []plugin.Permission{plugin.PermissionDeleteMessages},
+		UpdateTypes: []string{"message"},
+	})
+	host.Apply(context.Background(), []string{"gated"})
+	h := host.Handler("gated")
+	if types := h.(bot.Consumer).UpdateTypes(); !slices.Equal(types, []string{"message", "my_chat_member"}) {
+		t.Errorf("update types %v", types)
+	}
+
+	restricted := &api.Chat{ID: -1, Type: "supergroup"}
+	srv.SetChatMember(restricted.ID, api.ChatMember{User: &srv.Bot, Status: "administrator"})
+	handle := func(chat *api.Chat, u *api.Update) {
+		t.Helper()
+		if proceed, err := h.Handle(context.Background(), u, chat, nil); !proceed || err != nil {
+			t.Fatalf("got %v, %v", proceed, err)
+		}
+	}
+	message := &api.Update{Message: &api.Message{Date: int(time.Now().Unix())}}
+
+	// the plugin is skipped where the bot may not delete messages
+	handle(restricted, message)
+	handle(&api.Chat{ID: -2, Type: "supergroup"}, message)
+	handle(&api.Chat{ID: 2, Type: "private"}, message)
+	if *calls != 2 {
+		t.Errorf("%d calls", *calls)
+	}
+
+	// a change of the bot rights is seen at once
+	srv.SetChatMember(restricted.ID, api.ChatMember{User: &srv.Bot, Status: "administrator", CanDeleteMessages: true})
+	handle(restricted, message)
+	if *calls != 2 {
+		t.Errorf("%d calls with the rights cached", *calls)
+	}
+	handle(restricted, &api.Update{MyChatMember: &api.ChatMemberUpdated{}})
+	handle(restricted, message)
+	if *calls != 3 {
+		t.Errorf("%d calls after the rights changed", *calls)
+	}
+}
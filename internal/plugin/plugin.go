@@ -0,0 +1,222 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
+	"github.com/iamwavecut/ngbot/internal/lists"
+	"github.com/iamwavecut/ngbot/internal/llm"
+)
+
+const (
+	PermissionDeleteMessages  Permission = "can_delete_messages"
+	PermissionRestrictMembers Permission = "can_restrict_members"
+	PermissionInviteUsers     Permission = "can_invite_users"
+
+	SettingString   SettingType = "string"
+	SettingInt      SettingType = "int"
+	SettingBool     SettingType = "bool"
+	SettingDuration SettingType = "duration"
+)
+
+type (
+	// Permission is an administrator right the bot needs in a chat for the plugin or one of its actions to work there
+	Permission string
+
+	SettingType string
+
+	// SettingSpec declares a plugin setting, values come from the plugin_settings config section
+	SettingSpec struct {
+		Key         string      `json:"key"`
+		Type        SettingType `json:"type"`
+		Default     string      `json:"default"`
+		Description string      `json:"description"`
+	}
+
+	// Manifest describes a plugin to the host
+	Manifest struct {
+		Name string `json:"name"`
+		// Order places the plugin in the handler chain, lower runs first
+		Order int `json:"order"`
+		// Permissions are the rights every path of the plugin needs, the plugin is skipped in chats where the bot lacks them.
+		// Rights only some actions need are checked with Deps.Permitted instead.
+		Permissions []Permission `json:"permissions"`
+		// UpdateTypes are Bot API update type names the plugin receives, all of them if empty
+		UpdateTypes []string      `json:"update_types"`
+		Settings    []SettingSpec `json:"settings"`
+		// ErrorPolicy applies to the errors of the plugin, continue by default, the error_policies config key overrides it
+		ErrorPolicy bot.ErrorPolicy `json:"error_policy"`
+	}
+
+	// Deps are the services available to a plugin
+	Deps struct {
+		Service bot.Service
+		// LLM is the gateway to the LLM providers shared by all bots
+		LLM *llm.Gateway
+		// Lists are the operator lists shared by all bots
+		Lists *lists.Lists
+		// Spam are the fingerprints of recent spam shared by all bots, the view of the bot
+		Spam      *fingerprint.Index
+		Setting   Setting
+		Permitted Permitted
+		Log       *log.Entry
+	}
+
+	// Plugin is an update handler with a lifecycle, driven by a Host
+	Plugin interface {
+		bot.Handler
+		Manifest() Manifest
+		Init(deps Deps) error
+		Start(ctx context.Context) error
+		Stop(ctx context.Context) error
+	}
+
+	// Reloader is implemented by plugins that apply hot reloaded config
+	Reloader interface {
+		Reload(cfg config.Config)
+	}
+
+	// Factory creates a fresh plugin instance for every bot
+	Factory func() Plugin
+
+	// Setting returns the configured value of a setting declared in the manifest, or its default when unset or invalid
+	Setting func(key string) string
+
+	// Permitted reports whether the bot has the rights an action needs in the chat, missing rights are logged as a warning
+	Permitted func(chatID int64, required ...Permission) bool
+)
+
+var (
+	catalogMutex sync.RWMutex
+	catalog      = map[string]Factory{}
+)
+
+// Register adds a plugin factory to the catalog, usually from an init function of the plugin package
+func Register(name string, factory Factory) error {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	if _, ok := catalog[name]; ok {
+		return errors.Errorf("plugin %q is already registered", name)
+	}
+	catalog[name] = factory
+	return nil
+}
+
+// MustRegister is Register for init functions
+func MustRegister(name string, factory Factory) {
+	if err := Register(name, factory); err != nil {
+		panic(err)
+	}
+}
+
+// Names lists the registered plugins
+func Names() []string {
+	catalogMutex.RLock()
+	defer catalogMutex.RUnlock()
+	names := make([]string, 0, len(catalog))
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookup(name string) (Factory, bool) {
+	catalogMutex.RLock()
+	defer catalogMutex.RUnlock()
+	factory, ok := catalog[name]
+	return factory, ok
+}
+
+// Validate checks a configured value against the setting type
+func (s SettingSpec) Validate(value string) error {
+	var err error
+	switch s.Type {
+	case SettingString, "":
+	case SettingInt:
+		_, err = strconv.Atoi(value)
+	case SettingBool:
+		_, err = strconv.ParseBool(value)
+	case SettingDuration:
+		_, err = time.ParseDuration(value)
+	default:
+		err = fmt.Errorf("unknown type %q", s.Type)
+	}
+	return errors.WithMessagef(err, "setting %s", s.Key)
+}
+
+// Int returns the setting as a number, zero if it is not one
+func (s Setting) Int(key string) int {
+	n, _ := strconv.Atoi(s(key))
+	return n
+}
+
+// Duration returns the setting as a duration, zero if it is not one
+func (s Setting) Duration(key string) time.Duration {
+	d, _ := time.ParseDuration(s(key))
+	return d
+}
+
+// Simple turns a handler constructor into a plugin without own lifecycle
+func Simple(manifest Manifest, newHandler func(deps Deps) (bot.Handler, error)) Factory {
+	return func() Plugin {
+		return &simple{manifest: manifest, newHandler: newHandler}
+	}
+}
+
+type simple struct {
+	bot.Handler
+	manifest   Manifest
+	newHandler func(deps Deps) (bot.Handler, error)
+}
+
+func (p *simple) Manifest() Manifest { return p.manifest }
+
+func (p *simple) Init(deps Deps) (err error) {
+	p.Handler, err = p.newHandler(deps)
+	return err
+}
+
+func (p *simple) Start(context.Context) error { return nil }
+func (p *simple) Stop(context.Context) error  { return nil }
+
+// Reload passes the config to the wrapped handler when it implements Reloader
+func (p *simple) Reload(cfg config.Config) {
+	if r, ok := p.Handler.(Reloader); ok {
+		r.Reload(cfg)
+	}
+}
+
+// missingPermissions reports which of the required permissions the member lacks
+func missingPermissions(member api.ChatMember, required []Permission) []Permission {
+	if member.IsCreator() {
+		return nil
+	}
+	var missing []Permission
+	for _, p := range required {
+		var granted bool
+		switch p {
+		case PermissionDeleteMessages:
+			granted = member.CanDeleteMessages
+		case PermissionRestrictMembers:
+			granted = member.CanRestrictMembers
+		case PermissionInviteUsers:
+			granted = member.CanInviteUsers
+		}
+		if !member.IsAdministrator() || !granted {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
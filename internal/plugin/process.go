@@ -0,0 +1,314 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+)
+
+const (
+	defaultProcessTimeout = 5 * time.Second
+	rpcMethodNotFound     = -32601
+)
+
+// actionPermissions are the Bot API methods a subprocess plugin may call, with the manifest permission each needs
+var actionPermissions = map[string]Permission{
+	"sendMessage":            "",
+	"answerCallbackQuery":    "",
+	"deleteMessage":          PermissionDeleteMessages,
+	"banChatMember":          PermissionRestrictMembers,
+	"unbanChatMember":        PermissionRestrictMembers,
+	"restrictChatMember":     PermissionRestrictMembers,
+	"approveChatJoinRequest": PermissionInviteUsers,
+	"declineChatJoinRequest": PermissionInviteUsers,
+}
+
+type (
+	// process is a plugin running as a subprocess, speaking newline delimited JSON-RPC 2.0 on stdin and stdout
+	process struct {
+		cfg      config.ExternalPlugin
+		deps     Deps
+		manifest Manifest
+
+		cmd     *exec.Cmd
+		stdin   io.WriteCloser
+		mutex   sync.Mutex
+		nextID  int64
+		pending map[int64]chan rpcResponse
+		exited  chan struct{}
+	}
+
+	rpcRequest struct {
+		JSONRPC string `json:"jsonrpc"`
+		ID      int64  `json:"id"`
+		Method  string `json:"method"`
+		Params  any    `json:"params,omitempty"`
+	}
+
+	rpcResponse struct {
+		ID     int64           `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+
+	rpcError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+
+	initParams struct {
+		BotID       int64             `json:"bot_id"`
+		BotUsername string            `json:"bot_username"`
+		Settings    map[string]string `json:"settings"`
+	}
+
+	reloadParams struct {
+		Settings map[string]string `json:"settings"`
+	}
+
+	handleParams struct {
+		Update *api.Update `json:"update"`
+	}
+
+	handleResult struct {
+		Proceed bool     `json:"proceed"`
+		Actions []action `json:"actions"`
+	}
+
+	// action is a Bot API call requested by the plugin, executed by the host
+	action struct {
+		Method string         `json:"method"`
+		Params map[string]any `json:"params"`
+	}
+)
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// NewProcess returns a factory of plugins running the configured command, one subprocess per bot
+func NewProcess(cfg config.ExternalPlugin) Factory {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultProcessTimeout
+	}
+	return func() Plugin {
+		return &process{cfg: cfg, pending: map[int64]chan rpcResponse{}, exited: make(chan struct{})}
+	}
+}
+
+func (p *process) Manifest() Manifest {
+	return p.manifest
+}
+
+func (p *process) Init(deps Deps) error {
+	p.deps = deps
+	p.cmd = exec.Command(p.cfg.Command[0], p.cfg.Command[1:]...)
+	var err error
+	if p.stdin, err = p.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := p.cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return errors.WithMessage(err, "cant start plugin process")
+	}
+	go p.readResponses(stdout)
+	go p.logStderr(stderr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+	defer cancel()
+	if err := p.call(ctx, "manifest", nil, &p.manifest); err != nil {
+		p.kill()
+		return errors.WithMessage(err, "cant get manifest")
+	}
+	self := deps.Service.GetBot().Self
+	if err := p.call(ctx, "init", initParams{BotID: self.ID, BotUsername: self.UserName, Settings: p.settings()}, nil); err != nil {
+		p.kill()
+		return errors.WithMessage(err, "init call failed")
+	}
+	return nil
+}
+
+// Reload hands the reloaded settings to the plugin with the optional reload call
+func (p *process) Reload(config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+	defer cancel()
+	if err := optional(p.call(ctx, "reload", reloadParams{Settings: p.settings()}, nil)); err != nil {
+		p.getLogEntry().WithError(err).Warn("reload call failed")
+	}
+}
+
+// settings are the current values of the settings of the manifest
+func (p *process) settings() map[string]string {
+	settings := map[string]string{}
+	for _, spec := range p.manifest.Settings {
+		settings[spec.Key] = p.deps.Setting(spec.Key)
+	}
+	return settings
+}
+
+func (p *process) Start(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	return optional(p.call(ctx, "start", nil, nil))
+}
+
+func (p *process) Stop(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	err := optional(p.call(ctx, "stop", nil, nil))
+	_ = p.stdin.Close()
+	select {
+	case <-p.exited:
+	case <-ctx.Done():
+		p.kill()
+	}
+	return err
+}
+
+func (p *process) Handle(ctx context.Context, u *api.Update, chat *api.Chat, user *api.User) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	var result handleResult
+	if err := p.call(ctx, "handle", handleParams{Update: u}, &result); err != nil {
+		return true, errors.WithMessage(err, "handle call failed")
+	}
+	for _, a := range result.Actions {
+		if err := p.execute(a); err != nil {
+			p.deps.Log.WithError(err).WithField("action", a.Method).Warn("plugin action failed")
+		}
+	}
+	return result.Proceed, nil
+}
+
+// execute performs an action if the method is allowed and the manifest declares its permission
+func (p *process) execute(a action) error {
+	required, ok := actionPermissions[a.Method]
+	if !ok {
+		return errors.Errorf("method %s is not allowed", a.Method)
+	}
+	if required != "" && !slices.Contains(p.manifest.Permissions, required) {
+		return errors.Errorf("method %s needs the %s permission in the manifest", a.Method, required)
+	}
+	params := api.Params{}
+	for key, value := range a.Params {
+		if s, ok := value.(string); ok {
+			params[key] = s
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return errors.WithMessagef(err, "param %s", key)
+		}
+		params[key] = string(raw)
+	}
+	_, err := p.deps.Service.GetBot().MakeRequest(a.Method, params)
+	return err
+}
+
+func (p *process) call(ctx context.Context, method string, params any, result any) error {
+	p.mutex.Lock()
+	p.nextID++
+	id := p.nextID
+	ch := make(chan rpcResponse, 1)
+	p.pending[id] = ch
+	line, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err == nil {
+		_, err = p.stdin.Write(append(line, '\n'))
+	}
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		delete(p.pending, id)
+		p.mutex.Unlock()
+	}()
+	if err != nil {
+		return errors.WithMessage(err, "cant send request")
+	}
+
+	select {
+	case res := <-ch:
+		if res.Error != nil {
+			return res.Error
+		}
+		if result == nil || len(res.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(res.Result, result)
+	case <-p.exited:
+		return errors.New("plugin process exited")
+	case <-ctx.Done():
+		return errors.WithMessage(ctx.Err(), method)
+	}
+}
+
+func (p *process) readResponses(stdout io.Reader) {
+	defer close(p.exited)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var res rpcResponse
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			p.getLogEntry().WithError(err).Warn("malformed plugin response")
+			continue
+		}
+		p.mutex.Lock()
+		ch, ok := p.pending[res.ID]
+		p.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		// a call takes a single response, a duplicate ID must not hold up the others
+		select {
+		case ch <- res:
+		default:
+			p.getLogEntry().WithField("id", res.ID).Warn("duplicate plugin response")
+		}
+	}
+	_ = p.cmd.Wait()
+	p.getLogEntry().Info("plugin process exited")
+}
+
+func (p *process) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		p.getLogEntry().Debug(scanner.Text())
+	}
+}
+
+func (p *process) kill() {
+	if p.cmd.Process != nil {
+		_ = p.cmd.Process.Kill()
+	}
+}
+
+func (p *process) getLogEntry() *log.Entry {
+	return log.WithFields(log.Fields{"context": "plugin", "plugin": p.cfg.Name})
+}
+
+// optional treats lifecycle methods the plugin does not implement as no-ops
+func optional(err error) error {
+	var rpcErr *rpcError
+	if errors.As(err, &rpcErr) && rpcErr.Code == rpcMethodNotFound {
+		return nil
+	}
+	return err
+}
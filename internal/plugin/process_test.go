@@ -0,0 +1,116 @@
+package plugin_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/plugin"
+)
+
+const helperEnv = "NGBOT_TEST_PLUGIN"
+
+// TestHelperProcess is the subprocess plugin of TestProcess: it greets every message with the configured greeting,
+// and tries to delete it without declaring the permission
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv(helperEnv) == "" {
+		t.Skip("runs as a plugin subprocess")
+	}
+	var greeting string
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var req struct {
+			ID     int64           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		res := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		switch req.Method {
+		case "manifest":
+			res["result"] = plugin.Manifest{
+				Name:        "external",
+				Order:       5,
+				UpdateTypes: []string{"message"},
+				Settings:    []plugin.SettingSpec{{Key: "greeting", Default: "hello"}},
+			}
+		case "init":
+			var params struct {
+				Settings map[string]string `json:"settings"`
+			}
+			_ = json.Unmarshal(req.Params, &params)
+			greeting = params.Settings["greeting"]
+			res["result"] = map[string]any{}
+		case "handle":
+			var params struct {
+				Update api.Update `json:"update"`
+			}
+			_ = json.Unmarshal(req.Params, &params)
+			m := params.Update.Message
+			res["result"] = map[string]any{"proceed": false, "actions": []map[string]any{
+				{"method": "sendMessage", "params": map[string]any{"chat_id": m.Chat.ID, "text": greeting}},
+				{"method": "deleteMessage", "params": map[string]any{"chat_id": m.Chat.ID, "message_id": m.MessageID}},
+			}}
+		case "stop":
+			res["result"] = map[string]any{}
+		default:
+			res["error"] = map[string]any{"code": -32601, "message": "method not found"}
+		}
+		line, _ := json.Marshal(res)
+		fmt.Println(string(line))
+	}
+	os.Exit(0)
+}
+
+func TestProcess(t *testing.T) {
+	host, srv := setup(t, `
+plugin_settings:
+  external:
+    greeting: welcome
+`)
+	t.Setenv(helperEnv, "1")
+	err := plugin.Register("external", plugin.NewProcess(config.ExternalPlugin{
+		Name:    "external",
+		Command: []string{os.Args[0], "-test.run=^TestHelperProcess$"},
+		Timeout: 10 * time.Second,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded := host.Apply(context.Background(), []string{"external"}); len(loaded) != 1 {
+		t.Fatalf("loaded %v", loaded)
+	}
+	if m := host.Manifests(); len(m) != 1 || m[0].Order != 5 {
+		t.Errorf("manifests %+v", m)
+	}
+
+	chat := &api.Chat{ID: -100, Type: "supergroup"}
+	u := &api.Update{UpdateID: 1, Message: &api.Message{MessageID: 7, Date: int(time.Now().Unix()), Chat: *chat}}
+	proceed, err := host.Handler("external").Handle(context.Background(), u, chat, nil)
+	if err != nil || proceed {
+		t.Fatalf("got %v, %v", proceed, err)
+	}
+	if c, ok := srv.WaitCall("sendMessage", time.Second, nil); !ok || c.Int("chat_id") != chat.ID || c.Params.Get("text") != "welcome" {
+		t.Errorf("sent %+v", c)
+	}
+	// the manifest does not declare the right to delete messages
+	if calls := srv.Calls("deleteMessage"); len(calls) != 0 {
+		t.Errorf("deleted %+v", calls)
+	}
+
+	if loaded := host.Apply(context.Background(), nil); len(loaded) != 0 {
+		t.Errorf("loaded %v after stopping", loaded)
+	}
+}
@@ -0,0 +1,98 @@
+package privacy
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// ModeStrict never logs, stores or sends message content anywhere, classification is local only
+	ModeStrict Mode = "strict"
+	// ModeStandard keeps content out of logs but allows audit excerpts and remote LLM classification
+	ModeStandard Mode = "standard"
+	// ModePermissive allows everything, meant for debugging
+	ModePermissive Mode = "permissive"
+	// ModeInherit makes a chat follow the deployment mode
+	ModeInherit Mode = ""
+
+	Redacted = "[redacted]"
+
+	excerptLength = 200
+)
+
+type (
+	Mode string
+
+	// Policy tells what may be done with message content
+	Policy struct {
+		Mode         Mode
+		LogContent   bool
+		StoreContent bool
+		RemoteLLM    bool
+	}
+)
+
+var strictness = map[Mode]int{
+	ModePermissive: 0,
+	ModeStandard:   1,
+	ModeStrict:     2,
+}
+
+// ParseMode validates a mode name, empty string means inherit
+func ParseMode(s string) (Mode, bool) {
+	m := Mode(strings.ToLower(strings.TrimSpace(s)))
+	if m == ModeInherit {
+		return m, true
+	}
+	_, ok := strictness[m]
+	return m, ok
+}
+
+// Modes lists the selectable modes from the most to the least private
+func Modes() []Mode {
+	return []Mode{ModeStrict, ModeStandard, ModePermissive}
+}
+
+// Effective resolves the chat mode against the deployment one; a chat may only be stricter
+func Effective(deployment, chat Mode) Policy {
+	if _, ok := strictness[deployment]; !ok {
+		deployment = ModeStrict
+	}
+	mode := deployment
+	if s, ok := strictness[chat]; ok && s > strictness[deployment] {
+		mode = chat
+	}
+	return For(mode)
+}
+
+// For returns the policy of a single mode, unknown modes resolve to strict
+func For(mode Mode) Policy {
+	switch mode {
+	case ModePermissive:
+		return Policy{Mode: mode, LogContent: true, StoreContent: true, RemoteLLM: true}
+	case ModeStandard:
+		return Policy{Mode: mode, StoreContent: true, RemoteLLM: true}
+	default:
+		return Policy{Mode: ModeStrict}
+	}
+}
+
+// Loggable returns content if it may be logged, a placeholder otherwise
+func (p Policy) Loggable(content string) string {
+	if p.LogContent || content == "" {
+		return content
+	}
+	return Redacted
+}
+
+// Excerpt returns a shortened content for persistent records, empty if storing is not allowed
+func (p Policy) Excerpt(content string) string {
+	if !p.StoreContent {
+		return ""
+	}
+	content = strings.Join(strings.Fields(content), " ")
+	if utf8.RuneCountInString(content) <= excerptLength {
+		return content
+	}
+	return string([]rune(content)[:excerptLength]) + "…"
+}
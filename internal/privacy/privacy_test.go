@@ -0,0 +1,138 @@
+package privacy_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/privacy"
+)
+
+const canary = "buy cheap crypto at example dot com 4f9c2e"
+
+func TestEffective(t *testing.T) {
+	cases := []struct {
+		deployment, chat, want privacy.Mode
+	}{
+		{privacy.ModeStandard, privacy.ModeInherit, privacy.ModeStandard},
+		{privacy.ModeStandard, privacy.ModeStrict, privacy.ModeStrict},
+		{privacy.ModeStandard, privacy.ModePermissive, privacy.ModeStandard},
+		{privacy.ModeStrict, privacy.ModePermissive, privacy.ModeStrict},
+		{privacy.ModePermissive, privacy.ModeStandard, privacy.ModeStandard},
+		{"bogus", privacy.ModeInherit, privacy.ModeStrict},
+		{privacy.ModePermissive, "bogus", privacy.ModePermissive},
+	}
+	for _, c := range cases {
+		if got := privacy.Effective(c.deployment, c.chat).Mode; got != c.want {
+			t.Errorf("Effective(%q, %q) = %q, want %q", c.deployment, c.chat, got, c.want)
+		}
+	}
+}
+
+func TestStrictKeepsContent(t *testing.T) {
+	p := privacy.For(privacy.ModeStrict)
+	if p.RemoteLLM {
+		t.Error("strict mode allows remote LLM")
+	}
+	if got := p.Excerpt(canary); got != "" {
+		t.Errorf("strict mode stores excerpt %q", got)
+	}
+	if got := p.Loggable(canary); strings.Contains(got, canary) {
+		t.Errorf("strict mode logs content %q", got)
+	}
+}
+
+func TestContentDoesNotLeakIntoLogs(t *testing.T) {
+	for _, mode := range []privacy.Mode{privacy.ModeStrict, privacy.ModeStandard} {
+		for _, format := range []string{config.LogFormatText, config.LogFormatJSON} {
+			t.Run(string(mode)+"/"+format, func(t *testing.T) {
+				out := captureLogs(t, mode, format, func() {
+					policy := privacy.For(mode)
+					log.WithFields(log.Fields{
+						"context": "reactor",
+						"message": canary,
+						"text":    canary,
+						"caption": canary,
+						"excerpt": policy.Excerpt(canary),
+					}).Info("spam detected")
+					log.WithField("verdict", policy.Loggable(canary)).Warn("custom field")
+				})
+				if strings.Contains(out, canary) {
+					t.Fatalf("message content leaked into logs:\n%s", out)
+				}
+				if !strings.Contains(out, privacy.Redacted) {
+					t.Fatalf("expected redaction marker in logs:\n%s", out)
+				}
+			})
+		}
+	}
+}
+
+func TestPermissiveLogsContent(t *testing.T) {
+	out := captureLogs(t, privacy.ModePermissive, config.LogFormatText, func() {
+		log.WithField("message", canary).Info("spam detected")
+	})
+	if !strings.Contains(out, canary) {
+		t.Fatalf("permissive mode should keep content, got:\n%s", out)
+	}
+}
+
+func TestStricterChatRedactsContent(t *testing.T) {
+	config.SetChatPrivacy("test", func(chatID int64) (privacy.Mode, bool) {
+		switch chatID {
+		case 1:
+			return privacy.ModeStrict, true
+		case 2:
+			return privacy.ModeInherit, true
+		}
+		return privacy.ModeInherit, false
+	})
+	t.Cleanup(func() { config.SetChatPrivacy("test", nil) })
+
+	cases := []struct {
+		name   string
+		fields log.Fields
+		logged bool
+	}{
+		{"strict chat", log.Fields{"chat_id": int64(1)}, false},
+		{"inheriting chat", log.Fields{"chat_id": int64(2)}, true},
+		{"unknown chat", log.Fields{"chat_id": int64(3)}, false},
+		{"no chat", log.Fields{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out := captureLogs(t, privacy.ModePermissive, config.LogFormatText, func() {
+				log.WithFields(c.fields).WithField("text", canary).Info("spam detected")
+			})
+			if strings.Contains(out, canary) != c.logged {
+				t.Errorf("got logs:\n%s", out)
+			}
+		})
+	}
+}
+
+func captureLogs(t *testing.T, mode privacy.Mode, format string, fn func()) string {
+	t.Helper()
+	logger := log.StandardLogger()
+	prevOut, prevFormatter, prevLevel := logger.Out, logger.Formatter, logger.GetLevel()
+	t.Cleanup(func() {
+		logger.SetOutput(prevOut)
+		logger.SetFormatter(prevFormatter)
+		logger.SetLevel(prevLevel)
+		logger.SetReportCaller(false)
+		logger.ReplaceHooks(log.LevelHooks{})
+	})
+
+	config.SetupLogging(config.Config{
+		LogLevel:  int(log.TraceLevel),
+		LogFormat: format,
+		Privacy:   string(mode),
+	})
+	buf := &bytes.Buffer{}
+	logger.SetOutput(buf)
+	fn()
+	return buf.String()
+}
@@ -0,0 +1,303 @@
+// Package raid spots coordinated waves of joins and keeps track of chats in lockdown
+package raid
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	SignalJoinRate          Signal = "join_rate"
+	SignalIDCluster         Signal = "id_cluster"
+	SignalSimilarNames      Signal = "similar_names"
+	SignalIdenticalMessages Signal = "identical_messages"
+
+	// nameSimilarity is the share of matching characters for two names to count as similar
+	nameSimilarity = 0.8
+	// joinerMemory is how long a joiner's first message is waited for
+	joinerMemory = time.Hour
+)
+
+type (
+	// Signal names the detector that tripped
+	Signal string
+
+	// Thresholds configure the signals, a zero threshold disables its signal
+	Thresholds struct {
+		// Window is the time span the signals look at
+		Window time.Duration
+		// Joins trips on that many joins within the window
+		Joins int
+		// IDCluster trips on that many joiners whose account IDs are at most IDSpan apart
+		IDCluster int
+		IDSpan    int64
+		// SimilarNames trips on that many joiners with similar names
+		SimilarNames int
+		// IdenticalMessages trips when that many joiners send the same first message
+		IdenticalMessages int
+	}
+
+	// Lockdown describes a chat in lockdown
+	Lockdown struct {
+		ChatID  int64
+		Signal  Signal
+		Since   time.Time
+		Blocked int
+	}
+
+	Detector struct {
+		mutex sync.Mutex
+		chats map[int64]*chatState
+		now   func() time.Time
+	}
+
+	chatState struct {
+		joins    []join
+		messages []message
+		// joiners waiting for their first message, by user ID
+		joiners     map[int64]time.Time
+		lockdown    *Lockdown
+		lastAttempt time.Time
+	}
+
+	join struct {
+		userID int64
+		name   string
+		at     time.Time
+	}
+
+	message struct {
+		userID int64
+		text   string
+		at     time.Time
+	}
+)
+
+func NewDetector() *Detector {
+	return &Detector{
+		chats: map[int64]*chatState{},
+		now:   time.Now,
+	}
+}
+
+// Join records a join attempt, it locks the chat down and reports the signal when the join trips one.
+// Attempts in a chat already in lockdown are counted as blocked and keep the lockdown going.
+func (d *Detector) Join(chatID, userID int64, name string, t Thresholds) (Signal, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	cs := d.chat(chatID)
+	if cs.lockdown != nil {
+		cs.lockdown.Blocked++
+		cs.lastAttempt = now
+		return "", false
+	}
+
+	cs.expire(now, t.Window)
+	cs.joiners[userID] = now
+	// a join request followed by the join itself is a single joiner
+	if slices.ContainsFunc(cs.joins, func(j join) bool { return j.userID == userID }) {
+		return "", false
+	}
+	cs.joins = append(cs.joins, join{userID: userID, name: normalizeName(name), at: now})
+
+	var signal Signal
+	switch {
+	case t.Joins > 0 && len(cs.joins) >= t.Joins:
+		signal = SignalJoinRate
+	case t.IDCluster > 0 && largestIDCluster(cs.joins, t.IDSpan) >= t.IDCluster:
+		signal = SignalIDCluster
+	case t.SimilarNames > 0 && largestNameGroup(cs.joins) >= t.SimilarNames:
+		signal = SignalSimilarNames
+	default:
+		return "", false
+	}
+	d.lock(cs, chatID, signal, now)
+	return signal, true
+}
+
+// FirstMessage records the first message of a recent joiner, later messages are ignored
+func (d *Detector) FirstMessage(chatID, userID int64, text string, t Thresholds) (Signal, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	cs, ok := d.chats[chatID]
+	if !ok || cs.lockdown != nil {
+		return "", false
+	}
+	if _, ok := cs.joiners[userID]; !ok {
+		return "", false
+	}
+	delete(cs.joiners, userID)
+	text = normalizeText(text)
+	if text == "" || t.IdenticalMessages <= 0 {
+		return "", false
+	}
+
+	cs.expire(now, t.Window)
+	cs.messages = append(cs.messages, message{userID: userID, text: text, at: now})
+	same := 0
+	for _, m := range cs.messages {
+		if m.text == text {
+			same++
+		}
+	}
+	if same < t.IdenticalMessages {
+		return "", false
+	}
+	d.lock(cs, chatID, SignalIdenticalMessages, now)
+	return SignalIdenticalMessages, true
+}
+
+// Locked reports whether the chat is in lockdown
+func (d *Detector) Locked(chatID int64) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	cs, ok := d.chats[chatID]
+	return ok && cs.lockdown != nil
+}
+
+// Unlock ends the lockdown of the chat, reporting it if there was one
+func (d *Detector) Unlock(chatID int64) (Lockdown, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	cs, ok := d.chats[chatID]
+	if !ok || cs.lockdown == nil {
+		return Lockdown{}, false
+	}
+	ld := *cs.lockdown
+	delete(d.chats, chatID)
+	return ld, true
+}
+
+// Quiet ends and returns the lockdowns without join attempts for the quiet period, it also forgets idle chats
+func (d *Detector) Quiet(quiet time.Duration) []Lockdown {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	var ended []Lockdown
+	for chatID, cs := range d.chats {
+		if now.Sub(cs.lastAttempt) < quiet {
+			continue
+		}
+		if cs.lockdown != nil {
+			ended = append(ended, *cs.lockdown)
+			delete(d.chats, chatID)
+			continue
+		}
+		if now.Sub(cs.lastAttempt) > joinerMemory {
+			delete(d.chats, chatID)
+		}
+	}
+	return ended
+}
+
+func (d *Detector) chat(chatID int64) *chatState {
+	cs, ok := d.chats[chatID]
+	if !ok {
+		cs = &chatState{joiners: map[int64]time.Time{}}
+		d.chats[chatID] = cs
+	}
+	return cs
+}
+
+func (d *Detector) lock(cs *chatState, chatID int64, signal Signal, now time.Time) {
+	cs.lockdown = &Lockdown{ChatID: chatID, Signal: signal, Since: now}
+	cs.lastAttempt = now
+	cs.joins = nil
+	cs.messages = nil
+}
+
+// expire drops the joins and messages older than the window
+func (cs *chatState) expire(now time.Time, window time.Duration) {
+	cs.lastAttempt = now
+	cs.joins = slices.DeleteFunc(cs.joins, func(j join) bool { return now.Sub(j.at) > window })
+	cs.messages = slices.DeleteFunc(cs.messages, func(m message) bool { return now.Sub(m.at) > window })
+	for userID, at := range cs.joiners {
+		if now.Sub(at) > joinerMemory {
+			delete(cs.joiners, userID)
+		}
+	}
+}
+
+// largestIDCluster counts the most joiners with account IDs within the span, freshly registered accounts get close IDs
+func largestIDCluster(joins []join, span int64) int {
+	ids := make([]int64, 0, len(joins))
+	for _, j := range joins {
+		ids = append(ids, j.userID)
+	}
+	slices.Sort(ids)
+	largest := 0
+	for lo, hi := 0, 0; hi < len(ids); hi++ {
+		for ids[hi]-ids[lo] > span {
+			lo++
+		}
+		largest = max(largest, hi-lo+1)
+	}
+	return largest
+}
+
+// largestNameGroup counts the most joiners with names similar to the same one
+func largestNameGroup(joins []join) int {
+	largest := 0
+	for _, a := range joins {
+		group := 0
+		for _, b := range joins {
+			if similarity(a.name, b.name) >= nameSimilarity {
+				group++
+			}
+		}
+		largest = max(largest, group)
+	}
+	return largest
+}
+
+// normalizeName keeps the letters, so that "Anna 123" and "anna_77" look alike
+func normalizeName(name string) string {
+	letters := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+	if letters == "" {
+		return strings.ToLower(strings.TrimSpace(name))
+	}
+	return letters
+}
+
+func normalizeText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// similarity is 1 minus the edit distance relative to the longer name
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
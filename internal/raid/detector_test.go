@@ -0,0 +1,177 @@
+package raid
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const chatID = -100
+
+var thresholds = Thresholds{
+	Window:            time.Minute,
+	Joins:             10,
+	IDCluster:         5,
+	IDSpan:            1000,
+	SimilarNames:      5,
+	IdenticalMessages: 3,
+}
+
+type clock struct{ now time.Time }
+
+func (c *clock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestDetector() (*Detector, *clock) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	d := NewDetector()
+	d.now = func() time.Time { return c.now }
+	return d, c
+}
+
+// organicName returns unrelated names
+func organicName(i int) string {
+	return []string{"Alice", "Bob", "Carol", "Dmitry", "Eve", "Frank", "Grace", "Heidi", "Ivan", "Judy", "Mallory"}[i]
+}
+
+func TestJoinRate(t *testing.T) {
+	d, c := newTestDetector()
+	for i := 0; i < 9; i++ {
+		if signal, tripped := d.Join(chatID, int64(i)*1_000_000, organicName(i), thresholds); tripped {
+			t.Fatalf("join %d tripped %s", i, signal)
+		}
+		c.advance(time.Second)
+	}
+	signal, tripped := d.Join(chatID, 9_000_000, organicName(9), thresholds)
+	if !tripped || signal != SignalJoinRate {
+		t.Fatalf("got %q %v, want %q", signal, tripped, SignalJoinRate)
+	}
+	if !d.Locked(chatID) {
+		t.Fatal("chat is not locked down")
+	}
+}
+
+func TestJoinRateWindow(t *testing.T) {
+	d, c := newTestDetector()
+	for i := 0; i < 11; i++ {
+		if signal, tripped := d.Join(chatID, int64(i)*1_000_000, organicName(i), thresholds); tripped {
+			t.Fatalf("join %d tripped %s", i, signal)
+		}
+		c.advance(10 * time.Second)
+	}
+}
+
+func TestRepeatedJoinCountsOnce(t *testing.T) {
+	d, _ := newTestDetector()
+	for i := 0; i < 20; i++ {
+		if _, tripped := d.Join(chatID, 42, "Alice", thresholds); tripped {
+			t.Fatal("a single joiner tripped the detector")
+		}
+	}
+}
+
+func TestIDCluster(t *testing.T) {
+	d, _ := newTestDetector()
+	var signal Signal
+	var tripped bool
+	for i := 0; i < 5; i++ {
+		signal, tripped = d.Join(chatID, 7_000_000_000+int64(i)*97, organicName(i), thresholds)
+	}
+	if !tripped || signal != SignalIDCluster {
+		t.Fatalf("got %q %v, want %q", signal, tripped, SignalIDCluster)
+	}
+}
+
+func TestSimilarNames(t *testing.T) {
+	d, _ := newTestDetector()
+	var signal Signal
+	var tripped bool
+	for i := 0; i < 5; i++ {
+		signal, tripped = d.Join(chatID, int64(i)*1_000_000, fmt.Sprintf("Crypto Anna %d", i*7), thresholds)
+	}
+	if !tripped || signal != SignalSimilarNames {
+		t.Fatalf("got %q %v, want %q", signal, tripped, SignalSimilarNames)
+	}
+}
+
+func TestIdenticalFirstMessages(t *testing.T) {
+	d, _ := newTestDetector()
+	for i := 0; i < 3; i++ {
+		d.Join(chatID, int64(i)*1_000_000, organicName(i), thresholds)
+	}
+	if _, tripped := d.FirstMessage(chatID, 0, "Join my channel!", thresholds); tripped {
+		t.Fatal("first message tripped")
+	}
+	// only the first message of a joiner counts
+	if _, tripped := d.FirstMessage(chatID, 0, "join my  channel!", thresholds); tripped {
+		t.Fatal("second message of the same joiner tripped")
+	}
+	if _, tripped := d.FirstMessage(chatID, 777, "join my channel!", thresholds); tripped {
+		t.Fatal("message of an old member tripped")
+	}
+	if _, tripped := d.FirstMessage(chatID, 1_000_000, "JOIN my channel!", thresholds); tripped {
+		t.Fatal("second joiner tripped")
+	}
+	signal, tripped := d.FirstMessage(chatID, 2_000_000, "join my channel!", thresholds)
+	if !tripped || signal != SignalIdenticalMessages {
+		t.Fatalf("got %q %v, want %q", signal, tripped, SignalIdenticalMessages)
+	}
+}
+
+func TestLockdownEndsWhenQuiet(t *testing.T) {
+	d, c := newTestDetector()
+	for i := 0; i < 10; i++ {
+		d.Join(chatID, int64(i)*1_000_000, organicName(i), thresholds)
+	}
+	if !d.Locked(chatID) {
+		t.Fatal("chat is not locked down")
+	}
+
+	c.advance(5 * time.Minute)
+	d.Join(chatID, 11, "Late", thresholds)
+	d.Join(chatID, 12, "Later", thresholds)
+	c.advance(9 * time.Minute)
+	if ended := d.Quiet(10 * time.Minute); len(ended) != 0 {
+		t.Fatalf("lockdown ended %v after a join attempt", ended)
+	}
+
+	c.advance(time.Minute)
+	ended := d.Quiet(10 * time.Minute)
+	if len(ended) != 1 || ended[0].ChatID != chatID || ended[0].Blocked != 2 || ended[0].Signal != SignalJoinRate {
+		t.Fatalf("got %+v, want a join rate lockdown with 2 blocked joins", ended)
+	}
+	if d.Locked(chatID) {
+		t.Fatal("chat is still locked down")
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	d, _ := newTestDetector()
+	if _, ok := d.Unlock(chatID); ok {
+		t.Fatal("unlocked a chat without lockdown")
+	}
+	for i := 0; i < 10; i++ {
+		d.Join(chatID, int64(i)*1_000_000, organicName(i), thresholds)
+	}
+	if _, ok := d.Unlock(chatID); !ok {
+		t.Fatal("cant unlock")
+	}
+	if d.Locked(chatID) {
+		t.Fatal("chat is still locked down")
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{normalizeName("Anna 123"), normalizeName("anna_77"), true},
+		{normalizeName("Olivia Smith"), normalizeName("olivia smyth"), true},
+		{normalizeName("Alice"), normalizeName("Bob"), false},
+	}
+	for _, c := range cases {
+		if got := similarity(c.a, c.b) >= nameSimilarity; got != c.want {
+			t.Errorf("similar(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
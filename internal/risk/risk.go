@@ -0,0 +1,156 @@
+// Package risk scores joiners by the signals Telegram gives away about their accounts
+package risk
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	DecisionNone     Decision = "none"
+	DecisionStandard Decision = "standard"
+	DecisionHard     Decision = "hard"
+	DecisionDecline  Decision = "decline"
+
+	// PhotosUnknown is used when the profile photos could not be checked
+	PhotosUnknown = -1
+
+	weightNewAccount       = 25
+	weightNoUsername       = 10
+	weightNameLink         = 30
+	weightNameEmoji        = 15
+	weightNameKeywords     = 30
+	weightLanguageMismatch = 5
+	weightNoPhoto          = 15
+	weightBioLink          = 20
+	weightBioKeywords      = 20
+
+	// nameEmojiLimit is the number of emoji a name may have before it looks like spam
+	nameEmojiLimit = 3
+)
+
+type (
+	// Decision is what the gatekeeper does with a joiner
+	Decision string
+
+	// Profile is what is known about a joiner
+	Profile struct {
+		User *api.User
+		// Bio comes with join requests only
+		Bio string
+		// Photos is the number of profile photos, or PhotosUnknown
+		Photos       int
+		ChatLanguage string
+	}
+
+	// Assessment is the risk score and the signals that made it up
+	Assessment struct {
+		Score   int
+		Reasons []string
+	}
+
+	// Thresholds are the lowest scores of the stricter decisions
+	Thresholds struct {
+		Challenge int
+		Hard      int
+		Decline   int
+	}
+)
+
+var (
+	linkPattern = regexp.MustCompile(`(?i)(https?://|www\.|t\.me/|telegram\.me/|\.(com|net|org|io|me|ru|xyz|top|app)\b|@\w{5,})`)
+	// keywordPattern matches whole latin words, keywordStems are matched anywhere as \b does not work with cyrillic
+	keywordPattern = regexp.MustCompile(`(?i)\b(crypto\w*|bitcoin|btc|usdt|eth|nft|airdrop|invest\w*|profit\w*|casino|forex|trading|binance|earn\w*|income)\b`)
+	keywordStems   = []string{"крипт", "инвест", "заработ", "доход", "казино", "биткоин", "трейд"}
+)
+
+// Assess scores the profile, newAccountID is the lowest user ID taken for a recently registered account
+func Assess(p Profile, newAccountID int64) Assessment {
+	var a Assessment
+	add := func(weight int, reason string) {
+		a.Score += weight
+		a.Reasons = append(a.Reasons, reason)
+	}
+
+	if p.User == nil {
+		return a
+	}
+	if newAccountID > 0 && p.User.ID >= newAccountID {
+		add(weightNewAccount, "new account")
+	}
+	if p.User.UserName == "" {
+		add(weightNoUsername, "no username")
+	}
+
+	name := strings.TrimSpace(p.User.FirstName + " " + p.User.LastName)
+	if linkPattern.MatchString(name) {
+		add(weightNameLink, "link in name")
+	}
+	if countEmoji(name) > nameEmojiLimit {
+		add(weightNameEmoji, "emoji in name")
+	}
+	if hasKeywords(name) {
+		add(weightNameKeywords, "spam keywords in name")
+	}
+
+	if lang := baseLanguage(p.User.LanguageCode); lang != "" && p.ChatLanguage != "" && lang != baseLanguage(p.ChatLanguage) {
+		add(weightLanguageMismatch, "language mismatch")
+	}
+	if p.Photos == 0 {
+		add(weightNoPhoto, "no profile photo")
+	}
+
+	if linkPattern.MatchString(p.Bio) {
+		add(weightBioLink, "link in bio")
+	}
+	if hasKeywords(p.Bio) {
+		add(weightBioKeywords, "spam keywords in bio")
+	}
+	return a
+}
+
+// Decide picks the decision for the score, zero Hard or Decline turn their decision off, zero Challenge challenges everyone
+func (t Thresholds) Decide(score int) Decision {
+	switch {
+	case t.Decline > 0 && score >= t.Decline:
+		return DecisionDecline
+	case t.Hard > 0 && score >= t.Hard:
+		return DecisionHard
+	case score >= t.Challenge:
+		return DecisionStandard
+	default:
+		return DecisionNone
+	}
+}
+
+func hasKeywords(s string) bool {
+	if keywordPattern.MatchString(s) {
+		return true
+	}
+	lower := strings.ToLower(s)
+	for _, stem := range keywordStems {
+		if strings.Contains(lower, stem) {
+			return true
+		}
+	}
+	return false
+}
+
+func countEmoji(s string) int {
+	n := 0
+	for _, r := range s {
+		if unicode.Is(unicode.So, r) {
+			n++
+		}
+	}
+	return n
+}
+
+// baseLanguage strips the region, "pt-br" is "pt"
+func baseLanguage(code string) string {
+	lang, _, _ := strings.Cut(strings.ToLower(code), "-")
+	return lang
+}
@@ -0,0 +1,86 @@
+package risk_test
+
+import (
+	"testing"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/iamwavecut/ngbot/internal/risk"
+)
+
+const newAccountID = 7_000_000_000
+
+func TestAssess(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile risk.Profile
+		want    int
+	}{
+		{
+			name:    "established account",
+			profile: risk.Profile{User: &api.User{ID: 100, FirstName: "Anna", UserName: "anna", LanguageCode: "en"}, Photos: 2, ChatLanguage: "en"},
+			want:    0,
+		},
+		{
+			name:    "unknown photos are not held against the joiner",
+			profile: risk.Profile{User: &api.User{ID: 100, FirstName: "Anna", UserName: "anna"}, Photos: risk.PhotosUnknown},
+			want:    0,
+		},
+		{
+			name:    "regional language matches the chat",
+			profile: risk.Profile{User: &api.User{ID: 100, FirstName: "Ana", UserName: "ana", LanguageCode: "pt-br"}, Photos: 1, ChatLanguage: "pt"},
+			want:    0,
+		},
+		{
+			name:    "new account without username and photo",
+			profile: risk.Profile{User: &api.User{ID: newAccountID + 1, FirstName: "Anna"}, Photos: 0},
+			want:    25 + 10 + 15,
+		},
+		{
+			name:    "spam name",
+			profile: risk.Profile{User: &api.User{ID: 100, FirstName: "🚀🚀💰💰 Crypto signals", LastName: "t.me/pump", UserName: "x"}, Photos: 1},
+			want:    30 + 15 + 30,
+		},
+		{
+			name:    "cyrillic keywords and link in bio",
+			profile: risk.Profile{User: &api.User{ID: 100, FirstName: "Ольга", UserName: "olga", LanguageCode: "ru"}, Photos: 1, ChatLanguage: "en", Bio: "Заработок без вложений @easy_money_bot"},
+			want:    5 + 20 + 20,
+		},
+		{
+			name:    "names containing keywords are not flagged",
+			profile: risk.Profile{User: &api.User{ID: 100, FirstName: "Elizabeth", LastName: "Bethany", UserName: "liz"}, Photos: 1},
+			want:    0,
+		},
+	}
+	for _, c := range cases {
+		got := risk.Assess(c.profile, newAccountID)
+		if got.Score != c.want {
+			t.Errorf("%s: score %d %v, want %d", c.name, got.Score, got.Reasons, c.want)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	thresholds := risk.Thresholds{Challenge: 20, Hard: 50, Decline: 80}
+	cases := []struct {
+		score int
+		want  risk.Decision
+	}{
+		{0, risk.DecisionNone},
+		{19, risk.DecisionNone},
+		{20, risk.DecisionStandard},
+		{50, risk.DecisionHard},
+		{80, risk.DecisionDecline},
+		{200, risk.DecisionDecline},
+	}
+	for _, c := range cases {
+		if got := thresholds.Decide(c.score); got != c.want {
+			t.Errorf("Decide(%d) = %s, want %s", c.score, got, c.want)
+		}
+	}
+
+	challengeAll := risk.Thresholds{}
+	if got := challengeAll.Decide(200); got != risk.DecisionStandard {
+		t.Errorf("zero thresholds decided %s, want %s", got, risk.DecisionStandard)
+	}
+}
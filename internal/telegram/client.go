@@ -0,0 +1,211 @@
+// Package telegram is the HTTP layer under the Bot API client: it keeps the calls within Telegram rate limits
+// and retries the ones Telegram asks to repeat.
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/metrics"
+)
+
+// Limits follow https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+type Limits struct {
+	// Global is the requests per second over all chats
+	Global float64
+	// Chat is the messages per second to a private chat
+	Chat float64
+	// Group is the messages per second to a group or channel
+	Group float64
+	// Retries is how many times a request Telegram rejected with 429 or 5xx is repeated
+	Retries int
+	// MaxRetryAfter caps the wait Telegram asks for, longer waits fail the request
+	MaxRetryAfter time.Duration
+}
+
+var (
+	DefaultLimits = Limits{
+		Global:        30,
+		Chat:          1,
+		Group:         20.0 / 60,
+		Retries:       3,
+		MaxRetryAfter: time.Minute,
+	}
+
+	// urgentMethods skip ahead of informational messages when the limits are hit
+	urgentMethods = []string{
+		"banChatMember",
+		"restrictChatMember",
+		"deleteMessage",
+		"deleteMessages",
+		"declineChatJoinRequest",
+		"approveChatJoinRequest",
+	}
+
+	// unlimitedMethods are not counted, getUpdates is a long poll of its own
+	unlimitedMethods = []string{"getUpdates", "getMe"}
+)
+
+// Client implements api.HTTPClient
+type Client struct {
+	next   api.HTTPClient
+	limits Limits
+	global *bucket
+	chats  *buckets
+}
+
+// NewClient wraps next, usually http.DefaultClient
+func NewClient(next api.HTTPClient, limits Limits) *Client {
+	return &Client{
+		next:   next,
+		limits: limits,
+		global: newBucket(limits.Global, int(limits.Global)),
+		chats: newBuckets(func(chatID int64) *bucket {
+			if chatID < 0 {
+				return newBucket(limits.Group, max(1, int(limits.Group*60/4)))
+			}
+			return newBucket(limits.Chat, 1)
+		}),
+	}
+}
+
+// NewBotAPI creates a Bot API client making its calls through a Client with the default limits
+func NewBotAPI(token, endpoint string) (*api.BotAPI, error) {
+	return api.NewBotAPIWithClient(token, endpoint, NewClient(http.DefaultClient, DefaultLimits))
+}
+
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	method := path.Base(req.URL.Path)
+	if slices.Contains(unlimitedMethods, method) {
+		return c.next.Do(req)
+	}
+	entry := c.getLogEntry().WithField("api_method", method)
+
+	// form requests are replayable, multipart uploads are streamed and sent once
+	var body []byte
+	if req.GetBody != nil && req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+	}
+	chatID, hasChat := chatOf(req, body)
+	urgent := slices.Contains(urgentMethods, method)
+	lane := "normal"
+	if urgent {
+		lane = "urgent"
+	}
+
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		if err := c.global.wait(ctx, urgent); err != nil {
+			return nil, err
+		}
+		var chat *bucket
+		if hasChat && isMessage(method) {
+			chat = c.chats.get(chatID)
+			if err := chat.wait(ctx, urgent); err != nil {
+				return nil, err
+			}
+		}
+		metrics.TelegramLimiterWait.WithLabelValues(lane).Observe(time.Since(start).Seconds())
+
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		res, err := c.next.Do(req)
+		if err != nil || body == nil || attempt >= c.limits.Retries {
+			return res, err
+		}
+
+		var wait time.Duration
+		switch {
+		case res.StatusCode == http.StatusTooManyRequests:
+			retryAfter, raw, err := readRetryAfter(res)
+			if err != nil || retryAfter > c.limits.MaxRetryAfter {
+				// let the Bot API client report the rejection
+				res.Body = io.NopCloser(bytes.NewReader(raw))
+				return res, nil
+			}
+			wait = retryAfter
+			until := time.Now().Add(wait)
+			if chat != nil {
+				chat.block(until)
+			} else {
+				c.global.block(until)
+			}
+			metrics.TelegramRetries.WithLabelValues(method, "flood_wait").Inc()
+		case res.StatusCode >= http.StatusInternalServerError:
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = res.Body.Close()
+			wait = time.Duration(1<<attempt) * time.Second
+			metrics.TelegramRetries.WithLabelValues(method, "server_error").Inc()
+		default:
+			return res, nil
+		}
+		entry.WithFields(log.Fields{"status": res.StatusCode, "wait": wait, "attempt": attempt + 1}).Warn("retrying request")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) getLogEntry() *log.Entry {
+	return log.WithFields(log.Fields{"context": "bot_api", "object": "Client"})
+}
+
+// readRetryAfter consumes the response body, returning it for the caller to pass on
+func readRetryAfter(res *http.Response) (time.Duration, []byte, error) {
+	raw, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return 0, raw, err
+	}
+	var apiRes api.APIResponse
+	if err := json.Unmarshal(raw, &apiRes); err != nil {
+		return 0, raw, errors.WithMessage(err, "malformed 429 response")
+	}
+	if apiRes.Parameters == nil || apiRes.Parameters.RetryAfter == 0 {
+		return time.Second, raw, nil
+	}
+	return time.Duration(apiRes.Parameters.RetryAfter) * time.Second, raw, nil
+}
+
+// chatOf returns the chat_id of a form request, channel usernames are not counted per chat
+func chatOf(req *http.Request, body []byte) (int64, bool) {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return 0, false
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return 0, false
+	}
+	chatID, err := strconv.ParseInt(values.Get("chat_id"), 10, 64)
+	return chatID, err == nil
+}
+
+// isMessage reports whether the method posts to the chat, the per-chat limits only count those
+func isMessage(method string) bool {
+	return strings.HasPrefix(method, "send") ||
+		strings.HasPrefix(method, "edit") ||
+		slices.Contains([]string{"copyMessage", "copyMessages", "forwardMessage", "forwardMessages"}, method)
+}
@@ -0,0 +1,117 @@
+package telegram
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeAPI answers getMe and fails the first calls of other methods with the given responses
+func fakeAPI(t *testing.T, failures []func(w http.ResponseWriter)) (*api.BotAPI, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/botT/getMe" {
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"fake_bot"}}`))
+			return
+		}
+		n := int(calls.Add(1))
+		if n <= len(failures) {
+			failures[n-1](w)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	limits := DefaultLimits
+	limits.Chat = 100
+	b, err := api.NewBotAPIWithClient("T", srv.URL+"/bot%s/%s", NewClient(http.DefaultClient, limits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, &calls
+}
+
+func floodWait(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`))
+}
+
+func serverError(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func TestRetryAfter(t *testing.T) {
+	b, calls := fakeAPI(t, []func(http.ResponseWriter){floodWait})
+	start := time.Now()
+	if _, err := b.Request(api.NewDeleteMessage(-100, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("calls = %d, want 2", calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before retry_after", elapsed)
+	}
+}
+
+func TestRetryServerError(t *testing.T) {
+	b, calls := fakeAPI(t, []func(http.ResponseWriter){serverError})
+	if _, err := b.Request(api.NewMessage(1, "hi")); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("calls = %d, want 2", calls.Load())
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	failures := make([]func(http.ResponseWriter), DefaultLimits.Retries+1)
+	for i := range failures {
+		failures[i] = floodWait
+	}
+	b, _ := fakeAPI(t, failures)
+	b.Client.(*Client).limits.Retries = 0
+	if _, err := b.Request(api.NewMessage(1, "hi")); err == nil {
+		t.Fatal("want the 429 error when out of retries")
+	}
+}
+
+func TestUrgentLane(t *testing.T) {
+	bkt := newBucket(2, 1)
+	if err := bkt.wait(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mutex sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	take := func(name string, urgent bool) {
+		defer wg.Done()
+		if err := bkt.wait(context.Background(), urgent); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		order = append(order, name)
+		mutex.Unlock()
+	}
+	wg.Add(2)
+	go take("message", false)
+	time.Sleep(50 * time.Millisecond)
+	go take("ban", true)
+	wg.Wait()
+
+	if order[0] != "ban" {
+		t.Errorf("order = %v, want the ban first", order)
+	}
+}
@@ -0,0 +1,112 @@
+package telegram
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket where urgent waiters are served before the others
+type bucket struct {
+	mutex         sync.Mutex
+	rate          float64
+	burst         float64
+	tokens        float64
+	updated       time.Time
+	blockedUntil  time.Time
+	urgentWaiting int
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst), updated: time.Now()}
+}
+
+// wait takes a token, blocking until one is available or ctx is done
+func (b *bucket) wait(ctx context.Context, urgent bool) error {
+	if urgent {
+		b.mutex.Lock()
+		b.urgentWaiting++
+		b.mutex.Unlock()
+		defer func() {
+			b.mutex.Lock()
+			b.urgentWaiting--
+			b.mutex.Unlock()
+		}()
+	}
+
+	for {
+		b.mutex.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+		b.updated = now
+
+		var delay time.Duration
+		switch {
+		case now.Before(b.blockedUntil):
+			delay = b.blockedUntil.Sub(now)
+		case b.tokens >= 1 && (urgent || b.urgentWaiting == 0):
+			b.tokens--
+			b.mutex.Unlock()
+			return nil
+		case b.tokens >= 1:
+			// leave the token to the urgent lane
+			delay = 10 * time.Millisecond
+		default:
+			delay = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		}
+		b.mutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// block holds every waiter until the time Telegram asked to wait for
+func (b *bucket) block(until time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+// buckets keeps a bucket per chat, dropping the ones idle for long
+type buckets struct {
+	mutex    sync.Mutex
+	newFunc  func(chatID int64) *bucket
+	items    map[int64]*bucket
+	lastSeen map[int64]time.Time
+	swept    time.Time
+}
+
+func newBuckets(newFunc func(chatID int64) *bucket) *buckets {
+	return &buckets{newFunc: newFunc, items: map[int64]*bucket{}, lastSeen: map[int64]time.Time{}, swept: time.Now()}
+}
+
+func (bs *buckets) get(chatID int64) *bucket {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(bs.swept) > 10*time.Minute {
+		for id, seen := range bs.lastSeen {
+			if now.Sub(seen) > 10*time.Minute {
+				delete(bs.items, id)
+				delete(bs.lastSeen, id)
+			}
+		}
+		bs.swept = now
+	}
+	b, ok := bs.items[chatID]
+	if !ok {
+		b = bs.newFunc(chatID)
+		bs.items[chatID] = b
+	}
+	bs.lastSeen[chatID] = now
+	return b
+}
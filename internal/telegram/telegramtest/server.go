@@ -0,0 +1,411 @@
+// Package telegramtest provides a fake Bot API server for integration tests: updates are injected with Push
+// and the calls the bot makes are recorded for assertions.
+package telegramtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Token is accepted by the server, any other token is rejected
+const Token = "123456:TEST"
+
+type (
+	// Call is a Bot API request received by the server
+	Call struct {
+		Method string
+		Params url.Values
+		// MessageID is the ID of the message sent or edited by the call
+		MessageID int
+	}
+
+	// Server implements the Bot API methods ngbot uses
+	Server struct {
+		Bot api.User
+
+		srv           *httptest.Server
+		mutex         sync.Mutex
+		updates       []api.Update
+		nextUpdateID  int
+		nextMessageID int
+		calls         []Call
+		chats         map[int64]api.Chat
+		members       map[int64]map[int64]api.ChatMember
+		customEmoji   map[string]string
+		photos        map[int64]int
+		files         map[string][]byte
+		changed       chan struct{}
+		done          chan struct{}
+	}
+
+	response struct {
+		OK          bool   `json:"ok"`
+		Result      any    `json:"result"`
+		ErrorCode   int    `json:"error_code,omitempty"`
+		Description string `json:"description,omitempty"`
+	}
+)
+
+// Int returns the param as a number, 0 if it is missing
+func (c Call) Int(key string) int64 {
+	n, _ := strconv.ParseInt(c.Params.Get(key), 10, 64)
+	return n
+}
+
+// NewServer starts a server, the bot is an administrator with every right in every chat unless set otherwise
+func NewServer() *Server {
+	s := &Server{
+		Bot:           api.User{ID: 123456, IsBot: true, FirstName: "ngbot", UserName: "ngbot_test_bot"},
+		nextUpdateID:  1,
+		nextMessageID: 1,
+		chats:         map[int64]api.Chat{},
+		members:       map[int64]map[int64]api.ChatMember{},
+		customEmoji:   map[string]string{},
+		photos:        map[int64]int{},
+		files:         map[string][]byte{},
+		changed:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Endpoint is the format for api.NewBotAPIWithAPIEndpoint and NG_TELEGRAM_API_ENDPOINT
+func (s *Server) Endpoint() string {
+	return s.srv.URL + "/bot%s/%s"
+}
+
+// Close ends pending long polls and stops the server
+func (s *Server) Close() {
+	close(s.done)
+	s.srv.Close()
+}
+
+// AddChat makes the chat known to getChat and used in sent messages
+func (s *Server) AddChat(chat api.Chat) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.chats[chat.ID] = chat
+}
+
+// SetChatMember sets what getChatMember returns for the user of the member
+func (s *Server) SetChatMember(chatID int64, member api.ChatMember) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.members[chatID] == nil {
+		s.members[chatID] = map[int64]api.ChatMember{}
+	}
+	s.members[chatID][member.User.ID] = member
+}
+
+// SetCustomEmoji sets the emoji of a custom emoji sticker
+func (s *Server) SetCustomEmoji(id, emoji string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.customEmoji[id] = emoji
+}
+
+// SetProfilePhotos sets the number of profile photos of the user, users have none by default
+func (s *Server) SetProfilePhotos(userID int64, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.photos[userID] = count
+}
+
+// SetFile sets the content of the file downloaded by its ID
+func (s *Server) SetFile(fileID string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[fileID] = data
+}
+
+// Push queues an update for getUpdates, assigning its ID
+func (s *Server) Push(u api.Update) api.Update {
+	s.mutex.Lock()
+	u.UpdateID = s.nextUpdateID
+	s.nextUpdateID++
+	s.updates = append(s.updates, u)
+	s.notifyLocked()
+	s.mutex.Unlock()
+	return u
+}
+
+// Message returns a new message update, its message ID assigned
+func (s *Server) Message(chat api.Chat, from api.User, text string) api.Update {
+	return api.Update{Message: s.newMessage(chat, &from, text)}
+}
+
+// Command returns a new message update with a bot command, text starts with the command
+func (s *Server) Command(chat api.Chat, from api.User, text string) api.Update {
+	m := s.newMessage(chat, &from, text)
+	command, _, _ := strings.Cut(text, " ")
+	m.Entities = []api.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	return api.Update{Message: m}
+}
+
+// Edit returns an edited message update of the message with the new text, edited now
+func (s *Server) Edit(m *api.Message, text string) api.Update {
+	edited := *m
+	edited.Text = text
+	edited.EditDate = int(time.Now().Unix())
+	return api.Update{EditedMessage: &edited}
+}
+
+// JoinRequest returns a join request update of the user to the chat, the user chat is the private chat with the bot
+func (s *Server) JoinRequest(chat api.Chat, from api.User) api.Update {
+	return api.Update{ChatJoinRequest: &api.ChatJoinRequest{
+		Chat:       chat,
+		From:       from,
+		UserChatID: from.ID,
+		Date:       int(time.Now().Unix()),
+	}}
+}
+
+// Callback returns a callback query update pressing a button of the message
+func (s *Server) Callback(from api.User, message *api.Message, data string) api.Update {
+	return api.Update{CallbackQuery: &api.CallbackQuery{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		From:    &from,
+		Message: message,
+		Data:    data,
+	}}
+}
+
+// Calls returns the recorded calls of the method, all of them if method is empty
+func (s *Server) Calls(method string) []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var calls []Call
+	for _, c := range s.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// WaitCall waits for a call of the method matching match, which may be nil
+func (s *Server) WaitCall(method string, timeout time.Duration, match func(Call) bool) (Call, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mutex.Lock()
+		for _, c := range s.calls {
+			if c.Method == method && (match == nil || match(c)) {
+				s.mutex.Unlock()
+				return c, true
+			}
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return Call{}, false
+		}
+	}
+}
+
+func (s *Server) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) newMessage(chat api.Chat, from *api.User, text string) *api.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := &api.Message{
+		MessageID: s.nextMessageID,
+		From:      from,
+		Chat:      chat,
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	s.nextMessageID++
+	return m
+}
+
+func (s *Server) chat(id int64) api.Chat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if chat, ok := s.chats[id]; ok {
+		return chat
+	}
+	chatType := "private"
+	if id < 0 {
+		chatType = "supergroup"
+	}
+	return api.Chat{ID: id, Type: chatType}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	// files are downloaded from /file/bot<token>/<file path>, getFile returns files/<file id> as the path
+	if len(parts) == 4 && parts[0] == "file" && parts[1] == "bot"+Token && parts[2] == "files" {
+		s.mutex.Lock()
+		data, ok := s.files[parts[3]]
+		s.mutex.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+		return
+	}
+	if len(parts) != 2 || parts[0] != "bot"+Token {
+		write(w, response{ErrorCode: http.StatusUnauthorized, Description: "Unauthorized"})
+		return
+	}
+	method := path.Base(r.URL.Path)
+	if err := r.ParseForm(); err != nil {
+		write(w, response{ErrorCode: http.StatusBadRequest, Description: err.Error()})
+		return
+	}
+	call := Call{Method: method, Params: r.PostForm}
+	result, ok := s.handle(call)
+	if m, isMessage := result.(*api.Message); isMessage {
+		call.MessageID = m.MessageID
+	}
+	if method != "getUpdates" {
+		s.mutex.Lock()
+		s.calls = append(s.calls, call)
+		s.notifyLocked()
+		s.mutex.Unlock()
+	}
+	if !ok {
+		write(w, response{ErrorCode: http.StatusNotFound, Description: "Not Found: method " + method + " is not faked"})
+		return
+	}
+	write(w, response{OK: true, Result: result})
+}
+
+func (s *Server) handle(c Call) (any, bool) {
+	switch c.Method {
+	case "getMe":
+		return s.Bot, true
+	case "getUpdates":
+		return s.getUpdates(int(c.Int("offset")), time.Duration(c.Int("timeout"))*time.Second), true
+	case "sendMessage", "editMessageText":
+		m := s.newMessage(s.chat(c.Int("chat_id")), &s.Bot, c.Params.Get("text"))
+		if markup := c.Params.Get("reply_markup"); markup != "" {
+			keyboard := &api.InlineKeyboardMarkup{}
+			if json.Unmarshal([]byte(markup), keyboard) == nil {
+				m.ReplyMarkup = keyboard
+			}
+		}
+		return m, true
+	case "getFile":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		id := c.Params.Get("file_id")
+		data, ok := s.files[id]
+		if !ok {
+			return nil, false
+		}
+		return api.File{FileID: id, FileSize: int64(len(data)), FilePath: "files/" + id}, true
+	case "getChat":
+		return s.chat(c.Int("chat_id")), true
+	case "getChatMember":
+		return s.member(c.Int("chat_id"), c.Int("user_id")), true
+	case "getChatAdministrators":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		var admins []api.ChatMember
+		for _, m := range s.members[c.Int("chat_id")] {
+			if m.IsAdministrator() || m.IsCreator() {
+				admins = append(admins, m)
+			}
+		}
+		return admins, true
+	case "getCustomEmojiStickers":
+		var ids []string
+		_ = json.Unmarshal([]byte(c.Params.Get("custom_emoji_ids")), &ids)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		stickers := []api.Sticker{}
+		for _, id := range ids {
+			if emoji, ok := s.customEmoji[id]; ok {
+				stickers = append(stickers, api.Sticker{FileID: id, Emoji: emoji, CustomEmojiID: id})
+			}
+		}
+		return stickers, true
+	case "getUserProfilePhotos":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		count := s.photos[c.Int("user_id")]
+		photos := api.UserProfilePhotos{TotalCount: count, Photos: [][]api.PhotoSize{}}
+		for i := 0; i < min(count, int(max(c.Int("limit"), 1))); i++ {
+			photos.Photos = append(photos.Photos, []api.PhotoSize{{FileID: "photo" + strconv.Itoa(i), Width: 640, Height: 640}})
+		}
+		return photos, true
+	case "deleteMessage", "deleteMessages", "banChatMember", "unbanChatMember", "restrictChatMember",
+		"approveChatJoinRequest", "declineChatJoinRequest", "answerCallbackQuery", "editMessageReplyMarkup":
+		return true, true
+	}
+	return nil, false
+}
+
+func (s *Server) member(chatID, userID int64) api.ChatMember {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m, ok := s.members[chatID][userID]; ok {
+		return m
+	}
+	if userID == s.Bot.ID {
+		bot := s.Bot
+		return api.ChatMember{
+			User:               &bot,
+			Status:             "administrator",
+			CanDeleteMessages:  true,
+			CanRestrictMembers: true,
+			CanInviteUsers:     true,
+		}
+	}
+	return api.ChatMember{User: &api.User{ID: userID, FirstName: "user" + strconv.FormatInt(userID, 10)}, Status: "member"}
+}
+
+// getUpdates long polls like Telegram: it returns once there are updates from offset on, or after timeout
+func (s *Server) getUpdates(offset int, timeout time.Duration) []api.Update {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mutex.Lock()
+		pending := []api.Update{}
+		for _, u := range s.updates {
+			if u.UpdateID >= offset {
+				pending = append(pending, u)
+			}
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+		if len(pending) > 0 || timeout == 0 {
+			return pending
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return pending
+		case <-s.done:
+			return pending
+		}
+	}
+}
+
+func write(w http.ResponseWriter, res response) {
+	w.Header().Set("Content-Type", "application/json")
+	if !res.OK {
+		w.WriteHeader(res.ErrorCode)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
 	"strings"
@@ -10,26 +11,41 @@ import (
 	"time"
 
 	"github.com/iamwavecut/tool"
-	"github.com/sashabaranov/go-openai"
 
 	"github.com/iamwavecut/ngbot/internal/db/sqlite"
-	"github.com/iamwavecut/ngbot/internal/event"
-	"github.com/iamwavecut/ngbot/internal/handlers"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
+	_ "github.com/iamwavecut/ngbot/internal/handlers"
 	"github.com/iamwavecut/ngbot/internal/i18n"
+	"github.com/iamwavecut/ngbot/internal/metrics"
+	"github.com/iamwavecut/ngbot/internal/plugin"
 
 	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/iamwavecut/ngbot/internal/bot"
 	"github.com/iamwavecut/ngbot/internal/config"
 	"github.com/iamwavecut/ngbot/internal/infra"
+	"github.com/iamwavecut/ngbot/internal/lists"
+	"github.com/iamwavecut/ngbot/internal/llm"
 )
 
 func main() {
-	cfg := config.Get()
-	log.SetFormatter(&config.NbFormatter{})
-	log.SetOutput(os.Stdout)
-	log.SetLevel(log.Level(cfg.LogLevel))
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+
+	cfg, err := config.Init(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config.SetupLogging(cfg)
+	for _, b := range cfg.BotList() {
+		config.RegisterSecret(b.Token)
+	}
+	config.RegisterSecret(cfg.OpenAI.APIKey)
+	for _, p := range cfg.LLM.Providers {
+		config.RegisterSecret(p.APIKey)
+	}
 	tool.SetLogger(log.StandardLogger())
 
 	maskSecret := func(s string) string {
@@ -43,6 +59,11 @@ func main() {
 	maskedConfig := cfg
 	maskedConfig.TelegramAPIToken = maskSecret(cfg.TelegramAPIToken)
 	maskedConfig.OpenAI.APIKey = maskSecret(cfg.OpenAI.APIKey)
+	maskedConfig.Bots = make([]config.Bot, len(cfg.Bots))
+	for i, b := range cfg.Bots {
+		b.Token = maskSecret(b.Token)
+		maskedConfig.Bots[i] = b
+	}
 
 	configJSON, err := json.MarshalIndent(maskedConfig, "", "  ")
 	if err != nil {
@@ -61,73 +82,86 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		err := tool.Recoverer(-1, func() {
-			defer event.RunWorker()()
-			botAPI, err := api.NewBotAPI(cfg.TelegramAPIToken)
-			if err != nil {
-				log.WithError(err).Errorln("cant initialize bot api")
-				log.Panicln("exiting")
-			}
-			if log.Level(cfg.LogLevel) == log.TraceLevel {
-				botAPI.Debug = true
-			}
-			defer botAPI.StopReceivingUpdates()
-
-			service := bot.NewService(ctx, botAPI, sqlite.NewSQLiteClient("bot.db"), log.WithField("context", "service"))
-
-			bot.RegisterUpdateHandler("admin", handlers.NewAdmin(service))
-			bot.RegisterUpdateHandler("gatekeeper", handlers.NewGatekeeper(service))
-			llmAPIConfig := openai.DefaultConfig(cfg.OpenAI.APIKey)
-			llmAPIConfig.BaseURL = cfg.OpenAI.BaseURL
-			llmAPI := openai.NewClientWithConfig(llmAPIConfig)
-			bot.RegisterUpdateHandler("reactor", handlers.NewReactor(service, llmAPI, cfg.OpenAI.Model))
-
-			updateConfig := api.NewUpdate(0)
-			updateConfig.Timeout = 60
-			updateConfig.AllowedUpdates = []string{
-				"message",
-				"edited_message",
-				"channel_post",
-				"edited_channel_post",
-				"message_reaction",
-				"message_reaction_count",
-				"inline_query",
-				"chosen_inline_result",
-				"callback_query",
-				"shipping_query",
-				"pre_checkout_query",
-				"poll",
-				"poll_answer",
-				"my_chat_member",
-				"chat_member",
-				"chat_join_request",
-			}
-			updateProcessor := bot.NewUpdateProcessor(ctx, service)
-
-			updateChan, errorChan := bot.GetUpdatesChans(ctx, botAPI, updateConfig)
-
-		loop:
-			for {
-				select {
-				case err := <-errorChan:
-					log.WithError(err).Errorln("bot api get updates error")
-					return
-				case update := <-updateChan:
-					if err := updateProcessor.Process(&update); err != nil {
-						log.WithError(err).Errorln("cant process update")
-					}
-				case <-ctx.Done():
-					log.Info("Shutting down gracefully...")
-					break loop
-				}
+	config.OnReload(func(_, next config.Config) {
+		config.ApplyLogLevels(next)
+	})
+	go config.Watch(ctx)
+
+	health := infra.NewHealth()
+	if cfg.AdminAddr != "" {
+		adminServer := infra.NewAdminServer(cfg.AdminAddr)
+		adminServer.Handle("/metrics", metrics.Handler())
+		adminServer.Handle("/healthz", health.LivenessHandler())
+		adminServer.Handle("/readyz", health.ReadinessHandler())
+		if cfg.Pprof {
+			adminServer.EnableProfiling()
+		}
+		go func() {
+			if err := adminServer.Run(ctx); err != nil {
+				log.WithError(err).Error("admin server failed")
 			}
-		})
+		}()
+	}
+
+	dbClient := sqlite.NewSQLiteClient(cfg.DBPath)
+	defer dbClient.Close()
+	health.AddReadiness("db", dbClient.Ping)
+	health.AddReadiness("migrations", func(context.Context) error {
+		pending, err := dbClient.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return fmt.Errorf("%d pending migrations", pending)
+		}
+		return nil
+	})
+
+	gateway := llm.New(cfg, dbClient)
+	if cfg.HealthCheckLLM {
+		health.AddReadiness("llm", infra.Cached(time.Minute, gateway.Ping))
+	}
+
+	for _, p := range cfg.Plugins {
+		if err := plugin.Register(p.Name, plugin.NewProcess(p)); err != nil {
+			log.WithError(err).Fatalln("cant register plugin")
+		}
+	}
+
+	shared := sharedBackends{db: dbClient, llm: gateway, lists: lists.New(dbClient), spam: fingerprint.New(dbClient), health: health}
+	runtimes := map[string]*botRuntime{}
+	for _, b := range cfg.BotList() {
+		rt, err := newBotRuntime(ctx, b, shared)
 		if err != nil {
-			log.WithError(err).Errorln("recoverer exits")
+			log.WithError(err).WithField("bot", b.Name).Fatalln("cant initialize bot")
 		}
-		cancel() // Signal main goroutine to exit
-	}()
+		defer rt.close()
+		runtimes[b.Name] = rt
+	}
+
+	config.OnReload(func(prev, next config.Config) {
+		if next.OpenAI.APIKey != prev.OpenAI.APIKey {
+			config.RegisterSecret(next.OpenAI.APIKey)
+			log.Info("OpenAI API key rotated")
+		}
+		for _, p := range next.LLM.Providers {
+			config.RegisterSecret(p.APIKey)
+		}
+		gateway.Reload(next)
+		for _, b := range next.BotList() {
+			rt, ok := runtimes[b.Name]
+			if !ok {
+				log.WithField("bot", b.Name).Warn("new bots are started after a restart")
+				continue
+			}
+			rt.reload(ctx, b, next)
+		}
+	})
+
+	// a bot that stops polling is restarted on its own, the other bots keep running
+	for _, rt := range runtimes {
+		go rt.supervise(ctx)
+	}
 
 	select {
 	case <-infra.MonitorExecutable():
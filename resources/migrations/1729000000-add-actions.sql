@@ -0,0 +1,21 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS "actions" (
+    "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "chat_id" INTEGER NOT NULL,
+    "actor_id" INTEGER NOT NULL DEFAULT 0,
+    "target_id" INTEGER NOT NULL,
+    "target_name" TEXT NOT NULL DEFAULT '',
+    "action" TEXT NOT NULL,
+    "reason" TEXT NOT NULL DEFAULT '',
+    "source" TEXT NOT NULL,
+    "excerpt" TEXT NOT NULL DEFAULT '',
+    "created_at" DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS "actions_chat_created" ON "actions" ("chat_id", "created_at");
+CREATE INDEX IF NOT EXISTS "actions_target" ON "actions" ("target_id");
+
+ALTER TABLE "chats" ADD COLUMN "log_channel_id" INTEGER NOT NULL DEFAULT 0;
+
+-- +migrate Down
+DROP TABLE IF EXISTS "actions";
+ALTER TABLE "chats" DROP COLUMN "log_channel_id";
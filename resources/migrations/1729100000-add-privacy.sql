@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE "chats" ADD COLUMN "privacy" TEXT NOT NULL DEFAULT '';
+
+-- +migrate Down
+ALTER TABLE "chats" DROP COLUMN "privacy";
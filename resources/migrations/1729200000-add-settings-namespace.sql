@@ -0,0 +1,42 @@
+-- +migrate Up
+ALTER TABLE "chats" RENAME TO "chats_old";
+
+CREATE TABLE "chats" (
+    "namespace" TEXT NOT NULL DEFAULT '',
+    "id" INTEGER NOT NULL,
+    "enabled" BOOLEAN NOT NULL DEFAULT 1,
+    "challenge_timeout" INTEGER NOT NULL DEFAULT 180,
+    "reject_timeout" INTEGER NOT NULL DEFAULT 600,
+    "language" TEXT NOT NULL DEFAULT 'en',
+    "log_channel_id" INTEGER NOT NULL DEFAULT 0,
+    "privacy" TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY ("namespace", "id")
+);
+INSERT INTO "chats" ("namespace", "id", "enabled", "challenge_timeout", "reject_timeout", "language", "log_channel_id", "privacy")
+SELECT '', co.id, co.enabled, co.challenge_timeout, co.reject_timeout, co.language, co.log_channel_id, co.privacy FROM "chats_old" co;
+DROP TABLE IF EXISTS "chats_old";
+
+-- members are shared by all bots, so they no longer reference a single settings row
+ALTER TABLE "chat_members" RENAME TO "chat_members_old";
+CREATE TABLE "chat_members" (
+    "chat_id" INTEGER NOT NULL,
+    "user_id" INTEGER NOT NULL,
+    PRIMARY KEY ("chat_id", "user_id")
+);
+INSERT INTO "chat_members" ("chat_id", "user_id") SELECT chat_id, user_id FROM "chat_members_old";
+DROP TABLE IF EXISTS "chat_members_old";
+
+-- +migrate Down
+ALTER TABLE "chats" RENAME TO "chats_new";
+CREATE TABLE "chats" (
+    "id" INTEGER PRIMARY KEY,
+    "enabled" BOOLEAN NOT NULL DEFAULT 1,
+    "challenge_timeout" INTEGER NOT NULL DEFAULT 180,
+    "reject_timeout" INTEGER NOT NULL DEFAULT 600,
+    "language" TEXT NOT NULL DEFAULT 'en',
+    "log_channel_id" INTEGER NOT NULL DEFAULT 0,
+    "privacy" TEXT NOT NULL DEFAULT ''
+);
+INSERT INTO "chats" ("id", "enabled", "challenge_timeout", "reject_timeout", "language", "log_channel_id", "privacy")
+SELECT cn.id, cn.enabled, cn.challenge_timeout, cn.reject_timeout, cn.language, cn.log_channel_id, cn.privacy FROM "chats_new" cn WHERE cn.namespace = '';
+DROP TABLE IF EXISTS "chats_new";
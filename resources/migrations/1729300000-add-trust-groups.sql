@@ -0,0 +1,39 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS "trust_groups" (
+    "namespace" TEXT NOT NULL DEFAULT '',
+    "name" TEXT NOT NULL,
+    "code" TEXT NOT NULL,
+    "owner_chat_id" INTEGER NOT NULL,
+    "created_at" DATETIME NOT NULL,
+    PRIMARY KEY ("namespace", "name")
+);
+
+-- a chat belongs to one trust group at most
+CREATE TABLE IF NOT EXISTS "trust_members" (
+    "namespace" TEXT NOT NULL DEFAULT '',
+    "chat_id" INTEGER NOT NULL,
+    "group_name" TEXT NOT NULL,
+    "action" TEXT NOT NULL,
+    "joined_at" DATETIME NOT NULL,
+    PRIMARY KEY ("namespace", "chat_id")
+);
+CREATE INDEX IF NOT EXISTS "trust_members_group" ON "trust_members" ("namespace", "group_name");
+
+CREATE TABLE IF NOT EXISTS "reputation" (
+    "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "namespace" TEXT NOT NULL DEFAULT '',
+    "group_name" TEXT NOT NULL,
+    "user_id" INTEGER NOT NULL,
+    "verdict" TEXT NOT NULL,
+    "chat_id" INTEGER NOT NULL,
+    "actor_id" INTEGER NOT NULL DEFAULT 0,
+    "source" TEXT NOT NULL,
+    "reason" TEXT NOT NULL DEFAULT '',
+    "created_at" DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS "reputation_user" ON "reputation" ("namespace", "group_name", "user_id", "created_at");
+
+-- +migrate Down
+DROP TABLE IF EXISTS "reputation";
+DROP TABLE IF EXISTS "trust_members";
+DROP TABLE IF EXISTS "trust_groups";
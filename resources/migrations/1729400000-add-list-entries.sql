@@ -0,0 +1,14 @@
+-- +migrate Up
+-- operator lists are shared by all bots of the process, so they are not namespaced
+CREATE TABLE IF NOT EXISTS "list_entries" (
+    "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "list" TEXT NOT NULL,
+    "kind" TEXT NOT NULL,
+    "pattern" TEXT NOT NULL,
+    "created_by" INTEGER NOT NULL DEFAULT 0,
+    "created_at" DATETIME NOT NULL,
+    UNIQUE ("list", "kind", "pattern")
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS "list_entries";
@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS "link_policies" (
+    "namespace" TEXT NOT NULL DEFAULT '',
+    "chat_id" INTEGER NOT NULL,
+    "mode" TEXT NOT NULL DEFAULT 'off',
+    -- space separated domains
+    "allowed" TEXT NOT NULL DEFAULT '',
+    "denied" TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY ("namespace", "chat_id")
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS "link_policies";
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE "chats" ADD COLUMN "vision" BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +migrate Down
+ALTER TABLE "chats" DROP COLUMN "vision";
@@ -0,0 +1,6 @@
+-- +migrate Up
+-- members trusted before have no date, so they are not on probation
+ALTER TABLE "chat_members" ADD COLUMN "trusted_at" DATETIME;
+
+-- +migrate Down
+ALTER TABLE "chat_members" DROP COLUMN "trusted_at";
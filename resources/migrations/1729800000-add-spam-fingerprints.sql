@@ -0,0 +1,15 @@
+-- +migrate Up
+-- spam waves cross chats and bots, so the fingerprints are not namespaced
+CREATE TABLE IF NOT EXISTS "spam_fingerprints" (
+    "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "signature" BLOB NOT NULL,
+    "chat_id" INTEGER NOT NULL,
+    "user_id" INTEGER NOT NULL,
+    "source" TEXT NOT NULL,
+    "created_at" DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS "spam_fingerprints_user_id" ON "spam_fingerprints" ("user_id");
+CREATE INDEX IF NOT EXISTS "spam_fingerprints_created_at" ON "spam_fingerprints" ("created_at");
+
+-- +migrate Down
+DROP TABLE IF EXISTS "spam_fingerprints";
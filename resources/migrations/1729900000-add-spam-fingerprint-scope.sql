@@ -0,0 +1,10 @@
+-- +migrate Up
+-- the fingerprints of an admin decision only apply to the chat or the trust group of the bot, an empty scope to every chat
+ALTER TABLE "spam_fingerprints" ADD COLUMN "namespace" TEXT NOT NULL DEFAULT '';
+ALTER TABLE "spam_fingerprints" ADD COLUMN "scope" TEXT NOT NULL DEFAULT '';
+-- the bot that added the ones of admins is unknown
+DELETE FROM "spam_fingerprints" WHERE "source" = 'admin';
+
+-- +migrate Down
+ALTER TABLE "spam_fingerprints" DROP COLUMN "scope";
+ALTER TABLE "spam_fingerprints" DROP COLUMN "namespace";
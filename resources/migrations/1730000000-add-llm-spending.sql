@@ -0,0 +1,12 @@
+-- +migrate Up
+-- the LLM gateway and its budget are shared by the bots, so the spending is not namespaced
+CREATE TABLE IF NOT EXISTS "llm_spending" (
+    "day" TEXT NOT NULL,
+    "chat_id" INTEGER NOT NULL,
+    "tokens" INTEGER NOT NULL DEFAULT 0,
+    "cost" REAL NOT NULL DEFAULT 0,
+    PRIMARY KEY ("day", "chat_id")
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS "llm_spending";
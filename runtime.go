@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	api "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/iamwavecut/tool"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ngbot/internal/audit"
+	"github.com/iamwavecut/ngbot/internal/bot"
+	"github.com/iamwavecut/ngbot/internal/config"
+	"github.com/iamwavecut/ngbot/internal/db"
+	"github.com/iamwavecut/ngbot/internal/event"
+	"github.com/iamwavecut/ngbot/internal/federation"
+	"github.com/iamwavecut/ngbot/internal/fingerprint"
+	"github.com/iamwavecut/ngbot/internal/infra"
+	"github.com/iamwavecut/ngbot/internal/lists"
+	"github.com/iamwavecut/ngbot/internal/llm"
+	"github.com/iamwavecut/ngbot/internal/metrics"
+	"github.com/iamwavecut/ngbot/internal/plugin"
+	"github.com/iamwavecut/ngbot/internal/privacy"
+	"github.com/iamwavecut/ngbot/internal/telegram"
+)
+
+const (
+	minRestartDelay = 5 * time.Second
+	maxRestartDelay = 5 * time.Minute
+)
+
+type (
+	// sharedBackends are used by every bot of the process
+	sharedBackends struct {
+		db     db.Client
+		llm    *llm.Gateway
+		lists  *lists.Lists
+		spam   *fingerprint.Index
+		health *infra.Health
+	}
+
+	rotatableService interface {
+		bot.Service
+		SetBot(bot *api.BotAPI)
+		CachedPrivacy(chatID int64) (privacy.Mode, bool)
+	}
+
+	// botRuntime is a single Telegram bot with its own client, settings namespace, handlers and update loop
+	botRuntime struct {
+		name       string
+		service    rotatableService
+		bus        *event.Bus
+		recorder   *audit.Recorder
+		federation *federation.Federation
+		processor  *bot.UpdateProcessor
+		plugins    *plugin.Host
+		heartbeat  *infra.Heartbeat
+		botSwaps   chan *api.BotAPI
+		// allowedChanged restarts polling when the handlers consume other update types
+		allowedChanged chan struct{}
+	}
+)
+
+func newBotRuntime(ctx context.Context, b config.Bot, shared sharedBackends) (*botRuntime, error) {
+	botAPI, err := telegram.NewBotAPI(b.Token, config.Get().TelegramAPIEndpoint)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cant initialize bot api")
+	}
+	if config.LevelFor("bot_api") == log.TraceLevel {
+		botAPI.Debug = true
+	}
+
+	rt := &botRuntime{
+		name:           b.Name,
+		bus:            event.NewBus(),
+		heartbeat:      &infra.Heartbeat{},
+		botSwaps:       make(chan *api.BotAPI, 1),
+		allowedChanged: make(chan struct{}, 1),
+	}
+	metrics.ObserveBus(rt.bus, b.Name)
+	shared.health.AddLiveness("updates."+b.Name, rt.heartbeat.Check(10*time.Minute))
+	shared.health.AddReadiness("updates."+b.Name, rt.heartbeat.Check(2*time.Minute))
+
+	rt.service = bot.NewService(
+		ctx,
+		botAPI,
+		shared.db.Namespaced(b.SettingsNamespace()),
+		rt.bus,
+		log.WithFields(log.Fields{"context": "service", "bot": b.Name}),
+	)
+	config.SetChatPrivacy(b.Name, rt.service.CachedPrivacy)
+	rt.recorder = audit.NewRecorder(rt.service)
+	rt.federation = federation.New(rt.service)
+
+	rt.processor = bot.NewUpdateProcessor(ctx, rt.service)
+	rt.processor.Use(
+		bot.Tracing(),
+		bot.Logging(),
+		bot.Metrics(),
+		bot.Recovery(),
+		bot.ChatEnabled(rt.service, "admin"),
+		bot.RateLimit("raid", "gatekeeper", "reactor"),
+	)
+	rt.plugins = plugin.NewHost(rt.service, shared.llm, shared.lists, shared.spam.Namespaced(b.SettingsNamespace()))
+	rt.applyPlugins(ctx, b.Handlers)
+	select {
+	case <-rt.allowedChanged: // the first poll requests them anyway
+	default:
+	}
+
+	log.WithFields(log.Fields{"bot": b.Name, "username": botAPI.Self.UserName}).Info("bot initialized")
+	return rt, nil
+}
+
+// supervise runs the bot until ctx is done, restarting it with a growing delay when polling fails or it panics
+func (rt *botRuntime) supervise(ctx context.Context) {
+	entry := log.WithFields(log.Fields{"bot": rt.name, "method": "supervise"})
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		if err := tool.Recoverer(0, func() { rt.run(ctx) }); err != nil {
+			entry.WithError(err).Error("bot panicked")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		entry.WithField("delay", delay).Error("bot stopped, restarting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRestartDelay)
+	}
+}
+
+// run polls and processes updates until ctx is done or polling fails
+func (rt *botRuntime) run(ctx context.Context) {
+	entry := log.WithFields(log.Fields{"bot": rt.name, "method": "run"})
+	updateConfig := api.NewUpdate(0)
+	updateConfig.Timeout = 60
+
+	process := func(update api.Update) {
+		updateConfig.Offset = update.UpdateID + 1
+		if err := rt.processor.Process(&update); err != nil {
+			entry.WithError(err).Errorln("cant process update")
+		}
+	}
+
+	// a rotated token or other consumed update types replace the poller, the offset carries over
+	var (
+		stopPolling context.CancelFunc
+		updateChan  api.UpdatesChannel
+		errorChan   chan error
+	)
+	poll := func(b *api.BotAPI) {
+		if stopPolling != nil {
+			stopPolling()
+			// the old poller exits once its request is aborted, the updates it got are processed
+			// so that the new one does not confirm them unread
+			if updateChan != nil {
+				for update := range updateChan {
+					process(update)
+				}
+			}
+		}
+		updateConfig.AllowedUpdates = rt.processor.AllowedUpdates()
+		entry.WithField("allowed_updates", updateConfig.AllowedUpdates).Debug("polling updates")
+		var pollCtx context.Context
+		pollCtx, stopPolling = context.WithCancel(ctx)
+		updateChan, errorChan = bot.GetUpdatesChans(pollCtx, b, updateConfig, rt.heartbeat)
+	}
+	poll(rt.service.GetBot())
+	defer func() { stopPolling() }()
+
+	for {
+		select {
+		case rotated := <-rt.botSwaps:
+			poll(rotated)
+		case <-rt.allowedChanged:
+			poll(rt.service.GetBot())
+		case err := <-errorChan:
+			entry.WithError(err).Errorln("bot api get updates error")
+			return
+		case update, ok := <-updateChan:
+			if !ok {
+				updateChan = nil
+				continue
+			}
+			process(update)
+		case <-ctx.Done():
+			entry.Info("Shutting down gracefully...")
+			return
+		}
+	}
+}
+
+// applyPlugins starts the listed plugins, stops the others and chains them in manifest order
+func (rt *botRuntime) applyPlugins(ctx context.Context, names []string) {
+	allowed := rt.processor.AllowedUpdates()
+	ordered := rt.plugins.Apply(ctx, names)
+	for _, name := range ordered {
+		rt.processor.RegisterUpdateHandler(name, rt.plugins.Handler(name))
+	}
+	rt.processor.SetEnabledHandlers(ordered)
+	if slices.Equal(allowed, rt.processor.AllowedUpdates()) {
+		return
+	}
+	select {
+	case rt.allowedChanged <- struct{}{}:
+	default:
+	}
+}
+
+// reload applies the hot reloadable settings of the bot
+func (rt *botRuntime) reload(ctx context.Context, b config.Bot, next config.Config) {
+	entry := log.WithFields(log.Fields{"bot": rt.name, "method": "reload"})
+	rt.applyPlugins(ctx, b.Handlers)
+	rt.plugins.Reload(next)
+
+	current := rt.service.GetBot()
+	if b.Token == current.Token {
+		return
+	}
+	config.RegisterSecret(b.Token)
+	rotated, err := telegram.NewBotAPI(b.Token, next.TelegramAPIEndpoint)
+	if err != nil {
+		entry.WithError(err).Error("rotated bot token does not work, keeping the previous one")
+		return
+	}
+	if rotated.Self.ID != current.Self.ID {
+		entry.WithField("bot_id", rotated.Self.ID).Error("rotated token belongs to another bot, keeping the previous one")
+		return
+	}
+	rotated.Debug = current.Debug
+	rt.service.SetBot(rotated)
+	// a stopped or restarting update loop must not hold the reload up, it only needs the latest client
+	for {
+		select {
+		case rt.botSwaps <- rotated:
+			entry.Info("Telegram bot token rotated")
+			return
+		default:
+		}
+		select {
+		case <-rt.botSwaps:
+		default:
+		}
+	}
+}
+
+func (rt *botRuntime) close() {
+	rt.processor.Shutdown()
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer closeCancel()
+	rt.plugins.Stop(closeCtx)
+	rt.recorder.Stop()
+	rt.federation.Stop()
+	config.SetChatPrivacy(rt.name, nil)
+	if err := rt.bus.Close(closeCtx); err != nil {
+		log.WithError(err).WithField("bot", rt.name).Warn("event bus did not drain")
+	}
+}